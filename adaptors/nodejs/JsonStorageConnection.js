@@ -11,6 +11,10 @@ class JsonStorageConnection {
         this.debug = true;
         this.timeout = 5000; // milliseconds
         this.maxListeners = 20;
+        // Framed mode (PROTOCOL 2) keeps values byte-for-byte, see command()
+        this.framed = false;
+        this.buffer = Buffer.alloc(0);
+        this.waiter = null;
     }
 
     async connect() {
@@ -41,8 +45,15 @@ class JsonStorageConnection {
                 }
             });
 
+            // Incoming data is buffered, so nothing is lost between reads
+            this.socket.on('data', (data) => {
+                this.buffer = Buffer.concat([this.buffer, data]);
+                this.wake();
+            });
+
             this.socket.on('error', (error) => {
                 reject(error);
+                this.wake(error);
                 this.close();
             });
         });
@@ -74,6 +85,9 @@ class JsonStorageConnection {
         }
 
         this.authenticated = true;
+
+        await this.write('PROTOCOL 2');
+        this.framed = (await this.readLine()) === 'OK';
         return true;
     }
 
@@ -98,29 +112,76 @@ class JsonStorageConnection {
     }
 
     read() {
+        if (this.framed) {
+            return this.readFrame().then((value) => (value === null ? 'nil' : value));
+        }
+        return this.readLine();
+    }
+
+    fill() {
         return new Promise((resolve, reject) => {
             if (!this.socket) {
                 reject(new Error('Socket not connected'));
                 return;
             }
+            this.waiter = { resolve, reject };
+        });
+    }
 
-            const dataHandler = (data) => {
-                cleanup();
-                resolve(data.toString().trim());
-            };
+    wake(error = null) {
+        const waiter = this.waiter;
+        this.waiter = null;
+        if (waiter) {
+            if (error) waiter.reject(error);
+            else waiter.resolve();
+        }
+    }
 
-            const errorHandler = (error) => {
-                cleanup();
-                reject(error);
-            };
+    async readLine() {
+        let end;
+        while ((end = this.buffer.indexOf('\n')) === -1) {
+            await this.fill();
+        }
+        const line = this.buffer.subarray(0, end).toString().trim();
+        this.buffer = this.buffer.subarray(end + 1);
+        return line;
+    }
 
-            const cleanup = () => {
-                this.socket.removeListener('data', dataHandler);
-                this.socket.removeListener('error', errorHandler);
-            };
+    async readBytes(size) {
+        while (this.buffer.length < size) {
+            await this.fill();
+        }
+        const data = this.buffer.subarray(0, size);
+        this.buffer = this.buffer.subarray(size);
+        return data;
+    }
 
-            this.socket.once('data', dataHandler);
-            this.socket.once('error', errorHandler);
+    // Reads a VALUE <len>, ERROR <len> or NIL response of the framed protocol
+    async readFrame() {
+        const header = await this.readLine();
+        if (header === 'NIL') return null;
+
+        const [kind, size] = header.split(' ');
+        const payload = (await this.readBytes(parseInt(size, 10) + 1)).subarray(0, -1).toString();
+        return kind === 'ERROR' ? `ERROR ${payload}` : payload;
+    }
+
+    // Sends a command, with value as a length-prefixed literal in framed mode
+    command(args, value = null) {
+        if (value === null) {
+            return this.write(args.join(' '));
+        }
+        if (!this.framed) {
+            return this.write(`${args.join(' ')} ${value}`);
+        }
+
+        const data = Buffer.from(value);
+        return new Promise((resolve, reject) => {
+            const frame = Buffer.concat([Buffer.from(`${args.join(' ')} {${data.length}}\n`), data, Buffer.from('\n')]);
+            this.socket.write(frame, (error) => {
+                if (error) reject(error);
+                else resolve();
+            });
         });
     }
 
@@ -131,8 +192,8 @@ class JsonStorageConnection {
         // Handle different data types
         let processedValue;
         if (typeof value === 'string') {
-            // For strings, escape quotes and wrap in quotes
-            processedValue = `"${value.replace(/"/g, '\\"')}"`;
+            // Framed mode sends strings exactly, the line protocol needs them quoted
+            processedValue = this.framed ? value : `"${value.replace(/"/g, '\\"')}"`;
         } else if (typeof value === 'boolean') {
             processedValue = value ? 'true' : 'false';
         } else if (value === null) {
@@ -143,14 +204,12 @@ class JsonStorageConnection {
             processedValue = value.toString();
         }
 
-        const command = `SET ${key} ${processedValue}`;
-        
         if (this.debug) {
-            console.log(`Sending command: ${command}`);
+            console.log(`Sending command: SET ${key}`);
             console.log('Processed value:', processedValue);
         }
 
-        await this.write(command);
+        await this.command(['SET', key], processedValue);
         const response = await this.read();
 
         if (response.trim() !== 'OK') {
@@ -160,7 +219,7 @@ class JsonStorageConnection {
         if (ttl > 0) {
             await this.write(`EXPIRE ${key} ${ttl}`);
             const expireResponse = await this.read();
-            return expireResponse.trim() === 'OK';
+            return expireResponse.trim() === '1';
         }
 
         return true;
@@ -181,7 +240,7 @@ class JsonStorageConnection {
         if (response === 'nil') return null;
 
         // Remove surrounding quotes if present
-        if (response.startsWith('"') && response.endsWith('"')) {
+        if (!this.framed && response.startsWith('"') && response.endsWith('"')) {
             return response.slice(1, -1).replace(/\\"/g, '"');
         }
 
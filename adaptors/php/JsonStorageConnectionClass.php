@@ -34,6 +34,12 @@ class JsonStorageConnection {
     /** @var int Socket timeout in seconds */
     private $timeout = 5;
 
+    /** @var bool Framed mode (PROTOCOL 2), keeps values byte-for-byte */
+    private $framed = false;
+
+    /** @var string Bytes received but not consumed yet */
+    private $buffer = '';
+
     /**
      * Constructor initializes the connection parameters
      * 
@@ -87,6 +93,10 @@ class JsonStorageConnection {
         }
 
         $this->authenticated = true;
+
+        // Switch to length-prefixed framing so values survive unchanged
+        $this->write("PROTOCOL 2");
+        $this->framed = $this->readLine() === "OK";
         return true;
     }
 
@@ -117,17 +127,83 @@ class JsonStorageConnection {
     }
 
     /**
-     * Reads data from the socket with error handling
+     * Reads a response from the socket with error handling
      * 
      * @throws Exception If read operation fails
-     * @return string Response from server
+     * @return string Response from server, 'nil' for a missing value
      */
     private function read(): string {
-        $response = socket_read($this->socket, 1024);
-        if ($response === false) {
+        if (!$this->framed) {
+            return $this->readLine();
+        }
+
+        // Framed responses are VALUE <len>, ERROR <len> or NIL
+        $header = $this->readLine();
+        if ($header === 'NIL') {
+            return 'nil';
+        }
+        [$kind, $size] = explode(' ', $header, 2);
+        $payload = substr($this->readExact((int)$size + 1), 0, -1);
+        return $kind === 'ERROR' ? "ERROR {$payload}" : $payload;
+    }
+
+    /**
+     * Receives more data into the buffer
+     * 
+     * @throws Exception If read operation fails
+     * @return void
+     */
+    private function fill(): void {
+        $chunk = socket_read($this->socket, 65536, PHP_BINARY_READ);
+        if ($chunk === false || $chunk === '') {
             throw new Exception("Failed to read from socket: " . socket_strerror(socket_last_error()));
         }
-        return trim($response);
+        $this->buffer .= $chunk;
+    }
+
+    /**
+     * Reads one newline terminated line
+     * 
+     * @return string Line without surrounding whitespace
+     */
+    private function readLine(): string {
+        while (($end = strpos($this->buffer, "\n")) === false) {
+            $this->fill();
+        }
+        $line = substr($this->buffer, 0, $end);
+        $this->buffer = (string)substr($this->buffer, $end + 1);
+        return trim($line);
+    }
+
+    /**
+     * Reads exactly $size bytes
+     * 
+     * @param int $size Number of bytes to read
+     * @return string Bytes read
+     */
+    private function readExact(int $size): string {
+        while (strlen($this->buffer) < $size) {
+            $this->fill();
+        }
+        $data = substr($this->buffer, 0, $size);
+        $this->buffer = (string)substr($this->buffer, $size);
+        return $data;
+    }
+
+    /**
+     * Sends a command whose last argument is a value, as a length-prefixed
+     * literal in framed mode
+     * 
+     * @param string $command Command and leading arguments
+     * @param string $value Value appended to the command
+     * @return void
+     */
+    private function command(string $command, string $value): void {
+        if (!$this->framed) {
+            $this->write("{$command} {$value}");
+            return;
+        }
+        $this->write($command . ' {' . strlen($value) . "}\n" . $value);
     }
 
     /**
@@ -154,19 +230,16 @@ class JsonStorageConnection {
         } elseif (is_numeric($value)) {
             // Don't quote numbers
             $value = (string)$value;
-        } else {
+        } elseif (!$this->framed) {
             // Quote strings
             $value = '"' . addslashes($value) . '"';
         }
 
-        // Build SET command
-        $command = "SET {$key} {$value}";
-        
         if ($this->debug) {
-            echo "Sending command: " . $command . "\n";
+            echo "Sending command: SET {$key} {$value}\n";
         }
         
-        $this->write($command);
+        $this->command("SET {$key}", $value);
         $response = $this->read();
         
         if (trim($response) !== 'OK') {
@@ -177,7 +250,7 @@ class JsonStorageConnection {
         if ($ttl > 0) {
             $this->write("EXPIRE {$key} {$ttl}");
             $expireResponse = $this->read();
-            return trim($expireResponse) === 'OK';
+            return trim($expireResponse) === '1';
         }
 
         return true;
@@ -208,7 +281,9 @@ class JsonStorageConnection {
         }
 
         // Remove surrounding quotes if present
-        $response = trim($response, '"');
+        if (!$this->framed) {
+            $response = trim($response, '"');
+        }
         
         // Handle special values
         if ($response === 'null') {
@@ -12,6 +12,9 @@ class JsonStorageConnection:
         self.authenticated = False
         self.debug = True
         self.timeout = 5
+        # Framed mode (PROTOCOL 2) keeps values byte-for-byte, see _command
+        self.framed = False
+        self._buffer = b""
         
     def connect(self) -> bool:
         if self.debug:
@@ -51,17 +54,62 @@ class JsonStorageConnection:
             raise Exception(f"Authentication failed: {response.strip()}")
             
         self.authenticated = True
+
+        self._write("PROTOCOL 2")
+        self.framed = self._read_line() == "OK"
         return True
         
     def _write(self, data: str) -> None:
         if not self.socket:
             raise Exception("Not connected")
-        self.socket.send(f"{data}\n".encode())
+        self.socket.sendall(f"{data}\n".encode())
         
     def _read(self) -> str:
         if not self.socket:
             raise Exception("Not connected")
-        return self.socket.recv(1024).decode()
+        if self.framed:
+            value = self._read_frame()
+            return "nil" if value is None else value
+        return self._read_line()
+
+    def _fill(self) -> None:
+        chunk = self.socket.recv(65536)
+        if not chunk:
+            raise ConnectionError("Connection closed by server")
+        self._buffer += chunk
+
+    def _read_line(self) -> str:
+        while b"\n" not in self._buffer:
+            self._fill()
+        line, self._buffer = self._buffer.split(b"\n", 1)
+        return line.decode().strip()
+
+    def _read_exact(self, size: int) -> bytes:
+        while len(self._buffer) < size:
+            self._fill()
+        data, self._buffer = self._buffer[:size], self._buffer[size:]
+        return data
+
+    def _read_frame(self) -> Optional[str]:
+        """Reads a VALUE <len>, ERROR <len> or NIL response of the framed protocol."""
+        header = self._read_line()
+        if header == "NIL":
+            return None
+        kind, _, size = header.partition(" ")
+        payload = self._read_exact(int(size) + 1)[:-1].decode()
+        if kind == "ERROR":
+            return f"ERROR {payload}"
+        return payload
+
+    def _command(self, *args: str, value: Optional[str] = None) -> None:
+        """Sends a command, with value as a length-prefixed literal in framed mode."""
+        if value is None:
+            self._write(" ".join(args))
+        elif self.framed:
+            data = value.encode()
+            self.socket.sendall(f"{' '.join(args)} {{{len(data)}}}\n".encode() + data + b"\n")
+        else:
+            self._write(f"{' '.join(args)} {value}")
         
     def set(self, key: str, value: Any, ttl: int = -1) -> bool:
         if not self.connected:
@@ -69,9 +117,10 @@ class JsonStorageConnection:
             
         if isinstance(value, (dict, list)):
             value = json.dumps(value)
+        elif not isinstance(value, str):
+            value = json.dumps(value)
         
-        command = f"SET {key} {value}"
-        self._write(command)
+        self._command("SET", key, value=value)
         response = self._read()
         
         if response.strip() != 'OK':
@@ -80,7 +129,7 @@ class JsonStorageConnection:
         if ttl > 0:
             self._write(f"EXPIRE {key} {ttl}")
             expire_response = self._read()
-            return expire_response.strip() == 'OK'
+            return expire_response.strip() == '1'
             
         return True
         
@@ -93,12 +142,13 @@ class JsonStorageConnection:
             return self._read().strip()
             
         self._write(f"GET {key}")
-        response = self._read().strip()
+        response = self._read()
         
         if response == 'nil':
             return None
             
-        response = response.strip('"')
+        if not self.framed:
+            response = response.strip('"')
         
         if response == 'null':
             return None
@@ -32,12 +32,22 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 
-	// Handle graceful shutdown
+	// Handle graceful shutdown, SIGHUP reloads the TLS certificates
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Wait for shutdown signal
-	<-sigChan
+	for sig := range sigChan {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		if cfg.TLSCertFile == "" {
+			continue
+		}
+		if err := srv.ReloadTLS(); err != nil {
+			log.Printf("Failed to reload TLS certificates: %v", err)
+		}
+	}
 	log.Println("Shutting down server...")
 
 	// Stop the server
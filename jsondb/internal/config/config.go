@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -23,15 +24,124 @@ const (
 type Config struct {
     Port                    int
     Password                string
+    AdminPassword           string
+    // PasswordHashIterations is the PBKDF2 cost of ACL password hashes, 0
+    // for the server's default
+    PasswordHashIterations  int
     EncryptionKey           string
     Environment             Environment
     EnableEncryption        bool
     MaxConnections          int
+    IdleTimeoutSeconds      int
+    ReadTimeoutSeconds      int
+    WriteTimeoutSeconds     int
+    AuthTimeoutSeconds      int
+    // Failed authentication limits, see the server's authGuard
+    AuthMaxFailuresPerConnection int
+    AuthMaxFailuresPerIP    int
+    AuthBanSeconds          int
+    AuthBackoffMs           int
+    AuthAuditLog            string
     Debug                   bool
     DumpMemoryOn           bool
     DumpMemoryEverySecond  int
     RestoreMemoryDumpAtStart bool
     DumpPath               string
+    ActiveExpiryIntervalMs int
+    AofEnabled             bool
+    AofFsync               string
+    AofRewriteMinSizeMB    int
+    ShardCount             int
+    EncryptionKeys         map[string]string
+    EncryptionKeyID        string
+    // EncryptionLegacyDecrypt reads values written by releases before the
+    // authenticated format, for migrating them with REENCRYPT
+    EncryptionLegacyDecrypt bool
+    Indexes                []IndexConfig
+    Listeners              []ListenerConfig
+    NotifyKeyspaceEvents   []string
+    PubsubClientBuffer     int
+    ChangeFeedSize         int
+    ReplicaOf              string
+    ReplicaPassword        string
+    // ReplicaTLS connects to the leader over TLS, verified against
+    // ReplicaTLSCAFile (the system roots when empty) and presenting
+    // ReplicaTLSCertFile and ReplicaTLSKeyFile when the leader asks for a
+    // client certificate
+    ReplicaTLS             bool
+    ReplicaTLSCAFile       string
+    ReplicaTLSCertFile     string
+    ReplicaTLSKeyFile      string
+    MaxMemory              int64
+    MaxMemoryPolicy        string
+    TLSCertFile            string
+    TLSKeyFile             string
+    TLSMinVersion          string
+    TLSClientCAFile        string
+    TLSClientAuth          string
+    // TLSClientIdentities maps the common name of a verified client
+    // certificate to the ACL user it authenticates as
+    TLSClientIdentities    map[string]string
+    ACLFile                string
+}
+
+// Wire protocols a listener can speak
+const (
+    ProtocolNative = "native"
+    ProtocolRESP   = "resp"
+    // ProtocolHTTP is the REST gateway, see the server's http.go
+    ProtocolHTTP   = "http"
+)
+
+// ListenerConfig describes one TCP listener and the protocol spoken on it
+type ListenerConfig struct {
+    Protocol string
+    Port     int
+    // TLS terminates TLS on the listener with TLSCertFile and TLSKeyFile
+    TLS      bool
+}
+
+// LineWhitespace holds the characters that split or end a command of the
+// native line protocol, which a follower's AUTH password cannot contain
+const LineWhitespace = " \t\r\n\v\f"
+
+// MaxShardCount is the largest SHARD_COUNT: a SCAN cursor keeps the shard
+// index in its top 16 bits
+const MaxShardCount = 1 << 16
+
+// TLS versions accepted by TLSMinVersion
+var tlsVersions = map[string]bool{"1.0": true, "1.1": true, "1.2": true, "1.3": true}
+
+// Client certificate requirements accepted by TLSClientAuth
+const (
+    TLSClientAuthRequire  = "require"
+    TLSClientAuthOptional = "optional"
+)
+
+// Keyspace events that can be published, see NotifyKeyspaceEvents
+var keyspaceEvents = map[string]bool{
+    "set":     true,
+    "del":     true,
+    "expired": true,
+    "evicted": true,
+    "all":     true,
+}
+
+// Eviction policies accepted by MaxMemoryPolicy
+var evictionPolicies = map[string]bool{
+    "noeviction":   true,
+    "allkeys-lru":  true,
+    "allkeys-lfu":  true,
+    "volatile-lru": true,
+    "volatile-ttl": true,
+    "random":       true,
+}
+
+// IndexConfig declares a secondary index created at startup
+type IndexConfig struct {
+    Name    string
+    Pattern string
+    Path    string
 }
 
 // LoadConfig loads the configuration from environment variables
@@ -82,12 +192,112 @@ func (c *Config) Validate() error {
     if c.Password == "" {
         return fmt.Errorf("server password cannot be empty")
     }
-    if c.EnableEncryption && c.EncryptionKey == "" {
+    if c.AdminPassword != "" && c.AdminPassword == c.Password {
+        return fmt.Errorf("admin password must differ from the server password")
+    }
+    if c.PasswordHashIterations < 0 {
+        return fmt.Errorf("invalid password hash iterations: %d", c.PasswordHashIterations)
+    }
+    if c.EnableEncryption && c.EncryptionKey == "" && len(c.EncryptionKeys) == 0 {
         return fmt.Errorf("encryption enabled but no key provided")
     }
+    for name, timeout := range map[string]int{
+        "idle":  c.IdleTimeoutSeconds,
+        "read":  c.ReadTimeoutSeconds,
+        "write": c.WriteTimeoutSeconds,
+        "auth":  c.AuthTimeoutSeconds,
+    } {
+        if timeout < 0 {
+            return fmt.Errorf("invalid %s timeout: %d", name, timeout)
+        }
+    }
+    for name, limit := range map[string]int{
+        "max auth failures per connection": c.AuthMaxFailuresPerConnection,
+        "max auth failures per IP":         c.AuthMaxFailuresPerIP,
+        "auth ban duration":                c.AuthBanSeconds,
+        "auth backoff":                     c.AuthBackoffMs,
+    } {
+        if limit < 0 {
+            return fmt.Errorf("invalid %s: %d", name, limit)
+        }
+    }
+    if c.MaxMemory < 0 {
+        return fmt.Errorf("invalid max memory: %d", c.MaxMemory)
+    }
+    if c.MaxMemoryPolicy != "" && !evictionPolicies[c.MaxMemoryPolicy] {
+        return fmt.Errorf("invalid max memory policy: %s", c.MaxMemoryPolicy)
+    }
+    if c.ChangeFeedSize < 0 {
+        return fmt.Errorf("invalid change feed size: %d", c.ChangeFeedSize)
+    }
+    if c.ShardCount < 0 || c.ShardCount > MaxShardCount {
+        return fmt.Errorf("invalid shard count: %d (at most %d)", c.ShardCount, MaxShardCount)
+    }
     if c.DumpMemoryOn && c.DumpPath == "" {
         return fmt.Errorf("memory dump enabled but no dump path provided")
     }
+    for _, listener := range c.Listeners {
+        switch listener.Protocol {
+        case ProtocolNative, ProtocolRESP, ProtocolHTTP:
+        default:
+            return fmt.Errorf("invalid listener protocol: %s", listener.Protocol)
+        }
+        if listener.Port <= 0 {
+            return fmt.Errorf("invalid listener port: %d", listener.Port)
+        }
+        if listener.TLS && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+            return fmt.Errorf("TLS listener on port %d requires a certificate and key", listener.Port)
+        }
+    }
+    if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+        return fmt.Errorf("TLS requires both a certificate and a key")
+    }
+    if c.TLSMinVersion != "" && !tlsVersions[c.TLSMinVersion] {
+        return fmt.Errorf("invalid TLS min version: %s", c.TLSMinVersion)
+    }
+    if c.TLSClientCAFile != "" {
+        switch c.TLSClientAuth {
+        case "", TLSClientAuthRequire, TLSClientAuthOptional:
+        default:
+            return fmt.Errorf("invalid TLS client auth: %s", c.TLSClientAuth)
+        }
+    }
+    for name, user := range c.TLSClientIdentities {
+        if user == "" {
+            return fmt.Errorf("no user for client certificate %s", name)
+        }
+    }
+    if c.ReplicaOf != "" {
+        if _, _, err := net.SplitHostPort(c.ReplicaOf); err != nil {
+            return fmt.Errorf("invalid replica of address: %s", c.ReplicaOf)
+        }
+    }
+    // A follower authenticates with REPLICA_PASSWORD, or SERVER_PASSWORD
+    // when it is empty, in a line mode AUTH command
+    if strings.ContainsAny(c.ReplicaPassword, LineWhitespace) {
+        return fmt.Errorf("replica password cannot contain whitespace")
+    }
+    if c.ReplicaOf != "" && c.ReplicaPassword == "" && strings.ContainsAny(c.Password, LineWhitespace) {
+        return fmt.Errorf("server password contains whitespace, set a replica password to follow a leader")
+    }
+    if (c.ReplicaTLSCertFile == "") != (c.ReplicaTLSKeyFile == "") {
+        return fmt.Errorf("replica TLS requires both a certificate and a key")
+    }
+    if !c.ReplicaTLS && (c.ReplicaTLSCAFile != "" || c.ReplicaTLSCertFile != "") {
+        return fmt.Errorf("replica TLS certificates require replica TLS to be enabled")
+    }
+    for _, event := range c.NotifyKeyspaceEvents {
+        if !keyspaceEvents[event] {
+            return fmt.Errorf("invalid keyspace event: %s", event)
+        }
+    }
+    if c.AofEnabled {
+        switch c.AofFsync {
+        case "always", "everysec", "never":
+        default:
+            return fmt.Errorf("invalid AOF fsync policy: %s", c.AofFsync)
+        }
+    }
     return nil
 }
 
@@ -96,15 +306,54 @@ func NewDevelopmentConfig() *Config {
     return &Config{
         Port:                    getEnvInt("PORT", 5555),
         Password:               getEnvStr("SERVER_PASSWORD", "password"),
+        AdminPassword:          getEnvStr("ADMIN_PASSWORD", ""),
+        PasswordHashIterations: getEnvInt("PASSWORD_HASH_ITERATIONS", 0),
         EncryptionKey:          getEnvStr("ENCRYPTION_KEY", ""),
+        EncryptionKeys:         getEnvKeyMap("ENCRYPTION_KEYS"),
+        EncryptionKeyID:        getEnvStr("ENCRYPTION_KEY_ID", ""),
+        EncryptionLegacyDecrypt: getEnvBool("ENCRYPTION_LEGACY_DECRYPT", false),
         EnableEncryption:       getEnvBool("ENABLE_ENCRYPTION", false),
         Environment:            Development,
         MaxConnections:         getEnvInt("MAX_CONNECTIONS", -1),
+        IdleTimeoutSeconds:     getEnvInt("IDLE_TIMEOUT_SECONDS", 0),
+        ReadTimeoutSeconds:     getEnvInt("READ_TIMEOUT_SECONDS", 30),
+        WriteTimeoutSeconds:    getEnvInt("WRITE_TIMEOUT_SECONDS", 30),
+        AuthTimeoutSeconds:     getEnvInt("AUTH_TIMEOUT_SECONDS", 10),
+        AuthMaxFailuresPerConnection: getEnvInt("AUTH_MAX_FAILURES_PER_CONNECTION", 5),
+        AuthMaxFailuresPerIP:   getEnvInt("AUTH_MAX_FAILURES_PER_IP", 10),
+        AuthBanSeconds:         getEnvInt("AUTH_BAN_SECONDS", 300),
+        AuthBackoffMs:          getEnvInt("AUTH_BACKOFF_MS", 100),
+        AuthAuditLog:           getEnvStr("AUTH_AUDIT_LOG", ""),
         Debug:                  getEnvBool("DEBUG", true),
         DumpMemoryOn:          getEnvBool("DUMP_MEMORY_ON", false),
         DumpMemoryEverySecond: getEnvInt("DUMP_MEMORY_EVERY_SECOND", 60),
         RestoreMemoryDumpAtStart: getEnvBool("RESTORE_MEMORY_DUMP_AT_START", false),
         DumpPath:              getEnvStr("DUMP_PATH", "data/dump"),
+        ActiveExpiryIntervalMs: getEnvInt("ACTIVE_EXPIRY_INTERVAL_MS", 100),
+        AofEnabled:            getEnvBool("AOF_ENABLED", false),
+        AofFsync:              getEnvStr("AOF_FSYNC", "everysec"),
+        AofRewriteMinSizeMB:   getEnvInt("AOF_REWRITE_MIN_SIZE_MB", 64),
+        ShardCount:            getEnvInt("SHARD_COUNT", 0),
+        Indexes:               getEnvIndexes("INDEXES"),
+        Listeners:             getEnvListeners("LISTENERS"),
+        NotifyKeyspaceEvents:  getEnvList("NOTIFY_KEYSPACE_EVENTS"),
+        PubsubClientBuffer:    getEnvInt("PUBSUB_CLIENT_BUFFER", 1024),
+        ChangeFeedSize:        getEnvInt("CHANGEFEED_SIZE", 10000),
+        ReplicaOf:             getEnvStr("REPLICAOF", ""),
+        ReplicaPassword:       getEnvStr("REPLICA_PASSWORD", ""),
+        ReplicaTLS:            getEnvBool("REPLICA_TLS", false),
+        ReplicaTLSCAFile:      getEnvStr("REPLICA_TLS_CA_FILE", ""),
+        ReplicaTLSCertFile:    getEnvStr("REPLICA_TLS_CERT_FILE", ""),
+        ReplicaTLSKeyFile:     getEnvStr("REPLICA_TLS_KEY_FILE", ""),
+        MaxMemory:             getEnvBytes("MAX_MEMORY", 0),
+        MaxMemoryPolicy:       strings.ToLower(getEnvStr("MAX_MEMORY_POLICY", "noeviction")),
+        TLSCertFile:           getEnvStr("TLS_CERT_FILE", ""),
+        TLSKeyFile:            getEnvStr("TLS_KEY_FILE", ""),
+        TLSMinVersion:         getEnvStr("TLS_MIN_VERSION", "1.2"),
+        TLSClientCAFile:       getEnvStr("TLS_CLIENT_CA_FILE", ""),
+        TLSClientAuth:         strings.ToLower(getEnvStr("TLS_CLIENT_AUTH", TLSClientAuthRequire)),
+        TLSClientIdentities:   getEnvKeyMap("TLS_CLIENT_IDENTITIES"),
+        ACLFile:               getEnvStr("ACL_FILE", ""),
     }
 }
 
@@ -113,15 +362,54 @@ func NewProductionConfig() *Config {
     return &Config{
         Port:                    getEnvInt("PORT", 5555),
         Password:               getEnvStr("SERVER_PASSWORD", ""),
+        AdminPassword:          getEnvStr("ADMIN_PASSWORD", ""),
+        PasswordHashIterations: getEnvInt("PASSWORD_HASH_ITERATIONS", 0),
         EncryptionKey:          getEnvStr("ENCRYPTION_KEY", ""),
+        EncryptionKeys:         getEnvKeyMap("ENCRYPTION_KEYS"),
+        EncryptionKeyID:        getEnvStr("ENCRYPTION_KEY_ID", ""),
+        EncryptionLegacyDecrypt: getEnvBool("ENCRYPTION_LEGACY_DECRYPT", false),
         EnableEncryption:       getEnvBool("ENABLE_ENCRYPTION", true),
         Environment:            Production,
         MaxConnections:         getEnvInt("MAX_CONNECTIONS", 1000),
+        IdleTimeoutSeconds:     getEnvInt("IDLE_TIMEOUT_SECONDS", 0),
+        ReadTimeoutSeconds:     getEnvInt("READ_TIMEOUT_SECONDS", 30),
+        WriteTimeoutSeconds:    getEnvInt("WRITE_TIMEOUT_SECONDS", 30),
+        AuthTimeoutSeconds:     getEnvInt("AUTH_TIMEOUT_SECONDS", 10),
+        AuthMaxFailuresPerConnection: getEnvInt("AUTH_MAX_FAILURES_PER_CONNECTION", 5),
+        AuthMaxFailuresPerIP:   getEnvInt("AUTH_MAX_FAILURES_PER_IP", 10),
+        AuthBanSeconds:         getEnvInt("AUTH_BAN_SECONDS", 300),
+        AuthBackoffMs:          getEnvInt("AUTH_BACKOFF_MS", 100),
+        AuthAuditLog:           getEnvStr("AUTH_AUDIT_LOG", ""),
         Debug:                  getEnvBool("DEBUG", false),
         DumpMemoryOn:          getEnvBool("DUMP_MEMORY_ON", true),
         DumpMemoryEverySecond: getEnvInt("DUMP_MEMORY_EVERY_SECOND", 300),
         RestoreMemoryDumpAtStart: getEnvBool("RESTORE_MEMORY_DUMP_AT_START", true),
         DumpPath:              getEnvStr("DUMP_PATH", "data/dump"),
+        ActiveExpiryIntervalMs: getEnvInt("ACTIVE_EXPIRY_INTERVAL_MS", 100),
+        AofEnabled:            getEnvBool("AOF_ENABLED", false),
+        AofFsync:              getEnvStr("AOF_FSYNC", "everysec"),
+        AofRewriteMinSizeMB:   getEnvInt("AOF_REWRITE_MIN_SIZE_MB", 64),
+        ShardCount:            getEnvInt("SHARD_COUNT", 0),
+        Indexes:               getEnvIndexes("INDEXES"),
+        Listeners:             getEnvListeners("LISTENERS"),
+        NotifyKeyspaceEvents:  getEnvList("NOTIFY_KEYSPACE_EVENTS"),
+        PubsubClientBuffer:    getEnvInt("PUBSUB_CLIENT_BUFFER", 1024),
+        ChangeFeedSize:        getEnvInt("CHANGEFEED_SIZE", 10000),
+        ReplicaOf:             getEnvStr("REPLICAOF", ""),
+        ReplicaPassword:       getEnvStr("REPLICA_PASSWORD", ""),
+        ReplicaTLS:            getEnvBool("REPLICA_TLS", false),
+        ReplicaTLSCAFile:      getEnvStr("REPLICA_TLS_CA_FILE", ""),
+        ReplicaTLSCertFile:    getEnvStr("REPLICA_TLS_CERT_FILE", ""),
+        ReplicaTLSKeyFile:     getEnvStr("REPLICA_TLS_KEY_FILE", ""),
+        MaxMemory:             getEnvBytes("MAX_MEMORY", 0),
+        MaxMemoryPolicy:       strings.ToLower(getEnvStr("MAX_MEMORY_POLICY", "noeviction")),
+        TLSCertFile:           getEnvStr("TLS_CERT_FILE", ""),
+        TLSKeyFile:            getEnvStr("TLS_KEY_FILE", ""),
+        TLSMinVersion:         getEnvStr("TLS_MIN_VERSION", "1.2"),
+        TLSClientCAFile:       getEnvStr("TLS_CLIENT_CA_FILE", ""),
+        TLSClientAuth:         strings.ToLower(getEnvStr("TLS_CLIENT_AUTH", TLSClientAuthRequire)),
+        TLSClientIdentities:   getEnvKeyMap("TLS_CLIENT_IDENTITIES"),
+        ACLFile:               getEnvStr("ACL_FILE", ""),
     }
 }
 
@@ -139,6 +427,121 @@ func getEnvBool(key string, fallback bool) bool {
     return fallback
 }
 
+// getEnvKeyMap parses a comma separated list of id:value pairs
+func getEnvKeyMap(key string) map[string]string {
+    value := os.Getenv(key)
+    if value == "" {
+        return nil
+    }
+
+    result := make(map[string]string)
+    for _, pair := range strings.Split(value, ",") {
+        id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+        if !ok || id == "" {
+            log.Printf("Warning: ignoring malformed entry in %s", key)
+            continue
+        }
+        result[id] = secret
+    }
+    return result
+}
+
+// getEnvIndexes parses a comma separated list of name|pattern|path entries
+func getEnvIndexes(key string) []IndexConfig {
+    value := os.Getenv(key)
+    if value == "" {
+        return nil
+    }
+
+    var result []IndexConfig
+    for _, entry := range strings.Split(value, ",") {
+        parts := strings.Split(strings.TrimSpace(entry), "|")
+        if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+            log.Printf("Warning: ignoring malformed entry in %s", key)
+            continue
+        }
+        result = append(result, IndexConfig{Name: parts[0], Pattern: parts[1], Path: parts[2]})
+    }
+    return result
+}
+
+// getEnvListeners parses a comma separated list of protocol:port entries,
+// each optionally followed by :tls
+func getEnvListeners(key string) []ListenerConfig {
+    value := os.Getenv(key)
+    if value == "" {
+        return nil
+    }
+
+    var result []ListenerConfig
+    for _, entry := range strings.Split(value, ",") {
+        parts := strings.Split(strings.TrimSpace(entry), ":")
+        if len(parts) == 3 && strings.ToLower(parts[2]) != "tls" {
+            parts = nil
+        }
+        if len(parts) != 2 && len(parts) != 3 {
+            log.Printf("Warning: ignoring malformed entry in %s", key)
+            continue
+        }
+        port, err := strconv.Atoi(parts[1])
+        if err != nil {
+            log.Printf("Warning: ignoring malformed entry in %s", key)
+            continue
+        }
+        result = append(result, ListenerConfig{Protocol: strings.ToLower(parts[0]), Port: port, TLS: len(parts) == 3})
+    }
+    return result
+}
+
+// getEnvBytes parses a size in bytes with an optional kb, mb or gb suffix
+func getEnvBytes(key string, fallback int64) int64 {
+    value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+    if value == "" {
+        return fallback
+    }
+
+    multiplier := int64(1)
+    for suffix, m := range map[string]int64{"kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30} {
+        if strings.HasSuffix(value, suffix) {
+            value = strings.TrimSuffix(value, suffix)
+            multiplier = m
+            break
+        }
+    }
+    size, err := strconv.ParseInt(value, 10, 64)
+    if err != nil {
+        log.Printf("Warning: ignoring malformed value of %s", key)
+        return fallback
+    }
+    return size * multiplier
+}
+
+// getEnvList parses a comma separated list of lowercase names
+func getEnvList(key string) []string {
+    value := os.Getenv(key)
+    if value == "" {
+        return nil
+    }
+
+    var result []string
+    for _, entry := range strings.Split(value, ",") {
+        if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+            result = append(result, entry)
+        }
+    }
+    return result
+}
+
+// ServerListeners returns the configured listeners, or a single native
+// protocol listener on Port when none are configured, using TLS when a
+// certificate is configured
+func (c *Config) ServerListeners() []ListenerConfig {
+    if len(c.Listeners) > 0 {
+        return c.Listeners
+    }
+    return []ListenerConfig{{Protocol: ProtocolNative, Port: c.Port, TLS: c.TLSCertFile != ""}}
+}
+
 func getEnvInt(key string, fallback int) int {
     if value := os.Getenv(key); value != "" {
         if i, err := strconv.Atoi(value); err == nil {
@@ -153,6 +556,7 @@ func NewTestConfig() *Config {
     return &Config{
         Port:                    6380,
         Password:                "test-password",
+        PasswordHashIterations:  1000,
         EncryptionKey:           "test-key",
         Environment:             Testing,
         EnableEncryption:        false,
@@ -162,6 +566,7 @@ func NewTestConfig() *Config {
         DumpMemoryEverySecond:  5,
         RestoreMemoryDumpAtStart: false,
         DumpPath:               "dump",
+        ActiveExpiryIntervalMs: 10,
     }
 }
 
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"os"
 	"testing"
 )
 
@@ -77,3 +78,22 @@ func TestNewTestConfig(t *testing.T) {
         })
     }
 }
+
+func TestValidateShardCount(t *testing.T) {
+    // A SCAN cursor has 16 bits for the shard index
+    for count, valid := range map[int]bool{0: true, 1: true, MaxShardCount: true, MaxShardCount + 1: false, -1: false} {
+        cfg := NewTestConfig()
+        cfg.ShardCount = count
+        if err := cfg.Validate(); (err == nil) != valid {
+            t.Errorf("Validate() with %d shards error = %v, want valid %v", count, err, valid)
+        }
+    }
+}
+
+func TestNewProductionConfigIdleTimeout(t *testing.T) {
+    // Pooled clients keep idle connections, closing them is opt-in
+    os.Unsetenv("IDLE_TIMEOUT_SECONDS")
+    if got := NewProductionConfig().IdleTimeoutSeconds; got != 0 {
+        t.Errorf("IdleTimeoutSeconds = %d, want 0", got)
+    }
+}
@@ -7,68 +7,229 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 )
 
 var (
 	ErrInvalidKeyLength = errors.New("encryption key must be 32 bytes long")
-	ErrEncryption      = errors.New("encryption failed")
-	ErrDecryption      = errors.New("decryption failed")
+	ErrEncryption       = errors.New("encryption failed")
+	ErrDecryption       = errors.New("decryption failed")
+	ErrUnknownKey       = errors.New("unknown encryption key id")
+	ErrInvalidHeader    = errors.New("invalid ciphertext header")
+)
+
+// DefaultKeyID is the key ID used for the single key passed to NewEncryptor.
+const DefaultKeyID = "default"
+
+// Ciphertext layout (version 1):
+//
+//	magic "JE" | version byte | key ID length byte | key ID | 12 byte nonce | AES-256-GCM ciphertext and tag
+//
+// Everything in front of the nonce is authenticated as additional data, so a
+// value cannot be moved to another key ID without detection.
+const (
+	headerMagic   = "JE"
+	headerVersion = 1
+	legacyNonce   = 16
 )
 
 type Encryptor struct {
-	block cipher.Block
+	keys      map[string]cipher.AEAD
+	currentID string
+	// legacy decrypts unauthenticated AES-CTR values written before the
+	// versioned format existed, once enabled by AllowLegacy
+	legacy        cipher.Block
+	legacyAllowed bool
 }
 
+// NewEncryptor creates an encryptor with a single key under DefaultKeyID.
 func NewEncryptor(key string) (*Encryptor, error) {
-	if len(key) != 32 {
-		return nil, fmt.Errorf("encryption key must be exactly 32 bytes, got %d", len(key))
+	return NewKeyringEncryptor(map[string]string{DefaultKeyID: key}, DefaultKeyID)
+}
+
+// NewKeyringEncryptor creates an encryptor that encrypts with the key
+// currentID and decrypts values written under any of the given keys.
+func NewKeyringEncryptor(keys map[string]string, currentID string) (*Encryptor, error) {
+	if _, ok := keys[currentID]; !ok {
+		return nil, fmt.Errorf("current encryption key %q is not configured", currentID)
 	}
-	
-	block, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+
+	e := &Encryptor{keys: make(map[string]cipher.AEAD), currentID: currentID}
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid encryption key id %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be exactly 32 bytes, got %d", id, len(key))
+		}
+
+		block, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GCM: %v", err)
+		}
+		e.keys[id] = aead
+
+		if id == DefaultKeyID {
+			e.legacy = block
+		}
 	}
-	
-	return &Encryptor{block: block}, nil
+
+	return e, nil
+}
+
+// AllowLegacy enables reading values written before the versioned format,
+// with the key under DefaultKeyID. Those values are not authenticated, so
+// damaged data decrypts to garbage instead of failing: it is only meant for
+// migrating them with REENCRYPT.
+func (e *Encryptor) AllowLegacy(allowed bool) {
+	e.legacyAllowed = allowed
+}
+
+// CurrentKeyID returns the ID of the key used for new values.
+func (e *Encryptor) CurrentKeyID() string {
+	return e.currentID
+}
+
+// KeyIDs returns the configured key IDs in sorted order.
+func (e *Encryptor) KeyIDs() []string {
+	ids := make([]string, 0, len(e.keys))
+	for id := range e.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
 }
 
 func (e *Encryptor) Encrypt(data []byte) ([]byte, error) {
 	log.Printf("Encrypting data of length: %d", len(data))
-	
-	nonce := make([]byte, 16)
+
+	aead := e.keys[e.currentID]
+	header := make([]byte, 0, len(headerMagic)+2+len(e.currentID))
+	header = append(header, headerMagic...)
+	header = append(header, headerVersion, byte(len(e.currentID)))
+	header = append(header, e.currentID...)
+
+	nonce := make([]byte, aead.NonceSize())
 	if _, err := rand.Read(nonce); err != nil {
 		return nil, fmt.Errorf("failed to generate nonce: %v", err)
 	}
 
-	stream := cipher.NewCTR(e.block, nonce)
-	encrypted := make([]byte, len(data))
-	stream.XORKeyStream(encrypted, data)
-
-	// Combine nonce and encrypted data
-	result := make([]byte, len(nonce)+len(encrypted))
-	copy(result, nonce)
-	copy(result[len(nonce):], encrypted)
+	result := make([]byte, 0, len(header)+len(nonce)+len(data)+aead.Overhead())
+	result = append(result, header...)
+	result = append(result, nonce...)
+	result = aead.Seal(result, nonce, data, header)
 
 	log.Printf("Encrypted data length: %d", len(result))
-	
+
 	return result, nil
 }
 
 func (e *Encryptor) Decrypt(data []byte) ([]byte, error) {
 	log.Printf("Decrypting data of length: %d", len(data))
-	
-	if len(data) < 16 {
+
+	keyID, header, ok := parseHeader(data)
+	if !ok {
+		// A legacy IV is random and may happen to resemble a header, so
+		// anything without a valid one, or naming a key that is not
+		// configured, is read as legacy when allowed
+		if e.legacyAllowed || !e.looksVersioned(data) {
+			return e.decryptLegacy(data)
+		}
+		return nil, fmt.Errorf("%w: %w", ErrDecryption, ErrInvalidHeader)
+	}
+
+	aead, exists := e.keys[keyID]
+	if !exists {
+		if e.legacyAllowed {
+			return e.decryptLegacy(data)
+		}
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+
+	rest := data[len(header):]
+	if len(rest) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("encrypted data too short: %d bytes", len(data))
+	}
+	nonce := rest[:aead.NonceSize()]
+
+	decrypted, err := aead.Open(nil, nonce, rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: authentication failed", ErrDecryption)
+	}
+
+	log.Printf("Decrypted data length: %d", len(decrypted))
+
+	return decrypted, nil
+}
+
+// KeyID returns the ID of the key a value was encrypted with, or an empty
+// string for values in the legacy format.
+func (e *Encryptor) KeyID(data []byte) string {
+	keyID, _, _ := parseHeader(data)
+	return keyID
+}
+
+// NeedsRotation reports whether a value was not encrypted with the current key.
+func (e *Encryptor) NeedsRotation(data []byte) bool {
+	return e.KeyID(data) != e.currentID
+}
+
+func hasMagic(data []byte) bool {
+	return len(data) >= len(headerMagic) && string(data[:len(headerMagic)]) == headerMagic
+}
+
+// looksVersioned reports whether data claims to be in the versioned format:
+// it starts with the magic, or carries the version and a configured key ID
+// behind a damaged magic. Unless legacy values are allowed, a damaged header
+// on such data is reported as ErrInvalidHeader.
+func (e *Encryptor) looksVersioned(data []byte) bool {
+	if hasMagic(data) {
+		return true
+	}
+	keyID, _, ok := parseKeyID(data)
+	_, known := e.keys[keyID]
+	return ok && known
+}
+
+func parseHeader(data []byte) (keyID string, header []byte, ok bool) {
+	if !hasMagic(data) {
+		return "", nil, false
+	}
+	return parseKeyID(data)
+}
+
+// parseKeyID reads the version and key ID following the magic, without
+// checking the magic itself.
+func parseKeyID(data []byte) (keyID string, header []byte, ok bool) {
+	if len(data) < len(headerMagic)+2 || data[len(headerMagic)] != headerVersion {
+		return "", nil, false
+	}
+	idLen := int(data[len(headerMagic)+1])
+	end := len(headerMagic) + 2 + idLen
+	if idLen == 0 || len(data) < end {
+		return "", nil, false
+	}
+	return string(data[len(headerMagic)+2 : end]), data[:end], true
+}
+
+func (e *Encryptor) decryptLegacy(data []byte) ([]byte, error) {
+	if !e.legacyAllowed || e.legacy == nil {
+		return nil, fmt.Errorf("%w: unrecognised ciphertext format", ErrDecryption)
+	}
+	if len(data) < legacyNonce {
 		return nil, fmt.Errorf("encrypted data too short: %d bytes", len(data))
 	}
 
-	nonce := data[:16]
-	ciphertext := data[16:]
-	
-	stream := cipher.NewCTR(e.block, nonce)
+	nonce := data[:legacyNonce]
+	ciphertext := data[legacyNonce:]
+
+	stream := cipher.NewCTR(e.legacy, nonce)
 	decrypted := make([]byte, len(ciphertext))
 	stream.XORKeyStream(decrypted, ciphertext)
-	
-	log.Printf("Decrypted data length: %d", len(decrypted))
-	
+
 	return decrypted, nil
-}
\ No newline at end of file
+}
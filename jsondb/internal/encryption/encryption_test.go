@@ -2,6 +2,9 @@ package encryption
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
 	"testing"
 )
 
@@ -92,4 +95,124 @@ func TestDecryptInvalidData(t *testing.T) {
             }
         })
     }
-}
\ No newline at end of file
+}
+func TestDecryptTamperedData(t *testing.T) {
+    enc, err := NewEncryptor("0123456789abcdef0123456789abcdef")
+    if err != nil {
+        t.Fatalf("Failed to create encryptor: %v", err)
+    }
+
+    encrypted, err := enc.Encrypt([]byte(`{"name":"John"}`))
+    if err != nil {
+        t.Fatalf("Encryption failed: %v", err)
+    }
+
+    // Flip one bit in the ciphertext, the tag, the magic, the version, the
+    // key ID length and the key ID in turn. With legacy values enabled, data
+    // without a valid header for a configured key is read as legacy, which is
+    // unauthenticated, so only the ciphertext and the tag are checked.
+    for _, legacy := range []bool{false, true} {
+        enc.AllowLegacy(legacy)
+        positions := []int{len(encrypted) - 20, len(encrypted) - 1, 0, 1, 2, 3, 4}
+        if legacy {
+            positions = positions[:2]
+        }
+        for _, pos := range positions {
+            tampered := append([]byte(nil), encrypted...)
+            tampered[pos] ^= 0x01
+            if _, err := enc.Decrypt(tampered); err == nil {
+                t.Errorf("Decrypt() with legacy %v accepted data with a flipped bit at %d", legacy, pos)
+            }
+        }
+    }
+}
+
+func TestKeyRotation(t *testing.T) {
+    oldEnc, err := NewEncryptor("0123456789abcdef0123456789abcdef")
+    if err != nil {
+        t.Fatalf("Failed to create encryptor: %v", err)
+    }
+    oldValue, err := oldEnc.Encrypt([]byte("old value"))
+    if err != nil {
+        t.Fatalf("Encryption failed: %v", err)
+    }
+
+    keyring, err := NewKeyringEncryptor(map[string]string{
+        DefaultKeyID: "0123456789abcdef0123456789abcdef",
+        "2024-06":    "fedcba9876543210fedcba9876543210",
+    }, "2024-06")
+    if err != nil {
+        t.Fatalf("Failed to create keyring encryptor: %v", err)
+    }
+
+    // Values written under the previous key still decrypt
+    decrypted, err := keyring.Decrypt(oldValue)
+    if err != nil || string(decrypted) != "old value" {
+        t.Fatalf("Decrypt(old value) = %q, %v", decrypted, err)
+    }
+    if !keyring.NeedsRotation(oldValue) {
+        t.Errorf("NeedsRotation(old value) = false, want true")
+    }
+
+    newValue, err := keyring.Encrypt([]byte("new value"))
+    if err != nil {
+        t.Fatalf("Encryption failed: %v", err)
+    }
+    if keyring.KeyID(newValue) != "2024-06" || keyring.NeedsRotation(newValue) {
+        t.Errorf("new value key ID = %q, want 2024-06", keyring.KeyID(newValue))
+    }
+
+    // An encryptor without the new key reports it instead of returning garbage
+    if _, err := oldEnc.Decrypt(newValue); !errors.Is(err, ErrUnknownKey) {
+        t.Errorf("Decrypt() with missing key error = %v, want ErrUnknownKey", err)
+    }
+
+    if _, err := NewKeyringEncryptor(map[string]string{"a": "0123456789abcdef0123456789abcdef"}, "b"); err == nil {
+        t.Errorf("NewKeyringEncryptor() accepted an unknown current key")
+    }
+}
+
+func TestDecryptLegacyCTR(t *testing.T) {
+    key := "0123456789abcdef0123456789abcdef"
+    enc, err := NewEncryptor(key)
+    if err != nil {
+        t.Fatalf("Failed to create encryptor: %v", err)
+    }
+
+    // Build a value the way the previous AES-CTR implementation did
+    block, err := aes.NewCipher([]byte(key))
+    if err != nil {
+        t.Fatalf("Failed to create cipher: %v", err)
+    }
+    nonce := bytes.Repeat([]byte{7}, 16)
+    legacy := make([]byte, 16+len("legacy data"))
+    copy(legacy, nonce)
+    cipher.NewCTR(block, nonce).XORKeyStream(legacy[16:], []byte("legacy data"))
+
+    // Legacy values are unauthenticated and only read when migrating
+    if _, err := enc.Decrypt(legacy); !errors.Is(err, ErrDecryption) {
+        t.Errorf("Decrypt(legacy) without AllowLegacy error = %v, want ErrDecryption", err)
+    }
+
+    enc.AllowLegacy(true)
+    decrypted, err := enc.Decrypt(legacy)
+    if err != nil || string(decrypted) != "legacy data" {
+        t.Errorf("Decrypt(legacy) = %q, %v", decrypted, err)
+    }
+    if !enc.NeedsRotation(legacy) {
+        t.Errorf("NeedsRotation(legacy) = false, want true")
+    }
+
+    // An IV is random and may start like a versioned header, up to the
+    // version and the length of a configured key ID
+    for _, prefix := range []string{"JE", "JE\x01", "JF\x01\x07default"} {
+        nonce := append([]byte(prefix), bytes.Repeat([]byte{7}, 16-len(prefix))...)
+        legacy := make([]byte, 16+len("legacy data"))
+        copy(legacy, nonce)
+        cipher.NewCTR(block, nonce).XORKeyStream(legacy[16:], []byte("legacy data"))
+        decrypted, err := enc.Decrypt(legacy)
+        if err != nil || string(decrypted) != "legacy data" {
+            t.Errorf("Decrypt(legacy with IV %q) = %q, %v", prefix, decrypted, err)
+        }
+    }
+}
@@ -0,0 +1,375 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fsync policies for the append-only log
+const (
+	FsyncAlways   = "always"
+	FsyncEverySec = "everysec"
+	FsyncNever    = "never"
+)
+
+const (
+	aofFileName    = "memory.aof"
+	aofOldFileName = "memory.aof.old"
+
+	opSet    = "set"
+	opDel    = "del"
+	opExpire = "expire"
+	opReset  = "reset"
+	// opRestore replaces the data with the snapshot in restoreFileName
+	opRestore = "restore"
+)
+
+// logEntry is a single mutating operation in the append-only log. Values are
+// stored exactly as they are kept in memory, so encrypted values stay encrypted.
+type logEntry struct {
+	Op        string    `json:"op"`
+	Key       string    `json:"key,omitempty"`
+	Value     []byte    `json:"value,omitempty"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type appendLog struct {
+	mu          sync.Mutex
+	dir         string
+	fsync       string
+	file        *os.File
+	writer      *bufio.Writer
+	encoder     *json.Encoder
+	size        int64
+	rewriteSize int64
+	dirty       bool
+	closed      bool
+}
+
+func openAppendLog(dir, fsync string) (*appendLog, error) {
+	switch fsync {
+	case FsyncAlways, FsyncEverySec, FsyncNever:
+	case "":
+		fsync = FsyncEverySec
+	default:
+		return nil, fmt.Errorf("invalid fsync policy: %s", fsync)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+
+	aof := &appendLog{dir: dir, fsync: fsync}
+	if err := aof.open(); err != nil {
+		return nil, err
+	}
+	aof.rewriteSize = aof.size
+	return aof, nil
+}
+
+// open opens the active log file for appending. The caller must hold mu
+// unless the log is not shared yet.
+func (a *appendLog) open() error {
+	file, err := os.OpenFile(filepath.Join(a.dir, aofFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open append-only log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat append-only log: %v", err)
+	}
+
+	a.file = file
+	a.writer = bufio.NewWriter(file)
+	a.encoder = json.NewEncoder(a.writer)
+	a.size = info.Size()
+	return nil
+}
+
+func (a *appendLog) append(entry logEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return errors.New("append-only log is closed")
+	}
+	before := a.writer.Buffered()
+	if err := a.encoder.Encode(entry); err != nil {
+		return fmt.Errorf("failed to append to log: %v", err)
+	}
+	a.size += int64(a.writer.Buffered() - before)
+	a.dirty = true
+
+	if a.fsync == FsyncAlways {
+		return a.syncLocked()
+	}
+	return nil
+}
+
+// syncLocked flushes buffered entries and, unless the policy is never,
+// fsyncs the file. The caller must hold mu.
+func (a *appendLog) syncLocked() error {
+	if !a.dirty {
+		return nil
+	}
+	if err := a.writer.Flush(); err != nil {
+		return fmt.Errorf("failed to flush log: %v", err)
+	}
+	if a.fsync != FsyncNever {
+		if err := a.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync log: %v", err)
+		}
+	}
+	a.dirty = false
+	return nil
+}
+
+func (a *appendLog) sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.syncLocked()
+}
+
+// rotate moves the active log aside so a snapshot can be taken while new
+// entries go to a fresh file.
+func (a *appendLog) rotate() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.syncLocked(); err != nil {
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log: %v", err)
+	}
+
+	oldPath := filepath.Join(a.dir, aofOldFileName)
+	if _, err := os.Stat(oldPath); err == nil {
+		// A previous rewrite did not finish, keep its entries ahead of ours
+		if err := appendFile(oldPath, filepath.Join(a.dir, aofFileName)); err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(a.dir, aofFileName)); err != nil {
+			return fmt.Errorf("failed to remove log: %v", err)
+		}
+	} else if err := os.Rename(filepath.Join(a.dir, aofFileName), oldPath); err != nil {
+		return fmt.Errorf("failed to rotate log: %v", err)
+	}
+
+	return a.open()
+}
+
+// finishRewrite drops the rotated log once a snapshot covering it is on disk.
+func (a *appendLog) finishRewrite() error {
+	if err := os.Remove(filepath.Join(a.dir, aofOldFileName)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove rotated log: %v", err)
+	}
+
+	a.mu.Lock()
+	a.rewriteSize = a.size
+	a.mu.Unlock()
+	return nil
+}
+
+// needsRewrite reports whether the log has grown past minSize and doubled
+// since the last rewrite.
+func (a *appendLog) needsRewrite(minSize int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.size >= minSize && a.size >= 2*a.rewriteSize
+}
+
+func (a *appendLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if err := a.syncLocked(); err != nil {
+		return err
+	}
+	return a.file.Close()
+}
+
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %v", err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open rotated log: %v", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to merge logs: %v", err)
+	}
+	return out.Sync()
+}
+
+// logMutation appends an entry to the append-only log when it is enabled.
+// It is called with the shard lock held so entries follow the in-memory order,
+// and before the change is applied, so a failed append leaves memory as the
+// log describes it.
+func (me *MemoryEngine) logMutation(entry logEntry) error {
+	if me.aof == nil {
+		return nil
+	}
+	if err := me.aof.append(entry); err != nil {
+		log.Printf("Append-only log error: %v", err)
+		return err
+	}
+	return nil
+}
+
+// applyLogEntry replays a single log entry without logging it again.
+func (me *MemoryEngine) applyLogEntry(entry logEntry, now time.Time) error {
+	switch entry.Op {
+	case opReset:
+		me.replaceShards(nil)
+		return nil
+	case opRestore:
+		shards, err := me.readSnapshotFile(filepath.Join(me.dumpPath, restoreFileName))
+		if err != nil {
+			return fmt.Errorf("failed to load restored snapshot: %w", err)
+		}
+		me.replaceShards(shards)
+		return nil
+	}
+
+	shard := me.getShard(entry.Key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	switch entry.Op {
+	case opSet:
+		if !entry.ExpiresAt.IsZero() && !entry.ExpiresAt.After(now) {
+			me.removeKey(shard, entry.Key)
+			return nil
+		}
+		me.putKey(shard, entry.Key, &KeyData{Value: entry.Value, ExpiresAt: entry.ExpiresAt})
+	case opDel:
+		me.removeKey(shard, entry.Key)
+	case opExpire:
+		data, exists := shard.data[entry.Key]
+		if !exists {
+			return nil
+		}
+		if !entry.ExpiresAt.IsZero() && !entry.ExpiresAt.After(now) {
+			me.removeKey(shard, entry.Key)
+			return nil
+		}
+		data.ExpiresAt = entry.ExpiresAt
+		data.Version = me.nextVersion()
+		shard.trackExpiry(entry.Key, entry.ExpiresAt)
+	}
+	return nil
+}
+
+// replayLogFile applies every entry of a log file. Every entry is written as
+// one line, so only the last line can be torn by a crash in the middle of a
+// write: a last line without its newline is truncated away. Any other line
+// that cannot be decoded means the log is damaged, and replay fails rather
+// than dropping the entries after it.
+func (me *MemoryEngine) replayLogFile(path string) (int, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open log: %w", err)
+	}
+	defer file.Close()
+
+	now := time.Now()
+	reader := bufio.NewReader(file)
+	replayed := 0
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				return replayed, nil
+			}
+			log.Printf("Truncating torn entry at the end of append-only log %s, offset %d", path, offset)
+			if err := file.Truncate(offset); err != nil {
+				return replayed, fmt.Errorf("failed to truncate log: %v", err)
+			}
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("failed to read log: %v", err)
+		}
+
+		var entry logEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return replayed, fmt.Errorf("append-only log %s is damaged at offset %d: %v", path, offset, err)
+		}
+		if err := me.applyLogEntry(entry, now); err != nil {
+			return replayed, fmt.Errorf("append-only log %s at offset %d: %v", path, offset, err)
+		}
+		offset += int64(len(line))
+		replayed++
+	}
+}
+
+// replayLog applies the rotated log of an unfinished rewrite, then the active log.
+func (me *MemoryEngine) replayLog(dir string) error {
+	total := 0
+	for _, name := range []string{aofOldFileName, aofFileName} {
+		n, err := me.replayLogFile(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+	if me.debug {
+		log.Printf("Replayed %d entries from the append-only log", total)
+	}
+	return nil
+}
+
+// RewriteLog folds the append-only log into a fresh snapshot.
+func (me *MemoryEngine) RewriteLog() error {
+	if me.aof == nil {
+		return errors.New("append-only log is not enabled")
+	}
+	return me.DumpToDisk()
+}
+
+func (me *MemoryEngine) runLogMaintenance(rewriteMinSize int64) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := me.aof.sync(); err != nil {
+				log.Printf("Append-only log error: %v", err)
+			}
+			if rewriteMinSize > 0 && me.aof.needsRewrite(rewriteMinSize) {
+				if err := me.RewriteLog(); err != nil {
+					log.Printf("Failed to rewrite append-only log: %v", err)
+				} else if me.debug {
+					log.Printf("Rewrote append-only log")
+				}
+			}
+		case <-me.stopCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// groupByShard returns, for every shard touched by keys, the positions of
+// its keys so batch operations take each shard lock only once.
+func (me *MemoryEngine) groupByShard(keys []string) map[int][]int {
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		index := me.shardIndex(key)
+		groups[index] = append(groups[index], i)
+	}
+	return groups
+}
+
+// MGet returns the values of keys in the same order. Missing and expired keys
+// yield a nil entry. Values are copied under the shard lock and decoded after
+// it is released.
+func (me *MemoryEngine) MGet(keys []string) ([][]byte, error) {
+	if me.debug {
+		log.Printf("Getting %d keys", len(keys))
+	}
+
+	stored := make([][]byte, len(keys))
+	now := time.Now()
+	for index, positions := range me.groupByShard(keys) {
+		shard := me.shards[index]
+		shard.mu.RLock()
+		for _, i := range positions {
+			if data, exists := shard.data[keys[i]]; exists && !data.isExpired(now) {
+				data.touch(now)
+				stored[i] = data.Value
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	values := make([][]byte, len(keys))
+	for i, value := range stored {
+		if value == nil {
+			continue
+		}
+		decoded, err := me.decodeValue(keys[i], value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt value for key %s: %v", keys[i], err)
+		}
+		values[i] = decoded
+	}
+	return values, nil
+}
+
+// MSet stores every key with the value at the same position, clearing any
+// expiry like Set. All values are encoded before the first lock is taken, so
+// an invalid value leaves the engine untouched. When a key appears more than
+// once the last value wins.
+func (me *MemoryEngine) MSet(keys []string, values [][]byte) error {
+	if len(keys) != len(values) {
+		return fmt.Errorf("got %d keys and %d values", len(keys), len(values))
+	}
+	if me.debug {
+		log.Printf("Setting %d keys", len(keys))
+	}
+
+	encoded := make([][]byte, len(values))
+	for i, value := range values {
+		stored, err := me.encodeValue(keys[i], value)
+		if err != nil {
+			return err
+		}
+		encoded[i] = stored
+	}
+
+	if err := me.reserve(); err != nil {
+		return err
+	}
+	for index, positions := range me.groupByShard(keys) {
+		shard := me.shards[index]
+		shard.mu.Lock()
+		for _, i := range positions {
+			if err := me.logMutation(logEntry{Op: opSet, Key: keys[i], Value: encoded[i]}); err != nil {
+				shard.mu.Unlock()
+				return err
+			}
+			me.putKey(shard, keys[i], &KeyData{Value: encoded[i]})
+		}
+		shard.mu.Unlock()
+	}
+	return nil
+}
+
+// MDelete removes keys and returns how many of them existed. Expired keys
+// are expired on the way but not counted.
+func (me *MemoryEngine) MDelete(keys []string) (int, error) {
+	deleted := 0
+	now := time.Now()
+	for index, positions := range me.groupByShard(keys) {
+		shard := me.shards[index]
+		shard.mu.Lock()
+		for _, i := range positions {
+			data, exists := shard.data[keys[i]]
+			if !exists {
+				continue
+			}
+			if data.isExpired(now) {
+				me.expireLazily(shard, keys[i])
+				continue
+			}
+			if err := me.logMutation(logEntry{Op: opDel, Key: keys[i]}); err != nil {
+				shard.mu.Unlock()
+				return deleted, err
+			}
+			deleted++
+			me.removeKey(shard, keys[i])
+		}
+		shard.mu.Unlock()
+	}
+	return deleted, nil
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Values are kept as JSON, which has no room for bytes that are not valid
+// UTF-8: encoding them as JSON strings would replace them with U+FFFD. A
+// string is therefore stored with each such byte escaped as \udc80 to \udcff,
+// lone surrogates that valid text never contains, and DecodeString turns
+// them back into the original bytes.
+
+// encodeString encodes str as a JSON string, escaping the bytes that are not
+// valid UTF-8.
+func encodeString(str string) []byte {
+	if utf8.ValidString(str) {
+		data, _ := json.Marshal(str)
+		return data
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for len(str) > 0 {
+		if r, size := utf8.DecodeRuneInString(str); r == utf8.RuneError && size == 1 {
+			fmt.Fprintf(&buf, `\udc%02x`, str[0])
+			str = str[1:]
+			continue
+		}
+		end := 0
+		for end < len(str) {
+			r, size := utf8.DecodeRuneInString(str[end:])
+			if r == utf8.RuneError && size == 1 {
+				break
+			}
+			end += size
+		}
+		data, _ := json.Marshal(str[:end])
+		buf.Write(data[1 : len(data)-1])
+		str = str[end:]
+	}
+	buf.WriteByte('"')
+	return buf.Bytes()
+}
+
+// DecodeString returns the text of a value stored as a JSON string, with
+// the bytes escaped by encodeString restored. ok is false when the value is
+// not a JSON string.
+func DecodeString(value []byte) (str string, ok bool) {
+	if err := json.Unmarshal(value, &str); err != nil {
+		return "", false
+	}
+	if !bytes.Contains(value, []byte(`\udc`)) && !bytes.Contains(value, []byte(`\uDC`)) {
+		return str, true
+	}
+	return unescapeString(bytes.TrimSpace(value)), true
+}
+
+// unescapeString decodes a JSON string already known to be valid, turning
+// lone low surrogates in \udc80-\udcff back into single bytes.
+func unescapeString(quoted []byte) string {
+	in := quoted[1 : len(quoted)-1]
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); i++ {
+		if in[i] != '\\' {
+			out = append(out, in[i])
+			continue
+		}
+		i++
+		switch in[i] {
+		case 'b':
+			out = append(out, '\b')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r := hexRune(in[i+1 : i+5])
+			i += 4
+			switch {
+			case utf16.IsSurrogate(r) && r < 0xdc00 && i+6 < len(in) && in[i+1] == '\\' && in[i+2] == 'u':
+				if pair := utf16.DecodeRune(r, hexRune(in[i+3:i+7])); pair != utf8.RuneError {
+					out = utf8.AppendRune(out, pair)
+					i += 6
+					continue
+				}
+				out = utf8.AppendRune(out, utf8.RuneError)
+			case r >= 0xdc80 && r <= 0xdcff:
+				out = append(out, byte(r-0xdc00))
+			case utf16.IsSurrogate(r):
+				out = utf8.AppendRune(out, utf8.RuneError)
+			default:
+				out = utf8.AppendRune(out, r)
+			}
+		default:
+			// \" \\ and \/
+			out = append(out, in[i])
+		}
+	}
+	return string(out)
+}
+
+func hexRune(digits []byte) rune {
+	n, err := strconv.ParseUint(string(digits), 16, 16)
+	if err != nil {
+		return utf8.RuneError
+	}
+	return rune(n)
+}
@@ -0,0 +1,229 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Operations of a ChangeEvent besides the key events
+const (
+	// ChangeExpire is a change of a key's expiry, the value is unchanged
+	ChangeExpire = "expire"
+	// ChangeReset is the removal of every key by a reset
+	ChangeReset = "reset"
+)
+
+var (
+	ErrFeedDisabled = errors.New("change feed is disabled")
+	// ErrChangesLost is returned when the requested changes were already
+	// dropped from the feed, or belong to an earlier run of the server
+	ErrChangesLost = errors.New("changes are no longer in the change feed")
+)
+
+// ChangeEvent is one mutation recorded in the change feed.
+type ChangeEvent struct {
+	Seq uint64
+	// Op is EventSet, ChangeExpire, EventDel, EventExpired, EventEvicted
+	// or ChangeReset
+	Op  string
+	Key string
+	// Value is the value after the change, nil when the key was removed
+	Value     []byte
+	ExpiresAt time.Time
+}
+
+// changeFeed keeps the most recent changes in a ring buffer. Sequence numbers
+// start from the clock, like versions, so a position taken before a restart
+// is recognised as lost instead of silently skipping changes.
+type changeFeed struct {
+	mu      sync.Mutex
+	events  []ChangeEvent
+	head    int
+	count   int
+	nextSeq uint64
+	// wake is closed when the next change is recorded
+	wake    chan struct{}
+	waiting bool
+}
+
+func newChangeFeed(size int) *changeFeed {
+	return &changeFeed{
+		events:  make([]ChangeEvent, size),
+		nextSeq: uint64(time.Now().UnixNano()),
+		wake:    make(chan struct{}),
+	}
+}
+
+// append records a change, overwriting the oldest one when the feed is full.
+// Values are kept as stored and decoded when read.
+func (f *changeFeed) append(op, key string, value []byte, expiresAt time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	index := (f.head + f.count) % len(f.events)
+	if f.count == len(f.events) {
+		f.head = (f.head + 1) % len(f.events)
+	} else {
+		f.count++
+	}
+	f.events[index] = ChangeEvent{Seq: f.nextSeq, Op: op, Key: key, Value: value, ExpiresAt: expiresAt}
+	f.nextSeq++
+	f.wakeReaders()
+}
+
+// wakeReaders closes the channel returned by read. The caller holds f.mu.
+func (f *changeFeed) wakeReaders() {
+	if f.waiting {
+		close(f.wake)
+		f.wake = make(chan struct{})
+		f.waiting = false
+	}
+}
+
+// read returns up to max changes starting at sequence from, and a channel
+// closed once a change after them is recorded.
+func (f *changeFeed) read(from uint64, max int) ([]ChangeEvent, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldest := f.nextSeq - uint64(f.count)
+	if from == 0 {
+		from = oldest
+	}
+	if from < oldest || from > f.nextSeq {
+		return nil, nil, fmt.Errorf("%w: requested %d, available from %d", ErrChangesLost, from, oldest)
+	}
+
+	n := int(f.nextSeq - from)
+	if n > max {
+		n = max
+	}
+	events := make([]ChangeEvent, n)
+	start := f.head + int(from-oldest)
+	for i := range events {
+		events[i] = f.events[(start+i)%len(f.events)]
+	}
+	f.waiting = true
+	return events, f.wake, nil
+}
+
+// bounds returns the sequence number of the oldest change kept and the one
+// the next change gets.
+func (f *changeFeed) bounds() (uint64, uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nextSeq - uint64(f.count), f.nextSeq
+}
+
+// recordChange adds a change to the feed when it is enabled. It is called
+// with the key's shard locked, so the feed follows the order of the writes.
+func (me *MemoryEngine) recordChange(op, key string, data *KeyData) {
+	feed := me.feed.Load()
+	if feed == nil {
+		return
+	}
+	if data == nil {
+		feed.append(op, key, nil, time.Time{})
+		return
+	}
+	feed.append(op, key, data.Value, data.ExpiresAt)
+}
+
+// restartFeed replaces the change feed once the data was loaded from a
+// snapshot, which is not recorded key by key. Positions in the old feed are
+// then lost, so followers start over from a full copy.
+func (me *MemoryEngine) restartFeed() {
+	old := me.feed.Load()
+	if old == nil {
+		return
+	}
+	feed := newChangeFeed(len(old.events))
+	if _, next := old.bounds(); feed.nextSeq <= next {
+		feed.nextSeq = next + 1
+	}
+	me.feed.Store(feed)
+
+	// Readers waiting on the old feed read again and find their position lost
+	old.mu.Lock()
+	old.wakeReaders()
+	old.mu.Unlock()
+}
+
+// ReadChanges returns up to max changes starting at sequence from, where 0
+// stands for the oldest change kept, along with a channel that is closed
+// once a change after them is recorded. Followers read until no change is
+// returned and then wait on the channel. ErrChangesLost means the changes
+// were dropped and the follower has to start over from a full copy.
+func (me *MemoryEngine) ReadChanges(from uint64, max int) ([]ChangeEvent, <-chan struct{}, error) {
+	feed := me.feed.Load()
+	if feed == nil {
+		return nil, nil, ErrFeedDisabled
+	}
+
+	events, wake, err := feed.read(from, max)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range events {
+		if events[i].Value == nil {
+			continue
+		}
+		value, err := me.decodeValue(events[i].Key, events[i].Value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decrypt value for key %s: %v", events[i].Key, err)
+		}
+		events[i].Value = value
+	}
+	return events, wake, nil
+}
+
+// ChangeFeedBounds returns the sequence number of the oldest change kept and
+// the one the next change will get.
+func (me *MemoryEngine) ChangeFeedBounds() (oldest, next uint64, err error) {
+	feed := me.feed.Load()
+	if feed == nil {
+		return 0, 0, ErrFeedDisabled
+	}
+	oldest, next = feed.bounds()
+	return oldest, next, nil
+}
+
+// ApplyChange performs a change read from another engine's feed, as a
+// replication follower does. Values are taken as the JSON they were stored
+// as; changes are recorded in this engine's own feed and log like any write.
+func (me *MemoryEngine) ApplyChange(event ChangeEvent) error {
+	switch event.Op {
+	case EventSet, ChangeExpire:
+		if !event.ExpiresAt.IsZero() && !event.ExpiresAt.After(time.Now()) {
+			return me.removeChanged(event.Key)
+		}
+		stored, err := me.encryptValue(event.Key, event.Value)
+		if err != nil {
+			return err
+		}
+		// A follower mirrors its leader, it does not evict nor reject on its own
+		return me.withShard(event.Key, func(shard *engineShard) error {
+			if err := me.logMutation(logEntry{Op: opSet, Key: event.Key, Value: stored, ExpiresAt: event.ExpiresAt}); err != nil {
+				return err
+			}
+			me.putKey(shard, event.Key, &KeyData{Value: stored, ExpiresAt: event.ExpiresAt})
+			return nil
+		})
+	case EventDel, EventExpired, EventEvicted:
+		return me.removeChanged(event.Key)
+	case ChangeReset:
+		return me.ResetMemory()
+	}
+	return fmt.Errorf("unknown change operation: %s", event.Op)
+}
+
+// removeChanged deletes a key removed on the other side, which may already
+// be gone here.
+func (me *MemoryEngine) removeChanged(key string) error {
+	if err := me.Delete(key); err != nil && err != ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"log"
+	"time"
+)
+
+// SetCondition selects when SetIf writes a value.
+type SetCondition int
+
+const (
+	// SetAlways writes unconditionally, like Set
+	SetAlways SetCondition = iota
+	// SetIfAbsent only writes when the key does not exist (SET NX)
+	SetIfAbsent
+	// SetIfPresent only writes when the key exists (SET XX)
+	SetIfPresent
+	// SetIfVersion only writes when the key is at a given version, where
+	// version 0 stands for a key that does not exist
+	SetIfVersion
+)
+
+// SetIf stores value when cond holds and reports whether it did. The check
+// and the write happen under the same shard lock, so two clients racing on
+// SetIfAbsent cannot both win. A zero expiresAt stores the key without
+// expiry; one in the past deletes it instead.
+func (me *MemoryEngine) SetIf(key string, value []byte, expiresAt time.Time, cond SetCondition, version uint64) (bool, error) {
+	return me.setIf(me, key, value, expiresAt, cond, version)
+}
+
+func (me *MemoryEngine) setIf(l shardLocker, key string, value []byte, expiresAt time.Time, cond SetCondition, version uint64) (bool, error) {
+	if me.debug {
+		log.Printf("Setting key %s with condition %d", key, cond)
+	}
+
+	stored, err := me.encodeValue(key, value)
+	if err != nil {
+		return false, err
+	}
+	if err := l.reserve(); err != nil {
+		return false, err
+	}
+
+	written := false
+	err = l.withShard(key, func(shard *engineShard) error {
+		data, exists := me.liveKey(shard, key)
+		switch cond {
+		case SetIfAbsent:
+			if exists {
+				return nil
+			}
+		case SetIfPresent:
+			if !exists {
+				return nil
+			}
+		case SetIfVersion:
+			var current uint64
+			if exists {
+				current = data.Version
+			}
+			if current != version {
+				return nil
+			}
+		}
+		written = true
+
+		if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+			if !exists {
+				return nil
+			}
+			if err := me.logMutation(logEntry{Op: opDel, Key: key}); err != nil {
+				return err
+			}
+			me.removeKey(shard, key)
+			return nil
+		}
+		if err := me.logMutation(logEntry{Op: opSet, Key: key, Value: stored, ExpiresAt: expiresAt}); err != nil {
+			return err
+		}
+		me.putKey(shard, key, &KeyData{Value: stored, ExpiresAt: expiresAt})
+		return nil
+	})
+	return written, err
+}
+
+// GetSet stores value without expiry and returns the previous value, or nil
+// when the key did not exist.
+func (me *MemoryEngine) GetSet(key string, value []byte) ([]byte, error) {
+	return me.getSet(me, key, value)
+}
+
+func (me *MemoryEngine) getSet(l shardLocker, key string, value []byte) ([]byte, error) {
+	stored, err := me.encodeValue(key, value)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.reserve(); err != nil {
+		return nil, err
+	}
+
+	var previous []byte
+	err = l.withShard(key, func(shard *engineShard) error {
+		if err := me.logMutation(logEntry{Op: opSet, Key: key, Value: stored}); err != nil {
+			return err
+		}
+		if data, exists := me.liveKey(shard, key); exists {
+			previous = data.Value
+		}
+		me.putKey(shard, key, &KeyData{Value: stored})
+		return nil
+	})
+	if err != nil || previous == nil {
+		return nil, err
+	}
+	return me.decodeValue(key, previous)
+}
+
+// GetDel deletes a key and returns the value it had.
+func (me *MemoryEngine) GetDel(key string) ([]byte, error) {
+	return me.getDel(me, key)
+}
+
+func (me *MemoryEngine) getDel(l shardLocker, key string) ([]byte, error) {
+	var previous []byte
+	err := l.withShard(key, func(shard *engineShard) error {
+		data, exists := me.liveKey(shard, key)
+		if !exists {
+			return ErrKeyNotFound
+		}
+		if err := me.logMutation(logEntry{Op: opDel, Key: key}); err != nil {
+			return err
+		}
+		previous = data.Value
+		me.removeKey(shard, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return me.decodeValue(key, previous)
+}
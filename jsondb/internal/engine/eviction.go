@@ -0,0 +1,237 @@
+package engine
+
+import (
+	"errors"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Eviction policies applied once MAX_MEMORY is reached
+const (
+	// EvictNone rejects writes instead of removing keys
+	EvictNone = "noeviction"
+	// EvictAllKeysLRU removes the least recently used keys
+	EvictAllKeysLRU = "allkeys-lru"
+	// EvictAllKeysLFU removes the least frequently used keys
+	EvictAllKeysLFU = "allkeys-lfu"
+	// EvictVolatileLRU removes the least recently used keys with an expiry
+	EvictVolatileLRU = "volatile-lru"
+	// EvictVolatileTTL removes the keys with an expiry closest to expiring
+	EvictVolatileTTL = "volatile-ttl"
+	// EvictRandom removes random keys
+	EvictRandom = "random"
+)
+
+var ErrOutOfMemory = errors.New("out of memory: writes are rejected while used memory exceeds MAX_MEMORY")
+
+const (
+	// keyOverhead approximates the memory a key takes besides its name and
+	// value: the map entry, KeyData and its expiry and index entries
+	keyOverhead = 96
+
+	// evictionSamples keys are compared in each of evictionShards shards to
+	// pick a key to evict, approximating the policy without a global order
+	evictionSamples = 5
+	evictionShards  = 4
+
+	// lfuInitial is the access counter of a new key, so it is not the first
+	// candidate for eviction; lfuLogFactor slows the counter down as it
+	// grows and lfuDecay is the idle time that takes one off
+	lfuInitial   = 5
+	lfuLogFactor = 10
+	lfuDecay     = time.Minute
+)
+
+// MemoryStats reports the approximate memory use and the eviction counters.
+type MemoryStats struct {
+	UsedBytes int64
+	MaxBytes  int64
+	Policy    string
+	// Evicted counts keys removed to stay under MaxBytes
+	Evicted uint64
+	// Rejected counts writes refused because no key could be evicted
+	Rejected uint64
+}
+
+// keyMemory approximates the memory held by a key.
+func keyMemory(key string, data *KeyData) int64 {
+	return int64(len(key) + len(data.Value) + keyOverhead)
+}
+
+// touch records an access for the LRU and LFU policies. Reads call it under
+// the shard's read lock, so the counters are updated atomically.
+func (kd *KeyData) touch(now time.Time) {
+	atomic.StoreInt64(&kd.lastAccess, now.UnixNano())
+
+	// A logarithmic counter: the more hits a key has, the less likely the
+	// next one increments it
+	hits := atomic.LoadUint32(&kd.hits)
+	if hits < 255 && rand.Float64() < 1/float64(hits*lfuLogFactor+1) {
+		atomic.CompareAndSwapUint32(&kd.hits, hits, hits+1)
+	}
+}
+
+// frequency returns the access counter decayed by the time the key was idle.
+func (kd *KeyData) frequency(now time.Time) int64 {
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&kd.lastAccess)))
+	frequency := int64(atomic.LoadUint32(&kd.hits)) - int64(idle/lfuDecay)
+	if frequency < 0 {
+		return 0
+	}
+	return frequency
+}
+
+// usedMemory returns the approximate memory held by all keys.
+func (me *MemoryEngine) usedMemory() int64 {
+	var used int64
+	for _, shard := range me.shards {
+		used += atomic.LoadInt64(&shard.used)
+	}
+	return used
+}
+
+// overLimit reports whether the memory limit is exceeded.
+func (me *MemoryEngine) overLimit() bool {
+	return me.maxMemory > 0 && me.usedMemory() > me.maxMemory
+}
+
+// reserve makes room for a write before any shard is locked, evicting keys
+// as the policy allows. The write is rejected when memory stays over the
+// limit. Deletes never call it, so they work when memory is full.
+func (me *MemoryEngine) reserve() error {
+	if !me.evictToLimit() {
+		atomic.AddUint64(&me.rejected, 1)
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// reserve of a transaction cannot evict, its shards are already locked and
+// Atomic made room before taking them.
+func (tx *Tx) reserve() error {
+	if tx.me.overLimit() {
+		atomic.AddUint64(&tx.me.rejected, 1)
+		return ErrOutOfMemory
+	}
+	return nil
+}
+
+// evictToLimit evicts keys until memory is under the limit and reports
+// whether it is. No shard lock may be held by the caller.
+func (me *MemoryEngine) evictToLimit() bool {
+	for me.overLimit() {
+		if me.policy == EvictNone || me.policy == "" || !me.evictOne() {
+			return false
+		}
+	}
+	return true
+}
+
+// evictionCandidate is the best key to evict found so far. A higher score
+// is a better candidate.
+type evictionCandidate struct {
+	shard *engineShard
+	key   string
+	data  *KeyData
+	score int64
+}
+
+// evictOne removes the best key among a sample and reports whether one was
+// found.
+func (me *MemoryEngine) evictOne() bool {
+	now := time.Now()
+	start := int(atomic.AddUint64(&me.evictCursor, 1))
+	var best *evictionCandidate
+
+	// Empty shards are skipped, so a few keys left anywhere are still found
+	sampledShards := 0
+	for i := 0; i < me.numShards && sampledShards < evictionShards; i++ {
+		shard := me.shards[(start+i)%me.numShards]
+		sampled := false
+		shard.mu.RLock()
+		me.sampleShard(shard, func(key string, data *KeyData) {
+			sampled = true
+			score := me.evictionScore(data, now)
+			if best == nil || score > best.score {
+				best = &evictionCandidate{shard: shard, key: key, data: data, score: score}
+			}
+		})
+		shard.mu.RUnlock()
+		if sampled {
+			sampledShards++
+		}
+	}
+	if best == nil {
+		return false
+	}
+
+	best.shard.mu.Lock()
+	defer best.shard.mu.Unlock()
+	// The key may have been written since it was sampled, it is then left
+	// alone and the next round samples again
+	if best.shard.data[best.key] != best.data {
+		return true
+	}
+	if best.data.isExpired(time.Now()) {
+		me.expireLazily(best.shard, best.key)
+		return true
+	}
+	if err := me.logMutation(logEntry{Op: opDel, Key: best.key}); err != nil {
+		return false
+	}
+	me.dropKey(best.shard, best.key, EventEvicted)
+	atomic.AddUint64(&me.evicted, 1)
+	return true
+}
+
+// sampleShard passes up to evictionSamples keys the policy may evict to fn.
+// Volatile policies sample the expiry heap, which only holds keys with an
+// expiry. The caller must hold the shard's read lock.
+func (me *MemoryEngine) sampleShard(shard *engineShard, fn func(key string, data *KeyData)) {
+	if me.policy == EvictVolatileLRU || me.policy == EvictVolatileTTL {
+		for i := 0; i < evictionSamples && len(shard.expires) > 0; i++ {
+			entry := shard.expires[rand.Intn(len(shard.expires))]
+			if data, exists := shard.data[entry.key]; exists && data.ExpiresAt.Equal(entry.expiresAt) {
+				fn(entry.key, data)
+			}
+		}
+		return
+	}
+
+	// Map iteration starts at a random position, the first keys are a sample
+	sampled := 0
+	for key, data := range shard.data {
+		fn(key, data)
+		if sampled++; sampled == evictionSamples {
+			return
+		}
+	}
+}
+
+func (me *MemoryEngine) evictionScore(data *KeyData, now time.Time) int64 {
+	switch me.policy {
+	case EvictAllKeysLRU, EvictVolatileLRU:
+		return now.UnixNano() - atomic.LoadInt64(&data.lastAccess)
+	case EvictAllKeysLFU:
+		return -data.frequency(now)
+	case EvictVolatileTTL:
+		return -data.ExpiresAt.UnixNano()
+	}
+	return rand.Int63()
+}
+
+// MemoryStats returns the memory use and eviction counters.
+func (me *MemoryEngine) MemoryStats() MemoryStats {
+	policy := me.policy
+	if policy == "" {
+		policy = EvictNone
+	}
+	return MemoryStats{
+		UsedBytes: me.usedMemory(),
+		MaxBytes:  me.maxMemory,
+		Policy:    policy,
+		Evicted:   atomic.LoadUint64(&me.evicted),
+		Rejected:  atomic.LoadUint64(&me.rejected),
+	}
+}
@@ -0,0 +1,141 @@
+package engine
+
+import (
+	"container/heap"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultExpiryInterval is how often the active expiry cycle runs when
+	// the configuration does not say otherwise.
+	defaultExpiryInterval = 100 * time.Millisecond
+
+	// maxExpiredPerShard bounds the work done while holding a shard lock in a
+	// single cycle, so a burst of expirations cannot stall regular traffic.
+	maxExpiredPerShard = 1000
+)
+
+// ExpiryStats reports how many keys were reclaimed by the background expiry
+// cycle and how many were removed lazily when a command touched them.
+type ExpiryStats struct {
+	ActiveExpired uint64
+	LazyExpired   uint64
+}
+
+type expiryEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// expiryHeap is a min-heap of expiry deadlines. Entries are never updated in
+// place: when a key's expiry changes a new entry is pushed and the old one is
+// recognised as stale when it is popped.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryEntry)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	*h = old[:n-1]
+	return entry
+}
+
+// trackExpiry registers a key's deadline with the shard's expiry heap.
+// The caller must hold the shard's write lock.
+func (s *engineShard) trackExpiry(key string, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		return
+	}
+	heap.Push(&s.expires, expiryEntry{key: key, expiresAt: expiresAt})
+
+	// Drop stale entries once they clearly outnumber the live keys
+	if len(s.expires) > 2*len(s.data)+64 {
+		s.rebuildExpiries()
+	}
+}
+
+// rebuildExpiries recreates the expiry heap from the live keys.
+// The caller must hold the shard's write lock.
+func (s *engineShard) rebuildExpiries() {
+	s.expires = s.expires[:0]
+	for key, data := range s.data {
+		if !data.ExpiresAt.IsZero() {
+			s.expires = append(s.expires, expiryEntry{key: key, expiresAt: data.ExpiresAt})
+		}
+	}
+	heap.Init(&s.expires)
+}
+
+// removeExpired deletes keys of a shard whose deadline has passed, up to
+// limit keys. The caller must hold the shard's write lock.
+func (me *MemoryEngine) removeExpired(shard *engineShard, now time.Time, limit int) int {
+	removed := 0
+	for len(shard.expires) > 0 && removed < limit {
+		next := shard.expires[0]
+		if next.expiresAt.After(now) {
+			break
+		}
+		heap.Pop(&shard.expires)
+
+		data, exists := shard.data[next.key]
+		if !exists || !data.ExpiresAt.Equal(next.expiresAt) {
+			// Stale entry, the key was deleted or its expiry changed
+			continue
+		}
+		me.dropKey(shard, next.key, EventExpired)
+		removed++
+	}
+	return removed
+}
+
+// expireLazily removes a key that was found expired while serving a command.
+// The caller must hold the shard's write lock.
+func (me *MemoryEngine) expireLazily(shard *engineShard, key string) {
+	me.dropKey(shard, key, EventExpired)
+	atomic.AddUint64(&me.lazyExpired, 1)
+}
+
+// activeExpireCycle runs one pass of the background expiry over all shards.
+func (me *MemoryEngine) activeExpireCycle() {
+	now := time.Now()
+	for _, shard := range me.shards {
+		shard.mu.Lock()
+		removed := me.removeExpired(shard, now, maxExpiredPerShard)
+		shard.mu.Unlock()
+
+		if removed > 0 {
+			atomic.AddUint64(&me.activeExpired, uint64(removed))
+		}
+	}
+}
+
+func (me *MemoryEngine) runActiveExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			me.activeExpireCycle()
+		case <-me.stopCh:
+			if me.debug {
+				log.Printf("Active expiry stopped")
+			}
+			return
+		}
+	}
+}
+
+// ExpiryStats returns the expiry counters.
+func (me *MemoryEngine) ExpiryStats() ExpiryStats {
+	return ExpiryStats{
+		ActiveExpired: atomic.LoadUint64(&me.activeExpired),
+		LazyExpired:   atomic.LoadUint64(&me.lazyExpired),
+	}
+}
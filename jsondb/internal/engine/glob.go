@@ -0,0 +1,141 @@
+package engine
+
+// matchGlob reports whether key matches the glob pattern as a whole.
+// Supported syntax:
+//
+//   - "*" matches any sequence of characters, including none
+//   - "?" matches exactly one character
+//   - "[abc]" matches one of the listed characters, ranges like [a-z] are allowed
+//   - "[^ab]" matches any character except the listed ones ([!ab] works as well)
+//   - "\x" matches the character x literally
+//
+// Every other character, including regular expression metacharacters such
+// as . + ( or |, only matches itself.
+func matchGlob(pattern, key string) bool {
+	p, k := 0, 0
+	// Position to resume from when the last * has to absorb one more character
+	starP, starK := -1, 0
+
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starK = p, k
+				p++
+				continue
+			case '?':
+				p++
+				k++
+				continue
+			case '[':
+				if end, ok := matchClass(pattern, p, key[k]); end > 0 {
+					if ok {
+						p = end
+						k++
+						continue
+					}
+				} else if key[k] == '[' {
+					// An unterminated class is a literal bracket
+					p++
+					k++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == key[k] {
+					p += 2
+					k++
+					continue
+				}
+				if p+1 == len(pattern) && key[k] == '\\' {
+					p++
+					k++
+					continue
+				}
+			default:
+				if pattern[p] == key[k] {
+					p++
+					k++
+					continue
+				}
+			}
+		}
+
+		if starP == -1 {
+			return false
+		}
+		starK++
+		p, k = starP+1, starK
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchClass matches c against the character class starting at pattern[start].
+// It returns the index just past the closing bracket, or 0 when the class is
+// not terminated.
+func matchClass(pattern string, start int, c byte) (int, bool) {
+	i := start + 1
+	negate := false
+	if i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!') {
+		negate = true
+		i++
+	}
+
+	matched := false
+	first := true
+	for i < len(pattern) {
+		if pattern[i] == ']' && !first {
+			return i + 1, matched != negate
+		}
+		first = false
+
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			if hi == '\\' && i+3 < len(pattern) {
+				i++
+				hi = pattern[i+2]
+			}
+			i += 2
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if c >= lo && c <= hi {
+			matched = true
+		}
+		i++
+	}
+	return 0, false
+}
+
+// globPrefix returns the literal prefix of a pattern, every key matching the
+// pattern starts with it.
+func globPrefix(pattern string) string {
+	prefix := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?', '[':
+			return string(prefix)
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+		}
+		prefix = append(prefix, pattern[i])
+	}
+	return string(prefix)
+}
+
+// MatchGlob reports whether s matches pattern, using the syntax of KEYS.
+func MatchGlob(pattern, s string) bool {
+	return matchGlob(pattern, s)
+}
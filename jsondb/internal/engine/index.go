@@ -0,0 +1,500 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrIndexNotFound = errors.New("index not found")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrInvalidQuery  = errors.New("invalid query")
+)
+
+// Query operators supported by Query.
+const (
+	QueryEq     = "EQ"
+	QueryRange  = "RANGE"
+	QueryGt     = "GT"
+	QueryGte    = "GTE"
+	QueryLt     = "LT"
+	QueryLte    = "LTE"
+	QueryPrefix = "PREFIX"
+)
+
+// IndexDef declares a secondary index on the JSON field at Path of every key
+// matching the glob Pattern.
+type IndexDef struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Path    string `json:"path"`
+}
+
+// IndexQuery is a predicate evaluated against a single index. Values holds
+// one operand, or two for RANGE. Results are ordered by indexed value and
+// then by key. A Limit of zero or less returns every match.
+type IndexQuery struct {
+	Op     string
+	Values []string
+	Offset int
+	Limit  int
+}
+
+// indexValue is the comparable form of an indexed field. Numbers sort before
+// strings; booleans are indexed as the strings "true" and "false". Objects,
+// arrays and null are not indexed.
+type indexValue struct {
+	isString bool
+	num      float64
+	str      string
+}
+
+func compareIndexValues(a, b indexValue) int {
+	if a.isString != b.isString {
+		if a.isString {
+			return 1
+		}
+		return -1
+	}
+	if a.isString {
+		return strings.Compare(a.str, b.str)
+	}
+	switch {
+	case a.num < b.num:
+		return -1
+	case a.num > b.num:
+		return 1
+	}
+	return 0
+}
+
+// toIndexValue converts a decoded JSON value to its indexed form.
+func toIndexValue(value interface{}) (indexValue, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return indexValue{}, false
+		}
+		return indexValue{num: f}, true
+	case float64:
+		return indexValue{num: v}, true
+	case string:
+		return indexValue{isString: true, str: v}, true
+	case bool:
+		return indexValue{isString: true, str: strconv.FormatBool(v)}, true
+	}
+	return indexValue{}, false
+}
+
+// parseIndexValue converts a query operand. Operands that parse as JSON
+// scalars keep their type, so 42 matches a number and "42" (quoted) a string;
+// anything else is taken as a plain string.
+func parseIndexValue(arg string) (indexValue, error) {
+	if doc, err := decodeJSON([]byte(arg)); err == nil {
+		if value, ok := toIndexValue(doc); ok {
+			return value, nil
+		}
+		return indexValue{}, fmt.Errorf("%w: %s is not a number or string", ErrInvalidQuery, arg)
+	}
+	return indexValue{isString: true, str: arg}, nil
+}
+
+type indexEntry struct {
+	value indexValue
+	key   string
+}
+
+func compareEntries(a, b indexEntry) int {
+	if c := compareIndexValues(a.value, b.value); c != 0 {
+		return c
+	}
+	return strings.Compare(a.key, b.key)
+}
+
+// fieldIndex keeps the indexed keys sorted by (value, key) in a skip list,
+// so writes update it in O(log n) and equality, range and prefix predicates
+// seek to their first match.
+type fieldIndex struct {
+	def      IndexDef
+	segments []pathSegment
+
+	mu      sync.RWMutex
+	byKey   map[string]indexValue
+	entries *skipList[indexEntry]
+}
+
+func newFieldIndex(def IndexDef) (*fieldIndex, error) {
+	if def.Name == "" || def.Pattern == "" {
+		return nil, fmt.Errorf("index name and pattern are required")
+	}
+	segments, err := parsePath(def.Path)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: an index needs a field path", ErrInvalidPath)
+	}
+	return &fieldIndex{
+		def:      def,
+		segments: segments,
+		byKey:    make(map[string]indexValue),
+		entries:  newSkipList(compareEntries),
+	}, nil
+}
+
+// search returns the node of the first entry not less than target.
+func (idx *fieldIndex) search(target indexEntry) *skipNode[indexEntry] {
+	return idx.entries.search(func(entry indexEntry) bool {
+		return compareEntries(entry, target) >= 0
+	})
+}
+
+// set records the value of key, replacing any previous one.
+func (idx *fieldIndex) set(key string, value indexValue) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, exists := idx.byKey[key]; exists {
+		if compareIndexValues(old, value) == 0 {
+			return
+		}
+		idx.removeEntry(key, old)
+	}
+
+	idx.entries.insert(indexEntry{value: value, key: key})
+	idx.byKey[key] = value
+}
+
+func (idx *fieldIndex) remove(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if old, exists := idx.byKey[key]; exists {
+		idx.removeEntry(key, old)
+	}
+}
+
+// removeEntry deletes key from the index. The caller must hold idx.mu.
+func (idx *fieldIndex) removeEntry(key string, value indexValue) {
+	idx.entries.delete(indexEntry{value: value, key: key})
+	delete(idx.byKey, key)
+}
+
+func (idx *fieldIndex) reset() {
+	idx.mu.Lock()
+	idx.byKey = make(map[string]indexValue)
+	idx.entries = newSkipList(compareEntries)
+	idx.mu.Unlock()
+}
+
+// extract returns the indexed value of a decoded document.
+func (idx *fieldIndex) extract(doc interface{}) (indexValue, bool) {
+	value, err := lookupPath(doc, idx.segments)
+	if err != nil {
+		return indexValue{}, false
+	}
+	return toIndexValue(value)
+}
+
+// collect returns up to max entries that fall between lower and upper, in
+// index order, resuming after the entry after when it is set. A nil bound is
+// unbounded, a max of zero or less collects every match. Numbers and strings
+// never compare with each other, so a bounded range only covers values of
+// its bound's type.
+func (idx *fieldIndex) collect(lower, upper *queryBound, prefix *string, after *indexEntry, max int) []indexEntry {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	start := idx.entries.first()
+	if after != nil {
+		// Every entry up to after was collected already
+		start = idx.entries.search(func(entry indexEntry) bool {
+			return compareEntries(entry, *after) > 0
+		})
+	} else if lower != nil {
+		start = idx.entries.search(func(entry indexEntry) bool {
+			c := compareIndexValues(entry.value, lower.value)
+			return c > 0 || (c == 0 && lower.inclusive)
+		})
+	} else if prefix != nil {
+		start = idx.search(indexEntry{value: indexValue{isString: true, str: *prefix}})
+	} else if upper != nil && upper.value.isString {
+		start = idx.search(indexEntry{value: indexValue{isString: true}})
+	}
+	numbersOnly := (lower != nil && !lower.value.isString) || (upper != nil && !upper.value.isString)
+
+	var entries []indexEntry
+	for node := start; node != nil && (max <= 0 || len(entries) < max); node = node.next[0] {
+		entry := node.item
+		if numbersOnly && entry.value.isString {
+			break
+		}
+		if upper != nil {
+			c := compareIndexValues(entry.value, upper.value)
+			if c > 0 || (c == 0 && !upper.inclusive) {
+				break
+			}
+		}
+		if prefix != nil && (!entry.value.isString || !strings.HasPrefix(entry.value.str, *prefix)) {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+type queryBound struct {
+	value     indexValue
+	inclusive bool
+}
+
+// parseBound parses a RANGE bound, where -inf and +inf leave that side open.
+func parseBound(arg string) (*queryBound, error) {
+	switch strings.ToLower(arg) {
+	case "-inf", "+inf", "inf":
+		return nil, nil
+	}
+	value, err := parseIndexValue(arg)
+	if err != nil {
+		return nil, err
+	}
+	return &queryBound{value: value, inclusive: true}, nil
+}
+
+// CreateIndex registers an index and fills it from the existing keys.
+func (me *MemoryEngine) CreateIndex(def IndexDef) error {
+	idx, err := newFieldIndex(def)
+	if err != nil {
+		return err
+	}
+
+	me.indexMu.Lock()
+	if _, exists := me.indexes[def.Name]; exists {
+		me.indexMu.Unlock()
+		return fmt.Errorf("%w: %s", ErrIndexExists, def.Name)
+	}
+	me.indexes[def.Name] = idx
+	me.indexMu.Unlock()
+
+	// Writes from here on maintain the index themselves; the backfill only
+	// has to catch up with keys that were already stored
+	me.backfillIndex(idx)
+
+	if me.debug {
+		log.Printf("Created index %s on %s %s", def.Name, def.Pattern, def.Path)
+	}
+	return nil
+}
+
+// DropIndex removes an index.
+func (me *MemoryEngine) DropIndex(name string) error {
+	me.indexMu.Lock()
+	defer me.indexMu.Unlock()
+
+	if _, exists := me.indexes[name]; !exists {
+		return fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	}
+	delete(me.indexes, name)
+	return nil
+}
+
+// Indexes returns the definitions of all indexes sorted by name.
+func (me *MemoryEngine) Indexes() []IndexDef {
+	me.indexMu.RLock()
+	defer me.indexMu.RUnlock()
+
+	defs := make([]IndexDef, 0, len(me.indexes))
+	for _, idx := range me.indexes {
+		defs = append(defs, idx.def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// Query returns the keys whose indexed field satisfies q.
+func (me *MemoryEngine) Query(name string, q IndexQuery) ([]string, error) {
+	me.indexMu.RLock()
+	idx, exists := me.indexes[name]
+	me.indexMu.RUnlock()
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrIndexNotFound, name)
+	}
+
+	wantArgs := 1
+	if strings.ToUpper(q.Op) == QueryRange {
+		wantArgs = 2
+	}
+	if len(q.Values) != wantArgs {
+		return nil, fmt.Errorf("%w: %s expects %d value(s)", ErrInvalidQuery, q.Op, wantArgs)
+	}
+	if q.Offset < 0 {
+		return nil, fmt.Errorf("%w: negative offset", ErrInvalidQuery)
+	}
+
+	var lower, upper *queryBound
+	var prefix *string
+	switch strings.ToUpper(q.Op) {
+	case QueryRange:
+		var err error
+		if lower, err = parseBound(q.Values[0]); err != nil {
+			return nil, err
+		}
+		if upper, err = parseBound(q.Values[1]); err != nil {
+			return nil, err
+		}
+	case QueryPrefix:
+		prefix = &q.Values[0]
+	case QueryEq, QueryGt, QueryGte, QueryLt, QueryLte:
+		value, err := parseIndexValue(q.Values[0])
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToUpper(q.Op) {
+		case QueryEq:
+			lower = &queryBound{value: value, inclusive: true}
+			upper = lower
+		case QueryGt:
+			lower = &queryBound{value: value}
+		case QueryGte:
+			lower = &queryBound{value: value, inclusive: true}
+		case QueryLt:
+			upper = &queryBound{value: value}
+		case QueryLte:
+			upper = &queryBound{value: value, inclusive: true}
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown operator %s", ErrInvalidQuery, q.Op)
+	}
+
+	// With a limit, candidates are collected in batches of the keys still
+	// missing: keys that expired but were not reclaimed yet are still in the
+	// index, and only turn out to be dead here
+	now := time.Now()
+	keys := []string{}
+	skipped := 0
+	var after *indexEntry
+	for {
+		want := 0
+		if q.Limit > 0 {
+			want = q.Offset + q.Limit - skipped - len(keys)
+		}
+		candidates := idx.collect(lower, upper, prefix, after, want)
+		for _, entry := range candidates {
+			shard := me.getShard(entry.key)
+			shard.mu.RLock()
+			data, exists := shard.data[entry.key]
+			live := exists && !data.isExpired(now)
+			shard.mu.RUnlock()
+			if !live {
+				continue
+			}
+
+			if skipped < q.Offset {
+				skipped++
+				continue
+			}
+			keys = append(keys, entry.key)
+		}
+		if want <= 0 || len(candidates) < want || len(keys) >= q.Limit {
+			return keys, nil
+		}
+		after = &candidates[len(candidates)-1]
+	}
+}
+
+// backfillIndex adds every live key matching the index pattern.
+func (me *MemoryEngine) backfillIndex(idx *fieldIndex) {
+	prefix := globPrefix(idx.def.Pattern)
+	for _, shard := range me.shards {
+		shard.mu.RLock()
+		for key, data := range shard.data {
+			if !strings.HasPrefix(key, prefix) || !matchGlob(idx.def.Pattern, key) {
+				continue
+			}
+			if value, ok := me.indexedValue(idx, key, data); ok {
+				idx.set(key, value)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+}
+
+// indexedValue decodes a stored value and extracts the field of idx.
+func (me *MemoryEngine) indexedValue(idx *fieldIndex, key string, data *KeyData) (indexValue, bool) {
+	plaintext, err := me.decodeValue(key, data.Value)
+	if err != nil {
+		return indexValue{}, false
+	}
+	doc, err := decodeJSON(plaintext)
+	if err != nil {
+		return indexValue{}, false
+	}
+	return idx.extract(doc)
+}
+
+// indexKey updates every index whose pattern matches key after a write.
+// The caller must hold the key's shard write lock.
+func (me *MemoryEngine) indexKey(key string, data *KeyData) {
+	me.indexMu.RLock()
+	defer me.indexMu.RUnlock()
+
+	if len(me.indexes) == 0 {
+		return
+	}
+
+	// The value is decoded at most once, however many indexes match
+	var doc interface{}
+	decoded := false
+	for _, idx := range me.indexes {
+		if !matchGlob(idx.def.Pattern, key) {
+			continue
+		}
+
+		if !decoded {
+			decoded = true
+			if plaintext, err := me.decodeValue(key, data.Value); err == nil {
+				doc, _ = decodeJSON(plaintext)
+			}
+		}
+
+		if value, ok := idx.extract(doc); doc != nil && ok {
+			idx.set(key, value)
+		} else {
+			idx.remove(key)
+		}
+	}
+}
+
+// unindexKey removes a deleted key from every index.
+// The caller must hold the key's shard write lock.
+func (me *MemoryEngine) unindexKey(key string) {
+	me.indexMu.RLock()
+	defer me.indexMu.RUnlock()
+
+	for _, idx := range me.indexes {
+		idx.remove(key)
+	}
+}
+
+// rebuildIndexes refills every index after the shards were replaced.
+func (me *MemoryEngine) rebuildIndexes() {
+	me.indexMu.RLock()
+	indexes := make([]*fieldIndex, 0, len(me.indexes))
+	for _, idx := range me.indexes {
+		indexes = append(indexes, idx)
+	}
+	me.indexMu.RUnlock()
+
+	for _, idx := range indexes {
+		idx.reset()
+		me.backfillIndex(idx)
+	}
+}
@@ -0,0 +1,479 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidPath  = errors.New("invalid JSON path")
+	ErrPathNotFound = errors.New("path not found")
+	ErrNotJSON      = errors.New("value is not a JSON document")
+	ErrWrongType    = errors.New("value at path has the wrong type")
+	ErrOverflow     = errors.New("increment would overflow")
+)
+
+// pathSegment is one step of a JSON path: an object member or an array index.
+type pathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parsePath parses a JSON path of the form $.a.b[0]["c d"]. The leading $ is
+// optional and an empty path or $ alone refers to the whole document.
+func parsePath(path string) ([]pathSegment, error) {
+	p := strings.TrimSpace(path)
+	p = strings.TrimPrefix(p, "$")
+
+	var segments []pathSegment
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end == -1 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidPath, path)
+			}
+			segments = append(segments, pathSegment{key: p[:end]})
+			p = p[end:]
+
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end == -1 {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidPath, path)
+			}
+			inner := p[1:end]
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				segments = append(segments, pathSegment{key: inner[1 : len(inner)-1]})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("%w: %s", ErrInvalidPath, path)
+				}
+				segments = append(segments, pathSegment{index: index, isIndex: true})
+			}
+			p = p[end+1:]
+
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPath, path)
+		}
+	}
+	return segments, nil
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, ErrNotJSON
+	}
+	// The value must be the whole input, {"a":1} garbage is not JSON
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, ErrNotJSON
+	}
+	return doc, nil
+}
+
+// resolveIndex turns a possibly negative index into a position in arr.
+func resolveIndex(arr []interface{}, index int) (int, bool) {
+	if index < 0 {
+		index += len(arr)
+	}
+	return index, index >= 0 && index < len(arr)
+}
+
+// lookupPath returns the value at the given path.
+func lookupPath(doc interface{}, segments []pathSegment) (interface{}, error) {
+	current := doc
+	for _, seg := range segments {
+		if seg.isIndex {
+			arr, ok := current.([]interface{})
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			i, ok := resolveIndex(arr, seg.index)
+			if !ok {
+				return nil, ErrPathNotFound
+			}
+			current = arr[i]
+			continue
+		}
+
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		current, ok = obj[seg.key]
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+	}
+	return current, nil
+}
+
+// updatePath replaces the value at the given path with the result of fn and
+// returns the new document. A missing object member is created when it is the
+// last segment of the path; fn then receives nil and exists is false.
+func updatePath(doc interface{}, segments []pathSegment, fn func(value interface{}, exists bool) (interface{}, error)) (interface{}, error) {
+	if len(segments) == 0 {
+		return fn(doc, true)
+	}
+
+	parent, err := lookupPath(doc, segments[:len(segments)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	last := segments[len(segments)-1]
+	if last.isIndex {
+		arr, ok := parent.([]interface{})
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		i, ok := resolveIndex(arr, last.index)
+		if !ok {
+			return nil, ErrPathNotFound
+		}
+		value, err := fn(arr[i], true)
+		if err != nil {
+			return nil, err
+		}
+		arr[i] = value
+		return doc, nil
+	}
+
+	obj, ok := parent.(map[string]interface{})
+	if !ok {
+		return nil, ErrPathNotFound
+	}
+	current, exists := obj[last.key]
+	value, err := fn(current, exists)
+	if err != nil {
+		return nil, err
+	}
+	obj[last.key] = value
+	return doc, nil
+}
+
+// deletePath removes the value at the given path and reports whether it existed.
+func deletePath(doc interface{}, segments []pathSegment) (interface{}, bool, error) {
+	parent, err := lookupPath(doc, segments[:len(segments)-1])
+	if err != nil {
+		return doc, false, nil
+	}
+
+	last := segments[len(segments)-1]
+	if last.isIndex {
+		arr, ok := parent.([]interface{})
+		if !ok {
+			return doc, false, nil
+		}
+		i, ok := resolveIndex(arr, last.index)
+		if !ok {
+			return doc, false, nil
+		}
+		updated := append(arr[:i:i], arr[i+1:]...)
+		// The parent slice changed length, so it has to be written back
+		if len(segments) == 1 {
+			return updated, true, nil
+		}
+		doc, err = updatePath(doc, segments[:len(segments)-1], func(interface{}, bool) (interface{}, error) {
+			return updated, nil
+		})
+		return doc, err == nil, err
+	}
+
+	obj, ok := parent.(map[string]interface{})
+	if !ok {
+		return doc, false, nil
+	}
+	if _, exists := obj[last.key]; !exists {
+		return doc, false, nil
+	}
+	delete(obj, last.key)
+	return doc, true, nil
+}
+
+// loadJSON returns the decoded document stored under key. The caller must
+// hold the shard lock.
+func (me *MemoryEngine) loadJSON(shard *engineShard, key string) (*KeyData, interface{}, error) {
+	data, exists := me.liveKey(shard, key)
+	if !exists {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	plaintext, err := me.decodeValue(key, data.Value)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := decodeJSON(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, doc, nil
+}
+
+// saveJSON re-encodes a modified document through the regular write pipeline,
+// keeping the key's expiry. The caller must hold the shard lock.
+func (me *MemoryEngine) saveJSON(shard *engineShard, key string, doc interface{}, expiresAt time.Time) error {
+	jsonData, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal value: %v", err)
+	}
+	stored, err := me.encryptValue(key, jsonData)
+	if err != nil {
+		return err
+	}
+
+	if err := me.logMutation(logEntry{Op: opSet, Key: key, Value: stored, ExpiresAt: expiresAt}); err != nil {
+		return err
+	}
+	me.putKey(shard, key, &KeyData{Value: stored, ExpiresAt: expiresAt})
+	return nil
+}
+
+// modifyJSON runs fn on the document stored under key while holding the shard
+// lock, so the read-modify-write cannot interleave with other writers.
+func (me *MemoryEngine) modifyJSON(l shardLocker, key string, fn func(doc interface{}) (interface{}, error)) error {
+	return l.withShard(key, func(shard *engineShard) error {
+		data, doc, err := me.loadJSON(shard, key)
+		if err != nil {
+			return err
+		}
+
+		doc, err = fn(doc)
+		if err != nil {
+			return err
+		}
+		return me.saveJSON(shard, key, doc, data.ExpiresAt)
+	})
+}
+
+// JSONGet returns the JSON encoding of the value at path.
+func (me *MemoryEngine) JSONGet(key, path string) ([]byte, error) {
+	return me.jsonGet(me, key, path)
+}
+
+func (me *MemoryEngine) jsonGet(l shardLocker, key, path string) ([]byte, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []byte
+	err = l.withShard(key, func(shard *engineShard) error {
+		_, doc, err := me.loadJSON(shard, key)
+		if err != nil {
+			return err
+		}
+		value, err := lookupPath(doc, segments)
+		if err != nil {
+			return err
+		}
+		result, err = json.Marshal(value)
+		return err
+	})
+	return result, err
+}
+
+// JSONSet sets the value at path to the given JSON. Setting the root path
+// creates the key when it does not exist.
+func (me *MemoryEngine) JSONSet(key, path string, value []byte) error {
+	return me.jsonSet(me, key, path, value)
+}
+
+func (me *MemoryEngine) jsonSet(l shardLocker, key, path string, value []byte) error {
+	segments, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	if err := l.reserve(); err != nil {
+		return err
+	}
+	newValue, err := decodeJSON(value)
+	if err != nil {
+		return err
+	}
+
+	if len(segments) == 0 {
+		jsonData, err := json.Marshal(newValue)
+		if err != nil {
+			return fmt.Errorf("failed to marshal value: %v", err)
+		}
+		stored, err := me.encryptValue(key, jsonData)
+		if err != nil {
+			return err
+		}
+
+		// Replacing the whole document keeps the expiry, like any other JSON.SET
+		return l.withShard(key, func(shard *engineShard) error {
+			var expiresAt time.Time
+			if data, exists := shard.data[key]; exists && !data.isExpired(time.Now()) {
+				expiresAt = data.ExpiresAt
+			}
+			if err := me.logMutation(logEntry{Op: opSet, Key: key, Value: stored, ExpiresAt: expiresAt}); err != nil {
+				return err
+			}
+			me.putKey(shard, key, &KeyData{Value: stored, ExpiresAt: expiresAt})
+			return nil
+		})
+	}
+
+	return me.modifyJSON(l, key, func(doc interface{}) (interface{}, error) {
+		return updatePath(doc, segments, func(interface{}, bool) (interface{}, error) {
+			return newValue, nil
+		})
+	})
+}
+
+// JSONDel removes the value at path and returns the number of removed values.
+// Deleting the root path deletes the key.
+func (me *MemoryEngine) JSONDel(key, path string) (int, error) {
+	return me.jsonDel(me, key, path)
+}
+
+func (me *MemoryEngine) jsonDel(l shardLocker, key, path string) (int, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(segments) == 0 {
+		if err := me.delete(l, key); err != nil {
+			if err == ErrKeyNotFound {
+				return 0, nil
+			}
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	removed := false
+	err = me.modifyJSON(l, key, func(doc interface{}) (interface{}, error) {
+		var err error
+		doc, removed, err = deletePath(doc, segments)
+		return doc, err
+	})
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil || !removed {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// JSONArrAppend appends JSON values to the array at path and returns its new length.
+func (me *MemoryEngine) JSONArrAppend(key, path string, values ...[]byte) (int, error) {
+	return me.jsonArrAppend(me, key, path, values...)
+}
+
+func (me *MemoryEngine) jsonArrAppend(l shardLocker, key, path string, values ...[]byte) (int, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return 0, err
+	}
+	if err := l.reserve(); err != nil {
+		return 0, err
+	}
+
+	decoded := make([]interface{}, len(values))
+	for i, value := range values {
+		if decoded[i], err = decodeJSON(value); err != nil {
+			return 0, err
+		}
+	}
+
+	length := 0
+	err = me.modifyJSON(l, key, func(doc interface{}) (interface{}, error) {
+		return updatePath(doc, segments, func(current interface{}, exists bool) (interface{}, error) {
+			arr, ok := current.([]interface{})
+			if !exists {
+				return nil, ErrPathNotFound
+			}
+			if !ok {
+				return nil, ErrWrongType
+			}
+			arr = append(arr, decoded...)
+			length = len(arr)
+			return arr, nil
+		})
+	})
+	return length, err
+}
+
+// JSONNumIncrBy adds delta to the number at path and returns the new number.
+func (me *MemoryEngine) JSONNumIncrBy(key, path string, delta json.Number) ([]byte, error) {
+	return me.jsonNumIncrBy(me, key, path, delta)
+}
+
+func (me *MemoryEngine) jsonNumIncrBy(l shardLocker, key, path string, delta json.Number) ([]byte, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.reserve(); err != nil {
+		return nil, err
+	}
+
+	var result json.Number
+	err = me.modifyJSON(l, key, func(doc interface{}) (interface{}, error) {
+		return updatePath(doc, segments, func(current interface{}, exists bool) (interface{}, error) {
+			number, ok := current.(json.Number)
+			if !exists {
+				return nil, ErrPathNotFound
+			}
+			if !ok {
+				return nil, ErrWrongType
+			}
+			result, err = addNumbers(number, delta)
+			return result, err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(result), nil
+}
+
+// addNumbers adds two JSON numbers, staying in integer arithmetic when both
+// are integers. A sum of integers past the int64 range is ErrOverflow rather
+// than wrapping around or silently losing precision.
+func addNumbers(a, b json.Number) (json.Number, error) {
+	if x, err := a.Int64(); err == nil {
+		if y, err := b.Int64(); err == nil {
+			sum := x + y
+			if (y > 0 && sum < x) || (y < 0 && sum > x) {
+				return "", ErrOverflow
+			}
+			return json.Number(strconv.FormatInt(sum, 10)), nil
+		}
+	}
+
+	x, err := a.Float64()
+	if err != nil {
+		return "", ErrWrongType
+	}
+	y, err := b.Float64()
+	if err != nil {
+		return "", fmt.Errorf("invalid increment: %s", b)
+	}
+	sum := x + y
+	if math.IsInf(sum, 0) {
+		return "", ErrOverflow
+	}
+	return json.Number(strconv.FormatFloat(sum, 'f', -1, 64)), nil
+}
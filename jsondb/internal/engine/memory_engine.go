@@ -1,7 +1,6 @@
 package engine
 
 import (
-	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,11 +10,12 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -30,6 +30,16 @@ type Match struct {
 type KeyData struct {
 	Value     []byte    `json:"value"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// Version changes on every write to the key, see nextVersion
+	Version uint64 `json:"-"`
+
+	// Access tracking for eviction, see touch
+	lastAccess int64
+	hits       uint32
+}
+
+func (kd *KeyData) isExpired(now time.Time) bool {
+	return !kd.ExpiresAt.IsZero() && !kd.ExpiresAt.After(now)
 }
 
 type MemoryEngine struct {
@@ -39,11 +49,47 @@ type MemoryEngine struct {
 	useEncryption bool
 	debug         bool
 	dumpPath      string
+
+	activeExpired uint64
+	lazyExpired   uint64
+	version       uint64
+	evicted       uint64
+	rejected      uint64
+	evictCursor   uint64
+	stopCh        chan struct{}
+	stopOnce      sync.Once
+
+	aof    *appendLog
+	dumpMu sync.Mutex
+	// restoreMu serializes RestoreSnapshot, which owns restoreFileName
+	restoreMu sync.Mutex
+
+	// Snapshots written by DumpToDisk, see SaveStatus
+	saving    atomic.Bool
+	lastSave  atomic.Int64
+	saveMu    sync.Mutex
+	bgsaveErr error
+
+	indexMu sync.RWMutex
+	indexes map[string]*fieldIndex
+
+	// Memory limit in bytes, 0 for none, and the eviction policy
+	maxMemory int64
+	policy    string
+
+	keyEvents atomic.Pointer[KeyEventFunc]
+	// feed is set once startup loading is done, see recordChange
+	feed atomic.Pointer[changeFeed]
 }
 
 type engineShard struct {
-	data map[string]*KeyData
-	mu   sync.RWMutex
+	data    map[string]*KeyData
+	expires expiryHeap
+	// order holds the keys in scan order, see Scan
+	order *skipList[scanKey]
+	mu      sync.RWMutex
+	// used is the approximate memory of the shard's keys, see keyMemory
+	used int64
 }
 
 type DumpData struct {
@@ -63,24 +109,44 @@ func NewMemoryEngine(cfg *config.Config) (*MemoryEngine, error) {
 	}
 
 	if cfg.EnableEncryption {
-		if cfg.EncryptionKey == "" {
+		keys := make(map[string]string)
+		for id, key := range cfg.EncryptionKeys {
+			keys[id] = key
+		}
+		if cfg.EncryptionKey != "" {
+			keys[encryption.DefaultKeyID] = cfg.EncryptionKey
+		}
+		if len(keys) == 0 {
 			return nil, fmt.Errorf("encryption enabled but no key provided")
 		}
-		encryptor, err = encryption.NewEncryptor(cfg.EncryptionKey)
+
+		currentID := cfg.EncryptionKeyID
+		if currentID == "" {
+			currentID = encryption.DefaultKeyID
+		}
+		encryptor, err = encryption.NewKeyringEncryptor(keys, currentID)
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize encryptor: %v", err)
 		}
+		encryptor.AllowLegacy(cfg.EncryptionLegacyDecrypt)
 		if cfg.Debug {
-			log.Printf("Encryption enabled with key length: %d", len(cfg.EncryptionKey))
+			log.Printf("Encryption enabled with %d key(s), current key: %s", len(keys), currentID)
 		}
 	}
 
-	numShards := runtime.NumCPU() * 2
+	numShards := cfg.ShardCount
+	if numShards <= 0 {
+		numShards = runtime.NumCPU() * 2
+	}
+	if numShards > maxShards {
+		return nil, fmt.Errorf("invalid shard count: %d (at most %d)", numShards, maxShards)
+	}
 	shards := make([]*engineShard, numShards)
 	for i := 0; i < numShards; i++ {
 			shards[i] = &engineShard{
-				data: make(map[string]*KeyData),
-				mu:   sync.RWMutex{},
+				data:  make(map[string]*KeyData),
+				order: newSkipList(compareScanKeys),
+				mu:    sync.RWMutex{},
 			}
 	}
 
@@ -91,6 +157,51 @@ func NewMemoryEngine(cfg *config.Config) (*MemoryEngine, error) {
 		useEncryption: cfg.EnableEncryption,
 		debug:         cfg.Debug,
 		dumpPath:      dumpPath,
+		maxMemory:     cfg.MaxMemory,
+		policy:        cfg.MaxMemoryPolicy,
+		stopCh:        make(chan struct{}),
+		indexes:       make(map[string]*fieldIndex),
+		// Versions are not persisted, starting from the clock keeps them
+		// increasing across restarts
+		version: uint64(time.Now().UnixNano()),
+	}
+
+	// Indexes are declared before anything is loaded, so restored and
+	// replayed keys are indexed as they arrive
+	for _, def := range cfg.Indexes {
+		if err := me.CreateIndex(IndexDef{Name: def.Name, Pattern: def.Pattern, Path: def.Path}); err != nil {
+			return nil, fmt.Errorf("failed to create index %s: %v", def.Name, err)
+		}
+	}
+
+	expiryInterval := defaultExpiryInterval
+	if cfg.ActiveExpiryIntervalMs > 0 {
+		expiryInterval = time.Duration(cfg.ActiveExpiryIntervalMs) * time.Millisecond
+	}
+	go me.runActiveExpiry(expiryInterval)
+
+	if cfg.AofEnabled {
+		// The log only holds changes since the last snapshot, so both are
+		// always loaded when it is enabled
+		if err := me.RestoreFromDisk(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			me.Close()
+			return nil, fmt.Errorf("failed to restore memory dump: %v", err)
+		}
+		if err := me.replayLog(dumpPath); err != nil {
+			me.Close()
+			return nil, fmt.Errorf("failed to replay append-only log: %v", err)
+		}
+
+		me.aof, err = openAppendLog(dumpPath, cfg.AofFsync)
+		if err != nil {
+			me.Close()
+			return nil, err
+		}
+		go me.runLogMaintenance(int64(cfg.AofRewriteMinSizeMB) * 1024 * 1024)
+
+		if cfg.Debug {
+			log.Printf("Append-only log enabled. Path: %s, Fsync: %s", dumpPath, me.aof.fsync)
+		}
 	}
 
 	if cfg.DumpMemoryOn {
@@ -109,11 +220,16 @@ func NewMemoryEngine(cfg *config.Config) (*MemoryEngine, error) {
 			ticker := time.NewTicker(time.Duration(dumpInterval) * time.Second)
 			defer ticker.Stop()
 
-			for range ticker.C {
-				if err := me.DumpToDisk(); err != nil {
-					log.Printf("Failed to dump memory: %v", err)
-				} else if cfg.Debug {
-					log.Printf("Successfully dumped memory to disk")
+			for {
+				select {
+				case <-ticker.C:
+					if err := me.DumpToDisk(); err != nil {
+						log.Printf("Failed to dump memory: %v", err)
+					} else if cfg.Debug {
+						log.Printf("Successfully dumped memory to disk")
+					}
+				case <-me.stopCh:
+					return
 				}
 			}
 		}()
@@ -123,7 +239,7 @@ func NewMemoryEngine(cfg *config.Config) (*MemoryEngine, error) {
 			return nil, fmt.Errorf("failed to create dump directory: %v", err)
 		}
 
-		if cfg.RestoreMemoryDumpAtStart {
+		if cfg.RestoreMemoryDumpAtStart && !cfg.AofEnabled {
 			if err := me.RestoreFromDisk(); err != nil {
 				log.Printf("Failed to restore memory dump: %v", err)
 			} else if cfg.Debug {
@@ -132,13 +248,39 @@ func NewMemoryEngine(cfg *config.Config) (*MemoryEngine, error) {
 		}
 	}
 
+	// Keys loaded at startup are not changes, the feed starts empty
+	if cfg.ChangeFeedSize > 0 {
+		me.feed.Store(newChangeFeed(cfg.ChangeFeedSize))
+	}
+
 	return me, nil
 }
 
+// Close stops the engine's background goroutines. It is safe to call more than once.
+func (me *MemoryEngine) Close() error {
+	var err error
+	me.stopOnce.Do(func() {
+		close(me.stopCh)
+		if me.aof != nil {
+			err = me.aof.close()
+		}
+	})
+	return err
+}
+
+// ShardCount returns the number of shards the keyspace is split into.
+func (me *MemoryEngine) ShardCount() int {
+	return me.numShards
+}
+
 func (me *MemoryEngine) getShard(key string) *engineShard {
+	return me.shards[me.shardIndex(key)]
+}
+
+func (me *MemoryEngine) shardIndex(key string) int {
 	hash := fnv.New32a()
 	hash.Write([]byte(key))
-	return me.shards[hash.Sum32()%uint32(me.numShards)]
+	return int(hash.Sum32() % uint32(me.numShards))
 }
 
 func (me *MemoryEngine) Set(key string, value interface{}) error {
@@ -146,7 +288,40 @@ func (me *MemoryEngine) Set(key string, value interface{}) error {
 		log.Printf("Setting key %s with value type: %T", key, value)
 	}
 
-	// Convert value to JSON bytes
+	dataToStore, err := me.encodeValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	return me.storeValue(me, key, dataToStore, time.Time{})
+}
+
+func (me *MemoryEngine) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("TTL must be positive")
+	}
+
+	if me.debug {
+		log.Printf("Setting key %s with TTL %v", key, ttl)
+	}
+
+	dataToStore, err := me.encodeValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	return me.storeValue(me, key, dataToStore, time.Now().Add(ttl))
+}
+
+// normalizeValue converts a value to the JSON bytes kept for a key. Strings
+// and byte slices that already hold a JSON object or array are kept as they
+// are, any other string is stored as a JSON string, binary data included,
+// see encodeString.
+func normalizeValue(value interface{}) ([]byte, error) {
+	if b, ok := value.([]byte); ok {
+		value = string(b)
+	}
+
 	var jsonData []byte
 	var err error
 
@@ -154,62 +329,97 @@ func (me *MemoryEngine) Set(key string, value interface{}) error {
 		jsonData = []byte("null")
 	} else if str, ok := value.(string); ok {
 		// If it's already a JSON string, use it directly
-		if (strings.HasPrefix(str, "{") && strings.HasSuffix(str, "}")) ||
-		   (strings.HasPrefix(str, "[") && strings.HasSuffix(str, "]")) {
+		if ((strings.HasPrefix(str, "{") && strings.HasSuffix(str, "}")) ||
+		   (strings.HasPrefix(str, "[") && strings.HasSuffix(str, "]"))) && utf8.ValidString(str) {
 			jsonData = []byte(str)
 		} else {
-			jsonData, err = json.Marshal(str)
+			jsonData = encodeString(str)
 		}
 	} else {
 		jsonData, err = json.Marshal(value)
 	}
 	
 	if err != nil {
-		return fmt.Errorf("failed to marshal value: %v", err)
+		return nil, fmt.Errorf("failed to marshal value: %v", err)
 	}
+	return jsonData, nil
+}
 
-	var dataToStore []byte
-	if me.useEncryption && me.encryptor != nil {
-		if me.debug {
-			log.Printf("Encrypting data for key: %s", key)
-		}
-		dataToStore, err = me.encryptor.Encrypt(jsonData)
-		if err != nil {
-			return fmt.Errorf("encryption failed: %v", err)
-		}
-	} else {
-		dataToStore = jsonData
+// encodeValue is the single write pipeline: every mutating entry point turns
+// its value into the stored form here, so normalization and encryption are
+// applied the same way everywhere.
+func (me *MemoryEngine) encodeValue(key string, value interface{}) ([]byte, error) {
+	jsonData, err := normalizeValue(value)
+	if err != nil {
+		return nil, err
 	}
+	return me.encryptValue(key, jsonData)
+}
 
-	shard := me.getShard(key)
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
-
-	shard.data[key] = &KeyData{
-		Value:     dataToStore,
-		ExpiresAt: time.Time{},
+// encryptValue encrypts already normalized JSON bytes when encryption is enabled.
+func (me *MemoryEngine) encryptValue(key string, jsonData []byte) ([]byte, error) {
+	if !me.useEncryption || me.encryptor == nil {
+		return jsonData, nil
 	}
 
-	return nil
+	if me.debug {
+		log.Printf("Encrypting data for key: %s", key)
+	}
+	encrypted, err := me.encryptor.Encrypt(jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("encryption failed: %v", err)
+	}
+	return encrypted, nil
 }
 
-func (me *MemoryEngine) SetWithTTL(key string, value []byte, ttl time.Duration) error {
-	if ttl <= 0 {
-		return errors.New("TTL must be positive")
+// decodeValue turns a stored value back into its JSON bytes.
+func (me *MemoryEngine) decodeValue(key string, stored []byte) ([]byte, error) {
+	if !me.useEncryption || me.encryptor == nil {
+		return stored, nil
 	}
 
-	shard := me.getShard(key)
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+	if me.debug {
+		log.Printf("Decrypting data for key: %s", key)
+	}
+	decrypted, err := me.encryptor.Decrypt(stored)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %v", err)
+	}
+	return decrypted, nil
+}
 
-	expiresAt := time.Now().Add(ttl)
-	
-	shard.data[key] = &KeyData{
-		Value:     value,
-		ExpiresAt: expiresAt,
+// storeValue writes a value produced by encodeValue, replacing any previous
+// value and expiry of the key.
+func (me *MemoryEngine) storeValue(l shardLocker, key string, stored []byte, expiresAt time.Time) error {
+	if err := l.reserve(); err != nil {
+		return err
 	}
-	
-	return nil
+	return l.withShard(key, func(shard *engineShard) error {
+		if err := me.logMutation(logEntry{Op: opSet, Key: key, Value: stored, ExpiresAt: expiresAt}); err != nil {
+			return err
+		}
+		me.putKey(shard, key, &KeyData{
+			Value:     stored,
+			ExpiresAt: expiresAt,
+		})
+		return nil
+	})
+}
+
+// liveKey returns the data of a key that exists and has not expired, removing
+// it when it has. The caller must hold the shard's write lock.
+func (me *MemoryEngine) liveKey(shard *engineShard, key string) (*KeyData, bool) {
+	data, exists := shard.data[key]
+	if !exists {
+		return nil, false
+	}
+	now := time.Now()
+	if data.isExpired(now) {
+		me.expireLazily(shard, key)
+		return nil, false
+	}
+	data.touch(now)
+	return data, true
 }
 
 func (me *MemoryEngine) Get(key string) ([]byte, error) {
@@ -219,160 +429,327 @@ func (me *MemoryEngine) Get(key string) ([]byte, error) {
 
 	shard := me.getShard(key)
 	shard.mu.RLock()
-	defer shard.mu.RUnlock()
 
 	data, exists := shard.data[key]
 	if !exists {
+		shard.mu.RUnlock()
 		return nil, ErrKeyNotFound
 	}
 
-	if !data.ExpiresAt.IsZero() && data.ExpiresAt.Before(time.Now()) {
-		delete(shard.data, key)
-		return nil, ErrKeyNotFound
-	}
+	now := time.Now()
+	if data.isExpired(now) {
+		shard.mu.RUnlock()
 
-	if me.useEncryption && me.encryptor != nil {
-		if me.debug {
-			log.Printf("Decrypting data for key: %s", key)
-		}
-		decrypted, err := me.encryptor.Decrypt(data.Value)
-		if err != nil {
-			return nil, fmt.Errorf("decryption failed: %v", err)
+		// Deleting requires the write lock, re-check once it is held
+		shard.mu.Lock()
+		if data, exists := shard.data[key]; exists && data.isExpired(time.Now()) {
+			me.expireLazily(shard, key)
 		}
-		return decrypted, nil
+		shard.mu.Unlock()
+		return nil, ErrKeyNotFound
 	}
+	data.touch(now)
+	value := data.Value
+	shard.mu.RUnlock()
 
-	return data.Value, nil
+	return me.decodeValue(key, value)
 }
 
+// GetByPattern returns the keys matching the glob pattern with their values.
+// Values are copied under the shard lock and decoded after it is released.
 func (me *MemoryEngine) GetByPattern(pattern string) ([]Match, error) {
 	if me.debug {
 		log.Printf("Getting keys by pattern: %s", pattern)
 	}
 
-	var matches []Match
-	re, err := regexp.Compile(strings.ReplaceAll(strings.ReplaceAll(pattern, "*", ".*"), "?", "."))
-	if err != nil {
-		return nil, fmt.Errorf("invalid pattern: %v", err)
-	}
+	prefix := globPrefix(pattern)
+	now := time.Now()
 
-	// Search through all shards
-	for i := 0; i < me.numShards; i++ {
-		shard := me.shards[i]
+	var matches []Match
+	for _, shard := range me.shards {
+		var stored []Match
 		shard.mu.RLock()
-
 		for key, data := range shard.data {
-			if re.MatchString(key) {
-				var value []byte
-				if me.useEncryption && me.encryptor != nil {
-					if me.debug {
-						log.Printf("Decrypting matched key %s, length: %d", key, len(data.Value))
-					}
-					decrypted, err := me.encryptor.Decrypt(data.Value)
-					if err != nil {
-						shard.mu.RUnlock()
-						return nil, fmt.Errorf("failed to decrypt value for key %s: %v", key, err)
-					}
-					value = decrypted
-				} else {
-					value = data.Value
-				}
-
-				matches = append(matches, Match{
-					Key:   key,
-					Value: string(value),
-				})
+			if data.isExpired(now) || !strings.HasPrefix(key, prefix) || !matchGlob(pattern, key) {
+				continue
 			}
+			stored = append(stored, Match{Key: key, Value: string(data.Value)})
 		}
 		shard.mu.RUnlock()
+
+		for _, match := range stored {
+			value, err := me.decodeValue(match.Key, []byte(match.Value))
+			if err != nil {
+				return nil, fmt.Errorf("failed to decrypt value for key %s: %v", match.Key, err)
+			}
+			matches = append(matches, Match{Key: match.Key, Value: string(value)})
+		}
 	}
 
 	return matches, nil
 }
 
 func (me *MemoryEngine) Delete(key string) error {
-	shard := me.getShard(key)
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+	return me.delete(me, key)
+}
 
-	if _, exists := shard.data[key]; !exists {
-		return ErrKeyNotFound
-	}
+func (me *MemoryEngine) delete(l shardLocker, key string) error {
+	return l.withShard(key, func(shard *engineShard) error {
+		if _, exists := shard.data[key]; !exists {
+			return ErrKeyNotFound
+		}
 
-	delete(shard.data, key)
-	return nil
+		if err := me.logMutation(logEntry{Op: opDel, Key: key}); err != nil {
+			return err
+		}
+		me.removeKey(shard, key)
+		return nil
+	})
 }
 
 func (me *MemoryEngine) TTL(key string) (time.Duration, error) {
+	return me.ttl(me, key)
+}
+
+func (me *MemoryEngine) ttl(l shardLocker, key string) (time.Duration, error) {
+	ttl := -2 * time.Second // Key does not exist
+	err := l.withShard(key, func(shard *engineShard) error {
+		data, exists := shard.data[key]
+		if !exists {
+			return nil
+		}
+
+		if data.ExpiresAt.IsZero() {
+			ttl = -1 * time.Second // Key exists but has no expiry
+			return nil
+		}
+
+		if remaining := time.Until(data.ExpiresAt); remaining > 0 {
+			ttl = remaining
+			return nil
+		}
+		// Key has expired, delete it immediately
+		me.expireLazily(shard, key)
+		return nil
+	})
+	return ttl, err
+}
+
+// Expire sets a new time to live on an existing key. A non-positive ttl
+// deletes the key, mirroring Redis. It reports whether the key existed.
+func (me *MemoryEngine) Expire(key string, ttl time.Duration) (bool, error) {
+	return me.ExpireAt(key, time.Now().Add(ttl))
+}
+
+// ExpireAt sets an absolute expiry time on an existing key.
+func (me *MemoryEngine) ExpireAt(key string, expiresAt time.Time) (bool, error) {
+	return me.expireAt(me, key, expiresAt)
+}
+
+func (me *MemoryEngine) expireAt(l shardLocker, key string, expiresAt time.Time) (bool, error) {
+	found := false
+	err := l.withShard(key, func(shard *engineShard) error {
+		data, exists := me.liveKey(shard, key)
+		if !exists {
+			return nil
+		}
+		found = true
+
+		if !expiresAt.After(time.Now()) {
+			if err := me.logMutation(logEntry{Op: opDel, Key: key}); err != nil {
+				return err
+			}
+			me.removeKey(shard, key)
+			return nil
+		}
+
+		if err := me.logMutation(logEntry{Op: opExpire, Key: key, ExpiresAt: expiresAt}); err != nil {
+			return err
+		}
+		data.ExpiresAt = expiresAt
+		data.Version = me.nextVersion()
+		shard.trackExpiry(key, expiresAt)
+		me.recordChange(ChangeExpire, key, data)
+		return nil
+	})
+	return found, err
+}
+
+// Persist removes the expiry from a key. It reports whether an expiry was removed.
+func (me *MemoryEngine) Persist(key string) (bool, error) {
+	return me.persist(me, key)
+}
+
+func (me *MemoryEngine) persist(l shardLocker, key string) (bool, error) {
+	removed := false
+	err := l.withShard(key, func(shard *engineShard) error {
+		data, exists := me.liveKey(shard, key)
+		if !exists || data.ExpiresAt.IsZero() {
+			return nil
+		}
+
+		if err := me.logMutation(logEntry{Op: opExpire, Key: key}); err != nil {
+			return err
+		}
+		removed = true
+		data.ExpiresAt = time.Time{}
+		data.Version = me.nextVersion()
+		me.recordChange(ChangeExpire, key, data)
+		return nil
+	})
+	return removed, err
+}
+
+// Version returns the current version of a key, or 0 when it does not exist.
+// Any write to the key, including a change of its expiry, changes the version.
+func (me *MemoryEngine) Version(key string) uint64 {
 	shard := me.getShard(key)
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
 
 	data, exists := shard.data[key]
-	if !exists {
-		return -2 * time.Second, nil // Key does not exist
+	if !exists || data.isExpired(time.Now()) {
+		return 0
 	}
+	return data.Version
+}
+
+// nextVersion returns a version higher than any handed out before.
+func (me *MemoryEngine) nextVersion() uint64 {
+	return atomic.AddUint64(&me.version, 1)
+}
 
-	if data.ExpiresAt.IsZero() {
-		return -1 * time.Second, nil // Key exists but has no expiry
+// Reencrypt rewrites every value that was not encrypted with the current key.
+// Keys are processed in small batches so regular traffic keeps flowing while
+// it runs. A rewritten value counts as a write: its version changes and it is
+// recorded in the change feed. A value that cannot be decrypted or encrypted
+// again is left as it is and the others are still rewritten. It returns the
+// number of rewritten values and the keys of the values left behind.
+func (me *MemoryEngine) Reencrypt() (int, []string, error) {
+	if !me.useEncryption || me.encryptor == nil {
+		return 0, nil, errors.New("encryption is not enabled")
 	}
 
-	ttl := time.Until(data.ExpiresAt)
-	if ttl <= 0 {
-		// Key has expired, delete it immediately
-		delete(shard.data, key)
-		return -2 * time.Second, nil // Return -2 for non-existent key
+	const batchSize = 256
+	rewritten := 0
+	var failed []string
+	for _, shard := range me.shards {
+		shard.mu.RLock()
+		keys := make([]string, 0, len(shard.data))
+		for key, data := range shard.data {
+			if me.encryptor.NeedsRotation(data.Value) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mu.RUnlock()
+
+		for start := 0; start < len(keys); start += batchSize {
+			end := start + batchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+
+			n, skipped, err := me.reencryptBatch(shard, keys[start:end])
+			rewritten += n
+			failed = append(failed, skipped...)
+			if err != nil {
+				return rewritten, failed, err
+			}
+		}
 	}
 
-	return ttl, nil
+	if me.debug {
+		log.Printf("Re-encrypted %d values with key %s, %d failed", rewritten, me.encryptor.CurrentKeyID(), len(failed))
+	}
+	return rewritten, failed, nil
+}
+
+// reencryptBatch rewrites keys under the current key, returning the number
+// of rewritten values and the keys that could not be. Only a failure to log
+// a rewrite stops it.
+func (me *MemoryEngine) reencryptBatch(shard *engineShard, keys []string) (int, []string, error) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	rewritten := 0
+	var failed []string
+	for _, key := range keys {
+		// The key may have been rewritten or deleted since it was collected
+		data, exists := shard.data[key]
+		if !exists || !me.encryptor.NeedsRotation(data.Value) {
+			continue
+		}
+
+		plaintext, err := me.decodeValue(key, data.Value)
+		if err != nil {
+			log.Printf("Failed to re-encrypt value for key %s: %v", key, err)
+			failed = append(failed, key)
+			continue
+		}
+		ciphertext, err := me.encryptValue(key, plaintext)
+		if err != nil {
+			log.Printf("Failed to re-encrypt value for key %s: %v", key, err)
+			failed = append(failed, key)
+			continue
+		}
+		if err := me.logMutation(logEntry{Op: opSet, Key: key, Value: ciphertext, ExpiresAt: data.ExpiresAt}); err != nil {
+			return rewritten, failed, err
+		}
+
+		atomic.AddInt64(&shard.used, int64(len(ciphertext)-len(data.Value)))
+		data.Value = ciphertext
+		data.Version = me.nextVersion()
+		me.recordChange(EventSet, key, data)
+		rewritten++
+	}
+	return rewritten, failed, nil
 }
 
 func (me *MemoryEngine) DumpToDisk() error {
-	if err := os.MkdirAll(me.dumpPath, 0755); err != nil {
-		return fmt.Errorf("failed to create dump directory: %v", err)
+	me.dumpMu.Lock()
+	defer me.dumpMu.Unlock()
+
+	if me.aof != nil {
+		// New writes go to a fresh log while the snapshot is taken
+		if err := me.aof.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate append-only log: %v", err)
+		}
 	}
 
-	dump := DumpData{
-		Version:   1,
-		Timestamp: time.Now(),
-		Shards:    make(map[int]map[string]*KeyData),
+	if err := me.writeSnapshot(); err != nil {
+		return err
 	}
 
-	for i, shard := range me.shards {
-		shard.mu.RLock()
-		shardData := make(map[string]*KeyData)
-		for k, v := range shard.data {
-			if !v.ExpiresAt.IsZero() && v.ExpiresAt.Before(time.Now()) {
-				continue
-			}
-			// Create a deep copy of the KeyData
-			shardData[k] = &KeyData{
-				Value:     append([]byte(nil), v.Value...),
-				ExpiresAt: v.ExpiresAt,
-			}
+	if me.aof != nil {
+		if err := me.aof.finishRewrite(); err != nil {
+			return err
 		}
-		dump.Shards[i] = shardData
-		shard.mu.RUnlock()
+	}
+	me.lastSave.Store(time.Now().UnixNano())
+	return nil
+}
+
+func (me *MemoryEngine) writeSnapshot() error {
+	if err := os.MkdirAll(me.dumpPath, 0755); err != nil {
+		return fmt.Errorf("failed to create dump directory: %v", err)
 	}
 
-	tmpFile := filepath.Join(me.dumpPath, "memory.dump.tmp")
+	tmpFile := filepath.Join(me.dumpPath, snapshotFileName+".tmp")
 	file, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create dump file: %v", err)
 	}
 	defer file.Close()
 
-	writer := bufio.NewWriter(file)
-	encoder := json.NewEncoder(writer)
-	if err := encoder.Encode(dump); err != nil {
-		return fmt.Errorf("failed to encode dump: %v", err)
+	if err := me.WriteSnapshot(file); err != nil {
+		return err
 	}
 
-	if err := writer.Flush(); err != nil {
-		return fmt.Errorf("failed to flush writer: %v", err)
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync dump file: %v", err)
 	}
 
-	finalPath := filepath.Join(me.dumpPath, "memory.dump")
+	finalPath := filepath.Join(me.dumpPath, snapshotFileName)
 	if err := os.Rename(tmpFile, finalPath); err != nil {
 		return fmt.Errorf("failed to rename dump file: %v", err)
 	}
@@ -385,46 +762,121 @@ func (me *MemoryEngine) DumpToDisk() error {
 }
 
 func (me *MemoryEngine) RestoreFromDisk() error {
-	dumpPath := filepath.Join(me.dumpPath, "memory.dump")
+	dumpPath := filepath.Join(me.dumpPath, snapshotFileName)
 	file, err := os.OpenFile(dumpPath, os.O_RDONLY, 0644)
 	if err != nil {
 		return fmt.Errorf("failed to open dump file: %w", err)
 	}
 	defer file.Close()
 
-	reader := bufio.NewReader(file)
-	var dump DumpData
-	decoder := json.NewDecoder(reader)
-	if err := decoder.Decode(&dump); err != nil {
-		return fmt.Errorf("failed to decode dump: %w", err)
-	}
+	return me.LoadSnapshot(file)
+}
 
-	// Clear existing data and restore from dump
-	for i, shard := range me.shards {
-		shard.mu.Lock()
-		shard.data = make(map[string]*KeyData)
-		if shardData, ok := dump.Shards[i]; ok {
-			for k, v := range shardData {
-				// Skip expired keys
-				if !v.ExpiresAt.IsZero() && v.ExpiresAt.Before(time.Now()) {
-					continue
-				}
-				shard.data[k] = v
-			}
-		}
-		shard.mu.Unlock()
+func (me *MemoryEngine) ResetMemory() error {
+	// The reset is logged with every shard locked, so a write cannot land
+	// between the log entry and the swap and be lost on replay
+	me.lockShards()
+	if err := me.logMutation(logEntry{Op: opReset}); err != nil {
+		me.unlockShards()
+		return err
 	}
+	me.swapShards(nil)
+	me.unlockShards()
 
+	me.rebuildIndexes()
 	return nil
 }
 
-func (me *MemoryEngine) ResetMemory() error {
-	// Lock all shards while resetting
+// putKey stores data under key. Every write to a shard goes through here so
+// the expiry heap and secondary indexes stay in sync with the data.
+// The caller must hold the shard's write lock.
+func (me *MemoryEngine) putKey(shard *engineShard, key string, data *KeyData) {
+	data.Version = me.nextVersion()
+	data.lastAccess = time.Now().UnixNano()
+	data.hits = lfuInitial
+	if old, exists := shard.data[key]; exists {
+		// A write counts as an access, the frequency carries over
+		data.hits = atomic.LoadUint32(&old.hits)
+		atomic.AddInt64(&shard.used, -keyMemory(key, old))
+	} else {
+		shard.order.insert(newScanKey(key))
+	}
+	atomic.AddInt64(&shard.used, keyMemory(key, data))
+	shard.data[key] = data
+	shard.trackExpiry(key, data.ExpiresAt)
+	me.indexKey(key, data)
+	me.notifyKey(EventSet, key)
+	me.recordChange(EventSet, key, data)
+}
+
+// removeKey deletes a key from a shard. The caller must hold the shard's write lock.
+func (me *MemoryEngine) removeKey(shard *engineShard, key string) {
+	me.dropKey(shard, key, EventDel)
+}
+
+// dropKey deletes a key and reports the deletion as event, telling a delete
+// apart from an expiration. The caller must hold the shard's write lock.
+func (me *MemoryEngine) dropKey(shard *engineShard, key string, event string) {
+	if data, exists := shard.data[key]; exists {
+		atomic.AddInt64(&shard.used, -keyMemory(key, data))
+		shard.order.delete(newScanKey(key))
+	}
+	delete(shard.data, key)
+	me.unindexKey(key)
+	me.notifyKey(event, key)
+	me.recordChange(event, key, nil)
+}
+
+// replaceShards swaps the contents of every shard, used by restores and
+// resets. A nil slice empties the engine.
+func (me *MemoryEngine) replaceShards(shards []map[string]*KeyData) {
+	me.lockShards()
+	me.swapShards(shards)
+	me.unlockShards()
+	me.rebuildIndexes()
+}
+
+// lockShards write locks every shard, in the order Atomic locks them.
+func (me *MemoryEngine) lockShards() {
 	for _, shard := range me.shards {
 		shard.mu.Lock()
-		shard.data = make(map[string]*KeyData)
-		shard.mu.Unlock()
 	}
-	return nil
+}
+
+func (me *MemoryEngine) unlockShards() {
+	for i := len(me.shards) - 1; i >= 0; i-- {
+		me.shards[i].mu.Unlock()
+	}
+}
+
+// swapShards replaces the contents of every shard for replaceShards. The
+// caller must hold every shard's write lock.
+func (me *MemoryEngine) swapShards(shards []map[string]*KeyData) {
+	// Followers of the change feed drop their copy, and resync when keys
+	// were loaded since those are not recorded one by one
+	if shards == nil {
+		me.recordChange(ChangeReset, "", nil)
+	} else {
+		me.restartFeed()
+	}
+
+	now := time.Now().UnixNano()
+	for i, shard := range me.shards {
+		if shards == nil {
+			shard.data = make(map[string]*KeyData)
+		} else {
+			shard.data = shards[i]
+		}
+		var used int64
+		for key, data := range shard.data {
+			data.Version = me.nextVersion()
+			data.lastAccess = now
+			data.hits = lfuInitial
+			used += keyMemory(key, data)
+		}
+		atomic.StoreInt64(&shard.used, used)
+		shard.rebuildExpiries()
+		shard.rebuildScanOrder()
+	}
 }
 
@@ -1,10 +1,17 @@
 package engine
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -83,6 +90,49 @@ func TestMemoryEngine_SetAndGet(t *testing.T) {
 	}
 }
 
+func TestEncodeString(t *testing.T) {
+	tests := []struct {
+		value  string
+		stored string
+	}{
+		{"plain", `"plain"`},
+		{"caf\u00e9 \"q\"\n", `"café \"q\"\n"`},
+		{"\xff\xfe", `"\udcff\udcfe"`},
+		{"a\xc3\xa9\xc3<b>\x80", `"aé\udcc3\u003cb\u003e\udc80"`},
+		{"\U0001F600\xf0\x9f", `"😀\udcf0\udc9f"`},
+	}
+	for _, tt := range tests {
+		stored := encodeString(tt.value)
+		if string(stored) != tt.stored {
+			t.Errorf("encodeString(%q) = %s, want %s", tt.value, stored, tt.stored)
+		}
+		if got, ok := DecodeString(stored); !ok || got != tt.value {
+			t.Errorf("DecodeString(%s) = %q, %v, want %q", stored, got, ok, tt.value)
+		}
+	}
+	// Escaped surrogate pairs and other lone surrogates decode as usual
+	if got, _ := DecodeString([]byte(`"\ud83d\ude00 \udc10 \uDCFF"`)); got != "\U0001F600 \uFFFD \xff" {
+		t.Errorf("DecodeString of escaped surrogates = %q", got)
+	}
+	if _, ok := DecodeString([]byte(`{"a":1}`)); ok {
+		t.Errorf("DecodeString of an object succeeded")
+	}
+
+	engine, err := NewMemoryEngine(&config.Config{})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+	// Binary data that looks like a JSON object is not kept as JSON
+	for _, value := range []string{"\xff\xfe", "{\xff}"} {
+		engine.Set("bin", value)
+		stored, _ := engine.Get("bin")
+		if got, ok := DecodeString(stored); !ok || got != value {
+			t.Errorf("Set(%q) then Get = %s", value, stored)
+		}
+	}
+}
+
 func TestMemoryEngine_GetByPattern(t *testing.T) {
 	cfg := &config.Config{
 		EnableEncryption: false,
@@ -507,4 +557,1812 @@ func TestEncryptionWithDifferentTypes(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestMemoryEngine_ExpireAndPersist(t *testing.T) {
+	cfg := &config.Config{
+		EnableEncryption: false,
+		Debug:           false,
+		DumpMemoryOn:    false,
+		DumpPath:        "dump",
+	}
+
+	engine, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+
+	if ok, _ := engine.Expire("missing", time.Minute); ok {
+		t.Errorf("Expire on missing key reported success")
+	}
+
+	if err := engine.Set("session", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if ok, err := engine.Expire("session", time.Minute); err != nil || !ok {
+		t.Fatalf("Expire failed: ok=%v err=%v", ok, err)
+	}
+	if ttl, _ := engine.TTL("session"); ttl < 59*time.Second || ttl > time.Minute {
+		t.Errorf("TTL after Expire = %v, want about 1m", ttl)
+	}
+
+	if ok, err := engine.Persist("session"); err != nil || !ok {
+		t.Fatalf("Persist failed: ok=%v err=%v", ok, err)
+	}
+	if ttl, _ := engine.TTL("session"); ttl != -1*time.Second {
+		t.Errorf("TTL after Persist = %v, want -1s", ttl)
+	}
+	if ok, _ := engine.Persist("session"); ok {
+		t.Errorf("Persist on key without expiry reported success")
+	}
+
+	if ok, _ := engine.ExpireAt("session", time.Now().Add(-time.Second)); !ok {
+		t.Errorf("ExpireAt in the past reported failure")
+	}
+	if _, err := engine.Get("session"); err != ErrKeyNotFound {
+		t.Errorf("Get after past ExpireAt error = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestMemoryEngine_ActiveExpiry(t *testing.T) {
+	cfg := &config.Config{
+		EnableEncryption:       false,
+		Debug:                  false,
+		DumpMemoryOn:           false,
+		DumpPath:               "dump",
+		ActiveExpiryIntervalMs: 10,
+	}
+
+	engine, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	for i := 0; i < 50; i++ {
+		key := "session:" + string(rune('a'+i%26)) + string(rune('0'+i/26))
+		if err := engine.SetWithTTL(key, []byte("value"), 20*time.Millisecond); err != nil {
+			t.Fatalf("SetWithTTL failed: %v", err)
+		}
+	}
+	if err := engine.Set("session:keep", "value"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	// Nobody reads the keys again, the background cycle has to reclaim them
+	deadline := time.Now().Add(2 * time.Second)
+	for engine.ExpiryStats().ActiveExpired < 50 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := engine.ExpiryStats()
+	if stats.ActiveExpired != 50 {
+		t.Errorf("ActiveExpired = %d, want 50", stats.ActiveExpired)
+	}
+
+	matches, err := engine.GetByPattern("session:*")
+	if err != nil {
+		t.Fatalf("GetByPattern failed: %v", err)
+	}
+	if len(matches) != 1 || matches[0].Key != "session:keep" {
+		t.Errorf("GetByPattern after expiry = %v, want only session:keep", matches)
+	}
+}
+
+func TestMemoryEngine_LazyExpiry(t *testing.T) {
+	cfg := &config.Config{
+		EnableEncryption:       false,
+		Debug:                  false,
+		DumpMemoryOn:           false,
+		DumpPath:               "dump",
+		ActiveExpiryIntervalMs: 60000,
+	}
+
+	engine, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	if err := engine.SetWithTTL("short", []byte("value"), 5*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := engine.Get("short"); err != ErrKeyNotFound {
+		t.Errorf("Get on expired key error = %v, want ErrKeyNotFound", err)
+	}
+
+	stats := engine.ExpiryStats()
+	if stats.LazyExpired != 1 || stats.ActiveExpired != 0 {
+		t.Errorf("ExpiryStats = %+v, want 1 lazy and 0 active", stats)
+	}
+}
+
+func TestMemoryEngine_AppendOnlyLog(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "jsondb_aof_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		EnableEncryption: true,
+		EncryptionKey:    "0123456789abcdef0123456789abcdef",
+		DumpPath:         tmpDir,
+		AofEnabled:       true,
+		AofFsync:         FsyncAlways,
+	}
+
+	engine1, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+
+	mustSet := func(e *MemoryEngine, key string, value interface{}) {
+		if err := e.Set(key, value); err != nil {
+			t.Fatalf("Failed to set %s: %v", key, err)
+		}
+	}
+
+	mustSet(engine1, "user:1", map[string]interface{}{"name": "John"})
+	mustSet(engine1, "user:2", "Jane")
+	mustSet(engine1, "deleted", "gone")
+	mustSet(engine1, "persisted", "value")
+	if err := engine1.Delete("deleted"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := engine1.Expire("persisted", time.Hour); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	if _, err := engine1.Persist("persisted"); err != nil {
+		t.Fatalf("Persist failed: %v", err)
+	}
+	if _, err := engine1.Expire("user:2", time.Hour); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+
+	// Simulate a crash: no snapshot was ever written
+	engine1.Close()
+
+	engine2, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+
+	if got, err := engine2.Get("user:1"); err != nil || string(got) != `{"name":"John"}` {
+		t.Errorf("user:1 after replay = %q, %v", got, err)
+	}
+	if _, err := engine2.Get("deleted"); err != ErrKeyNotFound {
+		t.Errorf("deleted key after replay error = %v, want ErrKeyNotFound", err)
+	}
+	if ttl, _ := engine2.TTL("persisted"); ttl != -1*time.Second {
+		t.Errorf("persisted TTL after replay = %v, want -1s", ttl)
+	}
+	if ttl, _ := engine2.TTL("user:2"); ttl < 59*time.Minute {
+		t.Errorf("user:2 TTL after replay = %v, want about 1h", ttl)
+	}
+
+	// Rewriting folds the log into a snapshot and starts an empty log
+	if err := engine2.RewriteLog(); err != nil {
+		t.Fatalf("RewriteLog failed: %v", err)
+	}
+	info, err := os.Stat(tmpDir + "/memory.aof")
+	if err != nil {
+		t.Fatalf("Stat of the log after rewrite failed: %v", err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("log after rewrite: size=%d, want empty", info.Size())
+	}
+	mustSet(engine2, "after:rewrite", "value")
+	engine2.Close()
+
+	// A torn entry at the end of the log is ignored
+	f, err := os.OpenFile(tmpDir+"/memory.aof", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	f.WriteString(`{"op":"set","key":"torn`)
+	f.Close()
+
+	engine3, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine after rewrite: %v", err)
+	}
+
+	for _, key := range []string{"user:1", "user:2", "persisted", "after:rewrite"} {
+		if _, err := engine3.Get(key); err != nil {
+			t.Errorf("Get(%s) after rewrite and replay: %v", key, err)
+		}
+	}
+	if _, err := engine3.Get("torn"); err != ErrKeyNotFound {
+		t.Errorf("torn key error = %v, want ErrKeyNotFound", err)
+	}
+	engine3.Close()
+
+	// A damaged entry followed by more entries is not a torn write, the
+	// entries after it must not be dropped silently
+	f, err = os.OpenFile(tmpDir+"/memory.aof", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	info, _ = f.Stat()
+	f.WriteString("{\"op\":\"set\",\"key\":\"damaged\n{\"op\":\"del\",\"key\":\"user:1\",\"expires_at\":\"0001-01-01T00:00:00Z\"}\n")
+	f.Close()
+	if _, err := NewMemoryEngine(cfg); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("damaged at offset %d", info.Size())) {
+		t.Errorf("NewMemoryEngine with a damaged log entry error = %v", err)
+	}
+}
+
+func TestMemoryEngine_AppendOnlyLogConcurrentReset(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "jsondb_aof_reset_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{DumpPath: tmpDir, AofEnabled: true, AofFsync: FsyncNever, ShardCount: 4}
+	engine1, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+
+	// Writes racing a reset must replay to the state they left in memory
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				engine1.Set(fmt.Sprintf("key:%d:%d", w, i), "value")
+			}
+		}(w)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+			if err := engine1.ResetMemory(); err != nil {
+				t.Fatalf("ResetMemory failed: %v", err)
+			}
+		}
+	}
+
+	want := engine1.Keys("*")
+	sort.Strings(want)
+	engine1.Close()
+
+	engine2, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	defer engine2.Close()
+	got := engine2.Keys("*")
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %d keys, want the %d keys in memory before closing", len(got), len(want))
+	}
+}
+
+// failingWriter fails every write, like a full or broken disk.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestMemoryEngine_AppendOnlyLogFailure(t *testing.T) {
+	cfg := &config.Config{DumpPath: t.TempDir(), AofEnabled: true, AofFsync: FsyncAlways}
+	engine, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	engine.Set("kept", "value")
+	engine.Set("expiring", "value")
+	engine.Expire("expiring", time.Hour)
+	engine.JSONSet("doc", "$", []byte(`{"n":1}`))
+	version := engine.Version("kept")
+
+	engine.aof.writer = bufio.NewWriter(failingWriter{})
+	engine.aof.encoder = json.NewEncoder(engine.aof.writer)
+
+	// A write the log refused is not applied either
+	writes := map[string]func() error{
+		"Set":    func() error { return engine.Set("kept", "changed") },
+		"Delete": func() error { return engine.Delete("kept") },
+		"MSet": func() error {
+			return engine.MSet([]string{"kept", "new"}, [][]byte{[]byte(`"changed"`), []byte(`"new"`)})
+		},
+		"MDelete": func() error {
+			_, err := engine.MDelete([]string{"kept"})
+			return err
+		},
+		"SetIf": func() error {
+			_, err := engine.SetIf("new", []byte(`"new"`), time.Time{}, SetIfAbsent, 0)
+			return err
+		},
+		"GetSet": func() error {
+			_, err := engine.GetSet("kept", []byte(`"changed"`))
+			return err
+		},
+		"GetDel": func() error {
+			_, err := engine.GetDel("kept")
+			return err
+		},
+		"Expire": func() error {
+			_, err := engine.Expire("kept", time.Hour)
+			return err
+		},
+		"Persist": func() error {
+			_, err := engine.Persist("expiring")
+			return err
+		},
+		"JSONSet": func() error { return engine.JSONSet("doc", "$.n", []byte("2")) },
+	}
+	for name, write := range writes {
+		if err := write(); err == nil {
+			t.Errorf("%s succeeded with a failing log", name)
+		}
+	}
+
+	if got, err := engine.Get("kept"); err != nil || string(got) != `"value"` || engine.Version("kept") != version {
+		t.Errorf("kept = %q, %v after failed writes, want it unchanged", got, err)
+	}
+	if _, err := engine.Get("new"); err != ErrKeyNotFound {
+		t.Errorf("new key error = %v, want ErrKeyNotFound", err)
+	}
+	if ttl, _ := engine.TTL("expiring"); ttl < 59*time.Minute {
+		t.Errorf("expiring TTL = %v, want about 1h", ttl)
+	}
+	if got, err := engine.JSONGet("doc", "$.n"); err != nil || string(got) != "1" {
+		t.Errorf("doc $.n = %q, %v, want 1", got, err)
+	}
+}
+
+func TestMemoryEngine_BinarySnapshot(t *testing.T) {
+	cfg := &config.Config{
+		EnableEncryption: false,
+		Debug:            false,
+		DumpPath:         "dump",
+	}
+
+	engine1, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine1.Close()
+
+	// Enough data to span several blocks
+	value := strings.Repeat("x", 1024)
+	for i := 0; i < 500; i++ {
+		if err := engine1.Set(fmt.Sprintf("key:%d", i), value); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	if err := engine1.SetWithTTL("ttl:key", []byte("value"), time.Hour); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := engine1.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("JSDBSNAP")) {
+		t.Fatalf("snapshot does not start with the magic header")
+	}
+
+	engine2, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine2.Close()
+
+	if err := engine2.LoadSnapshot(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if _, err := engine2.Get(fmt.Sprintf("key:%d", i)); err != nil {
+			t.Fatalf("Get(key:%d) after load: %v", i, err)
+		}
+	}
+	if ttl, _ := engine2.TTL("ttl:key"); ttl < 59*time.Minute {
+		t.Errorf("TTL after load = %v, want about 1h", ttl)
+	}
+
+	// A flipped bit must be reported and leave the engine untouched
+	corrupted := append([]byte(nil), buf.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0x01
+	if err := engine2.LoadSnapshot(bytes.NewReader(corrupted)); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("LoadSnapshot on corrupted data error = %v, want ErrCorruptSnapshot", err)
+	}
+	if _, err := engine2.Get("key:0"); err != nil {
+		t.Errorf("engine lost data after failed load: %v", err)
+	}
+
+	// Truncated snapshots are rejected as well
+	if err := engine2.LoadSnapshot(bytes.NewReader(buf.Bytes()[:buf.Len()-5])); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("LoadSnapshot on truncated data error = %v, want ErrCorruptSnapshot", err)
+	}
+
+	// A block announcing an oversized payload is refused before it is read
+	oversized := append([]byte(nil), buf.Bytes()[:len(snapshotMagic)+12]...)
+	oversized = append(oversized, blockMarker, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff)
+	if err := engine2.LoadSnapshot(bytes.NewReader(oversized)); !errors.Is(err, ErrCorruptSnapshot) || !strings.Contains(err.Error(), "block of 4294967295 bytes") {
+		t.Errorf("LoadSnapshot with an oversized block error = %v, want ErrCorruptSnapshot", err)
+	}
+}
+
+func TestMemoryEngine_RestoreVersion1Dump(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "jsondb_v1_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		EnableEncryption: false,
+		DumpPath:         tmpDir,
+	}
+
+	engine, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	dump := DumpData{
+		Version:   1,
+		Timestamp: time.Now(),
+		Shards: map[int]map[string]*KeyData{
+			engine.shardIndex("legacy"): {
+				"legacy": {Value: []byte(`"old format"`)},
+			},
+		},
+	}
+	data, err := json.Marshal(dump)
+	if err != nil {
+		t.Fatalf("Failed to marshal dump: %v", err)
+	}
+	if err := os.WriteFile(tmpDir+"/memory.dump", data, 0644); err != nil {
+		t.Fatalf("Failed to write dump: %v", err)
+	}
+
+	if err := engine.RestoreFromDisk(); err != nil {
+		t.Fatalf("RestoreFromDisk failed: %v", err)
+	}
+	if got, err := engine.Get("legacy"); err != nil || string(got) != `"old format"` {
+		t.Errorf("legacy key = %q, %v", got, err)
+	}
+
+	// The next dump migrates to the binary format
+	if err := engine.DumpToDisk(); err != nil {
+		t.Fatalf("DumpToDisk failed: %v", err)
+	}
+	written, err := os.ReadFile(tmpDir + "/memory.dump")
+	if err != nil {
+		t.Fatalf("Failed to read dump: %v", err)
+	}
+	if !bytes.HasPrefix(written, []byte("JSDBSNAP")) {
+		t.Errorf("dump was not written in the binary format")
+	}
+}
+
+func TestMemoryEngine_RestoreWithDifferentShardCount(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "jsondb_shards_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	source, err := NewMemoryEngine(&config.Config{DumpPath: tmpDir, ShardCount: 3})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer source.Close()
+
+	keys := make([]string, 200)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+		if err := source.Set(keys[i], map[string]int{"id": i}); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// A version 1 JSON dump records keys by shard index of the source engine
+	v1 := DumpData{Version: 1, Timestamp: time.Now(), Shards: make(map[int]map[string]*KeyData)}
+	for i, shard := range source.shards {
+		v1.Shards[i] = shard.data
+	}
+	v1Data, err := json.Marshal(v1)
+	if err != nil {
+		t.Fatalf("Failed to marshal v1 dump: %v", err)
+	}
+
+	var binary bytes.Buffer
+	if err := source.WriteSnapshot(&binary); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+
+	for _, format := range []struct {
+		name string
+		data []byte
+	}{
+		{"version 1 JSON", v1Data},
+		{"binary", binary.Bytes()},
+	} {
+		for _, shardCount := range []int{1, 7, 16} {
+			t.Run(fmt.Sprintf("%s to %d shards", format.name, shardCount), func(t *testing.T) {
+				target, err := NewMemoryEngine(&config.Config{DumpPath: tmpDir, ShardCount: shardCount})
+				if err != nil {
+					t.Fatalf("Failed to create engine: %v", err)
+				}
+				defer target.Close()
+
+				if err := target.LoadSnapshot(bytes.NewReader(format.data)); err != nil {
+					t.Fatalf("LoadSnapshot failed: %v", err)
+				}
+				for _, key := range keys {
+					if _, err := target.Get(key); err != nil {
+						t.Fatalf("Get(%s) after restore: %v", key, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMemoryEngine_Reencrypt(t *testing.T) {
+	oldKey := "0123456789abcdef0123456789abcdef"
+	newKey := "fedcba9876543210fedcba9876543210"
+
+	before, err := NewMemoryEngine(&config.Config{EnableEncryption: true, EncryptionKey: oldKey})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer before.Close()
+
+	for i := 0; i < 300; i++ {
+		if err := before.Set(fmt.Sprintf("key:%d", i), map[string]int{"n": i}); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	var snapshot bytes.Buffer
+	if err := before.WriteSnapshot(&snapshot); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+
+	// Rotate: the old key stays configured for reading, new writes use the new one
+	rotated, err := NewMemoryEngine(&config.Config{
+		EnableEncryption: true,
+		EncryptionKey:    oldKey,
+		EncryptionKeys:   map[string]string{"2024-06": newKey},
+		EncryptionKeyID:  "2024-06",
+		ChangeFeedSize:   1000,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer rotated.Close()
+
+	if err := rotated.LoadSnapshot(&snapshot); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	if _, err := rotated.Get("key:1"); err != nil {
+		t.Fatalf("Get with old key failed: %v", err)
+	}
+	version := rotated.Version("key:1")
+	_, next, _ := rotated.ChangeFeedBounds()
+
+	// A damaged value is skipped without stopping the others
+	damaged := rotated.getShard("key:7").data["key:7"].Value
+	damaged[len(damaged)-1] ^= 0x01
+
+	count, failed, err := rotated.Reencrypt()
+	if err != nil {
+		t.Fatalf("Reencrypt failed: %v", err)
+	}
+	if count != 299 || len(failed) != 1 || failed[0] != "key:7" {
+		t.Errorf("Reencrypt rewrote %d values, failed %v, want 299 and [key:7]", count, failed)
+	}
+	// A rewritten value is a write, watchers and followers see it
+	if rotated.Version("key:1") == version {
+		t.Errorf("Reencrypt kept the version of key:1")
+	}
+	changes, _, err := rotated.ReadChanges(next, 1000)
+	if err != nil || len(changes) != 299 {
+		t.Errorf("ReadChanges after Reencrypt returned %d changes, %v, want 299", len(changes), err)
+	}
+	if count, failed, _ := rotated.Reencrypt(); count != 0 || len(failed) != 1 {
+		t.Errorf("second Reencrypt rewrote %d values, failed %v, want 0 and [key:7]", count, failed)
+	}
+
+	// After re-encryption the old key can be dropped
+	snapshot.Reset()
+	if err := rotated.WriteSnapshot(&snapshot); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	after, err := NewMemoryEngine(&config.Config{
+		EnableEncryption: true,
+		EncryptionKeys:   map[string]string{"2024-06": newKey},
+		EncryptionKeyID:  "2024-06",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer after.Close()
+
+	if err := after.LoadSnapshot(&snapshot); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	got, err := after.Get("key:42")
+	if err != nil || string(got) != `{"n":42}` {
+		t.Errorf("Get(key:42) with new key only = %q, %v", got, err)
+	}
+}
+
+func TestMemoryEngine_PlainSnapshot(t *testing.T) {
+	source, err := NewMemoryEngine(&config.Config{EnableEncryption: true, EncryptionKey: "0123456789abcdef0123456789abcdef"})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer source.Close()
+	source.Set("user:1", map[string]string{"name": "Ann"})
+	source.SetWithTTL("session", []byte(`"abc"`), time.Hour)
+
+	// An engine with other keys, or none, loads the values and encrypts
+	// them with its own key
+	var snapshot bytes.Buffer
+	if err := source.WritePlainSnapshot(&snapshot); err != nil {
+		t.Fatalf("WritePlainSnapshot failed: %v", err)
+	}
+	if !bytes.Contains(snapshot.Bytes(), []byte(`"Ann"`)) {
+		t.Errorf("plain snapshot holds encrypted values")
+	}
+	for _, cfg := range []*config.Config{
+		{EnableEncryption: true, EncryptionKey: "fedcba9876543210fedcba9876543210"},
+		{},
+	} {
+		target, err := NewMemoryEngine(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create engine: %v", err)
+		}
+		defer target.Close()
+		if err := target.LoadSnapshot(bytes.NewReader(snapshot.Bytes())); err != nil {
+			t.Fatalf("LoadSnapshot failed: %v", err)
+		}
+		if got, err := target.Get("user:1"); err != nil || string(got) != `{"name":"Ann"}` {
+			t.Errorf("Get(user:1) = %q, %v", got, err)
+		}
+		if ttl, _ := target.TTL("session"); ttl <= 0 {
+			t.Errorf("TTL(session) = %v after loading", ttl)
+		}
+		if cfg.EnableEncryption && target.encryptor.KeyID(target.getShard("user:1").data["user:1"].Value) != "default" {
+			t.Errorf("loaded value was stored unencrypted")
+		}
+	}
+}
+
+func TestEncryptionWithTTL(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "jsondb_ttl_encryption_test_*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	cfg := &config.Config{
+		EnableEncryption: true,
+		EncryptionKey:    "0123456789abcdef0123456789abcdef",
+		DumpPath:         tmpDir,
+	}
+
+	engine1, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine1.Close()
+
+	testCases := []struct {
+		key      string
+		value    []byte
+		expected interface{}
+	}{
+		{"ttl:string", []byte("session data"), "session data"},
+		{"ttl:object", []byte(`{"user":"John","roles":["admin"]}`), map[string]interface{}{"user": "John", "roles": []interface{}{"admin"}}},
+		{"ttl:array", []byte(`[1,2,3]`), []interface{}{float64(1), float64(2), float64(3)}},
+	}
+
+	for _, tt := range testCases {
+		if err := engine1.SetWithTTL(tt.key, tt.value, time.Hour); err != nil {
+			t.Fatalf("SetWithTTL(%s) failed: %v", tt.key, err)
+		}
+
+		// The stored bytes must be encrypted exactly like Set does it
+		stored := engine1.getShard(tt.key).data[tt.key].Value
+		if bytes.Contains(stored, tt.value) {
+			t.Errorf("value of %s is stored in plaintext", tt.key)
+		}
+	}
+
+	verify := func(t *testing.T, e *MemoryEngine) {
+		t.Helper()
+		for _, tt := range testCases {
+			got, err := e.Get(tt.key)
+			if err != nil {
+				t.Fatalf("Get(%s) failed: %v", tt.key, err)
+			}
+			var decoded interface{}
+			if err := json.Unmarshal(got, &decoded); err != nil {
+				t.Fatalf("Failed to unmarshal %s: %v (raw %q)", tt.key, err, got)
+			}
+			if !reflect.DeepEqual(decoded, tt.expected) {
+				t.Errorf("Value mismatch for %s:\ngot:  %#v\nwant: %#v", tt.key, decoded, tt.expected)
+			}
+			if ttl, _ := e.TTL(tt.key); ttl < 59*time.Minute {
+				t.Errorf("TTL(%s) = %v, want about 1h", tt.key, ttl)
+			}
+		}
+	}
+
+	verify(t, engine1)
+
+	// Set and SetWithTTL produce the same value for the same input
+	if err := engine1.Set("plain:string", "session data"); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	fromSet, _ := engine1.Get("plain:string")
+	fromTTL, _ := engine1.Get("ttl:string")
+	if !bytes.Equal(fromSet, fromTTL) {
+		t.Errorf("Set stored %q but SetWithTTL stored %q", fromSet, fromTTL)
+	}
+
+	if err := engine1.DumpToDisk(); err != nil {
+		t.Fatalf("DumpToDisk failed: %v", err)
+	}
+
+	engine2, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine2.Close()
+
+	if err := engine2.RestoreFromDisk(); err != nil {
+		t.Fatalf("RestoreFromDisk failed: %v", err)
+	}
+	verify(t, engine2)
+}
+
+func TestMemoryEngine_JSONPath(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		t.Run(fmt.Sprintf("encryption=%v", encrypted), func(t *testing.T) {
+			engine, err := NewMemoryEngine(&config.Config{
+				EnableEncryption: encrypted,
+				EncryptionKey:    "0123456789abcdef0123456789abcdef",
+			})
+			if err != nil {
+				t.Fatalf("Failed to create engine: %v", err)
+			}
+			defer engine.Close()
+
+			if err := engine.SetWithTTL("user:1", []byte(`{"name":"John","age":30,"tags":["a"],"address":{"city":"Oslo"}}`), time.Hour); err != nil {
+				t.Fatalf("SetWithTTL failed: %v", err)
+			}
+
+			get := func(path string) string {
+				t.Helper()
+				value, err := engine.JSONGet("user:1", path)
+				if err != nil {
+					t.Fatalf("JSONGet(%s) failed: %v", path, err)
+				}
+				return string(value)
+			}
+
+			if got := get("$.address.city"); got != `"Oslo"` {
+				t.Errorf("JSONGet($.address.city) = %s", got)
+			}
+			if got := get(`$["tags"][0]`); got != `"a"` {
+				t.Errorf(`JSONGet($["tags"][0]) = %s`, got)
+			}
+			if _, err := engine.JSONGet("user:1", "$.missing"); err != ErrPathNotFound {
+				t.Errorf("JSONGet($.missing) error = %v, want ErrPathNotFound", err)
+			}
+
+			if err := engine.JSONSet("user:1", "$.address.zip", []byte(`"0150"`)); err != nil {
+				t.Fatalf("JSONSet failed: %v", err)
+			}
+			if err := engine.JSONSet("user:1", "$.name", []byte(`"Jane"`)); err != nil {
+				t.Fatalf("JSONSet failed: %v", err)
+			}
+			if err := engine.JSONSet("user:1", "$.nested.deep", []byte(`1`)); err != ErrPathNotFound {
+				t.Errorf("JSONSet on missing parent error = %v, want ErrPathNotFound", err)
+			}
+
+			if n, err := engine.JSONArrAppend("user:1", "$.tags", []byte(`"b"`), []byte(`{"c":1}`)); err != nil || n != 3 {
+				t.Errorf("JSONArrAppend = %d, %v, want 3", n, err)
+			}
+			if _, err := engine.JSONArrAppend("user:1", "$.name", []byte(`"x"`)); err != ErrWrongType {
+				t.Errorf("JSONArrAppend on string error = %v, want ErrWrongType", err)
+			}
+
+			if n, err := engine.JSONNumIncrBy("user:1", "$.age", "5"); err != nil || string(n) != "35" {
+				t.Errorf("JSONNumIncrBy = %s, %v, want 35", n, err)
+			}
+			if n, err := engine.JSONNumIncrBy("user:1", "$.age", "0.5"); err != nil || string(n) != "35.5" {
+				t.Errorf("JSONNumIncrBy = %s, %v, want 35.5", n, err)
+			}
+
+			if n, err := engine.JSONDel("user:1", "$.tags[0]"); err != nil || n != 1 {
+				t.Errorf("JSONDel($.tags[0]) = %d, %v, want 1", n, err)
+			}
+			if n, _ := engine.JSONDel("user:1", "$.missing"); n != 0 {
+				t.Errorf("JSONDel($.missing) = %d, want 0", n)
+			}
+
+			want := `{"address":{"city":"Oslo","zip":"0150"},"age":35.5,"name":"Jane","tags":["b",{"c":1}]}`
+			if got := get("$"); got != want {
+				t.Errorf("document = %s\nwant        %s", got, want)
+			}
+
+			// Partial updates keep the expiry and go through the same encryption as Set
+			if ttl, _ := engine.TTL("user:1"); ttl < 59*time.Minute {
+				t.Errorf("TTL after JSON updates = %v, want about 1h", ttl)
+			}
+			stored := engine.getShard("user:1").data["user:1"].Value
+			if encrypted == bytes.Contains(stored, []byte("Jane")) {
+				t.Errorf("stored value encrypted = %v, want %v", !encrypted, encrypted)
+			}
+
+			if err := engine.Set("plain", "text"); err != nil {
+				t.Fatalf("Set failed: %v", err)
+			}
+			if err := engine.JSONSet("plain", "$.x", []byte("1")); err != ErrPathNotFound {
+				t.Errorf("JSONSet into a string error = %v, want ErrPathNotFound", err)
+			}
+
+			// Trailing data after a value is not JSON
+			for _, value := range []string{`{"a":1} garbage`, `{"a":1}}`, `1 2`} {
+				if err := engine.JSONSet("trailing", "$", []byte(value)); err != ErrNotJSON {
+					t.Errorf("JSONSet(%s) error = %v, want ErrNotJSON", value, err)
+				}
+			}
+
+			// Integer increments stop at the int64 boundary instead of wrapping
+			if err := engine.JSONSet("counter", "$", []byte(`{"n":9223372036854775806,"m":-9223372036854775807}`)); err != nil {
+				t.Fatalf("JSONSet failed: %v", err)
+			}
+			if n, err := engine.JSONNumIncrBy("counter", "$.n", "1"); err != nil || string(n) != "9223372036854775807" {
+				t.Errorf("JSONNumIncrBy to the maximum = %s, %v", n, err)
+			}
+			if _, err := engine.JSONNumIncrBy("counter", "$.n", "1"); err != ErrOverflow {
+				t.Errorf("JSONNumIncrBy past the maximum error = %v, want ErrOverflow", err)
+			}
+			if _, err := engine.JSONNumIncrBy("counter", "$.m", "-2"); err != ErrOverflow {
+				t.Errorf("JSONNumIncrBy past the minimum error = %v, want ErrOverflow", err)
+			}
+			if got, err := engine.JSONGet("counter", "$.n"); err != nil || string(got) != "9223372036854775807" {
+				t.Errorf("counter after overflow = %s, %v, want it unchanged", got, err)
+			}
+		})
+	}
+}
+
+func TestMemoryEngine_JSONNumIncrByConcurrent(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	if err := engine.Set("counter", map[string]int{"hits": 0}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := engine.JSONNumIncrBy("counter", "$.hits", "1"); err != nil {
+					t.Errorf("JSONNumIncrBy failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := engine.JSONGet("counter", "$.hits"); string(got) != "1000" {
+		t.Errorf("hits = %s, want 1000", got)
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	list := newSkipList(func(a, b int) int { return a - b })
+	present := make(map[int]bool)
+
+	// Random inserts and deletes, checked against a map of the items
+	for i := 0; i < 5000; i++ {
+		item := (i * 7919) % 1000
+		if i%3 == 2 {
+			if deleted := list.delete(item); deleted != present[item] {
+				t.Fatalf("delete(%d) = %v, want %v", item, deleted, present[item])
+			}
+			delete(present, item)
+		} else {
+			list.insert(item)
+			present[item] = true
+		}
+	}
+
+	var want, got []int
+	for item := range present {
+		want = append(want, item)
+	}
+	sort.Ints(want)
+	for node := list.first(); node != nil; node = node.next[0] {
+		got = append(got, node.item)
+	}
+	if !reflect.DeepEqual(got, want) || list.Len() != len(want) {
+		t.Fatalf("skip list holds %d items (Len %d), want %d in order", len(got), list.Len(), len(want))
+	}
+
+	if node := list.search(func(item int) bool { return item >= 500 }); node == nil || node.item != want[sort.SearchInts(want, 500)] {
+		t.Errorf("search(>= 500) = %v", node)
+	}
+	if node := list.search(func(item int) bool { return item >= 1000 }); node != nil {
+		t.Errorf("search(>= 1000) = %d, want nil", node.item)
+	}
+}
+
+func TestMemoryEngine_Indexes(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{
+		Indexes: []config.IndexConfig{{Name: "users_age", Pattern: "users:*", Path: "$.age"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	users := map[string]string{
+		"users:1": `{"email":"ann@example.com","age":31}`,
+		"users:2": `{"email":"bob@example.com","age":25}`,
+		"users:3": `{"email":"bea@example.org","age":40}`,
+		"users:4": `{"email":"cid@example.com"}`,
+		"other:1": `{"email":"ann@example.net","age":31}`,
+	}
+	for key, value := range users {
+		if err := engine.Set(key, value); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// An index created after the data exists is backfilled
+	if err := engine.CreateIndex(IndexDef{Name: "users_email", Pattern: "users:*", Path: "$.email"}); err != nil {
+		t.Fatalf("CreateIndex failed: %v", err)
+	}
+	if err := engine.CreateIndex(IndexDef{Name: "users_email", Pattern: "users:*", Path: "$.email"}); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("duplicate CreateIndex error = %v, want ErrIndexExists", err)
+	}
+
+	query := func(name string, q IndexQuery) string {
+		t.Helper()
+		keys, err := engine.Query(name, q)
+		if err != nil {
+			t.Fatalf("Query(%s %v) failed: %v", name, q, err)
+		}
+		return strings.Join(keys, ",")
+	}
+
+	tests := []struct {
+		name  string
+		query IndexQuery
+		want  string
+	}{
+		{"users_age", IndexQuery{Op: QueryEq, Values: []string{"31"}}, "users:1"},
+		{"users_age", IndexQuery{Op: QueryRange, Values: []string{"25", "31"}}, "users:2,users:1"},
+		{"users_age", IndexQuery{Op: QueryRange, Values: []string{"30", "+inf"}}, "users:1,users:3"},
+		{"users_age", IndexQuery{Op: QueryGt, Values: []string{"25"}}, "users:1,users:3"},
+		{"users_age", IndexQuery{Op: QueryLte, Values: []string{"31"}}, "users:2,users:1"},
+		{"users_age", IndexQuery{Op: QueryGte, Values: []string{"0"}, Offset: 1, Limit: 1}, "users:1"},
+		{"users_email", IndexQuery{Op: QueryPrefix, Values: []string{"b"}}, "users:3,users:2"},
+		{"users_email", IndexQuery{Op: QueryEq, Values: []string{"cid@example.com"}}, "users:4"},
+	}
+	for _, tt := range tests {
+		if got := query(tt.name, tt.query); got != tt.want {
+			t.Errorf("Query(%s %s %v) = %q, want %q", tt.name, tt.query.Op, tt.query.Values, got, tt.want)
+		}
+	}
+
+	// Writes, partial updates, deletes and expirations keep the index current
+	if err := engine.JSONSet("users:2", "$.age", []byte("33")); err != nil {
+		t.Fatalf("JSONSet failed: %v", err)
+	}
+	if err := engine.Delete("users:1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := engine.SetWithTTL("users:5", []byte(`{"age":50}`), 20*time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+	if err := engine.Set("users:4", `{"age":"unknown"}`); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if got := query("users_age", IndexQuery{Op: QueryGte, Values: []string{"0"}}); got != "users:2,users:3,users:5" {
+		t.Errorf("ages after updates = %q", got)
+	}
+	if got := query("users_age", IndexQuery{Op: QueryEq, Values: []string{"unknown"}}); got != "users:4" {
+		t.Errorf("string age = %q, want users:4", got)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if got := query("users_age", IndexQuery{Op: QueryGte, Values: []string{"0"}}); got != "users:2,users:3" {
+		t.Errorf("ages after expiry = %q", got)
+	}
+
+	// A limited query collects candidates in batches, past the expired keys
+	// still in the index, and stops once it has enough
+	for i := 10; i < 20; i++ {
+		engine.SetWithTTL(fmt.Sprintf("users:%d", i), []byte(fmt.Sprintf(`{"age":%d}`, i)), 10*time.Millisecond)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got := query("users_age", IndexQuery{Op: QueryGte, Values: []string{"0"}, Offset: 1, Limit: 1}); got != "users:3" {
+		t.Errorf("limited query past expired keys = %q, want users:3", got)
+	}
+	idx := engine.indexes["users_age"]
+	all := idx.collect(nil, nil, nil, nil, 0)
+	if entries := idx.collect(nil, nil, nil, nil, 3); len(entries) != 3 {
+		t.Errorf("collect with a max of 3 returned %d entries", len(entries))
+	} else if rest := idx.collect(nil, nil, nil, &entries[2], 0); len(rest) != len(all)-3 || rest[0] != all[3] {
+		t.Errorf("collect after the first 3 entries returned %d entries, want %d", len(rest), len(all)-3)
+	}
+
+	if err := engine.ResetMemory(); err != nil {
+		t.Fatalf("ResetMemory failed: %v", err)
+	}
+	if got := query("users_email", IndexQuery{Op: QueryPrefix, Values: []string{""}}); got != "" {
+		t.Errorf("index after reset = %q, want empty", got)
+	}
+
+	if _, err := engine.Query("users_age", IndexQuery{Op: "LIKE", Values: []string{"x"}}); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("unknown operator error = %v, want ErrInvalidQuery", err)
+	}
+	if err := engine.DropIndex("users_age"); err != nil {
+		t.Fatalf("DropIndex failed: %v", err)
+	}
+	if _, err := engine.Query("users_age", IndexQuery{Op: QueryEq, Values: []string{"1"}}); !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("Query on dropped index error = %v, want ErrIndexNotFound", err)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		want    bool
+	}{
+		{"user:*", "user:1", true},
+		{"user:*", "admin:user:1", false},
+		{"*:1", "user:1", true},
+		{"*:1", "user:10", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:10", false},
+		{"user:[12]", "user:2", true},
+		{"user:[12]", "user:3", false},
+		{"user:[a-c]x", "user:bx", true},
+		{"user:[^a-c]", "user:b", false},
+		{"user:[!a-c]", "user:d", true},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"a+(b|c)", "a+(b|c)", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"*a*b*", "xxaxxbxx", true},
+		{"*a*b*", "xxbxxaxx", false},
+		{"[", "[", true},
+		{"", "", true},
+		{"*", "", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryEngine_Scan(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{ShardCount: 4})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := engine.Set(fmt.Sprintf("user:%d", i), "v"); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		if err := engine.Set(fmt.Sprintf("post:%d", i), "v"); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	// Keys present for the whole scan are returned exactly once, even while
+	// other keys are written and deleted between calls
+	seen := make(map[string]int)
+	var cursor uint64
+	calls := 0
+	for {
+		var keys []string
+		cursor, keys = engine.Scan(cursor, "user:*", 25)
+		for _, key := range keys {
+			seen[key]++
+		}
+
+		calls++
+		engine.Set(fmt.Sprintf("user:new:%d", calls), "v")
+		engine.Delete(fmt.Sprintf("post:%d", calls))
+
+		if cursor == 0 {
+			break
+		}
+		if calls > 1000 {
+			t.Fatalf("scan did not terminate")
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		if n := seen[fmt.Sprintf("user:%d", i)]; n != 1 {
+			t.Errorf("user:%d returned %d times, want 1", i, n)
+		}
+	}
+	for key := range seen {
+		if !strings.HasPrefix(key, "user:") {
+			t.Errorf("key %s does not match the pattern", key)
+		}
+	}
+	if calls < 10 {
+		t.Errorf("scan took %d calls, want COUNT to bound each call", calls)
+	}
+
+	keys := engine.Keys("user:1?")
+	if len(keys) != 10 || keys[0] != "user:10" || keys[9] != "user:19" {
+		t.Errorf("Keys(user:1?) = %v", keys)
+	}
+
+	// The scan order follows restores and resets
+	var buf bytes.Buffer
+	if err := engine.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	if err := engine.ResetMemory(); err != nil {
+		t.Fatalf("ResetMemory failed: %v", err)
+	}
+	if cursor, keys := engine.Scan(0, "", 1000); cursor != 0 || len(keys) != 0 {
+		t.Errorf("Scan after reset = %d, %v, want nothing", cursor, keys)
+	}
+	if err := engine.LoadSnapshot(&buf); err != nil {
+		t.Fatalf("LoadSnapshot failed: %v", err)
+	}
+	total := 0
+	for cursor = 0; ; {
+		cursor, keys = engine.Scan(cursor, "", 50)
+		total += len(keys)
+		if cursor == 0 {
+			break
+		}
+	}
+	if want := len(engine.Keys("*")); total != want {
+		t.Errorf("Scan after restore returned %d keys, want %d", total, want)
+	}
+
+	// The cursor holds the index of the last shard the engine accepts
+	if _, err := NewMemoryEngine(&config.Config{ShardCount: maxShards + 1}); err == nil {
+		t.Errorf("NewMemoryEngine accepted %d shards", maxShards+1)
+	}
+	wide, err := NewMemoryEngine(&config.Config{ShardCount: maxShards})
+	if err != nil {
+		t.Fatalf("Failed to create engine with %d shards: %v", maxShards, err)
+	}
+	defer wide.Close()
+	last := ""
+	for i := 0; last == ""; i++ {
+		if key := fmt.Sprintf("key:%d", i); wide.shardIndex(key) == maxShards-1 {
+			last = key
+		}
+	}
+	wide.Set(last, "value")
+	wide.Set("first", "value")
+	var scanned []string
+	for cursor = 0; ; {
+		cursor, keys = wide.Scan(cursor, "", 1)
+		scanned = append(scanned, keys...)
+		if cursor == 0 {
+			break
+		}
+	}
+	if sort.Strings(scanned); len(scanned) != 2 || scanned[0] != "first" || scanned[1] != last {
+		t.Errorf("Scan over %d shards = %v, want first and %s", maxShards, scanned, last)
+	}
+}
+
+func TestMemoryEngine_Batch(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{ShardCount: 4})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	keys := make([]string, 20)
+	values := make([][]byte, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+		values[i] = []byte(fmt.Sprintf(`{"n":%d}`, i))
+	}
+	if err := engine.MSet(keys, values); err != nil {
+		t.Fatalf("MSet failed: %v", err)
+	}
+	if err := engine.MSet([]string{"a"}, nil); err == nil {
+		t.Errorf("MSet with mismatched values should fail")
+	}
+
+	if err := engine.SetWithTTL("expired", []byte("v"), time.Millisecond); err != nil {
+		t.Fatalf("SetWithTTL failed: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	got, err := engine.MGet([]string{"key:3", "missing", "key:17", "expired", "key:3"})
+	if err != nil {
+		t.Fatalf("MGet failed: %v", err)
+	}
+	want := []string{`{"n":3}`, "", `{"n":17}`, "", `{"n":3}`}
+	for i, value := range got {
+		if string(value) != want[i] || (want[i] == "") != (value == nil) {
+			t.Errorf("MGet[%d] = %q, want %q", i, value, want[i])
+		}
+	}
+
+	deleted, err := engine.MDelete([]string{"key:1", "key:2", "missing", "expired", "key:1"})
+	if err != nil {
+		t.Fatalf("MDelete failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("MDelete deleted %d keys, want 2", deleted)
+	}
+	if _, err := engine.Get("key:1"); err != ErrKeyNotFound {
+		t.Errorf("key:1 still present after MDelete")
+	}
+	if _, err := engine.Get("key:4"); err != nil {
+		t.Errorf("key:4 removed by MDelete: %v", err)
+	}
+}
+
+func TestMemoryEngine_Atomic(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{ShardCount: 8})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	if engine.Version("a") != 0 {
+		t.Errorf("missing key should have version 0")
+	}
+	engine.Set("a", 0)
+	engine.Set("b", 0)
+	version := engine.Version("a")
+	if version == 0 {
+		t.Fatalf("stored key has version 0")
+	}
+	engine.Persist("a")
+	if engine.Version("a") != version {
+		t.Errorf("Persist without expiry changed the version")
+	}
+	engine.ExpireAt("a", time.Now().Add(time.Hour))
+	if engine.Version("a") <= version {
+		t.Errorf("ExpireAt did not bump the version")
+	}
+
+	// Transfers between two keys never expose a state where the sum differs
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			from, to := "a", "b"
+			if i%2 == 1 {
+				from, to = to, from
+			}
+			for j := 0; j < 100; j++ {
+				err := engine.Atomic([]string{from, to}, func(tx *Tx) error {
+					if _, err := tx.JSONNumIncrBy(from, "$", "-1"); err != nil {
+						return err
+					}
+					_, err := tx.JSONNumIncrBy(to, "$", "1")
+					return err
+				})
+				if err != nil {
+					t.Errorf("Atomic failed: %v", err)
+					return
+				}
+			}
+		}(i)
+	}
+	for j := 0; j < 100; j++ {
+		engine.Atomic([]string{"a", "b"}, func(tx *Tx) error {
+			values, _ := tx.MGet([]string{"a", "b"})
+			var x, y int
+			json.Unmarshal(values[0], &x)
+			json.Unmarshal(values[1], &y)
+			if x+y != 0 {
+				t.Errorf("observed a=%d b=%d", x, y)
+			}
+			return nil
+		})
+	}
+	wg.Wait()
+
+	undeclared := "c"
+	for i := 0; engine.shardIndex(undeclared) == engine.shardIndex("a"); i++ {
+		undeclared = fmt.Sprintf("c%d", i)
+	}
+	err = engine.Atomic([]string{"a"}, func(tx *Tx) error {
+		return tx.Set(undeclared, "v")
+	})
+	if err != ErrKeyNotLocked {
+		t.Errorf("writing an undeclared key: got %v, want ErrKeyNotLocked", err)
+	}
+}
+
+func TestMemoryEngine_ConditionalWrites(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{ShardCount: 4})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	// Exactly one of many clients racing for a lock wins it
+	var wins int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := engine.SetIf("lock", []byte(fmt.Sprintf("owner-%d", i)), time.Now().Add(time.Minute), SetIfAbsent, 0)
+			if err != nil {
+				t.Errorf("SetIf failed: %v", err)
+			}
+			if ok {
+				atomic.AddInt32(&wins, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if wins != 1 {
+		t.Errorf("%d clients acquired the lock, want 1", wins)
+	}
+
+	if ok, _ := engine.SetIf("missing", []byte("v"), time.Time{}, SetIfPresent, 0); ok {
+		t.Errorf("SetIfPresent wrote a missing key")
+	}
+
+	engine.Set("doc", `{"n":1}`)
+	version := engine.Version("doc")
+	if ok, _ := engine.SetIf("doc", []byte(`{"n":2}`), time.Time{}, SetIfVersion, version+1); ok {
+		t.Errorf("SetIfVersion wrote with a wrong version")
+	}
+	if ok, _ := engine.SetIf("doc", []byte(`{"n":2}`), time.Time{}, SetIfVersion, version); !ok {
+		t.Errorf("SetIfVersion did not write with the current version")
+	}
+	if next := engine.Version("doc"); next <= version {
+		t.Errorf("version did not increase: %d -> %d", version, next)
+	}
+	if ok, _ := engine.SetIf("doc", []byte(`{"n":3}`), time.Time{}, SetIfVersion, version); ok {
+		t.Errorf("SetIfVersion wrote with a stale version")
+	}
+	if ok, _ := engine.SetIf("fresh", []byte("v"), time.Time{}, SetIfVersion, 0); !ok {
+		t.Errorf("SetIfVersion 0 did not create a missing key")
+	}
+
+	previous, err := engine.GetSet("doc", []byte(`{"n":4}`))
+	if err != nil || string(previous) != `{"n":2}` {
+		t.Errorf("GetSet returned %q, %v", previous, err)
+	}
+	if previous, err := engine.GetSet("new", []byte("v")); err != nil || previous != nil {
+		t.Errorf("GetSet on a missing key returned %q, %v", previous, err)
+	}
+
+	value, err := engine.GetDel("doc")
+	if err != nil || string(value) != `{"n":4}` {
+		t.Errorf("GetDel returned %q, %v", value, err)
+	}
+	if _, err := engine.GetDel("doc"); err != ErrKeyNotFound {
+		t.Errorf("GetDel on a deleted key: got %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestMemoryEngine_KeyEvents(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{ShardCount: 4})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	var mu sync.Mutex
+	var events []string
+	engine.OnKeyEvent(func(event, key string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event+" "+key)
+	})
+
+	engine.Set("a", 1)
+	engine.MSet([]string{"b", "c"}, [][]byte{[]byte("2"), []byte("3")})
+	engine.Delete("a")
+	engine.MDelete([]string{"b", "missing"})
+	engine.JSONSet("c", "$", []byte("4"))
+	engine.SetWithTTL("short", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	engine.Get("short")
+
+	engine.OnKeyEvent(nil)
+	engine.Set("quiet", 1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(events[1:3])
+	want := []string{"set a", "set b", "set c", "del a", "del b", "set c", "set short", "expired short"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+func TestMemoryEngine_ChangeFeed(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{ShardCount: 4, ChangeFeedSize: 5})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	oldest, next, err := engine.ChangeFeedBounds()
+	if err != nil || oldest != next {
+		t.Fatalf("empty feed bounds = %d, %d, %v", oldest, next, err)
+	}
+	_, wake, err := engine.ReadChanges(next, 10)
+	if err != nil {
+		t.Fatalf("ReadChanges failed: %v", err)
+	}
+
+	engine.Set("a", 1)
+	select {
+	case <-wake:
+	default:
+		t.Fatal("wake channel not closed by a change")
+	}
+	engine.ExpireAt("a", time.Now().Add(time.Hour))
+	engine.Delete("a")
+
+	events, _, err := engine.ReadChanges(0, 10)
+	if err != nil {
+		t.Fatalf("ReadChanges failed: %v", err)
+	}
+	var got []string
+	for i, event := range events {
+		if event.Seq != next+uint64(i) {
+			t.Errorf("event %d has sequence %d, want %d", i, event.Seq, next+uint64(i))
+		}
+		got = append(got, fmt.Sprintf("%s %s %s %v", event.Op, event.Key, event.Value, !event.ExpiresAt.IsZero()))
+	}
+	want := []string{"set a 1 false", "expire a 1 true", "del a  false"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+
+	// Reading resumes after the last change seen
+	if events, _, _ := engine.ReadChanges(next+2, 10); len(events) != 1 || events[0].Op != EventDel {
+		t.Errorf("resumed read = %+v", events)
+	}
+
+	// Older changes are dropped once the feed is full
+	for i := 0; i < 5; i++ {
+		engine.Set(fmt.Sprintf("k%d", i), i)
+	}
+	if _, _, err := engine.ReadChanges(next, 10); !errors.Is(err, ErrChangesLost) {
+		t.Errorf("read of dropped changes: %v, want ErrChangesLost", err)
+	}
+	if events, _, _ := engine.ReadChanges(0, 10); len(events) != 5 || events[0].Key != "k0" {
+		t.Errorf("read from the oldest change = %+v", events)
+	}
+
+	engine.ResetMemory()
+	if events, _, _ := engine.ReadChanges(next+8, 10); len(events) != 1 || events[0].Op != ChangeReset {
+		t.Errorf("reset change = %+v", events)
+	}
+
+	disabled, _ := NewMemoryEngine(&config.Config{ShardCount: 4})
+	defer disabled.Close()
+	if _, _, err := disabled.ReadChanges(0, 10); err != ErrFeedDisabled {
+		t.Errorf("disabled feed: %v", err)
+	}
+}
+
+func TestMemoryEngine_ApplyChange(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{ShardCount: 4})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	changes := []ChangeEvent{
+		{Op: EventSet, Key: "n", Value: []byte("1")},
+		{Op: EventSet, Key: "s", Value: []byte(`"1"`)},
+		{Op: ChangeExpire, Key: "n", Value: []byte("1"), ExpiresAt: time.Now().Add(time.Hour)},
+		{Op: EventExpired, Key: "s"},
+		{Op: EventDel, Key: "missing"},
+	}
+	for _, change := range changes {
+		if err := engine.ApplyChange(change); err != nil {
+			t.Fatalf("ApplyChange(%+v) failed: %v", change, err)
+		}
+	}
+
+	// Values are applied as the stored JSON, a number stays a number
+	if value, _ := engine.Get("n"); string(value) != "1" {
+		t.Errorf("n = %s", value)
+	}
+	if ttl, _ := engine.TTL("n"); ttl <= 0 {
+		t.Errorf("n has no expiry: %v", ttl)
+	}
+	if _, err := engine.Get("s"); err != ErrKeyNotFound {
+		t.Errorf("s was not removed: %v", err)
+	}
+
+	if err := engine.ApplyChange(ChangeEvent{Op: ChangeReset}); err != nil {
+		t.Fatalf("reset failed: %v", err)
+	}
+	if _, err := engine.Get("n"); err != ErrKeyNotFound {
+		t.Errorf("reset kept n: %v", err)
+	}
+}
+
+func TestMemoryEngine_Eviction(t *testing.T) {
+	// Every key below takes the same memory, the limit holds 10 of them
+	keySize := keyMemory("k00", &KeyData{Value: []byte("1234567")})
+	newEngine := func(policy string) *MemoryEngine {
+		t.Helper()
+		engine, err := NewMemoryEngine(&config.Config{ShardCount: 4, MaxMemory: 10 * keySize, MaxMemoryPolicy: policy})
+		if err != nil {
+			t.Fatalf("Failed to create engine: %v", err)
+		}
+		t.Cleanup(func() { engine.Close() })
+		return engine
+	}
+
+	t.Run("noeviction", func(t *testing.T) {
+		engine := newEngine(EvictNone)
+		for i := 0; i < 11; i++ {
+			if err := engine.Set(fmt.Sprintf("k%02d", i), 1234567); err != nil {
+				t.Fatalf("Set %d failed: %v", i, err)
+			}
+		}
+		if used := engine.MemoryStats().UsedBytes; used != 11*keySize {
+			t.Errorf("used memory = %d, want %d", used, 11*keySize)
+		}
+		if err := engine.Set("k11", 1234567); err != ErrOutOfMemory {
+			t.Errorf("Set over the limit: %v, want ErrOutOfMemory", err)
+		}
+		if err := engine.MSet([]string{"k11"}, [][]byte{[]byte("1")}); err != ErrOutOfMemory {
+			t.Errorf("MSet over the limit: %v, want ErrOutOfMemory", err)
+		}
+		// Deletes still work and free memory
+		if err := engine.Delete("k00"); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		engine.Delete("k01")
+		if err := engine.Set("k11", 1234567); err != nil {
+			t.Errorf("Set after freeing memory: %v", err)
+		}
+		if stats := engine.MemoryStats(); stats.Rejected != 2 || stats.Evicted != 0 {
+			t.Errorf("stats = %+v", stats)
+		}
+	})
+
+	for _, policy := range []string{EvictAllKeysLRU, EvictAllKeysLFU} {
+		t.Run(policy, func(t *testing.T) {
+			engine := newEngine(policy)
+			var evicted atomic.Int32
+			engine.OnKeyEvent(func(event, key string) {
+				if event == EventEvicted {
+					evicted.Add(1)
+				}
+			})
+
+			engine.Set("k00", 1234567)
+			for i := 1; i < 40; i++ {
+				for j := 0; j < 50; j++ {
+					engine.Get("k00")
+				}
+				if err := engine.Set(fmt.Sprintf("k%02d", i), 1234567); err != nil {
+					t.Fatalf("Set %d failed: %v", i, err)
+				}
+			}
+
+			if _, err := engine.Get("k00"); err != nil {
+				t.Errorf("the most used key was evicted")
+			}
+			stats := engine.MemoryStats()
+			if stats.UsedBytes > stats.MaxBytes+keySize {
+				t.Errorf("used memory %d is over the limit %d", stats.UsedBytes, stats.MaxBytes)
+			}
+			if stats.Evicted == 0 || uint64(evicted.Load()) != stats.Evicted {
+				t.Errorf("evicted %d keys, %d events", stats.Evicted, evicted.Load())
+			}
+		})
+	}
+
+	t.Run(EvictVolatileTTL, func(t *testing.T) {
+		engine := newEngine(EvictVolatileTTL)
+		for i := 0; i < 5; i++ {
+			engine.Set(fmt.Sprintf("k%02d", i), 1234567)
+		}
+		for i := 5; i < 11; i++ {
+			engine.SetWithTTL(fmt.Sprintf("k%02d", i), []byte("1234567"), time.Duration(i)*time.Hour)
+		}
+		if err := engine.Set("k11", 1234567); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+		// The key closest to expiring goes first, keys without expiry stay
+		if _, err := engine.Get("k05"); err != ErrKeyNotFound {
+			t.Errorf("k05 was not evicted: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if _, err := engine.Get(fmt.Sprintf("k%02d", i)); err != nil {
+				t.Errorf("k%02d without expiry was evicted", i)
+			}
+		}
+		for i := 12; i < 30; i++ {
+			engine.Set(fmt.Sprintf("k%02d", i), 1234567)
+		}
+		if err := engine.Set("last", 1234567); err != ErrOutOfMemory {
+			t.Errorf("Set without volatile keys left: %v, want ErrOutOfMemory", err)
+		}
+	})
+}
+
+func TestMemoryEngine_SaveAndRestore(t *testing.T) {
+	engine, err := NewMemoryEngine(&config.Config{DumpPath: t.TempDir(), ChangeFeedSize: 10})
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	defer engine.Close()
+
+	if status := engine.SaveStatus(); !status.LastSave.IsZero() || status.InProgress {
+		t.Errorf("status before any save = %+v", status)
+	}
+	engine.Set("kept", "before")
+	if err := engine.BackgroundSave(); err != nil {
+		t.Fatalf("BackgroundSave failed: %v", err)
+	}
+	for deadline := time.Now().Add(time.Second); engine.SaveStatus().InProgress; {
+		if time.Now().After(deadline) {
+			t.Fatalf("background save did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status := engine.SaveStatus(); status.LastSave.IsZero() || status.LastBackgroundErr != nil {
+		t.Errorf("status after the save = %+v", status)
+	}
+
+	// A snapshot kept under another name is restored by name
+	snapshot, err := os.ReadFile(engine.dumpPath + "/memory.dump")
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if err := os.WriteFile(engine.dumpPath+"/before-deploy.dump", snapshot, 0644); err != nil {
+		t.Fatalf("Failed to copy snapshot: %v", err)
+	}
+	engine.Set("kept", "after")
+	engine.Set("added", "after")
+	_, next, _ := engine.ChangeFeedBounds()
+
+	if err := engine.RestoreSnapshot("before-deploy.dump"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	var value string
+	if v, err := engine.Get("kept"); err != nil || json.Unmarshal(v, &value) != nil || value != "before" {
+		t.Errorf("kept = %s, %v", v, err)
+	}
+	if _, err := engine.Get("added"); err != ErrKeyNotFound {
+		t.Errorf("key written after the snapshot: %v", err)
+	}
+	// The restored keys are not in the feed, its readers have to start over
+	if _, _, err := engine.ReadChanges(next, 10); !errors.Is(err, ErrChangesLost) {
+		t.Errorf("ReadChanges after a restore: %v, want ErrChangesLost", err)
+	}
+
+	for _, name := range []string{"../memory.dump", "sub/memory.dump", ".."} {
+		if err := engine.RestoreSnapshot(name); !errors.Is(err, ErrInvalidSnapshotName) {
+			t.Errorf("RestoreSnapshot(%q): %v, want ErrInvalidSnapshotName", name, err)
+		}
+	}
+	if err := engine.RestoreSnapshot("missing.dump"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("RestoreSnapshot of a missing file: %v", err)
+	}
+}
+
+func TestMemoryEngine_RestoreSnapshotLog(t *testing.T) {
+	cfg := &config.Config{DumpPath: t.TempDir(), AofEnabled: true, AofFsync: FsyncAlways}
+	engine, err := NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create engine: %v", err)
+	}
+	engine.Set("kept", "before")
+	if err := engine.DumpToDisk(); err != nil {
+		t.Fatalf("DumpToDisk failed: %v", err)
+	}
+	snapshot, err := os.ReadFile(cfg.DumpPath + "/memory.dump")
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	os.WriteFile(cfg.DumpPath+"/before-deploy.dump", snapshot, 0644)
+	engine.Set("kept", "after")
+	engine.Set("added", "after")
+
+	if err := engine.RestoreSnapshot("before-deploy.dump"); err != nil {
+		t.Fatalf("RestoreSnapshot failed: %v", err)
+	}
+	engine.Set("late", "after")
+	engine.Close()
+	if _, err := os.Stat(cfg.DumpPath + "/memory.restore"); !os.IsNotExist(err) {
+		t.Errorf("copy of the restored snapshot was kept: %v", err)
+	}
+
+	check := func(engine *MemoryEngine) {
+		t.Helper()
+		var value string
+		if v, err := engine.Get("kept"); err != nil || json.Unmarshal(v, &value) != nil || value != "before" {
+			t.Errorf("kept = %s, %v", v, err)
+		}
+		if _, err := engine.Get("added"); err != ErrKeyNotFound {
+			t.Errorf("key written before the restore: %v", err)
+		}
+		if _, err := engine.Get("late"); err != nil {
+			t.Errorf("key written after the restore: %v", err)
+		}
+	}
+	engine, err = NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	check(engine)
+	engine.Set("kept", "after")
+	engine.Set("added", "after")
+	engine.Close()
+
+	// A crash after the restore was logged, before the new dump: the old
+	// snapshot and log are still there, the restore entry loads the copy
+	os.WriteFile(cfg.DumpPath+"/memory.restore", snapshot, 0644)
+	f, err := os.OpenFile(cfg.DumpPath+"/memory.aof", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	f.WriteString("{\"op\":\"restore\",\"expires_at\":\"0001-01-01T00:00:00Z\"}\n")
+	f.WriteString("{\"op\":\"set\",\"key\":\"late\",\"value\":\"MQ==\",\"expires_at\":\"0001-01-01T00:00:00Z\"}\n")
+	f.Close()
+
+	engine, err = NewMemoryEngine(cfg)
+	if err != nil {
+		t.Fatalf("Failed to reopen engine: %v", err)
+	}
+	check(engine)
+	engine.Close()
+
+	// The copy must be there for as long as the log refers to it
+	os.Remove(cfg.DumpPath + "/memory.restore")
+	if _, err := NewMemoryEngine(cfg); err == nil || !strings.Contains(err.Error(), "failed to load restored snapshot") {
+		t.Errorf("NewMemoryEngine without the restored snapshot copy: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package engine
+
+// Key events reported to a KeyEventFunc
+const (
+	EventSet     = "set"
+	EventDel     = "del"
+	EventExpired = "expired"
+	EventEvicted = "evicted"
+)
+
+// KeyEventFunc receives an event for every change of a key. It is called
+// with the key's shard locked, so it must not block nor call back into the
+// engine.
+type KeyEventFunc func(event, key string)
+
+// OnKeyEvent installs fn to receive key events, replacing any previous
+// function. A nil fn stops the events.
+func (me *MemoryEngine) OnKeyEvent(fn KeyEventFunc) {
+	if fn == nil {
+		me.keyEvents.Store(nil)
+		return
+	}
+	me.keyEvents.Store(&fn)
+}
+
+// notifyKey reports an event to the installed KeyEventFunc, if any.
+func (me *MemoryEngine) notifyKey(event, key string) {
+	if fn := me.keyEvents.Load(); fn != nil {
+		(*fn)(event, key)
+	}
+}
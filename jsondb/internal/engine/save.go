@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// snapshotFileName is the snapshot written by DumpToDisk in the dump directory
+	snapshotFileName = "memory.dump"
+	// restoreFileName is the copy of a snapshot being restored, loaded again
+	// by the restore entry of the append-only log until a new dump covers it
+	restoreFileName = "memory.restore"
+)
+
+var (
+	ErrSaveInProgress = errors.New("background save already in progress")
+	// ErrInvalidSnapshotName is returned for snapshot names that are not a
+	// plain file name in the dump directory
+	ErrInvalidSnapshotName = errors.New("invalid snapshot name")
+)
+
+// SaveStatus reports the snapshots written to disk.
+type SaveStatus struct {
+	// InProgress is set while a background save runs
+	InProgress bool
+	// LastSave is the time of the last successful save, zero before the first
+	LastSave time.Time
+	// LastBackgroundErr is the error of the last background save, nil when
+	// it succeeded or none ran
+	LastBackgroundErr error
+}
+
+// BackgroundSave writes a snapshot like DumpToDisk without waiting for it.
+// Shards are locked for reading one at a time, so writes carry on meanwhile.
+// Only one background save runs at a time; SaveStatus reports the outcome.
+func (me *MemoryEngine) BackgroundSave() error {
+	if !me.saving.CompareAndSwap(false, true) {
+		return ErrSaveInProgress
+	}
+	go func() {
+		err := me.DumpToDisk()
+		if err != nil {
+			log.Printf("Background save failed: %v", err)
+		}
+		me.saveMu.Lock()
+		me.bgsaveErr = err
+		me.saveMu.Unlock()
+		me.saving.Store(false)
+	}()
+	return nil
+}
+
+// SaveStatus returns the state of the snapshots written to disk.
+func (me *MemoryEngine) SaveStatus() SaveStatus {
+	status := SaveStatus{InProgress: me.saving.Load()}
+	if lastSave := me.lastSave.Load(); lastSave != 0 {
+		status.LastSave = time.Unix(0, lastSave)
+	}
+	me.saveMu.Lock()
+	status.LastBackgroundErr = me.bgsaveErr
+	me.saveMu.Unlock()
+	return status
+}
+
+// RestoreSnapshot replaces the data with the snapshot file name in the dump
+// directory, an empty name standing for the one DumpToDisk writes.
+//
+// With the append-only log enabled the restore has to survive a crash as a
+// whole: the snapshot is copied to restoreFileName and a restore entry is
+// logged as the data is swapped, so a replay yields either the old data or
+// the restored one with the writes made after it. A new snapshot then folds
+// the log and the copy is dropped.
+func (me *MemoryEngine) RestoreSnapshot(name string) error {
+	if name == "" {
+		name = snapshotFileName
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." || name == restoreFileName {
+		return fmt.Errorf("%w: %s", ErrInvalidSnapshotName, name)
+	}
+	if me.aof == nil {
+		shards, err := me.readSnapshotFile(filepath.Join(me.dumpPath, name))
+		if err != nil {
+			return err
+		}
+		me.replaceShards(shards)
+		return nil
+	}
+
+	me.restoreMu.Lock()
+	defer me.restoreMu.Unlock()
+
+	restorePath := filepath.Join(me.dumpPath, restoreFileName)
+	if _, err := os.Stat(restorePath); err == nil {
+		// The log may still refer to the copy of an earlier restore, it
+		// must not be replaced before a dump folds that restore
+		if err := me.DumpToDisk(); err != nil {
+			return err
+		}
+	}
+	if err := copySnapshot(restorePath, filepath.Join(me.dumpPath, name)); err != nil {
+		return err
+	}
+	shards, err := me.readSnapshotFile(restorePath)
+	if err != nil {
+		os.Remove(restorePath)
+		return err
+	}
+
+	// The restore is logged with every shard locked, as a reset is, so no
+	// write lands between the log entry and the swap
+	me.lockShards()
+	err = me.logMutation(logEntry{Op: opRestore})
+	if err == nil {
+		err = me.aof.sync()
+	}
+	if err != nil {
+		me.unlockShards()
+		return err
+	}
+	me.swapShards(shards)
+	me.unlockShards()
+	me.rebuildIndexes()
+
+	if err := me.DumpToDisk(); err != nil {
+		return err
+	}
+	if err := os.Remove(restorePath); err != nil {
+		return fmt.Errorf("failed to remove restored snapshot copy: %v", err)
+	}
+	return nil
+}
+
+// copySnapshot copies the snapshot at src to dst, replacing dst only once the
+// copy is complete on disk.
+func copySnapshot(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer in.Close()
+
+	tmpFile := dst + ".tmp"
+	out, err := os.OpenFile(tmpFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot copy: %v", err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy snapshot: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync snapshot copy: %v", err)
+	}
+	if err := os.Rename(tmpFile, dst); err != nil {
+		return fmt.Errorf("failed to rename snapshot copy: %v", err)
+	}
+	return nil
+}
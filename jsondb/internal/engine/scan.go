@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A scan cursor packs the shard index into the top 16 bits and a 48 bit key
+// hash into the rest. Keys of a shard are visited in hash order, so the cursor
+// stays valid while keys are added and removed: every key that exists for the
+// whole scan is returned exactly once, keys added or removed meanwhile may or
+// may not be. A returned cursor of 0 means the scan is complete.
+const (
+	cursorHashBits = 48
+	cursorHashMask = 1<<cursorHashBits - 1
+	// maxShards is the number of shards the cursor can tell apart
+	maxShards = 1 << (64 - cursorHashBits)
+
+	// DefaultScanCount is the number of keys examined per call when no
+	// COUNT is given.
+	DefaultScanCount = 10
+)
+
+func scanHash(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64() & cursorHashMask
+}
+
+type scanKey struct {
+	hash uint64
+	key  string
+}
+
+func newScanKey(key string) scanKey {
+	return scanKey{hash: scanHash(key), key: key}
+}
+
+func compareScanKeys(a, b scanKey) int {
+	switch {
+	case a.hash < b.hash:
+		return -1
+	case a.hash > b.hash:
+		return 1
+	}
+	return strings.Compare(a.key, b.key)
+}
+
+// rebuildScanOrder recreates the scan order from the shard's keys.
+// The caller must hold the shard's write lock.
+func (s *engineShard) rebuildScanOrder() {
+	s.order = newSkipList(compareScanKeys)
+	for key := range s.data {
+		s.order.insert(newScanKey(key))
+	}
+}
+
+// Scan examines about count keys starting at cursor and returns the ones
+// matching the glob pattern (all keys when pattern is empty) together with
+// the cursor to continue from. Each shard keeps its keys in hash order as
+// they are written, so a call seeks to the cursor and only walks the keys it
+// examines; values are never decoded.
+func (me *MemoryEngine) Scan(cursor uint64, pattern string, count int) (uint64, []string) {
+	if count <= 0 {
+		count = DefaultScanCount
+	}
+
+	shardIndex := int(cursor >> cursorHashBits)
+	start := cursor & cursorHashMask
+	now := time.Now()
+
+	var keys []string
+	examined := 0
+	for shardIndex < me.numShards && examined < count {
+		shard := me.shards[shardIndex]
+
+		shard.mu.RLock()
+		node := shard.order.search(func(candidate scanKey) bool { return candidate.hash >= start })
+		var previous uint64
+		for ; node != nil; node = node.next[0] {
+			// Keys sharing a hash are always returned together, the cursor
+			// cannot point between them
+			if examined >= count && node.item.hash != previous {
+				break
+			}
+			previous = node.item.hash
+			examined++
+			if data := shard.data[node.item.key]; data.isExpired(now) {
+				continue
+			}
+			if pattern == "" || matchGlob(pattern, node.item.key) {
+				keys = append(keys, node.item.key)
+			}
+		}
+		next, more := uint64(0), node != nil
+		if more {
+			next = node.item.hash
+		}
+		shard.mu.RUnlock()
+
+		if more {
+			return uint64(shardIndex)<<cursorHashBits | next, keys
+		}
+		shardIndex++
+		start = 0
+	}
+
+	if shardIndex >= me.numShards {
+		return 0, keys
+	}
+	return uint64(shardIndex) << cursorHashBits, keys
+}
+
+// Keys returns every live key matching the glob pattern in sorted order.
+func (me *MemoryEngine) Keys(pattern string) []string {
+	prefix := globPrefix(pattern)
+	now := time.Now()
+
+	var keys []string
+	for _, shard := range me.shards {
+		shard.mu.RLock()
+		for key, data := range shard.data {
+			if data.isExpired(now) || !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if matchGlob(pattern, key) {
+				keys = append(keys, key)
+			}
+		}
+		shard.mu.RUnlock()
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"math/bits"
+	"math/rand"
+)
+
+// Levels of a skip list: with a quarter of the nodes promoted at each level,
+// 16 levels keep lookups logarithmic up to billions of items.
+const skipListMaxLevel = 16
+
+// skipList keeps items ordered by compare with O(log n) inserts, deletes and
+// searches, where a sorted slice would shift its tail on every update. It is
+// not safe for concurrent use.
+type skipList[T any] struct {
+	compare func(a, b T) int
+	head    skipNode[T]
+	level   int
+	length  int
+}
+
+type skipNode[T any] struct {
+	item T
+	next []*skipNode[T]
+}
+
+func newSkipList[T any](compare func(a, b T) int) *skipList[T] {
+	return &skipList[T]{
+		compare: compare,
+		head:    skipNode[T]{next: make([]*skipNode[T], skipListMaxLevel)},
+		level:   1,
+	}
+}
+
+// Len returns the number of items.
+func (l *skipList[T]) Len() int {
+	return l.length
+}
+
+// path fills update with the last node before the first item for which
+// found is true, at every level, and returns that item's node or nil.
+// found must be false for a prefix of the items and true for the rest.
+func (l *skipList[T]) path(found func(T) bool, update []*skipNode[T]) *skipNode[T] {
+	node := &l.head
+	for level := l.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && !found(node.next[level].item) {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+// search returns the node of the first item for which found is true, like
+// sort.Search, or nil when there is none.
+func (l *skipList[T]) search(found func(T) bool) *skipNode[T] {
+	return l.path(found, nil)
+}
+
+// first returns the node of the smallest item, or nil when the list is empty.
+func (l *skipList[T]) first() *skipNode[T] {
+	return l.head.next[0]
+}
+
+// insert adds item, replacing an equal one.
+func (l *skipList[T]) insert(item T) {
+	var update [skipListMaxLevel]*skipNode[T]
+	node := l.path(func(other T) bool { return l.compare(other, item) >= 0 }, update[:])
+	if node != nil && l.compare(node.item, item) == 0 {
+		node.item = item
+		return
+	}
+
+	level := randomSkipLevel()
+	for ; l.level < level; l.level++ {
+		update[l.level] = &l.head
+	}
+	node = &skipNode[T]{item: item, next: make([]*skipNode[T], level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	l.length++
+}
+
+// delete removes the item equal to item and reports whether there was one.
+func (l *skipList[T]) delete(item T) bool {
+	var update [skipListMaxLevel]*skipNode[T]
+	node := l.path(func(other T) bool { return l.compare(other, item) >= 0 }, update[:])
+	if node == nil || l.compare(node.item, item) != 0 {
+		return false
+	}
+
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+	return true
+}
+
+// randomSkipLevel picks the level of a new node, each level a quarter as
+// likely as the one below.
+func randomSkipLevel() int {
+	level := 1 + bits.TrailingZeros64(rand.Uint64()|1<<(2*skipListMaxLevel))/2
+	if level > skipListMaxLevel {
+		return skipListMaxLevel
+	}
+	return level
+}
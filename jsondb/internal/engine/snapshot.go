@@ -0,0 +1,395 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// Binary snapshot layout (version 2), all integers big endian:
+//
+//	header: magic "JSDBSNAP" | version uint16 | flags uint16 | timestamp int64 (unix nanos)
+//	block:  'B' | record count uint32 | payload length uint32 | payload | crc32 of payload
+//	footer: 'E' | total records uint64 | crc32 over all block payloads
+//
+// A record inside a block payload is
+//
+//	key length uvarint | key | value length uvarint | value | expires at varint (unix nanos, 0 = none)
+//
+// Values are stored as the engine holds them, encrypted when encryption is
+// enabled, unless the header has flagPlainValues, see WritePlainSnapshot.
+const (
+	snapshotMagic   = "JSDBSNAP"
+	snapshotVersion = 2
+
+	flagPlainValues = 1 << 0
+
+	blockMarker  = 'B'
+	footerMarker = 'E'
+
+	// maxBlockSize is the payload size after which a block is closed
+	maxBlockSize = 64 * 1024
+	// maxBlockPayload is the largest block payload read. A block is closed
+	// after the record that crosses maxBlockSize, so it holds at most one
+	// large value, and no client can send a value of 512MB or more.
+	maxBlockPayload = 1 << 30
+)
+
+var (
+	ErrCorruptSnapshot     = errors.New("corrupt snapshot")
+	ErrUnsupportedSnapshot = errors.New("unsupported snapshot version")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type snapshotBlock struct {
+	count   uint32
+	payload []byte
+}
+
+type snapshotWriter struct {
+	w       *bufio.Writer
+	block   bytes.Buffer
+	count   uint32
+	pending []snapshotBlock
+	total   uint64
+	crc     uint32
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func newSnapshotWriter(w io.Writer, timestamp time.Time, flags uint16) (*snapshotWriter, error) {
+	sw := &snapshotWriter{w: bufio.NewWriter(w)}
+
+	header := make([]byte, 0, len(snapshotMagic)+12)
+	header = append(header, snapshotMagic...)
+	header = binary.BigEndian.AppendUint16(header, snapshotVersion)
+	header = binary.BigEndian.AppendUint16(header, flags)
+	header = binary.BigEndian.AppendUint64(header, uint64(timestamp.UnixNano()))
+	if _, err := sw.w.Write(header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// addRecord encodes a record into the current block. It does no I/O, so it
+// can be called while a shard lock is held.
+func (sw *snapshotWriter) addRecord(key string, data *KeyData) {
+	n := binary.PutUvarint(sw.scratch[:], uint64(len(key)))
+	sw.block.Write(sw.scratch[:n])
+	sw.block.WriteString(key)
+
+	n = binary.PutUvarint(sw.scratch[:], uint64(len(data.Value)))
+	sw.block.Write(sw.scratch[:n])
+	sw.block.Write(data.Value)
+
+	var expiresAt int64
+	if !data.ExpiresAt.IsZero() {
+		expiresAt = data.ExpiresAt.UnixNano()
+	}
+	n = binary.PutVarint(sw.scratch[:], expiresAt)
+	sw.block.Write(sw.scratch[:n])
+
+	sw.count++
+	if sw.block.Len() >= maxBlockSize {
+		sw.sealBlock()
+	}
+}
+
+func (sw *snapshotWriter) sealBlock() {
+	if sw.count == 0 {
+		return
+	}
+	sw.pending = append(sw.pending, snapshotBlock{
+		count:   sw.count,
+		payload: append([]byte(nil), sw.block.Bytes()...),
+	})
+	sw.count = 0
+	sw.block.Reset()
+}
+
+// flush writes every block encoded so far.
+func (sw *snapshotWriter) flush() error {
+	sw.sealBlock()
+
+	for _, block := range sw.pending {
+		header := make([]byte, 0, 9)
+		header = append(header, blockMarker)
+		header = binary.BigEndian.AppendUint32(header, block.count)
+		header = binary.BigEndian.AppendUint32(header, uint32(len(block.payload)))
+		if _, err := sw.w.Write(header); err != nil {
+			return err
+		}
+		if _, err := sw.w.Write(block.payload); err != nil {
+			return err
+		}
+		if _, err := sw.w.Write(binary.BigEndian.AppendUint32(nil, crc32.Checksum(block.payload, castagnoli))); err != nil {
+			return err
+		}
+
+		sw.crc = crc32.Update(sw.crc, castagnoli, block.payload)
+		sw.total += uint64(block.count)
+	}
+	sw.pending = sw.pending[:0]
+	return nil
+}
+
+func (sw *snapshotWriter) close() error {
+	if err := sw.flush(); err != nil {
+		return err
+	}
+
+	footer := make([]byte, 0, 13)
+	footer = append(footer, footerMarker)
+	footer = binary.BigEndian.AppendUint64(footer, sw.total)
+	footer = binary.BigEndian.AppendUint32(footer, sw.crc)
+	if _, err := sw.w.Write(footer); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// WriteSnapshot streams every live key to w in the binary snapshot format.
+// Shards are encoded one at a time, so only one shard is ever held in memory
+// and writers are blocked only for the shard being copied.
+func (me *MemoryEngine) WriteSnapshot(w io.Writer) error {
+	return me.streamSnapshot(w, false)
+}
+
+// WritePlainSnapshot is WriteSnapshot with every value decrypted, for an
+// engine that does not share this one's encryption keys, such as a
+// replication follower. LoadSnapshot encrypts the values again with the
+// loading engine's current key.
+func (me *MemoryEngine) WritePlainSnapshot(w io.Writer) error {
+	return me.streamSnapshot(w, true)
+}
+
+func (me *MemoryEngine) streamSnapshot(w io.Writer, plain bool) error {
+	var flags uint16
+	if plain {
+		flags |= flagPlainValues
+	}
+	sw, err := newSnapshotWriter(w, time.Now(), flags)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot header: %v", err)
+	}
+
+	for _, shard := range me.shards {
+		now := time.Now()
+		shard.mu.RLock()
+		for key, data := range shard.data {
+			if data.isExpired(now) {
+				continue
+			}
+			if plain {
+				value, err := me.decodeValue(key, data.Value)
+				if err != nil {
+					shard.mu.RUnlock()
+					return fmt.Errorf("failed to decrypt value for key %s: %v", key, err)
+				}
+				data = &KeyData{Value: value, ExpiresAt: data.ExpiresAt}
+			}
+			sw.addRecord(key, data)
+		}
+		shard.mu.RUnlock()
+
+		// Blocks are written once the shard lock is released
+		if err := sw.flush(); err != nil {
+			return fmt.Errorf("failed to write snapshot: %v", err)
+		}
+	}
+
+	if err := sw.close(); err != nil {
+		return fmt.Errorf("failed to write snapshot footer: %v", err)
+	}
+	return nil
+}
+
+// LoadSnapshot replaces the engine contents with a snapshot read from r.
+// Both the binary format and version 1 JSON dumps are accepted. Nothing is
+// replaced unless the whole snapshot is read and verified.
+func (me *MemoryEngine) LoadSnapshot(r io.Reader) error {
+	shards, err := me.readSnapshot(r)
+	if err != nil {
+		return err
+	}
+
+	me.replaceShards(shards)
+	return nil
+}
+
+// readSnapshot decodes a snapshot into shards without loading it.
+func (me *MemoryEngine) readSnapshot(r io.Reader) ([]map[string]*KeyData, error) {
+	reader := bufio.NewReader(r)
+
+	magic, err := reader.Peek(len(snapshotMagic))
+	if err != nil || string(magic) != snapshotMagic {
+		// Anything that is not a binary snapshot is treated as a version 1 JSON dump
+		return me.readJSONDump(reader)
+	}
+	return me.readBinarySnapshot(reader)
+}
+
+// readSnapshotFile decodes the snapshot at path, see readSnapshot.
+func (me *MemoryEngine) readSnapshotFile(path string) ([]map[string]*KeyData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer file.Close()
+
+	return me.readSnapshot(file)
+}
+
+func (me *MemoryEngine) readBinarySnapshot(reader *bufio.Reader) ([]map[string]*KeyData, error) {
+	header := make([]byte, len(snapshotMagic)+12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("%w: short header", ErrCorruptSnapshot)
+	}
+	version := binary.BigEndian.Uint16(header[len(snapshotMagic):])
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedSnapshot, version)
+	}
+	plain := binary.BigEndian.Uint16(header[len(snapshotMagic)+2:])&flagPlainValues != 0
+
+	shards := make([]map[string]*KeyData, me.numShards)
+	for i := range shards {
+		shards[i] = make(map[string]*KeyData)
+	}
+
+	now := time.Now()
+	var total uint64
+	var crc uint32
+	var payload bytes.Buffer
+	for {
+		marker, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: missing footer", ErrCorruptSnapshot)
+		}
+
+		if marker == footerMarker {
+			footer := make([]byte, 12)
+			if _, err := io.ReadFull(reader, footer); err != nil {
+				return nil, fmt.Errorf("%w: short footer", ErrCorruptSnapshot)
+			}
+			if binary.BigEndian.Uint64(footer) != total || binary.BigEndian.Uint32(footer[8:]) != crc {
+				return nil, fmt.Errorf("%w: footer checksum mismatch", ErrCorruptSnapshot)
+			}
+			return shards, nil
+		}
+		if marker != blockMarker {
+			return nil, fmt.Errorf("%w: unexpected marker %q", ErrCorruptSnapshot, marker)
+		}
+
+		blockHeader := make([]byte, 8)
+		if _, err := io.ReadFull(reader, blockHeader); err != nil {
+			return nil, fmt.Errorf("%w: short block header", ErrCorruptSnapshot)
+		}
+		count := binary.BigEndian.Uint32(blockHeader)
+		size := binary.BigEndian.Uint32(blockHeader[4:])
+
+		if size > maxBlockPayload {
+			return nil, fmt.Errorf("%w: block of %d bytes", ErrCorruptSnapshot, size)
+		}
+
+		// The buffer grows as the block arrives, a truncated snapshot does
+		// not allocate the size it announces
+		payload.Reset()
+		if _, err := io.CopyN(&payload, reader, int64(size)+4); err != nil {
+			return nil, fmt.Errorf("%w: short block", ErrCorruptSnapshot)
+		}
+		records := payload.Bytes()[:size]
+		if crc32.Checksum(records, castagnoli) != binary.BigEndian.Uint32(payload.Bytes()[size:]) {
+			return nil, fmt.Errorf("%w: block checksum mismatch", ErrCorruptSnapshot)
+		}
+		crc = crc32.Update(crc, castagnoli, records)
+		total += uint64(count)
+
+		if err := me.decodeBlock(records, count, plain, shards, now); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// decodeBlock adds the records of one block to shards, encrypting plain
+// values. Keys are placed with getShard, so a snapshot can be loaded with any
+// shard count.
+func (me *MemoryEngine) decodeBlock(records []byte, count uint32, plain bool, shards []map[string]*KeyData, now time.Time) error {
+	for i := uint32(0); i < count; i++ {
+		keyLen, n := binary.Uvarint(records)
+		if n <= 0 || uint64(len(records)-n) < keyLen {
+			return fmt.Errorf("%w: bad key length", ErrCorruptSnapshot)
+		}
+		records = records[n:]
+		key := string(records[:keyLen])
+		records = records[keyLen:]
+
+		valueLen, n := binary.Uvarint(records)
+		if n <= 0 || uint64(len(records)-n) < valueLen {
+			return fmt.Errorf("%w: bad value length", ErrCorruptSnapshot)
+		}
+		records = records[n:]
+		value := append([]byte(nil), records[:valueLen]...)
+		records = records[valueLen:]
+
+		expiresAtNanos, n := binary.Varint(records)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad expiry", ErrCorruptSnapshot)
+		}
+		records = records[n:]
+
+		data := &KeyData{Value: value}
+		if expiresAtNanos != 0 {
+			data.ExpiresAt = time.Unix(0, expiresAtNanos)
+			if data.isExpired(now) {
+				continue
+			}
+		}
+		if plain {
+			stored, err := me.encryptValue(key, value)
+			if err != nil {
+				return err
+			}
+			data.Value = stored
+		}
+		shards[me.shardIndex(key)][key] = data
+	}
+
+	if len(records) != 0 {
+		return fmt.Errorf("%w: trailing bytes in block", ErrCorruptSnapshot)
+	}
+	return nil
+}
+
+// readJSONDump decodes a version 1 JSON dump. The shard index recorded in
+// the dump is ignored and every key is rehashed, since the dump may come from
+// an engine with a different shard count.
+func (me *MemoryEngine) readJSONDump(reader io.Reader) ([]map[string]*KeyData, error) {
+	var dump DumpData
+	decoder := json.NewDecoder(reader)
+	if err := decoder.Decode(&dump); err != nil {
+		return nil, fmt.Errorf("failed to decode dump: %w", err)
+	}
+
+	now := time.Now()
+	shards := make([]map[string]*KeyData, me.numShards)
+	for i := range shards {
+		shards[i] = make(map[string]*KeyData)
+	}
+	for _, shardData := range dump.Shards {
+		for k, v := range shardData {
+			// Skip expired keys
+			if v.isExpired(now) {
+				continue
+			}
+			shards[me.shardIndex(k)][k] = v
+		}
+	}
+	return shards, nil
+}
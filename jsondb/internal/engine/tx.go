@@ -0,0 +1,251 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrKeyNotLocked = errors.New("key was not declared for the transaction")
+
+// Keyspace holds the single key operations shared by the engine and by a
+// transaction, so commands can be run against either.
+type Keyspace interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value interface{}) error
+	SetWithTTL(key string, value []byte, ttl time.Duration) error
+	SetIf(key string, value []byte, expiresAt time.Time, cond SetCondition, version uint64) (bool, error)
+	GetSet(key string, value []byte) ([]byte, error)
+	GetDel(key string) ([]byte, error)
+	Delete(key string) error
+	MGet(keys []string) ([][]byte, error)
+	MSet(keys []string, values [][]byte) error
+	MDelete(keys []string) (int, error)
+	TTL(key string) (time.Duration, error)
+	ExpireAt(key string, expiresAt time.Time) (bool, error)
+	Persist(key string) (bool, error)
+	Version(key string) uint64
+	JSONGet(key, path string) ([]byte, error)
+	JSONSet(key, path string, value []byte) error
+	JSONDel(key, path string) (int, error)
+	JSONArrAppend(key, path string, values ...[]byte) (int, error)
+	JSONNumIncrBy(key, path string, delta json.Number) ([]byte, error)
+}
+
+var (
+	_ Keyspace = (*MemoryEngine)(nil)
+	_ Keyspace = (*Tx)(nil)
+)
+
+// shardLocker runs fn with the shard holding key locked for writing. The
+// engine takes the lock around fn, a Tx hands out shards it already holds,
+// so each operation is written once for both.
+type shardLocker interface {
+	withShard(key string, fn func(shard *engineShard) error) error
+	// reserve is called before a write that may grow memory, see eviction.go
+	reserve() error
+}
+
+func (me *MemoryEngine) withShard(key string, fn func(shard *engineShard) error) error {
+	shard := me.getShard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return fn(shard)
+}
+
+// Tx gives access to a fixed set of keys whose shards are all locked, see
+// Atomic. It is only valid while the function passed to Atomic runs.
+type Tx struct {
+	me     *MemoryEngine
+	shards map[int]*engineShard
+}
+
+// Atomic locks the shards of every key, runs fn and releases them. No other
+// client observes the keys between the operations fn performs. Shards are
+// always locked in ascending order, so concurrent calls cannot deadlock.
+func (me *MemoryEngine) Atomic(keys []string, fn func(tx *Tx) error) error {
+	// Keys cannot be evicted once the shards are locked, make room first
+	me.evictToLimit()
+
+	tx := &Tx{me: me, shards: make(map[int]*engineShard)}
+	for _, key := range keys {
+		index := me.shardIndex(key)
+		tx.shards[index] = me.shards[index]
+	}
+
+	order := make([]int, 0, len(tx.shards))
+	for index := range tx.shards {
+		order = append(order, index)
+	}
+	sort.Ints(order)
+
+	for _, index := range order {
+		me.shards[index].mu.Lock()
+	}
+	defer func() {
+		tx.shards = nil
+		for i := len(order) - 1; i >= 0; i-- {
+			me.shards[order[i]].mu.Unlock()
+		}
+	}()
+
+	return fn(tx)
+}
+
+func (tx *Tx) withShard(key string, fn func(shard *engineShard) error) error {
+	shard, ok := tx.shards[tx.me.shardIndex(key)]
+	if !ok {
+		return ErrKeyNotLocked
+	}
+	return fn(shard)
+}
+
+func (tx *Tx) Get(key string) ([]byte, error) {
+	var stored []byte
+	err := tx.withShard(key, func(shard *engineShard) error {
+		data, exists := tx.me.liveKey(shard, key)
+		if !exists {
+			return ErrKeyNotFound
+		}
+		stored = data.Value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tx.me.decodeValue(key, stored)
+}
+
+func (tx *Tx) Set(key string, value interface{}) error {
+	stored, err := tx.me.encodeValue(key, value)
+	if err != nil {
+		return err
+	}
+	return tx.me.storeValue(tx, key, stored, time.Time{})
+}
+
+func (tx *Tx) SetWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New("TTL must be positive")
+	}
+	stored, err := tx.me.encodeValue(key, value)
+	if err != nil {
+		return err
+	}
+	return tx.me.storeValue(tx, key, stored, time.Now().Add(ttl))
+}
+
+func (tx *Tx) SetIf(key string, value []byte, expiresAt time.Time, cond SetCondition, version uint64) (bool, error) {
+	return tx.me.setIf(tx, key, value, expiresAt, cond, version)
+}
+
+func (tx *Tx) GetSet(key string, value []byte) ([]byte, error) {
+	return tx.me.getSet(tx, key, value)
+}
+
+func (tx *Tx) GetDel(key string) ([]byte, error) {
+	return tx.me.getDel(tx, key)
+}
+
+func (tx *Tx) Delete(key string) error {
+	return tx.me.delete(tx, key)
+}
+
+func (tx *Tx) MGet(keys []string) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		value, err := tx.Get(key)
+		if err != nil && err != ErrKeyNotFound {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (tx *Tx) MSet(keys []string, values [][]byte) error {
+	if len(keys) != len(values) {
+		return errors.New("keys and values differ in length")
+	}
+	encoded := make([][]byte, len(values))
+	for i, value := range values {
+		stored, err := tx.me.encodeValue(keys[i], value)
+		if err != nil {
+			return err
+		}
+		encoded[i] = stored
+	}
+	for i, key := range keys {
+		if err := tx.me.storeValue(tx, key, encoded[i], time.Time{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *Tx) MDelete(keys []string) (int, error) {
+	deleted := 0
+	for _, key := range keys {
+		err := tx.withShard(key, func(shard *engineShard) error {
+			if _, exists := tx.me.liveKey(shard, key); !exists {
+				return nil
+			}
+			if err := tx.me.logMutation(logEntry{Op: opDel, Key: key}); err != nil {
+				return err
+			}
+			deleted++
+			tx.me.removeKey(shard, key)
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+func (tx *Tx) TTL(key string) (time.Duration, error) {
+	return tx.me.ttl(tx, key)
+}
+
+func (tx *Tx) ExpireAt(key string, expiresAt time.Time) (bool, error) {
+	return tx.me.expireAt(tx, key, expiresAt)
+}
+
+func (tx *Tx) Persist(key string) (bool, error) {
+	return tx.me.persist(tx, key)
+}
+
+// Version returns the current version of a key, or 0 when it does not exist
+// or its shard is not held by the transaction.
+func (tx *Tx) Version(key string) uint64 {
+	var version uint64
+	tx.withShard(key, func(shard *engineShard) error {
+		if data, exists := shard.data[key]; exists && !data.isExpired(time.Now()) {
+			version = data.Version
+		}
+		return nil
+	})
+	return version
+}
+
+func (tx *Tx) JSONGet(key, path string) ([]byte, error) {
+	return tx.me.jsonGet(tx, key, path)
+}
+
+func (tx *Tx) JSONSet(key, path string, value []byte) error {
+	return tx.me.jsonSet(tx, key, path, value)
+}
+
+func (tx *Tx) JSONDel(key, path string) (int, error) {
+	return tx.me.jsonDel(tx, key, path)
+}
+
+func (tx *Tx) JSONArrAppend(key, path string, values ...[]byte) (int, error) {
+	return tx.me.jsonArrAppend(tx, key, path, values...)
+}
+
+func (tx *Tx) JSONNumIncrBy(key, path string, delta json.Number) ([]byte, error) {
+	return tx.me.jsonNumIncrBy(tx, key, path, delta)
+}
@@ -0,0 +1,730 @@
+package server
+
+import (
+    "bufio"
+    "crypto/sha256"
+    "crypto/subtle"
+    "errors"
+    "fmt"
+    "jsondb/internal/config"
+    "jsondb/internal/engine"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// Built-in users, see newACLStore
+const (
+    defaultUser = "default"
+    adminUser   = "admin"
+)
+
+// Command categories a user can be granted with +@category
+const (
+    categoryRead   = "read"
+    categoryWrite  = "write"
+    categoryAdmin  = "admin"
+    categoryPubsub = "pubsub"
+)
+
+var aclCategories = []string{categoryRead, categoryWrite, categoryAdmin, categoryPubsub}
+
+// Access to the keys matching a key pattern
+const (
+    keyRead = 1 << iota
+    keyWrite
+)
+
+var errNoPermission = errors.New("no permission")
+
+// commandSpec is the category of a command and the access it needs to the
+// keys it names, found with transactionKeys.
+type commandSpec struct {
+    category string
+    keys     int
+    // allKeys commands expose every key, such as the change feed
+    allKeys bool
+}
+
+// commandSpecs lists the commands that need a permission. Commands missing
+// here, such as PING or MULTI, are allowed to every authenticated user.
+var commandSpecs = map[string]commandSpec{
+    "GET": {categoryRead, keyRead, false}, "MGET": {categoryRead, keyRead, false},
+    "VERSION": {categoryRead, keyRead, false}, "TTL": {categoryRead, keyRead, false},
+    "PTTL": {categoryRead, keyRead, false}, "JSON.GET": {categoryRead, keyRead, false},
+    "WATCH": {categoryRead, keyRead, false},
+    // Replies listing keys are filtered instead, see filterKeys
+    "KEYS": {categoryRead, 0, false}, "SCAN": {categoryRead, 0, false}, "QUERY": {categoryRead, 0, false},
+    "INDEX.LIST": {categoryRead, 0, false}, "INFO": {categoryRead, 0, false}, "ROLE": {categoryRead, 0, false},
+    "WATCHFEED": {categoryRead, keyRead, true}, "PSYNC": {categoryRead, keyRead, true},
+
+    "SET": {categoryWrite, keyWrite, false}, "DELETE": {categoryWrite, keyWrite, false},
+    "DEL": {categoryWrite, keyWrite, false}, "MSET": {categoryWrite, keyWrite, false},
+    "MDEL": {categoryWrite, keyWrite, false}, "EXPIRE": {categoryWrite, keyWrite, false},
+    "PEXPIRE": {categoryWrite, keyWrite, false}, "PERSIST": {categoryWrite, keyWrite, false},
+    "JSON.SET": {categoryWrite, keyWrite, false}, "JSON.DEL": {categoryWrite, keyWrite, false},
+    "JSON.ARRAPPEND": {categoryWrite, keyWrite, false},
+    // These also return the value they replace or compute
+    "GETSET": {categoryWrite, keyRead | keyWrite, false}, "GETDEL": {categoryWrite, keyRead | keyWrite, false},
+    "JSON.NUMINCRBY": {categoryWrite, keyRead | keyWrite, false},
+
+    "FLUSHALL": {categoryAdmin, 0, false}, "RESET_MEMORY": {categoryAdmin, 0, false},
+    "SAVE": {categoryAdmin, 0, false}, "BGSAVE": {categoryAdmin, 0, false},
+    "LASTSAVE": {categoryAdmin, 0, false}, "RESTORE": {categoryAdmin, 0, false},
+    "REPLICAOF": {categoryAdmin, 0, false}, "INDEX.CREATE": {categoryAdmin, 0, false},
+    "INDEX.DROP": {categoryAdmin, 0, false}, "REENCRYPT": {categoryAdmin, 0, false},
+    "ACL": {categoryAdmin, 0, false},
+
+    "PUBLISH": {categoryPubsub, 0, false}, "SUBSCRIBE": {categoryPubsub, 0, false},
+    "PSUBSCRIBE": {categoryPubsub, 0, false}, "UNSUBSCRIBE": {categoryPubsub, 0, false},
+    "PUNSUBSCRIBE": {categoryPubsub, 0, false},
+}
+
+// keyPattern grants access to the keys matching a glob pattern.
+type keyPattern struct {
+    pattern string
+    access  int
+}
+
+// aclUser is a named user with its passwords, stored as salted hashes (see
+// hashPassword), and permissions. A stored user is never modified, ACL
+// SETUSER stores a copy.
+type aclUser struct {
+    name       string
+    enabled    bool
+    nopass     bool
+    passwords  []string
+    categories map[string]bool
+    keys       []keyPattern
+    // config is the password of a built-in user set in the configuration
+    config *configPassword
+}
+
+// configPassword is SERVER_PASSWORD or ADMIN_PASSWORD. The configuration
+// holds it in clear anyway, so it is compared in constant time instead of
+// through the key derivation, which keeps it from slowing down startup and
+// every login. It is only hashed once the user is listed or saved.
+type configPassword struct {
+    digest     [sha256.Size]byte
+    password   string
+    iterations int
+    hashOnce   sync.Once
+    hash       string
+    hashErr    error
+}
+
+func newConfigPassword(password string, iterations int) *configPassword {
+    return &configPassword{digest: sha256.Sum256([]byte(password)), password: password, iterations: iterations}
+}
+
+func (c *configPassword) matches(password string) bool {
+    digest := sha256.Sum256([]byte(password))
+    return subtle.ConstantTimeCompare(c.digest[:], digest[:]) == 1
+}
+
+// hashed returns the password hashed as by the > rule.
+func (c *configPassword) hashed() (string, error) {
+    c.hashOnce.Do(func() {
+        c.hash, c.hashErr = hashPassword(c.password, c.iterations)
+    })
+    return c.hash, c.hashErr
+}
+
+func (u *aclUser) clone() *aclUser {
+    c := *u
+    c.passwords = append([]string(nil), u.passwords...)
+    c.keys = append([]keyPattern(nil), u.keys...)
+    c.categories = make(map[string]bool, len(u.categories))
+    for category := range u.categories {
+        c.categories[category] = true
+    }
+    return &c
+}
+
+// matchingPasswords returns the stored hashes password matches.
+func (u *aclUser) matchingPasswords(password string) []string {
+    var matching []string
+    for _, stored := range u.passwords {
+        if hash, ok := parsePasswordHash(stored); ok && hash.matches(password) {
+            matching = append(matching, stored)
+        }
+    }
+    return matching
+}
+
+// canAccess reports whether the user has every access in access to key.
+// Read and write may come from different patterns.
+func (u *aclUser) canAccess(key string, access int) bool {
+    var granted int
+    for _, kp := range u.keys {
+        if kp.access&access != 0 && engine.MatchGlob(kp.pattern, key) {
+            granted |= kp.access
+        }
+    }
+    return granted&access == access
+}
+
+// canAccessAll reports whether the user has access to every key.
+func (u *aclUser) canAccessAll(access int) bool {
+    var granted int
+    for _, kp := range u.keys {
+        if kp.pattern == "*" {
+            granted |= kp.access
+        }
+    }
+    return granted&access == access
+}
+
+// applyRule changes the user according to one rule, in the syntax of Redis
+// ACL SETUSER. New passwords are hashed with the given iterations.
+func (u *aclUser) applyRule(rule string, iterations int) error {
+    switch lower := strings.ToLower(rule); {
+    case lower == "on":
+        u.enabled = true
+    case lower == "off":
+        u.enabled = false
+    case lower == "nopass":
+        u.nopass = true
+        u.passwords = nil
+        u.config = nil
+    case lower == "resetpass":
+        u.nopass = false
+        u.passwords = nil
+        u.config = nil
+    case lower == "allkeys":
+        u.keys = append(u.keys, keyPattern{"*", keyRead | keyWrite})
+    case lower == "resetkeys":
+        u.keys = nil
+    case lower == "allcommands":
+        return u.applyRule("+@all", iterations)
+    case lower == "nocommands":
+        return u.applyRule("-@all", iterations)
+    case lower == "reset":
+        *u = aclUser{name: u.name, categories: make(map[string]bool)}
+
+    case strings.HasPrefix(rule, ">"):
+        if u.config != nil && u.config.matches(rule[1:]) {
+            u.nopass = false
+            return nil
+        }
+        // Every hash has its own salt, the password's earlier hashes are
+        // found by checking it against them
+        for _, stored := range u.matchingPasswords(rule[1:]) {
+            u.removePassword(stored)
+        }
+        hash, err := hashPassword(rule[1:], iterations)
+        if err != nil {
+            return err
+        }
+        u.addPassword(hash)
+    case strings.HasPrefix(rule, "<"):
+        if u.config != nil && u.config.matches(rule[1:]) {
+            u.config = nil
+        }
+        for _, stored := range u.matchingPasswords(rule[1:]) {
+            u.removePassword(stored)
+        }
+    case strings.HasPrefix(rule, "#"), strings.HasPrefix(rule, "!"):
+        hash, ok := parsePasswordHash(rule[1:])
+        if !ok {
+            return fmt.Errorf("invalid password hash in ACL rule '%s'", rule)
+        }
+        if rule[0] == '#' {
+            u.addPassword(hash.String())
+        } else {
+            if u.config != nil {
+                if configHash, err := u.config.hashed(); err == nil && configHash == hash.String() {
+                    u.config = nil
+                }
+            }
+            u.removePassword(hash.String())
+        }
+
+    case strings.HasPrefix(rule, "~"):
+        u.keys = append(u.keys, keyPattern{rule[1:], keyRead | keyWrite})
+    case strings.HasPrefix(rule, "%"):
+        perms, pattern, ok := strings.Cut(rule[1:], "~")
+        access := 0
+        for _, p := range strings.ToUpper(perms) {
+            switch p {
+            case 'R':
+                access |= keyRead
+            case 'W':
+                access |= keyWrite
+            default:
+                ok = false
+            }
+        }
+        if !ok || access == 0 {
+            return fmt.Errorf("invalid key pattern in ACL rule '%s'", rule)
+        }
+        u.keys = append(u.keys, keyPattern{pattern, access})
+
+    case strings.HasPrefix(lower, "+@"), strings.HasPrefix(lower, "-@"):
+        grant := lower[0] == '+'
+        categories := []string{lower[2:]}
+        if lower[2:] == "all" {
+            categories = aclCategories
+        } else if !isACLCategory(lower[2:]) {
+            return fmt.Errorf("unknown command category '%s'", lower[2:])
+        }
+        for _, category := range categories {
+            if grant {
+                u.categories[category] = true
+            } else {
+                delete(u.categories, category)
+            }
+        }
+
+    default:
+        return fmt.Errorf("unknown ACL rule '%s'", rule)
+    }
+    return nil
+}
+
+func isACLCategory(name string) bool {
+    for _, category := range aclCategories {
+        if category == name {
+            return true
+        }
+    }
+    return false
+}
+
+func (u *aclUser) addPassword(hash string) {
+    u.nopass = false
+    u.removePassword(hash)
+    u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) {
+    for i, stored := range u.passwords {
+        if stored == hash {
+            u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+            return
+        }
+    }
+}
+
+// describe renders the user as the rules that create it, as in the ACL file
+// and ACL LIST. Passwords only appear hashed.
+func (u *aclUser) describe() string {
+    rules := []string{"user", u.name, "off"}
+    if u.enabled {
+        rules[2] = "on"
+    }
+    if u.nopass {
+        rules = append(rules, "nopass")
+    }
+    if u.config != nil {
+        if hash, err := u.config.hashed(); err == nil {
+            rules = append(rules, "#"+hash)
+        }
+    }
+    for _, hash := range u.passwords {
+        rules = append(rules, "#"+hash)
+    }
+    for _, kp := range u.keys {
+        switch kp.access {
+        case keyRead | keyWrite:
+            rules = append(rules, "~"+kp.pattern)
+        case keyRead:
+            rules = append(rules, "%R~"+kp.pattern)
+        case keyWrite:
+            rules = append(rules, "%W~"+kp.pattern)
+        }
+    }
+    for _, category := range aclCategories {
+        if u.categories[category] {
+            rules = append(rules, "+@"+category)
+        }
+    }
+    return strings.Join(rules, " ")
+}
+
+// aclStore holds the users. Connections keep the name of their user and
+// look it up for every command, so changes apply right away.
+type aclStore struct {
+    mu    sync.RWMutex
+    users map[string]*aclUser
+    file  string
+
+    // hashIterations is the PBKDF2 cost of new password hashes, and of
+    // dummyHash, which is checked for logins of unknown or disabled users
+    hashIterations int
+    dummyHash      passwordHash
+
+    // verified remembers the logins that already matched a hash, so clients
+    // authenticating on every request, like those of the HTTP gateway, do not
+    // pay for the key derivation each time. It only holds SHA-256 digests of
+    // the hash and password, in memory.
+    verifiedMu sync.Mutex
+    verified   map[[sha256.Size]byte]bool
+}
+
+// Logins remembered by aclStore.verified before it starts over
+const maxVerifiedLogins = 1024
+
+// newACLStore creates the built-in users and loads ACL_FILE. The default
+// user logs in with SERVER_PASSWORD and may run everything except the admin
+// commands; the admin user logs in with ADMIN_PASSWORD, or only through a
+// client certificate when it is not set. Users of the ACL file replace
+// built-in users of the same name.
+func newACLStore(cfg *config.Config) (*aclStore, error) {
+    iterations := cfg.PasswordHashIterations
+    if iterations == 0 {
+        iterations = passwordHashIterations
+    }
+    if iterations < 1 || iterations > maxPasswordHashIterations {
+        return nil, fmt.Errorf("password hash iterations must be between 1 and %d", maxPasswordHashIterations)
+    }
+    dummyHash, err := dummyPasswordHash(iterations)
+    if err != nil {
+        return nil, err
+    }
+    store := &aclStore{
+        users:          make(map[string]*aclUser),
+        file:           cfg.ACLFile,
+        hashIterations: iterations,
+        dummyHash:      dummyHash,
+    }
+
+    defaultRules := []string{"on", "allkeys", "+@all", "-@admin"}
+    adminRules := []string{"on", "allkeys", "+@all"}
+    for name, rules := range map[string][]string{defaultUser: defaultRules, adminUser: adminRules} {
+        if err := store.setUser(name, rules); err != nil {
+            return nil, err
+        }
+    }
+    // The store is not shared yet, the built-in users can take their
+    // configured passwords in place
+    store.users[defaultUser].config = newConfigPassword(cfg.Password, iterations)
+    if cfg.AdminPassword != "" {
+        store.users[adminUser].config = newConfigPassword(cfg.AdminPassword, iterations)
+    }
+
+    if cfg.ACLFile != "" {
+        if err := store.load(cfg.ACLFile); err != nil {
+            return nil, err
+        }
+    }
+    return store, nil
+}
+
+// load reads an ACL file: one "user name rules..." line per user, blank
+// lines and lines starting with # are skipped.
+func (a *aclStore) load(path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return fmt.Errorf("failed to open ACL file: %v", err)
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    for lineNum := 1; scanner.Scan(); lineNum++ {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+            continue
+        }
+        if len(fields) < 2 || fields[0] != "user" {
+            return fmt.Errorf("ACL file %s line %d: expected 'user name rules...'", path, lineNum)
+        }
+        // A user is defined once in the file, it does not build on a built-in
+        if err := a.setUser(fields[1], append([]string{"reset"}, fields[2:]...)); err != nil {
+            return fmt.Errorf("ACL file %s line %d: %v", path, lineNum, err)
+        }
+    }
+    return scanner.Err()
+}
+
+// save writes every user to the ACL file.
+func (a *aclStore) save() error {
+    if a.file == "" {
+        return fmt.Errorf("no ACL file configured")
+    }
+    lines, err := a.list()
+    if err != nil {
+        return err
+    }
+    var content strings.Builder
+    for _, line := range lines {
+        content.WriteString(line + "\n")
+    }
+
+    tmpFile := a.file + ".tmp"
+    if err := os.MkdirAll(filepath.Dir(a.file), 0755); err != nil {
+        return fmt.Errorf("failed to create ACL directory: %v", err)
+    }
+    if err := os.WriteFile(tmpFile, []byte(content.String()), 0600); err != nil {
+        return fmt.Errorf("failed to write ACL file: %v", err)
+    }
+    if err := os.Rename(tmpFile, a.file); err != nil {
+        return fmt.Errorf("failed to write ACL file: %v", err)
+    }
+    return nil
+}
+
+// checkPassword reports whether password logs user in. A missing or
+// disabled user is refused after hashing the password all the same, so the
+// time of a failed login does not tell whether the user exists.
+func (a *aclStore) checkPassword(user *aclUser, password string) bool {
+    if user == nil || !user.enabled {
+        a.dummyHash.matches(password)
+        return false
+    }
+    if user.nopass || (user.config != nil && user.config.matches(password)) {
+        return true
+    }
+
+    a.verifiedMu.Lock()
+    for _, stored := range user.passwords {
+        if a.verified[verifiedLogin(stored, password)] {
+            a.verifiedMu.Unlock()
+            return true
+        }
+    }
+    a.verifiedMu.Unlock()
+
+    matching := user.matchingPasswords(password)
+    if len(matching) == 0 {
+        return false
+    }
+    a.verifiedMu.Lock()
+    if a.verified == nil || len(a.verified) >= maxVerifiedLogins {
+        a.verified = make(map[[sha256.Size]byte]bool)
+    }
+    a.verified[verifiedLogin(matching[0], password)] = true
+    a.verifiedMu.Unlock()
+    return true
+}
+
+func verifiedLogin(hash, password string) [sha256.Size]byte {
+    return sha256.Sum256([]byte(hash + "\x00" + password))
+}
+
+func (a *aclStore) user(name string) *aclUser {
+    a.mu.RLock()
+    defer a.mu.RUnlock()
+    return a.users[name]
+}
+
+// canRead reports whether a user exists, is enabled and may read key.
+func (a *aclStore) canRead(name, key string) bool {
+    user := a.user(name)
+    return user != nil && user.enabled && user.canAccess(key, keyRead)
+}
+
+// setUser creates or changes a user. A new user starts disabled, without
+// passwords or permissions. Nothing changes when a rule is invalid.
+//
+// The rules are applied to a copy without holding the lock, since password
+// rules hash the password, and the copy is only stored if the user did not
+// change in the meantime. Otherwise the rules are applied again.
+func (a *aclStore) setUser(name string, rules []string) error {
+    if name == "" || strings.ContainsAny(name, " \t\r\n") {
+        return fmt.Errorf("invalid user name '%s'", name)
+    }
+    for {
+        a.mu.RLock()
+        existing := a.users[name]
+        a.mu.RUnlock()
+
+        user := &aclUser{name: name, categories: make(map[string]bool)}
+        if existing != nil {
+            user = existing.clone()
+        }
+        for _, rule := range rules {
+            if err := user.applyRule(rule, a.hashIterations); err != nil {
+                return err
+            }
+        }
+
+        a.mu.Lock()
+        if a.users[name] == existing {
+            a.users[name] = user
+            a.mu.Unlock()
+            return nil
+        }
+        a.mu.Unlock()
+    }
+}
+
+// deleteUser removes users and returns how many existed. The default user
+// cannot be removed.
+func (a *aclStore) deleteUser(names []string) (int, error) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+
+    for _, name := range names {
+        if name == defaultUser {
+            return 0, fmt.Errorf("the 'default' user cannot be removed")
+        }
+    }
+    deleted := 0
+    for _, name := range names {
+        if _, exists := a.users[name]; exists {
+            delete(a.users, name)
+            deleted++
+        }
+    }
+    return deleted, nil
+}
+
+// list describes every user, sorted by name. Configured passwords are
+// hashed the first time, outside the lock.
+func (a *aclStore) list() ([]string, error) {
+    a.mu.RLock()
+    users := make([]*aclUser, 0, len(a.users))
+    for _, user := range a.users {
+        users = append(users, user)
+    }
+    a.mu.RUnlock()
+
+    lines := make([]string, 0, len(users))
+    for _, user := range users {
+        if user.config != nil {
+            if _, err := user.config.hashed(); err != nil {
+                return nil, err
+            }
+        }
+        lines = append(lines, user.describe())
+    }
+    sort.Strings(lines)
+    return lines, nil
+}
+
+// authArgs splits the arguments of AUTH [username] password.
+func authArgs(args []string) (username, password string) {
+    if len(args) == 2 {
+        return args[0], args[1]
+    }
+    return "", args[len(args)-1]
+}
+
+// authenticate returns the user that username and password log in as. A
+// password alone logs in as the default user. Only that one user's hashes
+// are checked, so every attempt costs a single key derivation.
+func (s *Server) authenticate(username, password string) (string, bool) {
+    if username == "" {
+        username = defaultUser
+    }
+    if !s.acl.checkPassword(s.acl.user(username), password) {
+        return "", false
+    }
+    return username, true
+}
+
+// authorize checks that the client's user may run a command, before it is
+// queued or run.
+func (s *Server) authorize(client *ClientConnection, args []string) error {
+    cmd := strings.ToUpper(args[0])
+    spec, restricted := commandSpecs[cmd]
+    if !restricted || (cmd == "ACL" && len(args) > 1 && strings.EqualFold(args[1], "WHOAMI")) {
+        return nil
+    }
+
+    user := s.acl.user(client.user)
+    if user == nil || !user.enabled {
+        return fmt.Errorf("%w: user '%s' no longer exists or is disabled", errNoPermission, client.user)
+    }
+    if !user.categories[spec.category] {
+        return fmt.Errorf("%w: user '%s' may not run %s (@%s)", errNoPermission, user.name, cmd, spec.category)
+    }
+    if spec.allKeys {
+        if !user.canAccessAll(spec.keys) {
+            return fmt.Errorf("%w: user '%s' may not run %s without access to every key", errNoPermission, user.name, cmd)
+        }
+        return nil
+    }
+    if spec.keys == 0 {
+        return nil
+    }
+
+    keys := args[1:]
+    if cmd != "WATCH" {
+        var err error
+        if keys, err = transactionKeys(args); err != nil {
+            return err
+        }
+    }
+    for _, key := range keys {
+        if !user.canAccess(key, spec.keys) {
+            return fmt.Errorf("%w: user '%s' may not access key '%s'", errNoPermission, user.name, key)
+        }
+    }
+    return nil
+}
+
+// filterKeys removes the keys the client's user may not read from the reply
+// of KEYS, SCAN or QUERY.
+func (s *Server) filterKeys(client *ClientConnection, cmd string, result reply) reply {
+    user := s.acl.user(client.user)
+    if user == nil || user.canAccessAll(keyRead) {
+        return result
+    }
+    filter := func(keys reply) reply {
+        kept := []reply{}
+        for _, key := range keys.elems {
+            if user.canAccess(key.str, keyRead) {
+                kept = append(kept, key)
+            }
+        }
+        return arrayValue(kept...)
+    }
+    switch {
+    case cmd == "SCAN" && len(result.elems) == 2:
+        return arrayValue(result.elems[0], filter(result.elems[1]))
+    case cmd == "KEYS", cmd == "QUERY":
+        return filter(result)
+    }
+    return result
+}
+
+// aclCommand implements ACL WHOAMI, LIST, SETUSER name rules..., DELUSER
+// name... and SAVE.
+func (s *Server) aclCommand(client *ClientConnection, args []string) (reply, error) {
+    if len(args) < 2 {
+        return reply{}, fmt.Errorf("ACL command requires a subcommand")
+    }
+    switch sub := strings.ToUpper(args[1]); sub {
+    case "WHOAMI":
+        return bulkValue(client.user), nil
+
+    case "LIST":
+        lines, err := s.acl.list()
+        if err != nil {
+            return reply{}, err
+        }
+        return stringsValue(lines), nil
+
+    case "SETUSER":
+        if len(args) < 3 {
+            return reply{}, fmt.Errorf("ACL SETUSER requires a user name")
+        }
+        if err := s.acl.setUser(args[2], args[3:]); err != nil {
+            return reply{}, err
+        }
+        return okReply, nil
+
+    case "DELUSER":
+        if len(args) < 3 {
+            return reply{}, fmt.Errorf("ACL DELUSER requires at least one user name")
+        }
+        deleted, err := s.acl.deleteUser(args[2:])
+        if err != nil {
+            return reply{}, err
+        }
+        return integerValue(int64(deleted)), nil
+
+    case "SAVE":
+        if err := s.acl.save(); err != nil {
+            return reply{}, err
+        }
+        return okReply, nil
+
+    default:
+        return reply{}, fmt.Errorf("unknown ACL subcommand: %s", sub)
+    }
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+    "fmt"
+)
+
+// adminCommands affect the whole dataset, they are in the admin ACL
+// category, see commandSpecs.
+var adminCommands = map[string]bool{
+    "FLUSHALL": true, "RESET_MEMORY": true, "SAVE": true, "BGSAVE": true, "LASTSAVE": true, "RESTORE": true,
+}
+
+// adminCommand implements the admin commands:
+//
+//    FLUSHALL, RESET_MEMORY   remove every key
+//    SAVE                     write a snapshot, replying once it is on disk
+//    BGSAVE                   write a snapshot in the background, see INFO
+//    LASTSAVE                 Unix time of the last successful snapshot
+//    RESTORE [name]           replace the data with a snapshot file
+func (s *Server) adminCommand(client *ClientConnection, cmd string, args []string) (reply, error) {
+    if writeCommands[cmd] && s.readOnly() {
+        return reply{}, errReadOnly
+    }
+
+    switch cmd {
+    case "FLUSHALL", "RESET_MEMORY":
+        return s.handleResetMemory(cmd, args[1:])
+
+    case "SAVE":
+        if len(args) != 1 {
+            return reply{}, fmt.Errorf("SAVE command takes no arguments")
+        }
+        if err := s.Engine.DumpToDisk(); err != nil {
+            return reply{}, fmt.Errorf("failed to save: %v", err)
+        }
+        return okReply, nil
+
+    case "BGSAVE":
+        if len(args) != 1 {
+            return reply{}, fmt.Errorf("BGSAVE command takes no arguments")
+        }
+        if err := s.Engine.BackgroundSave(); err != nil {
+            return reply{}, err
+        }
+        return statusValue("Background saving started"), nil
+
+    case "LASTSAVE":
+        if len(args) != 1 {
+            return reply{}, fmt.Errorf("LASTSAVE command takes no arguments")
+        }
+        var lastSave int64
+        if save := s.Engine.SaveStatus(); !save.LastSave.IsZero() {
+            lastSave = save.LastSave.Unix()
+        }
+        return integerValue(lastSave), nil
+
+    case "RESTORE":
+        if len(args) > 2 {
+            return reply{}, fmt.Errorf("RESTORE command takes at most a snapshot name")
+        }
+        name := ""
+        if len(args) == 2 {
+            name = args[1]
+        }
+        if err := s.Engine.RestoreSnapshot(name); err != nil {
+            return reply{}, fmt.Errorf("failed to restore: %v", err)
+        }
+        return okReply, nil
+    }
+    return reply{}, fmt.Errorf("unknown command: %s", cmd)
+}
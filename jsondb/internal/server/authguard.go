@@ -0,0 +1,274 @@
+package server
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "jsondb/internal/config"
+    "log"
+    "net"
+    "os"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Longest delay before a failed authentication is answered
+const authBackoffMax = 5 * time.Second
+
+// Events of the authentication audit log
+const (
+    auditAuthFailure = "auth_failure"
+    auditAddressBan  = "address_banned"
+    // auditAuthBlocked is an attempt from an address already banned
+    auditAuthBlocked = "auth_blocked"
+)
+
+var (
+    errInvalidPassword = errors.New("Invalid password")
+    // errAuthLimit ends a connection that failed to authenticate too often,
+    // or comes from a banned address
+    errAuthLimit  = errors.New("too many failed authentication attempts")
+    errAuthBanned = fmt.Errorf("%w from this address, try again later", errAuthLimit)
+)
+
+// authRecord counts the failed attempts from one address. They are
+// forgotten once none happened for AUTH_BAN_SECONDS.
+type authRecord struct {
+    failures    int
+    lastFailure time.Time
+    bannedUntil time.Time
+}
+
+func (r *authRecord) expired(now time.Time, window time.Duration) bool {
+    return !now.Before(r.bannedUntil) && now.Sub(r.lastFailure) >= window
+}
+
+// authAuditEntry is one line of AUTH_AUDIT_LOG. Passwords are never
+// recorded.
+type authAuditEntry struct {
+    Time     string `json:"time"`
+    Event    string `json:"event"`
+    Address  string `json:"address"`
+    User     string `json:"user,omitempty"`
+    Failures int    `json:"failures,omitempty"`
+}
+
+// authGuard slows down and bans clients guessing passwords, and records
+// their attempts in the audit log.
+type authGuard struct {
+    mu        sync.Mutex
+    addresses map[string]*authRecord
+    lastSweep time.Time
+    failures  atomic.Uint64
+
+    auditMu sync.Mutex
+    audit   *os.File
+}
+
+func newAuthGuard(cfg *config.Config) (*authGuard, error) {
+    guard := &authGuard{addresses: make(map[string]*authRecord)}
+    if cfg.AuthAuditLog != "" {
+        file, err := os.OpenFile(cfg.AuthAuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+        if err != nil {
+            return nil, fmt.Errorf("failed to open auth audit log: %v", err)
+        }
+        guard.audit = file
+    }
+    return guard, nil
+}
+
+func (g *authGuard) close() {
+    g.auditMu.Lock()
+    defer g.auditMu.Unlock()
+    if g.audit != nil {
+        g.audit.Close()
+        g.audit = nil
+    }
+}
+
+// banned reports whether an address is banned.
+func (g *authGuard) banned(address string, now time.Time) bool {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    record := g.addresses[address]
+    return record != nil && now.Before(record.bannedUntil)
+}
+
+// fail records a failed attempt from an address. It returns the failures
+// the address made in a row and whether this one got it banned.
+func (g *authGuard) fail(address string, cfg *config.Config, now time.Time) (int, bool) {
+    g.failures.Add(1)
+    window := seconds(cfg.AuthBanSeconds)
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    // Addresses that stopped failing are dropped, so the map does not grow
+    // with every address that ever mistyped a password
+    if now.Sub(g.lastSweep) >= window {
+        for addr, record := range g.addresses {
+            if record.expired(now, window) {
+                delete(g.addresses, addr)
+            }
+        }
+        g.lastSweep = now
+    }
+
+    record := g.addresses[address]
+    if record == nil || record.expired(now, window) {
+        record = &authRecord{}
+        g.addresses[address] = record
+    }
+    record.failures++
+    record.lastFailure = now
+    if max := cfg.AuthMaxFailuresPerIP; max > 0 && window > 0 && record.failures >= max {
+        record.bannedUntil = now.Add(window)
+        return record.failures, true
+    }
+    return record.failures, false
+}
+
+// bannedCount returns the number of addresses currently banned.
+func (g *authGuard) bannedCount(now time.Time) int {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    count := 0
+    for _, record := range g.addresses {
+        if now.Before(record.bannedUntil) {
+            count++
+        }
+    }
+    return count
+}
+
+// record writes an entry to AUTH_AUDIT_LOG, or to the server log when no
+// audit log is configured.
+func (g *authGuard) record(entry authAuditEntry) {
+    g.auditMu.Lock()
+    defer g.auditMu.Unlock()
+    if g.audit == nil {
+        log.Printf("Auth audit: %s from %s, user %q, %d failures", entry.Event, entry.Address, entry.User, entry.Failures)
+        return
+    }
+    line, _ := json.Marshal(entry)
+    if _, err := g.audit.Write(append(line, '\n')); err != nil {
+        log.Printf("Failed to write auth audit log: %v", err)
+    }
+}
+
+// authBackoff returns the delay before answering the given number of failures
+// in a row: AUTH_BACKOFF_MS, doubled with every failure up to authBackoffMax.
+func authBackoff(cfg *config.Config, failures int) time.Duration {
+    delay := time.Duration(cfg.AuthBackoffMs) * time.Millisecond
+    for i := 1; i < failures && delay < authBackoffMax; i++ {
+        delay *= 2
+    }
+    if delay > authBackoffMax {
+        return authBackoffMax
+    }
+    return delay
+}
+
+// login checks the credentials of AUTH [username] password for a client.
+// errAuthLimit means the connection has to be closed: it failed
+// AUTH_MAX_FAILURES_PER_CONNECTION times, or its address is banned.
+func (s *Server) login(client *ClientConnection, args []string) (string, error) {
+    user, err := s.loginFrom(remoteIP(client.Conn.RemoteAddr().String()), args)
+    if err == nil {
+        client.authFailures = 0
+        return user, nil
+    }
+    if errors.Is(err, errInvalidPassword) {
+        client.authFailures++
+        if max := s.Config.AuthMaxFailuresPerConnection; max > 0 && client.authFailures >= max {
+            return "", errAuthLimit
+        }
+    }
+    return "", err
+}
+
+// loginFrom checks the credentials [username] password sent from an address.
+// When several readings of the credentials are given, they are tried in turn
+// and only count as one failure. A failure is answered after a delay growing
+// with the failures of the address, which is banned after
+// AUTH_MAX_FAILURES_PER_IP failures in a row.
+func (s *Server) loginFrom(address string, attempts ...[]string) (string, error) {
+    username, _ := authArgs(attempts[0])
+    now := time.Now()
+    if s.guard.banned(address, now) {
+        s.auditAuth(auditAuthBlocked, address, username, 0)
+        return "", errAuthBanned
+    }
+    for _, args := range attempts {
+        if user, ok := s.authenticate(authArgs(args)); ok {
+            return user, nil
+        }
+    }
+
+    failures, banned := s.guard.fail(address, s.Config, now)
+    s.auditAuth(auditAuthFailure, address, username, failures)
+    if banned {
+        s.auditAuth(auditAddressBan, address, username, failures)
+    }
+    select {
+    case <-time.After(authBackoff(s.Config, failures)):
+    case <-s.shutdownCh:
+    }
+
+    if banned {
+        return "", errAuthBanned
+    }
+    return "", errInvalidPassword
+}
+
+func (s *Server) auditAuth(event, address, username string, failures int) {
+    s.guard.record(authAuditEntry{
+        Time:     time.Now().UTC().Format(time.RFC3339),
+        Event:    event,
+        Address:  address,
+        User:     username,
+        Failures: failures,
+    })
+}
+
+// remoteIP returns the address of a client without its port, so the
+// connections of one host share their failures.
+func remoteIP(address string) string {
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return address
+    }
+    return host
+}
+
+// redactArgs returns the arguments of a command for logging, with the
+// passwords given to AUTH, HELLO and ACL SETUSER masked.
+func redactArgs(args []string) []string {
+    redacted := append([]string(nil), args...)
+    if len(args) == 0 {
+        return redacted
+    }
+    switch strings.ToUpper(args[0]) {
+    case "AUTH":
+        // The username of AUTH username password is kept
+        for i := 1; i < len(args); i++ {
+            if len(args) != 3 || i == 2 {
+                redacted[i] = "***"
+            }
+        }
+    case "HELLO":
+        for i := 1; i < len(args); i++ {
+            if strings.EqualFold(args[i], "AUTH") && i+2 < len(args) {
+                redacted[i+2] = "***"
+            }
+        }
+    case "ACL":
+        for i := 2; i < len(args); i++ {
+            if strings.HasPrefix(args[i], ">") || strings.HasPrefix(args[i], "<") {
+                redacted[i] = args[i][:1] + "***"
+            }
+        }
+    }
+    return redacted
+}
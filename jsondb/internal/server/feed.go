@@ -0,0 +1,161 @@
+package server
+
+import (
+    "fmt"
+    "jsondb/internal/engine"
+    "log"
+    "strconv"
+    "time"
+)
+
+// Changes read from the feed and written to a follower at once
+const feedBatchSize = 256
+
+// watchFeed implements WATCHFEED from_seq. The reply confirms the first
+// sequence number, then every change from there on is pushed to the client
+// until UNWATCHFEED or the connection closes.
+func (s *Server) watchFeed(client *ClientConnection, args []string) (reply, error) {
+    if len(args) != 2 {
+        return reply{}, fmt.Errorf("WATCHFEED command requires from_seq")
+    }
+    if client.feedDone != nil {
+        return reply{}, fmt.Errorf("connection is already watching the change feed")
+    }
+    from, err := strconv.ParseUint(args[1], 10, 64)
+    if err != nil {
+        return reply{}, fmt.Errorf("invalid sequence number: %s", args[1])
+    }
+
+    // Resolve the start now so a lost position is the reply to WATCHFEED
+    // instead of a message on the stream
+    if from == 0 {
+        if from, _, err = s.Engine.ChangeFeedBounds(); err != nil {
+            return reply{}, err
+        }
+    }
+    if _, _, err := s.Engine.ReadChanges(from, 0); err != nil {
+        return reply{}, err
+    }
+
+    s.startFeed(client, from, false)
+    return pushValue(bulkValue("watchfeed"), integerValue(int64(from))), nil
+}
+
+// unwatchFeed implements UNWATCHFEED.
+func (s *Server) unwatchFeed(client *ClientConnection) reply {
+    s.stopFeed(client)
+    return okReply
+}
+
+// startFeed streams changes from sequence from to a client. Followers
+// receive values as the JSON they are stored as, see PSYNC.
+func (s *Server) startFeed(client *ClientConnection, from uint64, follower bool) {
+    done := make(chan struct{})
+    client.feedDone = done
+    client.feedSeq.Store(from)
+    if follower {
+        s.followers.Store(client, struct{}{})
+    }
+    go s.streamFeed(client, from, follower, done)
+}
+
+// stopFeed ends the change stream of a client, if any.
+func (s *Server) stopFeed(client *ClientConnection) {
+    if client.feedDone != nil {
+        close(client.feedDone)
+        client.feedDone = nil
+        s.followers.Delete(client)
+    }
+}
+
+// streamFeed pushes changes to a follower. A slow follower only holds up
+// itself: once it falls further behind than the feed keeps, it is sent an
+// error and disconnected, and resumes from a full copy. A replication
+// follower is pinged while no change comes, so it can tell an idle leader
+// from a dead connection.
+func (s *Server) streamFeed(client *ClientConnection, from uint64, raw bool, done chan struct{}) {
+    for {
+        events, wake, err := s.Engine.ReadChanges(from, feedBatchSize)
+        if err != nil {
+            log.Printf("Disconnecting change feed follower %s: %v", client.Conn.RemoteAddr(), err)
+            client.writeMu.Lock()
+            client.encodePush(errorValue(err))
+            client.flushLocked()
+            client.writeMu.Unlock()
+            client.Conn.Close()
+            return
+        }
+
+        if len(events) > 0 {
+            client.writeMu.Lock()
+            select {
+            case <-done:
+                // UNWATCHFEED was answered while waiting for the writer
+                client.writeMu.Unlock()
+                return
+            default:
+            }
+            for _, event := range events {
+                client.encodePush(changeReply(event, raw))
+            }
+            err := client.flushLocked()
+            client.writeMu.Unlock()
+            if err != nil {
+                client.Conn.Close()
+                return
+            }
+            from = events[len(events)-1].Seq + 1
+            client.feedSeq.Store(from)
+            continue
+        }
+
+        var heartbeat <-chan time.Time
+        if raw {
+            heartbeat = time.After(replHeartbeatInterval)
+        }
+        select {
+        case <-wake:
+        case <-done:
+            return
+        case <-heartbeat:
+            client.writeMu.Lock()
+            select {
+            case <-done:
+                client.writeMu.Unlock()
+                return
+            default:
+            }
+            client.encodePush(pushValue(bulkValue("ping")))
+            err := client.flushLocked()
+            client.writeMu.Unlock()
+            if err != nil {
+                client.Conn.Close()
+                return
+            }
+        }
+    }
+}
+
+// changeReply renders a change as ["change", seq, op, key, value, expires_at]
+// with the value as GET returns it, or as stored JSON when raw, null for
+// removals, and the expiry in Unix milliseconds, 0 when the key does not expire.
+func changeReply(event engine.ChangeEvent, raw bool) reply {
+    value := nullValue()
+    if raw && event.Value != nil {
+        value = bulkValue(string(event.Value))
+    } else if event.Value != nil {
+        value = valueReply(event.Value)
+    }
+    var expiresAt int64
+    if !event.ExpiresAt.IsZero() {
+        expiresAt = event.ExpiresAt.UnixMilli()
+    }
+    return pushValue(
+        bulkValue("change"),
+        integerValue(int64(event.Seq)),
+        bulkValue(event.Op),
+        bulkValue(event.Key),
+        value,
+        integerValue(expiresAt),
+    )
+}
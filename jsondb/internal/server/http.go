@@ -0,0 +1,313 @@
+package server
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "jsondb/internal/config"
+    "jsondb/internal/engine"
+    "log"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Largest request body the HTTP gateway reads
+const httpMaxBodyBytes = 16 << 20
+
+var (
+    errHTTPUnauthorized = errors.New("authentication required")
+    errHTTPBadRequest   = errors.New("bad request")
+)
+
+// httpListener applies the connection limit and address bans to the HTTP
+// gateway, as acceptLoop does for the other listeners. Admitted connections
+// are released by the ConnState hook of newHTTPServer once closed.
+type httpListener struct {
+    net.Listener
+    s *Server
+}
+
+func (l httpListener) Accept() (net.Conn, error) {
+    for {
+        conn, err := l.Listener.Accept()
+        if err != nil {
+            return nil, err
+        }
+        if reason := l.s.screen(conn); reason != "" {
+            go l.s.reject(conn, config.ProtocolHTTP, reason)
+            continue
+        }
+        return conn, nil
+    }
+}
+
+// newHTTPServer creates the REST gateway. Every request is translated to the
+// command it stands for and run like one sent on a connection authenticated
+// with its bearer token, so permissions, read-only followers and the memory
+// limit apply the same way.
+func (s *Server) newHTTPServer() *http.Server {
+    mux := http.NewServeMux()
+    mux.HandleFunc("GET /keys", s.httpHandler(s.httpListKeys))
+    mux.HandleFunc("GET /keys/{key}", s.httpHandler(s.httpGetKey))
+    mux.HandleFunc("PUT /keys/{key}", s.httpHandler(s.httpPutKey))
+    mux.HandleFunc("DELETE /keys/{key}", s.httpHandler(s.httpDeleteKey))
+    mux.HandleFunc("GET /keys/{key}/json", s.httpHandler(s.httpGetPath))
+    mux.HandleFunc("PUT /keys/{key}/json", s.httpHandler(s.httpPutPath))
+    mux.HandleFunc("DELETE /keys/{key}/json", s.httpHandler(s.httpDeletePath))
+
+    return &http.Server{
+        Handler:      mux,
+        ReadTimeout:  seconds(s.Config.ReadTimeoutSeconds),
+        WriteTimeout: seconds(s.Config.WriteTimeoutSeconds),
+        IdleTimeout:  seconds(s.Config.IdleTimeoutSeconds),
+        ConnState: func(conn net.Conn, state http.ConnState) {
+            if state == http.StateClosed || state == http.StateHijacked {
+                s.clients.Add(-1)
+            }
+        },
+    }
+}
+
+// httpHandler authenticates a request before passing it to handle, and
+// answers the error handle returns.
+func (s *Server) httpHandler(handle func(client *ClientConnection, w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if s.Debug {
+            log.Printf("Received HTTP request: %s %s", r.Method, r.URL.Path)
+        }
+        user, err := s.httpAuthenticate(r)
+        if err == nil {
+            client := &ClientConnection{ID: r.RemoteAddr, Authenticated: true, user: user}
+            err = handle(client, w, r)
+        }
+        if err != nil {
+            s.writeHTTPError(w, err)
+        }
+    }
+}
+
+// httpAuthenticate logs a request in with its bearer token, a password alone
+// or username:password, under the same failure limits as AUTH. A token with
+// a colon is tried as username:password first and then as a password alone,
+// whether or not the user exists, so the time taken does not tell.
+func (s *Server) httpAuthenticate(r *http.Request) (string, error) {
+    scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+    if !strings.EqualFold(scheme, "Bearer") || token == "" {
+        return "", errHTTPUnauthorized
+    }
+    attempts := [][]string{{token}}
+    if username, password, found := strings.Cut(token, ":"); found {
+        attempts = [][]string{{username, password}, {token}}
+    }
+    return s.loginFrom(remoteIP(r.RemoteAddr), attempts...)
+}
+
+// httpGetKey implements GET /keys/{key}, returning the value as stored JSON.
+func (s *Server) httpGetKey(client *ClientConnection, w http.ResponseWriter, r *http.Request) error {
+    result, err := s.runCommand(client, []string{"JSON.GET", r.PathValue("key")})
+    if err != nil {
+        return err
+    }
+    return writeHTTPValue(w, result, engine.ErrKeyNotFound)
+}
+
+// httpPutKey implements PUT /keys/{key}?ttl=seconds, storing the JSON body.
+func (s *Server) httpPutKey(client *ClientConnection, w http.ResponseWriter, r *http.Request) error {
+    value, err := readHTTPValue(w, r)
+    if err != nil {
+        return err
+    }
+    key := r.PathValue("key")
+    set := []string{"JSON.SET", key, "$", value}
+    expiry := []string{"PERSIST", key}
+    if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+        seconds, err := strconv.ParseInt(ttl, 10, 64)
+        if _, valid := expiryDuration(seconds, time.Second); err != nil || seconds <= 0 || !valid {
+            return fmt.Errorf("%w: invalid ttl: %s", errHTTPBadRequest, ttl)
+        }
+        expiry = []string{"EXPIRE", key, ttl}
+    }
+    if err := s.authorize(client, set); err != nil {
+        return err
+    }
+
+    // JSON.SET keeps numbers and booleans typed where SET stores them as
+    // strings; the expiry is replaced in the same step, as SET does
+    err = s.Engine.Atomic([]string{key}, func(tx *engine.Tx) error {
+        for _, args := range [][]string{set, expiry} {
+            if _, err := s.execute(tx, args); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+// httpDeleteKey implements DELETE /keys/{key}.
+func (s *Server) httpDeleteKey(client *ClientConnection, w http.ResponseWriter, r *http.Request) error {
+    if _, err := s.runCommand(client, []string{"DELETE", r.PathValue("key")}); err != nil {
+        return err
+    }
+    w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+// httpListKeys implements GET /keys?match=pattern&cursor=n&count=n, a page of
+// SCAN. Listing is complete once the returned cursor is "0".
+func (s *Server) httpListKeys(client *ClientConnection, w http.ResponseWriter, r *http.Request) error {
+    query := r.URL.Query()
+    cursor := query.Get("cursor")
+    if cursor == "" {
+        cursor = "0"
+    } else if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+        return fmt.Errorf("%w: invalid cursor: %s", errHTTPBadRequest, cursor)
+    }
+    args := []string{"SCAN", cursor}
+    if match := query.Get("match"); match != "" {
+        args = append(args, "MATCH", match)
+    }
+    if count := query.Get("count"); count != "" {
+        if n, err := strconv.Atoi(count); err != nil || n <= 0 {
+            return fmt.Errorf("%w: invalid count: %s", errHTTPBadRequest, count)
+        }
+        args = append(args, "COUNT", count)
+    }
+
+    result, err := s.runCommand(client, args)
+    if err != nil {
+        return err
+    }
+    keys := []string{}
+    for _, key := range result.elems[1].elems {
+        keys = append(keys, key.str)
+    }
+    return writeHTTPJSON(w, http.StatusOK, map[string]interface{}{"cursor": result.elems[0].str, "keys": keys})
+}
+
+// httpGetPath implements GET /keys/{key}/json?path=, the value at a JSON path
+// ($ by default).
+func (s *Server) httpGetPath(client *ClientConnection, w http.ResponseWriter, r *http.Request) error {
+    result, err := s.runCommand(client, []string{"JSON.GET", r.PathValue("key"), httpPath(r)})
+    if err != nil {
+        return err
+    }
+    return writeHTTPValue(w, result, engine.ErrPathNotFound)
+}
+
+// httpPutPath implements PUT /keys/{key}/json?path=, setting the value at a
+// JSON path to the JSON body.
+func (s *Server) httpPutPath(client *ClientConnection, w http.ResponseWriter, r *http.Request) error {
+    value, err := readHTTPValue(w, r)
+    if err != nil {
+        return err
+    }
+    if _, err := s.runCommand(client, []string{"JSON.SET", r.PathValue("key"), httpPath(r), value}); err != nil {
+        return err
+    }
+    w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+// httpDeletePath implements DELETE /keys/{key}/json?path=.
+func (s *Server) httpDeletePath(client *ClientConnection, w http.ResponseWriter, r *http.Request) error {
+    result, err := s.runCommand(client, []string{"JSON.DEL", r.PathValue("key"), httpPath(r)})
+    if err != nil {
+        return err
+    }
+    if result.num == 0 {
+        return engine.ErrPathNotFound
+    }
+    w.WriteHeader(http.StatusNoContent)
+    return nil
+}
+
+func httpPath(r *http.Request) string {
+    if path := r.URL.Query().Get("path"); path != "" {
+        return path
+    }
+    return "$"
+}
+
+// readHTTPValue reads a request body, which must be a JSON value.
+func readHTTPValue(w http.ResponseWriter, r *http.Request) (string, error) {
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, httpMaxBodyBytes))
+    if err != nil {
+        return "", err
+    }
+    if !json.Valid(body) {
+        return "", fmt.Errorf("%w: the body must be a JSON value", errHTTPBadRequest)
+    }
+    return string(body), nil
+}
+
+// writeHTTPValue answers with the JSON returned by JSON.GET, a null reply
+// meaning notFound.
+func writeHTTPValue(w http.ResponseWriter, result reply, notFound error) error {
+    if result.typ == nullReply {
+        return notFound
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusOK)
+    io.WriteString(w, result.str)
+    return nil
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, body interface{}) error {
+    encoded, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    w.Write(encoded)
+    return nil
+}
+
+// writeHTTPError answers an error with its status code and a JSON body.
+func (s *Server) writeHTTPError(w http.ResponseWriter, err error) {
+    status := httpStatus(err)
+    switch status {
+    case http.StatusUnauthorized:
+        challenge := `Bearer realm="jsondb"`
+        if errors.Is(err, errInvalidPassword) {
+            challenge += `, error="invalid_token"`
+        }
+        w.Header().Set("WWW-Authenticate", challenge)
+    case http.StatusTooManyRequests:
+        w.Header().Set("Retry-After", strconv.Itoa(s.Config.AuthBanSeconds))
+    }
+    writeHTTPJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func httpStatus(err error) int {
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.Is(err, errHTTPUnauthorized), errors.Is(err, errInvalidPassword):
+        return http.StatusUnauthorized
+    case errors.Is(err, errAuthLimit):
+        return http.StatusTooManyRequests
+    case errors.Is(err, errNoPermission):
+        return http.StatusForbidden
+    case errors.Is(err, engine.ErrKeyNotFound), errors.Is(err, engine.ErrPathNotFound):
+        return http.StatusNotFound
+    case errors.Is(err, errReadOnly):
+        return http.StatusConflict
+    case errors.Is(err, engine.ErrOutOfMemory):
+        return http.StatusInsufficientStorage
+    case errors.As(err, &tooLarge):
+        return http.StatusRequestEntityTooLarge
+    case errors.Is(err, errHTTPBadRequest), errors.Is(err, engine.ErrInvalidPath),
+        errors.Is(err, engine.ErrNotJSON), errors.Is(err, engine.ErrWrongType):
+        return http.StatusBadRequest
+    }
+    return http.StatusInternalServerError
+}
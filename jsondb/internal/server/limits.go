@@ -0,0 +1,118 @@
+package server
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "jsondb/internal/config"
+    "log"
+    "net"
+    "time"
+)
+
+// Time given to a rejected connection to receive the reason
+const rejectWriteTimeout = time.Second
+
+const errMaxClients = "max number of clients reached"
+
+// admit counts a new connection against MAX_CONNECTIONS and reports whether
+// it may be served. Every admitted connection is released when it closes.
+func (s *Server) admit() bool {
+    open := s.clients.Add(1)
+    if max := s.Config.MaxConnections; max > 0 && open > int64(max) {
+        s.clients.Add(-1)
+        s.rejectedClients.Add(1)
+        return false
+    }
+    return true
+}
+
+// screen decides whether a new connection is served, and returns why not
+// otherwise. Banned addresses are turned away before they take a slot.
+func (s *Server) screen(conn net.Conn) string {
+    if s.guard.banned(remoteIP(conn.RemoteAddr().String()), time.Now()) {
+        return errAuthBanned.Error()
+    }
+    if !s.admit() {
+        return errMaxClients
+    }
+    return ""
+}
+
+// reject tells a client over the connection limit, or from a banned address,
+// why it is disconnected, in the protocol of its listener.
+func (s *Server) reject(conn net.Conn, protocol string, reason string) {
+    defer conn.Close()
+    if s.Debug {
+        log.Printf("Rejecting connection from %s: %s", conn.RemoteAddr(), reason)
+    }
+    message := "ERROR " + reason + "\n"
+    switch protocol {
+    case config.ProtocolRESP:
+        message = "-ERR " + reason + "\r\n"
+    case config.ProtocolHTTP:
+        body, _ := json.Marshal(map[string]string{"error": reason})
+        message = fmt.Sprintf("HTTP/1.1 503 Service Unavailable\r\nContent-Type: application/json\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+    }
+    conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+    conn.Write([]byte(message))
+}
+
+// newClient creates the state of an admitted connection.
+func (s *Server) newClient(conn net.Conn) *ClientConnection {
+    now := time.Now()
+    client := &ClientConnection{
+        Conn:         conn,
+        Reader:       bufio.NewReader(conn),
+        LastAccess:   now,
+        Connected:    true,
+        writer:       bufio.NewWriter(conn),
+        writeTimeout: seconds(s.Config.WriteTimeoutSeconds),
+    }
+    if timeout := seconds(s.Config.AuthTimeoutSeconds); timeout > 0 {
+        client.authDeadline = now.Add(timeout)
+    }
+    return client
+}
+
+// awaitCommand blocks until the next command starts to arrive. Until the
+// client authenticates it has AUTH_TIMEOUT_SECONDS from connecting, then
+// IDLE_TIMEOUT_SECONDS between commands, except while messages are pushed to
+// it; once a command starts it must be complete within READ_TIMEOUT_SECONDS.
+// A client that exceeds a timeout is disconnected.
+func (s *Server) awaitCommand(client *ClientConnection) error {
+    var deadline time.Time
+    if !client.Authenticated {
+        deadline = client.authDeadline
+    } else if idle := seconds(s.Config.IdleTimeoutSeconds); idle > 0 && !client.pushing() {
+        deadline = time.Now().Add(idle)
+    }
+    client.Conn.SetReadDeadline(deadline)
+    if _, err := client.Reader.Peek(1); err != nil {
+        return err
+    }
+
+    deadline = time.Time{}
+    if timeout := seconds(s.Config.ReadTimeoutSeconds); timeout > 0 {
+        deadline = time.Now().Add(timeout)
+    }
+    client.Conn.SetReadDeadline(deadline)
+    client.LastAccess = time.Now()
+    return nil
+}
+
+// flushLocked sends the buffered output within WRITE_TIMEOUT_SECONDS, so a
+// client that stops reading cannot hold the writer. The caller holds writeMu.
+func (c *ClientConnection) flushLocked() error {
+    if c.writer.Buffered() == 0 {
+        return nil
+    }
+    if c.writeTimeout > 0 {
+        c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+    }
+    return c.writer.Flush()
+}
+
+func seconds(n int) time.Duration {
+    return time.Duration(n) * time.Second
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "jsondb/internal/engine"
+    "strings"
+)
+
+var errExecAbort = errors.New("Transaction discarded because of previous errors")
+
+// transaction holds the commands a client queued between MULTI and EXEC.
+type transaction struct {
+    commands [][]string
+    // failed is set when a command was rejected while queuing, EXEC then
+    // discards the whole transaction
+    failed bool
+}
+
+// runCommand runs a command for a client, handling the transaction commands
+// and queuing everything else while the client is inside MULTI.
+func (s *Server) runCommand(client *ClientConnection, args []string) (reply, error) {
+    if err := s.authorize(client, args); err != nil {
+        if client.multi != nil {
+            client.multi.failed = true
+        }
+        return reply{}, err
+    }
+
+    switch strings.ToUpper(args[0]) {
+    case "MULTI":
+        if client.multi != nil {
+            return reply{}, fmt.Errorf("MULTI calls can not be nested")
+        }
+        client.multi = &transaction{}
+        return okReply, nil
+
+    case "EXEC":
+        if client.multi == nil {
+            return reply{}, fmt.Errorf("EXEC without MULTI")
+        }
+        tx := client.multi
+        client.multi = nil
+        defer func() { client.watched = nil }()
+        if tx.failed {
+            return reply{}, errExecAbort
+        }
+        return s.execTransaction(client, tx)
+
+    case "DISCARD":
+        if client.multi == nil {
+            return reply{}, fmt.Errorf("DISCARD without MULTI")
+        }
+        client.multi = nil
+        client.watched = nil
+        return okReply, nil
+
+    case "WATCH":
+        if client.multi != nil {
+            return reply{}, fmt.Errorf("WATCH inside MULTI is not allowed")
+        }
+        if len(args) < 2 {
+            return reply{}, fmt.Errorf("WATCH command requires at least one key")
+        }
+        if client.watched == nil {
+            client.watched = make(map[string]uint64)
+        }
+        for _, key := range args[1:] {
+            // Watching a key twice keeps the version seen first
+            if _, exists := client.watched[key]; !exists {
+                client.watched[key] = s.Engine.Version(key)
+            }
+        }
+        return okReply, nil
+
+    case "UNWATCH":
+        client.watched = nil
+        return okReply, nil
+    }
+
+    if client.multi != nil {
+        if _, err := transactionKeys(args); err != nil {
+            client.multi.failed = true
+            return reply{}, err
+        }
+        client.multi.commands = append(client.multi.commands, args)
+        return statusValue("QUEUED"), nil
+    }
+
+    cmd := strings.ToUpper(args[0])
+    if client.pushing() && !client.resp3 {
+        if !allowedWhilePushing(cmd) {
+            return reply{}, fmt.Errorf("only SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE, PUNSUBSCRIBE, UNWATCHFEED and PING are allowed while receiving messages")
+        }
+        if cmd == "PING" {
+            message := ""
+            if len(args) > 1 {
+                message = args[1]
+            }
+            return pushValue(bulkValue("pong"), bulkValue(message)), nil
+        }
+    }
+    switch cmd {
+    case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+        return s.subscribeCommand(client, cmd, args[1:])
+    case "WATCHFEED":
+        return s.watchFeed(client, args)
+    case "PSYNC":
+        return s.psync(client, args)
+    case "UNWATCHFEED":
+        return s.unwatchFeed(client), nil
+    }
+    if adminCommands[cmd] {
+        return s.adminCommand(client, cmd, args)
+    }
+    if cmd == "ACL" {
+        return s.aclCommand(client, args)
+    }
+    result, err := s.executeCommand(args)
+    if err == nil && (cmd == "KEYS" || cmd == "SCAN" || cmd == "QUERY") {
+        result = s.filterKeys(client, cmd, result)
+    }
+    return result, err
+}
+
+// execTransaction runs the queued commands with the shards of every queued
+// and watched key locked, so other clients see all of the writes or none.
+// The reply is null when a watched key changed since WATCH.
+func (s *Server) execTransaction(client *ClientConnection, tx *transaction) (reply, error) {
+    var keys []string
+    for key := range client.watched {
+        keys = append(keys, key)
+    }
+    for _, args := range tx.commands {
+        commandKeys, _ := transactionKeys(args)
+        keys = append(keys, commandKeys...)
+    }
+
+    var results []reply
+    aborted := false
+    err := s.Engine.Atomic(keys, func(ks *engine.Tx) error {
+        for key, version := range client.watched {
+            if ks.Version(key) != version {
+                aborted = true
+                return nil
+            }
+        }
+
+        // A failing command does not stop the others, its error is part of the reply
+        results = make([]reply, 0, len(tx.commands))
+        for _, args := range tx.commands {
+            result, err := s.execute(ks, args)
+            if err != nil {
+                result = errorValue(err)
+            }
+            results = append(results, result)
+        }
+        return nil
+    })
+    if err != nil {
+        return reply{}, err
+    }
+    if aborted {
+        return nullValue(), nil
+    }
+    return arrayValue(results...), nil
+}
+
+// transactionKeys returns the keys a command touches, which EXEC locks
+// before running it. Commands that are not bound to a set of keys, such as
+// KEYS or QUERY, cannot be part of a transaction.
+func transactionKeys(args []string) ([]string, error) {
+    cmd := strings.ToUpper(args[0])
+    switch cmd {
+    case "PING":
+        return nil, nil
+
+    case "SET", "GET", "GETSET", "GETDEL", "VERSION", "DELETE", "DEL", "TTL", "PTTL", "EXPIRE", "PEXPIRE", "PERSIST",
+        "JSON.GET", "JSON.SET", "JSON.DEL", "JSON.ARRAPPEND", "JSON.NUMINCRBY":
+        if len(args) < 2 {
+            return nil, fmt.Errorf("%s command requires key", cmd)
+        }
+        return args[1:2], nil
+
+    case "MGET", "MDEL":
+        if len(args) < 2 {
+            return nil, fmt.Errorf("%s command requires at least one key", cmd)
+        }
+        return args[1:], nil
+
+    case "MSET":
+        if len(args) < 3 || len(args)%2 != 1 {
+            return nil, fmt.Errorf("MSET command requires key value pairs")
+        }
+        keys := make([]string, 0, len(args)/2)
+        for i := 1; i < len(args); i += 2 {
+            keys = append(keys, args[i])
+        }
+        return keys, nil
+    }
+    return nil, fmt.Errorf("%s is not allowed inside MULTI", cmd)
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "strconv"
+    "strings"
+)
+
+// Versions of the native protocol. Connections start in line mode and may
+// switch to framed mode with PROTOCOL 2 once authenticated.
+const (
+    nativeLineProtocol   = 1
+    nativeFramedProtocol = 2
+
+    // maxFrameSize bounds the literals of a request together, and the
+    // payload of a response
+    maxFrameSize = 512 * 1024 * 1024
+    // maxNativeLineSize bounds a line mode command or a framed request
+    // header; until the connection is authenticated it is held to
+    // maxNativeLineSizeUnauthenticated, as RESP requests are
+    maxNativeLineSize                = maxFrameSize
+    maxNativeLineSizeUnauthenticated = maxRESPBulkSizeUnauthenticated
+)
+
+var (
+    errFraming     = errors.New("framing error")
+    errLineTooLong = errors.New("request line too long")
+)
+
+// readNativeLine reads a line terminated by a newline, failing with
+// errLineTooLong once it grows past the limit of the connection, so a client
+// cannot make the server buffer a line that never ends.
+func readNativeLine(reader *bufio.Reader, authenticated bool) (string, error) {
+    limit := maxNativeLineSize
+    if !authenticated {
+        limit = maxNativeLineSizeUnauthenticated
+    }
+    var line []byte
+    for {
+        chunk, err := reader.ReadSlice('\n')
+        if len(line)+len(chunk) > limit {
+            return "", fmt.Errorf("%w: more than %d bytes", errLineTooLong, limit)
+        }
+        line = append(line, chunk...)
+        if err != bufio.ErrBufferFull {
+            return string(line), err
+        }
+    }
+}
+
+// readFramedCommand reads one request of the framed protocol. A request is a
+// header line of space separated arguments in which a token {N} stands for a
+// literal: N raw bytes sent after the header line, each literal followed by
+// a newline. Literals are taken as they are, so values with spaces, quotes or
+// newlines round-trip byte-for-byte:
+//
+//	SET key {11}\n
+//	hello\nworld\n
+//
+// The literals of a request share maxFrameSize, and are read as they arrive
+// rather than allocated from their announced sizes. The header line is read
+// with readNativeLine.
+func readFramedCommand(reader *bufio.Reader, authenticated bool) ([]string, error) {
+    header, err := readNativeLine(reader, authenticated)
+    if err != nil {
+        return nil, err
+    }
+
+    args := strings.Fields(header)
+    // The whole request is checked against the budget before any literal
+    // is read
+    total := 0
+    for _, arg := range args {
+        if size, ok := literalSize(arg); ok {
+            if total += size; size > maxFrameSize || total > maxFrameSize {
+                return nil, fmt.Errorf("%w: literals of the request exceed %d bytes", errFraming, maxFrameSize)
+            }
+        }
+    }
+
+    for i, arg := range args {
+        size, ok := literalSize(arg)
+        if !ok {
+            continue
+        }
+        literal, err := readFramedPayload(reader, size)
+        if err != nil {
+            if errors.Is(err, errFraming) {
+                err = fmt.Errorf("%w: literal not terminated by a newline", errFraming)
+            }
+            return nil, err
+        }
+        args[i] = string(literal)
+    }
+    return args, nil
+}
+
+// readFramedPayload reads size bytes followed by a newline, growing its
+// buffer as the data arrives.
+func readFramedPayload(reader *bufio.Reader, size int) ([]byte, error) {
+    var buf bytes.Buffer
+    if _, err := io.CopyN(&buf, reader, int64(size)); err != nil {
+        return nil, err
+    }
+    end, err := reader.ReadByte()
+    if err != nil {
+        return nil, err
+    }
+    if end != '\n' {
+        return nil, errFraming
+    }
+    return buf.Bytes(), nil
+}
+
+// literalSize parses a {N} literal marker.
+func literalSize(token string) (int, bool) {
+    if len(token) < 3 || token[0] != '{' || token[len(token)-1] != '}' {
+        return 0, false
+    }
+    size, err := strconv.Atoi(token[1 : len(token)-1])
+    if err != nil || size < 0 {
+        return 0, false
+    }
+    return size, true
+}
+
+// framedResponse encodes a result of the framed protocol:
+//
+//	VALUE <len>\n<payload>\n   a reply, rendered as in line mode
+//	ERROR <len>\n<message>\n   an error
+//	NIL\n                      a missing key or path
+//
+// An empty value is sent as VALUE 0; only an empty status reply becomes OK.
+func framedResponse(result reply, err error) []byte {
+    if err != nil {
+        return []byte(fmt.Sprintf("ERROR %d\n%s\n", len(err.Error()), err.Error()))
+    }
+    if result.typ == nullReply {
+        return []byte("NIL\n")
+    }
+
+    payload := result.native()
+    if payload == "" && result.typ == statusReply {
+        payload = "OK"
+    }
+    return []byte(fmt.Sprintf("VALUE %d\n%s\n", len(payload), payload))
+}
+
+// readFramedResponse reads one response of the framed protocol, as sent by
+// framedResponse. A NIL response returns a nil payload, an ERROR response
+// returns the message as an error.
+func readFramedResponse(reader *bufio.Reader) ([]byte, error) {
+    header, err := reader.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    kind, sizeStr, _ := strings.Cut(strings.TrimSpace(header), " ")
+    if kind == "NIL" {
+        return nil, nil
+    }
+    size, err := strconv.Atoi(sizeStr)
+    if (kind != "VALUE" && kind != "ERROR") || err != nil || size < 0 || size > maxFrameSize {
+        return nil, fmt.Errorf("%w: invalid response header %q", errFraming, strings.TrimSpace(header))
+    }
+
+    payload, err := readFramedPayload(reader, size)
+    if err != nil {
+        if errors.Is(err, errFraming) {
+            err = fmt.Errorf("%w: response not terminated by a newline", errFraming)
+        }
+        return nil, err
+    }
+    if kind == "ERROR" {
+        return nil, errors.New(string(payload))
+    }
+    return payload, nil
+}
+
+// nativeResponse encodes a result in the line or framed native protocol. The
+// replies of a sequence are sent as separate responses.
+func nativeResponse(protocol int, result reply, err error) []byte {
+    if err == nil && result.typ == errorReply {
+        // An error pushed on its own, such as a lost change feed
+        err = errors.New(result.str)
+    }
+    if err == nil && result.typ == sequenceReply {
+        var out []byte
+        for _, elem := range result.elems {
+            out = append(out, nativeResponse(protocol, elem, nil)...)
+        }
+        return out
+    }
+
+    if protocol == nativeFramedProtocol {
+        return framedResponse(result, err)
+    }
+    if err != nil {
+        return []byte(fmt.Sprintf("ERROR %s\n", err.Error()))
+    }
+    if text := result.native(); text != "" {
+        return []byte(text + "\n")
+    }
+    return []byte("OK\n")
+}
+
+// parseProtocolVersion parses the argument of a PROTOCOL command.
+func parseProtocolVersion(args []string) (int, error) {
+    if len(args) != 2 {
+        return 0, fmt.Errorf("PROTOCOL command requires version")
+    }
+    version, err := strconv.Atoi(args[1])
+    if err != nil || (version != nativeLineProtocol && version != nativeFramedProtocol) {
+        return 0, fmt.Errorf("unsupported protocol version: %s", args[1])
+    }
+    return version, nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/binary"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// Passwords are hashed with PBKDF2-HMAC-SHA256 and a random salt, stored as
+// $pbkdf2-sha256$<iterations>$<salt>$<key> with the salt and key in unpadded
+// base64. Every hash keeps the iteration count it was made with, so the
+// count can be raised without invalidating existing hashes.
+const (
+    passwordHashScheme = "pbkdf2-sha256"
+    // Iterations of new hashes when PASSWORD_HASH_ITERATIONS is not set
+    passwordHashIterations = 310000
+    passwordSaltSize       = 16
+    // Bounds of the hashes accepted from ACL rules, so a rule cannot make
+    // every login arbitrarily slow
+    minPasswordSaltSize       = 8
+    maxPasswordHashIterations = 10000000
+)
+
+var passwordEncoding = base64.RawStdEncoding
+
+// passwordHash is a salted password hash, see parsePasswordHash.
+type passwordHash struct {
+    iterations int
+    salt       []byte
+    key        []byte
+}
+
+// hashPassword hashes a password with a new random salt.
+func hashPassword(password string, iterations int) (string, error) {
+    salt, err := newPasswordSalt()
+    if err != nil {
+        return "", err
+    }
+    hash := passwordHash{iterations: iterations, salt: salt}
+    hash.key = pbkdf2SHA256([]byte(password), salt, hash.iterations, sha256.Size)
+    return hash.String(), nil
+}
+
+// dummyPasswordHash returns a hash no password is expected to match, checked
+// in place of the hashes of users that do not exist so that a failed login
+// costs the same whether or not the user exists.
+func dummyPasswordHash(iterations int) (passwordHash, error) {
+    salt, err := newPasswordSalt()
+    if err != nil {
+        return passwordHash{}, err
+    }
+    key := make([]byte, sha256.Size)
+    if _, err := rand.Read(key); err != nil {
+        return passwordHash{}, fmt.Errorf("failed to generate password salt: %v", err)
+    }
+    return passwordHash{iterations: iterations, salt: salt, key: key}, nil
+}
+
+func newPasswordSalt() ([]byte, error) {
+    salt := make([]byte, passwordSaltSize)
+    if _, err := rand.Read(salt); err != nil {
+        return nil, fmt.Errorf("failed to generate password salt: %v", err)
+    }
+    return salt, nil
+}
+
+// parsePasswordHash parses a hash in the format written by hashPassword.
+func parsePasswordHash(s string) (passwordHash, bool) {
+    parts := strings.Split(s, "$")
+    if len(parts) != 5 || parts[0] != "" || parts[1] != passwordHashScheme {
+        return passwordHash{}, false
+    }
+    iterations, err := strconv.Atoi(parts[2])
+    if err != nil || iterations < 1 || iterations > maxPasswordHashIterations {
+        return passwordHash{}, false
+    }
+    salt, err := passwordEncoding.DecodeString(parts[3])
+    if err != nil || len(salt) < minPasswordSaltSize {
+        return passwordHash{}, false
+    }
+    key, err := passwordEncoding.DecodeString(parts[4])
+    if err != nil || len(key) != sha256.Size {
+        return passwordHash{}, false
+    }
+    return passwordHash{iterations: iterations, salt: salt, key: key}, true
+}
+
+func (h passwordHash) String() string {
+    return fmt.Sprintf("$%s$%d$%s$%s", passwordHashScheme, h.iterations,
+        passwordEncoding.EncodeToString(h.salt), passwordEncoding.EncodeToString(h.key))
+}
+
+// matches reports whether password hashes to h, compared in constant time.
+func (h passwordHash) matches(password string) bool {
+    key := pbkdf2SHA256([]byte(password), h.salt, h.iterations, len(h.key))
+    return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// pbkdf2SHA256 derives a key of keyLen bytes with PBKDF2 (RFC 8018) using
+// HMAC-SHA256 as the pseudorandom function.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+    prf := hmac.New(sha256.New, password)
+    key := make([]byte, 0, keyLen+sha256.Size)
+    block := make([]byte, sha256.Size)
+    var u []byte
+    for counter := uint32(1); len(key) < keyLen; counter++ {
+        prf.Reset()
+        prf.Write(salt)
+        prf.Write(binary.BigEndian.AppendUint32(nil, counter))
+        u = prf.Sum(u[:0])
+        copy(block, u)
+        for i := 1; i < iterations; i++ {
+            prf.Reset()
+            prf.Write(u)
+            u = prf.Sum(u[:0])
+            for j := range block {
+                block[j] ^= u[j]
+            }
+        }
+        key = append(key, block...)
+    }
+    return key[:keyLen]
+}
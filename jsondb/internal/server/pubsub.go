@@ -0,0 +1,350 @@
+package server
+
+import (
+    "fmt"
+    "jsondb/internal/engine"
+    "log"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// Messages a subscriber may fall behind by before it is disconnected
+const defaultPubsubBuffer = 1024
+
+// Channels keyspace notifications are published on, named as in Redis
+const (
+    keyspaceChannelPrefix = "__keyspace@0__:"
+    keyeventChannelPrefix = "__keyevent@0__:"
+)
+
+// pubsubMessage is a message queued for one subscriber.
+type pubsubMessage struct {
+    // pattern is set when the message matched a PSUBSCRIBE pattern
+    pattern string
+    channel string
+    payload string
+}
+
+func (m pubsubMessage) reply() reply {
+    if m.pattern != "" {
+        return pushValue(bulkValue("pmessage"), bulkValue(m.pattern), bulkValue(m.channel), bulkValue(m.payload))
+    }
+    return pushValue(bulkValue("message"), bulkValue(m.channel), bulkValue(m.payload))
+}
+
+// subscriber is the pub/sub state of one connection. Messages wait in a
+// bounded buffer; a client that falls further behind is dropped instead of
+// slowing down the publishers.
+type subscriber struct {
+    messages chan pubsubMessage
+    done     chan struct{}
+    doneOnce sync.Once
+    dropped  atomic.Bool
+    // user is the ACL user of the connection, see ClientConnection.setUser
+    user atomic.Value
+
+    // Subscriptions of the connection. They are changed by the connection's
+    // goroutine with the broker locked, so that goroutine reads them freely.
+    channels map[string]struct{}
+    patterns map[string]struct{}
+}
+
+func (sub *subscriber) count() int {
+    return len(sub.channels) + len(sub.patterns)
+}
+
+func (sub *subscriber) close() {
+    sub.doneOnce.Do(func() { close(sub.done) })
+}
+
+// broker routes published messages to subscribers.
+type broker struct {
+    mu       sync.RWMutex
+    channels map[string]map[*subscriber]struct{}
+    patterns map[string]map[*subscriber]struct{}
+    // subscriptions lets keyspace events return early while nobody listens
+    subscriptions atomic.Int64
+
+    bufferSize int
+    events     map[string]bool
+    // readable reports whether an ACL user may read a key. Keyspace
+    // notifications name keys, so they only reach subscribers allowed to
+    // read them.
+    readable func(user, key string) bool
+}
+
+// newBroker creates a broker. events lists the keyspace events to publish,
+// "all" standing for every event.
+func newBroker(bufferSize int, events []string) *broker {
+    if bufferSize <= 0 {
+        bufferSize = defaultPubsubBuffer
+    }
+    b := &broker{
+        channels:   make(map[string]map[*subscriber]struct{}),
+        patterns:   make(map[string]map[*subscriber]struct{}),
+        bufferSize: bufferSize,
+        events:     make(map[string]bool),
+    }
+    for _, event := range events {
+        if event == "all" {
+            for _, e := range []string{engine.EventSet, engine.EventDel, engine.EventExpired, engine.EventEvicted} {
+                b.events[e] = true
+            }
+            continue
+        }
+        b.events[event] = true
+    }
+    return b
+}
+
+func (b *broker) newSubscriber(user string) *subscriber {
+    sub := &subscriber{
+        messages: make(chan pubsubMessage, b.bufferSize),
+        done:     make(chan struct{}),
+        channels: make(map[string]struct{}),
+        patterns: make(map[string]struct{}),
+    }
+    sub.user.Store(user)
+    return sub
+}
+
+func (b *broker) subscribe(sub *subscriber, channel string) {
+    b.add(b.channels, sub.channels, sub, channel)
+}
+
+func (b *broker) unsubscribe(sub *subscriber, channel string) {
+    b.remove(b.channels, sub.channels, sub, channel)
+}
+
+func (b *broker) psubscribe(sub *subscriber, pattern string) {
+    b.add(b.patterns, sub.patterns, sub, pattern)
+}
+
+func (b *broker) punsubscribe(sub *subscriber, pattern string) {
+    b.remove(b.patterns, sub.patterns, sub, pattern)
+}
+
+func (b *broker) add(index map[string]map[*subscriber]struct{}, own map[string]struct{}, sub *subscriber, name string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if _, exists := own[name]; exists {
+        return
+    }
+    own[name] = struct{}{}
+    if index[name] == nil {
+        index[name] = make(map[*subscriber]struct{})
+    }
+    index[name][sub] = struct{}{}
+    b.subscriptions.Add(1)
+}
+
+func (b *broker) remove(index map[string]map[*subscriber]struct{}, own map[string]struct{}, sub *subscriber, name string) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if _, exists := own[name]; !exists {
+        return
+    }
+    delete(own, name)
+    delete(index[name], sub)
+    if len(index[name]) == 0 {
+        delete(index, name)
+    }
+    b.subscriptions.Add(-1)
+}
+
+// removeAll drops every subscription of a disconnecting client.
+func (b *broker) removeAll(sub *subscriber) {
+    for channel := range sub.channels {
+        b.unsubscribe(sub, channel)
+    }
+    for pattern := range sub.patterns {
+        b.punsubscribe(sub, pattern)
+    }
+}
+
+// publish queues a message for every subscriber of channel and returns how
+// many received it.
+func (b *broker) publish(channel, payload string) int {
+    return b.publishTo(channel, payload, nil)
+}
+
+// publishTo publishes a message to the subscribers accept returns true for,
+// every subscriber when accept is nil.
+func (b *broker) publishTo(channel, payload string, accept func(sub *subscriber) bool) int {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+
+    receivers := 0
+    for sub := range b.channels[channel] {
+        if accept != nil && !accept(sub) {
+            continue
+        }
+        if b.deliver(sub, pubsubMessage{channel: channel, payload: payload}) {
+            receivers++
+        }
+    }
+    for pattern, subs := range b.patterns {
+        if !engine.MatchGlob(pattern, channel) {
+            continue
+        }
+        for sub := range subs {
+            if accept != nil && !accept(sub) {
+                continue
+            }
+            if b.deliver(sub, pubsubMessage{pattern: pattern, channel: channel, payload: payload}) {
+                receivers++
+            }
+        }
+    }
+    return receivers
+}
+
+// deliver queues a message without blocking. A subscriber whose buffer is
+// full is dropped, its connection is closed by pushMessages.
+func (b *broker) deliver(sub *subscriber, msg pubsubMessage) bool {
+    select {
+    case sub.messages <- msg:
+        return true
+    default:
+        sub.dropped.Store(true)
+        sub.close()
+        return false
+    }
+}
+
+// keyEvent publishes the keyspace notifications of a key event. It is
+// installed as the engine's KeyEventFunc and never blocks. Subscribers whose
+// user may not read the key receive neither notification.
+func (b *broker) keyEvent(event, key string) {
+    if b.subscriptions.Load() == 0 || !b.events[event] {
+        return
+    }
+    var accept func(sub *subscriber) bool
+    if b.readable != nil {
+        accept = func(sub *subscriber) bool {
+            return b.readable(sub.user.Load().(string), key)
+        }
+    }
+    b.publishTo(keyspaceChannelPrefix+key, event, accept)
+    b.publishTo(keyeventChannelPrefix+event, key, accept)
+}
+
+// setUser records the ACL user a client authenticated as, for authorize and
+// for the keyspace notifications it may receive.
+func (c *ClientConnection) setUser(user string) {
+    c.user = user
+    if c.sub != nil {
+        c.sub.user.Store(user)
+    }
+}
+
+// subscribed reports whether the client has active subscriptions.
+func (c *ClientConnection) subscribed() bool {
+    return c.sub != nil && c.sub.count() > 0
+}
+
+// pushing reports whether messages are pushed to the client, from
+// subscriptions or from the change feed.
+func (c *ClientConnection) pushing() bool {
+    return c.subscribed() || c.feedDone != nil
+}
+
+// allowedWhilePushing reports whether a command may run on a connection
+// that receives pushed messages. Outside of RESP3 they cannot be told apart
+// from replies, so only the pub/sub and feed commands are accepted there.
+func allowedWhilePushing(cmd string) bool {
+    switch cmd {
+    case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "UNWATCHFEED", "PING":
+        return true
+    }
+    return false
+}
+
+// subscribeCommand implements SUBSCRIBE, PSUBSCRIBE, UNSUBSCRIBE and
+// PUNSUBSCRIBE, replying with one confirmation per channel or pattern.
+func (s *Server) subscribeCommand(client *ClientConnection, cmd string, names []string) (reply, error) {
+    kind := strings.ToLower(cmd)
+    if (cmd == "SUBSCRIBE" || cmd == "PSUBSCRIBE") && len(names) == 0 {
+        return reply{}, fmt.Errorf("%s command requires at least one channel", cmd)
+    }
+
+    sub := client.sub
+    if sub == nil {
+        if cmd == "UNSUBSCRIBE" || cmd == "PUNSUBSCRIBE" {
+            return pushValue(bulkValue(kind), nullValue(), integerValue(0)), nil
+        }
+        sub = s.pubsub.newSubscriber(client.user)
+        client.sub = sub
+        go s.pushMessages(client, sub)
+    }
+
+    if len(names) == 0 {
+        // Without arguments every channel, or every pattern, is left
+        own := sub.channels
+        if cmd == "PUNSUBSCRIBE" {
+            own = sub.patterns
+        }
+        for name := range own {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+    }
+
+    replies := make([]reply, 0, len(names))
+    for _, name := range names {
+        switch cmd {
+        case "SUBSCRIBE":
+            s.pubsub.subscribe(sub, name)
+        case "PSUBSCRIBE":
+            s.pubsub.psubscribe(sub, name)
+        case "UNSUBSCRIBE":
+            s.pubsub.unsubscribe(sub, name)
+        case "PUNSUBSCRIBE":
+            s.pubsub.punsubscribe(sub, name)
+        }
+        replies = append(replies, pushValue(bulkValue(kind), bulkValue(name), integerValue(int64(sub.count()))))
+    }
+    if len(replies) == 0 {
+        return pushValue(bulkValue(kind), nullValue(), integerValue(int64(sub.count()))), nil
+    }
+    return sequenceValue(replies...), nil
+}
+
+// pushMessages writes the messages queued for a client until it disconnects
+// or is dropped for falling behind, which closes its connection.
+func (s *Server) pushMessages(client *ClientConnection, sub *subscriber) {
+    for {
+        select {
+        case msg := <-sub.messages:
+            client.writeMu.Lock()
+            client.encodePush(msg.reply())
+            var err error
+            if len(sub.messages) == 0 {
+                err = client.flushLocked()
+            }
+            client.writeMu.Unlock()
+            if err != nil {
+                client.Conn.Close()
+                return
+            }
+        case <-sub.done:
+            if sub.dropped.Load() {
+                log.Printf("Disconnecting pub/sub client %s: more than %d messages behind", client.Conn.RemoteAddr(), s.pubsub.bufferSize)
+                client.Conn.Close()
+            }
+            return
+        }
+    }
+}
+
+// closeSubscriber releases the subscriptions of a disconnected client.
+func (s *Server) closeSubscriber(client *ClientConnection) {
+    if client.sub != nil {
+        s.pubsub.removeAll(client.sub)
+        client.sub.close()
+    }
+}
@@ -0,0 +1,446 @@
+package server
+
+import (
+    "bufio"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "jsondb/internal/config"
+    "jsondb/internal/engine"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// States of a follower's link to its leader, reported by ROLE
+const (
+    replStateConnect   = "connect"
+    replStateSync      = "sync"
+    replStateConnected = "connected"
+)
+
+const (
+    replicaDialTimeout = 5 * time.Second
+    replicaRetryDelay  = time.Second
+
+    // snapshotChunkSize bounds the frames a full sync snapshot is sent in
+    snapshotChunkSize = 1024 * 1024
+    // A leader pings an idle follower every replHeartbeatInterval; a
+    // follower that hears nothing for replicaReadTimeout drops the link,
+    // so a half-open connection does not stall replication
+    replHeartbeatInterval = 10 * time.Second
+    replicaReadTimeout    = 3 * replHeartbeatInterval
+)
+
+var errReadOnly = errors.New("You can't write against a read only replica.")
+
+// heartbeatPayload is the ping a leader sends an idle follower, see streamFeed
+var heartbeatPayload = pushValue(bulkValue("ping")).native()
+
+// writeCommands are the commands a follower refuses, its data only changes
+// through replication.
+var writeCommands = map[string]bool{
+    "SET": true, "GETSET": true, "GETDEL": true, "DELETE": true, "DEL": true,
+    "MSET": true, "MDEL": true, "EXPIRE": true, "PEXPIRE": true, "PERSIST": true,
+    "JSON.SET": true, "JSON.DEL": true, "JSON.ARRAPPEND": true, "JSON.NUMINCRBY": true,
+    "FLUSHALL": true, "RESET_MEMORY": true, "RESTORE": true,
+}
+
+// replicaLink is a follower's connection to its leader. offset is the
+// sequence number of the next change expected, kept across reconnects so a
+// short interruption resumes from the leader's change feed.
+type replicaLink struct {
+    address  string
+    password string
+    done     chan struct{}
+    offset   atomic.Uint64
+    state    atomic.Value
+
+    mu   sync.Mutex
+    conn net.Conn
+}
+
+func (link *replicaLink) setConn(conn net.Conn) bool {
+    link.mu.Lock()
+    defer link.mu.Unlock()
+    select {
+    case <-link.done:
+        return false
+    default:
+    }
+    link.conn = conn
+    return true
+}
+
+// stop ends replication, interrupting a connection in progress.
+func (link *replicaLink) stop() {
+    link.mu.Lock()
+    defer link.mu.Unlock()
+    close(link.done)
+    if link.conn != nil {
+        link.conn.Close()
+    }
+}
+
+// readOnly reports whether the server follows a leader.
+func (s *Server) readOnly() bool {
+    return s.replica.Load() != nil
+}
+
+// replicaOf makes the server follow the leader at address, or stops
+// following when address is empty. The data is kept either way; a new leader
+// replaces it with a full sync.
+func (s *Server) replicaOf(address string) {
+    s.replMu.Lock()
+    defer s.replMu.Unlock()
+
+    if link := s.replica.Swap(nil); link != nil {
+        link.stop()
+    }
+    if address == "" {
+        log.Printf("Replication stopped, accepting writes")
+        return
+    }
+
+    password := s.Config.ReplicaPassword
+    if password == "" {
+        password = s.Password
+    }
+    link := &replicaLink{address: address, password: password, done: make(chan struct{})}
+    link.state.Store(replStateConnect)
+    s.replica.Store(link)
+    go s.runReplica(link)
+}
+
+// replicaOfCommand implements REPLICAOF host port and REPLICAOF NO ONE.
+func (s *Server) replicaOfCommand(args []string) (reply, error) {
+    if len(args) != 3 {
+        return reply{}, fmt.Errorf("REPLICAOF command requires host and port, or NO ONE")
+    }
+    if strings.EqualFold(args[1], "NO") && strings.EqualFold(args[2], "ONE") {
+        s.replicaOf("")
+        return okReply, nil
+    }
+    if _, err := strconv.ParseUint(args[2], 10, 16); err != nil {
+        return reply{}, fmt.Errorf("invalid port: %s", args[2])
+    }
+    s.replicaOf(net.JoinHostPort(args[1], args[2]))
+    return okReply, nil
+}
+
+// roleCommand implements ROLE. A leader reports the sequence number of its
+// next change and the position of every follower, a follower its leader,
+// link state and the sequence number of the next change it expects.
+func (s *Server) roleCommand() (reply, error) {
+    if link := s.replica.Load(); link != nil {
+        host, port, _ := net.SplitHostPort(link.address)
+        portNum, _ := strconv.ParseInt(port, 10, 64)
+        return arrayValue(
+            bulkValue("slave"),
+            bulkValue(host),
+            integerValue(portNum),
+            bulkValue(link.state.Load().(string)),
+            integerValue(int64(link.offset.Load())),
+        ), nil
+    }
+
+    var next uint64
+    if _, n, err := s.Engine.ChangeFeedBounds(); err == nil {
+        next = n
+    }
+    followers := []reply{}
+    s.followers.Range(func(key, _ interface{}) bool {
+        client := key.(*ClientConnection)
+        followers = append(followers, arrayValue(
+            bulkValue(client.Conn.RemoteAddr().String()),
+            integerValue(int64(client.feedSeq.Load())),
+        ))
+        return true
+    })
+    return arrayValue(bulkValue("master"), integerValue(int64(next)), arrayValue(followers...)), nil
+}
+
+// psync implements PSYNC from_seq, sent by a follower. When the leader's
+// change feed still holds from_seq the reply is ["continue", seq]; otherwise
+// it is ["fullsync", seq] followed by a snapshot in the DumpToDisk format,
+// sent as it is written in VALUE frames of at most snapshotChunkSize bytes
+// and ended by an empty one. Changes from seq on are streamed after the
+// reply, with ["ping"] sent while there are none. Like the changes, the
+// snapshot holds decrypted values, which the follower encrypts with its own
+// keys. A snapshot is binary, so line mode connections cannot sync.
+// The caller holds the client's writeMu.
+func (s *Server) psync(client *ClientConnection, args []string) (reply, error) {
+    if len(args) != 2 {
+        return reply{}, fmt.Errorf("PSYNC command requires from_seq")
+    }
+    if client.Protocol != nativeFramedProtocol {
+        return reply{}, fmt.Errorf("PSYNC requires the framed protocol")
+    }
+    if client.feedDone != nil {
+        return reply{}, fmt.Errorf("connection is already watching the change feed")
+    }
+    from, err := strconv.ParseUint(args[1], 10, 64)
+    if err != nil {
+        return reply{}, fmt.Errorf("invalid sequence number: %s", args[1])
+    }
+
+    if from != 0 {
+        _, _, err := s.Engine.ReadChanges(from, 0)
+        if err == nil {
+            s.startFeed(client, from, true)
+            return pushValue(bulkValue("continue"), integerValue(int64(from))), nil
+        }
+        if !errors.Is(err, engine.ErrChangesLost) {
+            return reply{}, err
+        }
+    }
+
+    // Changes made while the snapshot is written are streamed again after
+    // it; applying a change twice leaves the same data
+    _, next, err := s.Engine.ChangeFeedBounds()
+    if err != nil {
+        return reply{}, err
+    }
+    client.writer.Write(framedResponse(pushValue(bulkValue("fullsync"), integerValue(int64(next))), nil))
+    chunks := &snapshotChunkWriter{client: client}
+    if err := s.Engine.WritePlainSnapshot(chunks); err != nil {
+        // The ERROR frame the failure is answered with ends the snapshot
+        return reply{}, err
+    }
+    if err := chunks.close(); err != nil {
+        return reply{}, err
+    }
+    s.startFeed(client, next, true)
+    // Everything was written already
+    return sequenceValue(), nil
+}
+
+// snapshotChunkWriter sends a snapshot to a follower as it is written, in
+// VALUE frames of at most snapshotChunkSize bytes, so neither side holds the
+// whole snapshot in memory. The caller holds the client's writeMu.
+type snapshotChunkWriter struct {
+    client *ClientConnection
+    chunk  []byte
+}
+
+func (cw *snapshotChunkWriter) Write(p []byte) (int, error) {
+    written := 0
+    for len(p) > 0 {
+        n := snapshotChunkSize - len(cw.chunk)
+        if n > len(p) {
+            n = len(p)
+        }
+        cw.chunk = append(cw.chunk, p[:n]...)
+        p = p[n:]
+        written += n
+        if len(cw.chunk) == snapshotChunkSize {
+            if err := cw.send(); err != nil {
+                return written, err
+            }
+        }
+    }
+    return written, nil
+}
+
+// send writes the pending chunk as one frame, an empty chunk ending the snapshot.
+func (cw *snapshotChunkWriter) send() error {
+    fmt.Fprintf(cw.client.writer, "VALUE %d\n", len(cw.chunk))
+    cw.client.writer.Write(cw.chunk)
+    cw.client.writer.WriteByte('\n')
+    cw.chunk = cw.chunk[:0]
+    return cw.client.flushLocked()
+}
+
+// close sends the last chunk and the empty frame ending the snapshot.
+func (cw *snapshotChunkWriter) close() error {
+    if len(cw.chunk) > 0 {
+        if err := cw.send(); err != nil {
+            return err
+        }
+    }
+    return cw.send()
+}
+
+// snapshotChunkReader reads a snapshot sent by snapshotChunkWriter, up to
+// the empty frame ending it.
+type snapshotChunkReader struct {
+    reader *bufio.Reader
+    conn   net.Conn
+    chunk  []byte
+    size   int
+    done   bool
+}
+
+func (cr *snapshotChunkReader) Read(p []byte) (int, error) {
+    for len(cr.chunk) == 0 {
+        if cr.done {
+            return 0, io.EOF
+        }
+        cr.conn.SetReadDeadline(time.Now().Add(replicaReadTimeout))
+        chunk, err := readFramedResponse(cr.reader)
+        if err != nil {
+            return 0, err
+        }
+        if chunk == nil {
+            return 0, fmt.Errorf("%w: unexpected NIL in snapshot", errFraming)
+        }
+        cr.chunk = chunk
+        cr.size += len(chunk)
+        cr.done = len(chunk) == 0
+    }
+    n := copy(p, cr.chunk)
+    cr.chunk = cr.chunk[n:]
+    return n, nil
+}
+
+// runReplica keeps a follower connected to its leader until the link stops.
+func (s *Server) runReplica(link *replicaLink) {
+    for {
+        err := s.replicate(link)
+        select {
+        case <-link.done:
+            return
+        default:
+        }
+        log.Printf("Replication from %s interrupted: %v", link.address, err)
+        link.state.Store(replStateConnect)
+
+        select {
+        case <-time.After(replicaRetryDelay):
+        case <-link.done:
+            return
+        }
+    }
+}
+
+// dialLeader connects to the leader, over TLS with REPLICA_TLS. The files are
+// read on every connection, so renewed certificates are picked up.
+func (s *Server) dialLeader(address string) (net.Conn, error) {
+    dialer := &net.Dialer{Timeout: replicaDialTimeout}
+    if !s.Config.ReplicaTLS {
+        return dialer.Dial("tcp", address)
+    }
+    tlsConfig, err := loadReplicaTLSConfig(s.Config)
+    if err != nil {
+        return nil, err
+    }
+    return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+}
+
+// replicate runs one connection to the leader: it authenticates, switches to
+// the framed protocol, syncs and applies changes until the connection fails.
+func (s *Server) replicate(link *replicaLink) error {
+    conn, err := s.dialLeader(link.address)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    if !link.setConn(conn) {
+        return nil
+    }
+    reader := bufio.NewReader(conn)
+
+    expect := func(want string) error {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return err
+        }
+        if line = strings.TrimSpace(line); line != want {
+            return fmt.Errorf("leader replied %q", line)
+        }
+        return nil
+    }
+    if err := expect("AUTH_REQUIRED"); err != nil {
+        return err
+    }
+    // AUTH is sent in line mode, where whitespace would split the password
+    // and a newline would end the command
+    if strings.ContainsAny(link.password, config.LineWhitespace) {
+        return fmt.Errorf("the replica password cannot be sent: it contains whitespace")
+    }
+    fmt.Fprintf(conn, "AUTH %s\n", link.password)
+    if err := expect("OK"); err != nil {
+        return err
+    }
+    fmt.Fprintf(conn, "PROTOCOL %d\n", nativeFramedProtocol)
+    if err := expect("OK"); err != nil {
+        return err
+    }
+
+    fmt.Fprintf(conn, "PSYNC %d\n", link.offset.Load())
+    conn.SetReadDeadline(time.Now().Add(replicaReadTimeout))
+    payload, err := readFramedResponse(reader)
+    if err != nil {
+        return err
+    }
+    var mode string
+    var seq uint64
+    if err := json.Unmarshal(payload, &[]interface{}{&mode, &seq}); err != nil {
+        return fmt.Errorf("invalid PSYNC reply %q", payload)
+    }
+
+    if mode == "fullsync" {
+        link.state.Store(replStateSync)
+        snapshot := &snapshotChunkReader{reader: reader, conn: conn}
+        if err := s.Engine.LoadSnapshot(snapshot); err != nil {
+            return fmt.Errorf("failed to load snapshot: %v", err)
+        }
+        // The loaded snapshot may end before the frame that closes it
+        if _, err := io.Copy(io.Discard, snapshot); err != nil {
+            return err
+        }
+        if s.Config.AofEnabled || s.Config.DumpMemoryOn {
+            // The append-only log does not hold the loaded keys
+            if err := s.Engine.DumpToDisk(); err != nil {
+                log.Printf("Failed to dump memory after full sync: %v", err)
+            }
+        }
+        log.Printf("Full sync from %s done, %d bytes", link.address, snapshot.size)
+    }
+    link.offset.Store(seq)
+    link.state.Store(replStateConnected)
+
+    for {
+        conn.SetReadDeadline(time.Now().Add(replicaReadTimeout))
+        payload, err := readFramedResponse(reader)
+        if err != nil {
+            return err
+        }
+        if string(payload) == heartbeatPayload {
+            continue
+        }
+        event, err := parseChange(payload)
+        if err != nil {
+            return err
+        }
+        if err := s.Engine.ApplyChange(event); err != nil {
+            return fmt.Errorf("failed to apply change %d: %v", event.Seq, err)
+        }
+        link.offset.Store(event.Seq + 1)
+    }
+}
+
+// parseChange decodes a change pushed by the leader, see changeReply.
+func parseChange(payload []byte) (engine.ChangeEvent, error) {
+    var kind string
+    var event engine.ChangeEvent
+    var value *string
+    var expiresAt int64
+    fields := []interface{}{&kind, &event.Seq, &event.Op, &event.Key, &value, &expiresAt}
+    if err := json.Unmarshal(payload, &fields); err != nil || kind != "change" {
+        return event, fmt.Errorf("invalid change %q", payload)
+    }
+    if value != nil {
+        event.Value = []byte(*value)
+    }
+    if expiresAt != 0 {
+        event.ExpiresAt = time.UnixMilli(expiresAt)
+    }
+    return event, nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+    "bufio"
+    "encoding/json"
+    "strconv"
+    "strings"
+)
+
+type replyType int
+
+const (
+    statusReply replyType = iota
+    bulkReply
+    integerReply
+    nullReply
+    arrayReply
+    mapReply
+    errorReply
+    pushReply
+    sequenceReply
+)
+
+// reply is the protocol independent result of a command. Each protocol
+// decides how the types are put on the wire.
+type reply struct {
+    typ   replyType
+    str   string
+    num   int64
+    elems []reply
+}
+
+func statusValue(s string) reply  { return reply{typ: statusReply, str: s} }
+func bulkValue(s string) reply    { return reply{typ: bulkReply, str: s} }
+func integerValue(n int64) reply  { return reply{typ: integerReply, num: n} }
+func nullValue() reply            { return reply{typ: nullReply} }
+
+// errorValue is an error inside an array, such as a failed command of a
+// transaction. Errors of a whole command are returned as error values instead.
+func errorValue(err error) reply { return reply{typ: errorReply, str: err.Error()} }
+func arrayValue(elems ...reply) reply {
+    if elems == nil {
+        elems = []reply{}
+    }
+    return reply{typ: arrayReply, elems: elems}
+}
+
+// mapValue builds a map reply from alternating keys and values. RESP2 has no
+// map type and sends it as a flat array.
+func mapValue(pairs ...reply) reply {
+    return reply{typ: mapReply, elems: pairs}
+}
+
+// pushValue builds an out of band message such as a pub/sub message. RESP3
+// marks it as a push, elsewhere it is an array.
+func pushValue(elems ...reply) reply {
+    return reply{typ: pushReply, elems: elems}
+}
+
+// sequenceValue holds several replies sent one after the other for a single
+// command, like the confirmations of SUBSCRIBE a b.
+func sequenceValue(replies ...reply) reply {
+    return reply{typ: sequenceReply, elems: replies}
+}
+
+var okReply = statusValue("OK")
+
+func boolValue(b bool) reply {
+    if b {
+        return integerValue(1)
+    }
+    return integerValue(0)
+}
+
+// stringsValue turns a list of keys into an array of bulk strings.
+func stringsValue(values []string) reply {
+    elems := make([]reply, len(values))
+    for i, value := range values {
+        elems[i] = bulkValue(value)
+    }
+    return arrayValue(elems...)
+}
+
+// native renders a reply for the line based protocol: strings as they are,
+// null as nil and arrays as JSON.
+func (r reply) native() string {
+    switch r.typ {
+    case statusReply, bulkReply:
+        return r.str
+    case integerReply:
+        return strconv.FormatInt(r.num, 10)
+    case nullReply:
+        return "nil"
+    case errorReply:
+        return "ERROR " + r.str
+    }
+    return string(r.nativeJSON())
+}
+
+func (r reply) nativeJSON() []byte {
+    switch r.typ {
+    case integerReply:
+        return []byte(strconv.FormatInt(r.num, 10))
+    case nullReply:
+        return []byte("null")
+    case arrayReply, pushReply, sequenceReply:
+        parts := make([]string, len(r.elems))
+        for i, elem := range r.elems {
+            parts[i] = string(elem.nativeJSON())
+        }
+        return []byte("[" + strings.Join(parts, ",") + "]")
+    case mapReply:
+        parts := make([]string, 0, len(r.elems)/2)
+        for i := 0; i+1 < len(r.elems); i += 2 {
+            key, _ := json.Marshal(r.elems[i].native())
+            parts = append(parts, string(key)+":"+string(r.elems[i+1].nativeJSON()))
+        }
+        return []byte("{" + strings.Join(parts, ",") + "}")
+    case errorReply:
+        data, _ := json.Marshal(r.native())
+        return data
+    }
+    data, _ := json.Marshal(r.str)
+    return data
+}
+
+// writeRESP encodes a reply in RESP2 or RESP3.
+func (r reply) writeRESP(w *bufio.Writer, proto int) {
+    switch r.typ {
+    case statusReply:
+        w.WriteString("+" + r.str + "\r\n")
+    case bulkReply:
+        w.WriteString("$" + strconv.Itoa(len(r.str)) + "\r\n")
+        w.WriteString(r.str)
+        w.WriteString("\r\n")
+    case integerReply:
+        w.WriteString(":" + strconv.FormatInt(r.num, 10) + "\r\n")
+    case nullReply:
+        if proto >= 3 {
+            w.WriteString("_\r\n")
+        } else {
+            w.WriteString("$-1\r\n")
+        }
+    case arrayReply:
+        w.WriteString("*" + strconv.Itoa(len(r.elems)) + "\r\n")
+        for _, elem := range r.elems {
+            elem.writeRESP(w, proto)
+        }
+    case pushReply:
+        if proto >= 3 {
+            w.WriteString(">" + strconv.Itoa(len(r.elems)) + "\r\n")
+        } else {
+            w.WriteString("*" + strconv.Itoa(len(r.elems)) + "\r\n")
+        }
+        for _, elem := range r.elems {
+            elem.writeRESP(w, proto)
+        }
+    case sequenceReply:
+        for _, elem := range r.elems {
+            elem.writeRESP(w, proto)
+        }
+    case mapReply:
+        if proto >= 3 {
+            w.WriteString("%" + strconv.Itoa(len(r.elems)/2) + "\r\n")
+        } else {
+            w.WriteString("*" + strconv.Itoa(len(r.elems)) + "\r\n")
+        }
+        for _, elem := range r.elems {
+            elem.writeRESP(w, proto)
+        }
+    case errorReply:
+        writeRESPError(w, "ERR", r.str)
+    }
+}
+
+// writeRESPError encodes an error reply with an error code such as ERR or NOAUTH.
+func writeRESPError(w *bufio.Writer, code, message string) {
+    // A simple error cannot span lines
+    message = strings.NewReplacer("\r", " ", "\n", " ").Replace(message)
+    w.WriteString("-" + code + " " + message + "\r\n")
+}
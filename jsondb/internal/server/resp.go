@@ -0,0 +1,309 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "jsondb/internal/engine"
+    "log"
+    "net"
+    "strconv"
+    "strings"
+)
+
+const (
+    // Limits applied to requests, matching the Redis defaults
+    maxRESPArgs     = 1024 * 1024
+    maxRESPBulkSize = 512 * 1024 * 1024
+    maxInlineSize   = 64 * 1024
+    // Limits applied until a connection is authenticated, so an anonymous
+    // client cannot make the server hold large requests
+    maxRESPArgsUnauthenticated     = 10
+    maxRESPBulkSizeUnauthenticated = 16 * 1024
+)
+
+var errProtocol = errors.New("Protocol error")
+
+// readRESPCommand reads one command, either as a RESP array of bulk strings
+// or as an inline command line as sent by telnet. Memory is allocated as the
+// data arrives rather than from the announced lengths, which are held to the
+// unauthenticated limits until the connection is authenticated.
+func readRESPCommand(reader *bufio.Reader, authenticated bool) ([]string, error) {
+    line, err := readRESPLine(reader)
+    if err != nil {
+        return nil, err
+    }
+
+    if !strings.HasPrefix(line, "*") {
+        return strings.Fields(line), nil
+    }
+
+    maxArgs, maxBulkSize, qualifier := maxRESPArgs, maxRESPBulkSize, ""
+    if !authenticated {
+        maxArgs, maxBulkSize, qualifier = maxRESPArgsUnauthenticated, maxRESPBulkSizeUnauthenticated, "unauthenticated "
+    }
+
+    count, err := strconv.Atoi(line[1:])
+    if err != nil || count > maxArgs {
+        return nil, fmt.Errorf("%w: invalid %smultibulk length", errProtocol, qualifier)
+    }
+
+    var args []string
+    for i := 0; i < count; i++ {
+        header, err := readRESPLine(reader)
+        if err != nil {
+            return nil, err
+        }
+        if !strings.HasPrefix(header, "$") {
+            return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, header)
+        }
+        size, err := strconv.Atoi(header[1:])
+        if err != nil || size < 0 || size > maxBulkSize {
+            return nil, fmt.Errorf("%w: invalid %sbulk length", errProtocol, qualifier)
+        }
+
+        var buf bytes.Buffer
+        if _, err := io.CopyN(&buf, reader, int64(size)); err != nil {
+            return nil, err
+        }
+        crlf := make([]byte, 2)
+        if _, err := io.ReadFull(reader, crlf); err != nil {
+            return nil, err
+        }
+        if crlf[0] != '\r' || crlf[1] != '\n' {
+            return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+        }
+        args = append(args, buf.String())
+    }
+    return args, nil
+}
+
+// readRESPLine reads a line terminated by CRLF, or a bare LF for inline commands.
+func readRESPLine(reader *bufio.Reader) (string, error) {
+    var line []byte
+    for {
+        chunk, isPrefix, err := reader.ReadLine()
+        if err != nil {
+            return "", err
+        }
+        line = append(line, chunk...)
+        if len(line) > maxInlineSize {
+            return "", fmt.Errorf("%w: too big inline request", errProtocol)
+        }
+        if !isPrefix {
+            return string(line), nil
+        }
+    }
+}
+
+// respSession is the per connection state of the RESP protocol.
+type respSession struct {
+    client *ClientConnection
+    writer *bufio.Writer
+    proto  int
+}
+
+func (s *Server) handleRESPConnection(conn net.Conn) {
+    defer conn.Close()
+
+    client := s.newClient(conn)
+    reader := client.Reader
+    writer := client.writer
+    session := &respSession{client: client, writer: writer, proto: 2}
+    client.encodePush = func(message reply) {
+        message.writeRESP(writer, session.proto)
+    }
+    if err := s.handshakeTLS(client); err != nil {
+        if s.Debug {
+            log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+        }
+        return
+    }
+    defer s.closeSubscriber(client)
+    defer s.stopFeed(client)
+
+    for {
+        err := s.awaitCommand(client)
+        var args []string
+        if err == nil {
+            args, err = readRESPCommand(reader, client.Authenticated)
+        }
+        if err != nil {
+            client.writeMu.Lock()
+            if errors.Is(err, errProtocol) {
+                writeRESPError(writer, "ERR", err.Error())
+            } else if err != io.EOF && s.Debug {
+                log.Printf("Error reading command: %v", err)
+            }
+            client.flushLocked()
+            client.writeMu.Unlock()
+            return
+        }
+        if len(args) == 0 {
+            if reader.Buffered() == 0 {
+                client.flush()
+            }
+            continue
+        }
+
+        if s.Debug {
+            log.Printf("Received command: %s", args[0])
+        }
+
+        // Replies to pipelined commands are flushed together once the
+        // commands that already arrived are handled. Pushed pub/sub messages
+        // share the writer, so it is held until the reply is complete.
+        client.writeMu.Lock()
+        quit := s.dispatchRESP(session, args)
+        client.writeMu.Unlock()
+        if quit || reader.Buffered() == 0 {
+            if err := client.flush(); err != nil {
+                if s.Debug {
+                    log.Printf("Error writing response: %v", err)
+                }
+                return
+            }
+        }
+        if quit {
+            return
+        }
+    }
+}
+
+// dispatchRESP runs one command and writes its reply. It reports whether the
+// connection should be closed.
+func (s *Server) dispatchRESP(session *respSession, args []string) bool {
+    w := session.writer
+
+    switch strings.ToUpper(args[0]) {
+    case "QUIT":
+        okReply.writeRESP(w, session.proto)
+        return true
+
+    case "HELLO":
+        return s.handleHello(session, args[1:])
+
+    case "AUTH":
+        if len(args) < 2 || len(args) > 3 {
+            writeRESPError(w, "ERR", "wrong number of arguments for 'auth' command")
+            return false
+        }
+        user, err := s.login(session.client, args[1:])
+        if err != nil {
+            writeRESPAuthError(w, err)
+            return errors.Is(err, errAuthLimit)
+        }
+        session.client.Authenticated = true
+        session.client.setUser(user)
+        okReply.writeRESP(w, session.proto)
+        return false
+    }
+
+    if !session.client.Authenticated {
+        writeRESPError(w, "NOAUTH", "Authentication required.")
+        return false
+    }
+
+    result, err := s.runCommand(session.client, args)
+    if err != nil {
+        code := "ERR"
+        if errors.Is(err, errExecAbort) {
+            code = "EXECABORT"
+        } else if errors.Is(err, errReadOnly) {
+            code = "READONLY"
+        } else if errors.Is(err, engine.ErrOutOfMemory) {
+            code = "OOM"
+        } else if errors.Is(err, errNoPermission) {
+            code = "NOPERM"
+        }
+        writeRESPError(w, code, err.Error())
+        return false
+    }
+    result.writeRESP(w, session.proto)
+    return false
+}
+
+// writeRESPAuthError replies to a failed AUTH or HELLO AUTH.
+func writeRESPAuthError(w *bufio.Writer, err error) {
+    if errors.Is(err, errInvalidPassword) {
+        writeRESPError(w, "WRONGPASS", "invalid username-password pair or user is disabled.")
+        return
+    }
+    writeRESPError(w, "ERR", err.Error())
+}
+
+// handleHello implements HELLO [protover [AUTH username password] [SETNAME name]],
+// which switches the connection between RESP2 and RESP3. It reports whether
+// the connection should be closed.
+func (s *Server) handleHello(session *respSession, args []string) bool {
+    w := session.writer
+
+    proto := session.proto
+    if len(args) > 0 {
+        version, err := strconv.Atoi(args[0])
+        if err != nil {
+            writeRESPError(w, "ERR", "Protocol version is not an integer or out of range")
+            return false
+        }
+        if version != 2 && version != 3 {
+            writeRESPError(w, "NOPROTO", "unsupported protocol version")
+            return false
+        }
+        proto = version
+    }
+
+    authenticated := session.client.Authenticated
+    user := session.client.user
+    for i := 1; i < len(args); i++ {
+        switch strings.ToUpper(args[i]) {
+        case "AUTH":
+            if i+2 >= len(args) {
+                writeRESPError(w, "ERR", "Syntax error in HELLO option 'auth'")
+                return false
+            }
+            name, err := s.login(session.client, args[i+1:i+3])
+            if err != nil {
+                writeRESPAuthError(w, err)
+                return errors.Is(err, errAuthLimit)
+            }
+            authenticated = true
+            user = name
+            i += 2
+        case "SETNAME":
+            if i+1 >= len(args) {
+                writeRESPError(w, "ERR", "Syntax error in HELLO option 'setname'")
+                return false
+            }
+            session.client.ID = args[i+1]
+            i++
+        default:
+            writeRESPError(w, "ERR", fmt.Sprintf("Syntax error in HELLO option '%s'", args[i]))
+            return false
+        }
+    }
+
+    if !authenticated {
+        writeRESPError(w, "NOAUTH", "HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+        return false
+    }
+
+    session.client.Authenticated = true
+    session.client.setUser(user)
+    session.proto = proto
+    session.client.resp3 = proto == 3
+    role := "master"
+    if s.readOnly() {
+        role = "replica"
+    }
+    mapValue(
+        bulkValue("server"), bulkValue("jsondb"),
+        bulkValue("version"), bulkValue("1.0.0"),
+        bulkValue("proto"), integerValue(int64(proto)),
+        bulkValue("mode"), bulkValue("standalone"),
+        bulkValue("role"), bulkValue(role),
+        bulkValue("modules"), arrayValue(),
+    ).writeRESP(w, proto)
+    return false
+}
@@ -2,13 +2,21 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"jsondb/internal/config"
 	"jsondb/internal/engine"
 	"log"
+	"math"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 type ClientConnection struct {
@@ -18,6 +26,25 @@ type ClientConnection struct {
     Conn       net.Conn
     Reader     *bufio.Reader
     Authenticated bool
+    Protocol   int
+    // Transaction state, see runCommand
+    multi      *transaction
+    watched    map[string]uint64
+    // Output shared by replies and pushed pub/sub messages, see pushMessages
+    writer     *bufio.Writer
+    writeMu    sync.Mutex
+    encodePush func(message reply)
+    sub        *subscriber
+    feedDone   chan struct{}
+    feedSeq    atomic.Uint64
+    resp3      bool
+    // user is the ACL user the client authenticated as, see authorize
+    user       string
+    // Failed AUTH attempts in a row, see login
+    authFailures int
+    // Timeouts, see awaitCommand and flushLocked
+    authDeadline time.Time
+    writeTimeout time.Duration
 }
 
 type Server struct {
@@ -26,8 +53,23 @@ type Server struct {
     Debug     bool
     Config    *config.Config
     Listener  net.Listener
-    isRunning bool
+    listeners []net.Listener
+    isRunning atomic.Bool
     shutdownCh chan struct{}
+    // Open connections, limited by MAX_CONNECTIONS
+    clients         atomic.Int64
+    rejectedClients atomic.Uint64
+    pubsub    *broker
+    // Replication, see replication.go
+    followers sync.Map
+    replMu    sync.Mutex
+    replica   atomic.Pointer[replicaLink]
+    // TLS configuration of new connections, see ReloadTLS
+    tls       tlsState
+    acl       *aclStore
+    guard     *authGuard
+    // REST gateways, see http.go
+    httpServers []*http.Server
 }
 
 func NewServer(cfg *config.Config) (*Server, error) {
@@ -36,32 +78,82 @@ func NewServer(cfg *config.Config) (*Server, error) {
         return nil, fmt.Errorf("failed to create engine: %v", err)
     }
 
-    return &Server{
+    acl, err := newACLStore(cfg)
+    if err != nil {
+        eng.Close()
+        return nil, err
+    }
+    pubsub := newBroker(cfg.PubsubClientBuffer, cfg.NotifyKeyspaceEvents)
+    pubsub.readable = acl.canRead
+    if len(pubsub.events) > 0 {
+        eng.OnKeyEvent(pubsub.keyEvent)
+    }
+
+    guard, err := newAuthGuard(cfg)
+    if err != nil {
+        eng.Close()
+        return nil, err
+    }
+
+    s := &Server{
+        acl:        acl,
+        guard:      guard,
         Engine:     eng,
         Password:   cfg.Password,
         Debug:      cfg.Debug,
         Config:     cfg,
-        isRunning:  false,
         shutdownCh: make(chan struct{}),
-    }, nil
+        pubsub:     pubsub,
+    }
+    if cfg.TLSCertFile != "" {
+        tlsConfig, err := loadTLSConfig(cfg)
+        if err != nil {
+            eng.Close()
+            guard.close()
+            return nil, err
+        }
+        s.tls.config.Store(tlsConfig)
+    }
+    return s, nil
 }
 
 func (s *Server) Start() error {
-    var err error
-    s.Listener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.Config.Port))
-    if err != nil {
-        return fmt.Errorf("failed to start server: %v", err)
+    listenerConfigs := s.Config.ServerListeners()
+    for _, lc := range listenerConfigs {
+        listener, err := net.Listen("tcp", fmt.Sprintf(":%d", lc.Port))
+        if err != nil {
+            for _, l := range s.listeners {
+                l.Close()
+            }
+            s.listeners = nil
+            return fmt.Errorf("failed to start server: %v", err)
+        }
+        if lc.TLS {
+            listener = tls.NewListener(listener, s.listenerTLSConfig())
+        }
+        s.listeners = append(s.listeners, listener)
     }
+    s.Listener = s.listeners[0]
 
-    s.isRunning = true
+    s.isRunning.Store(true)
 
     // Display server configuration
     log.Printf("Server Configuration:")
     log.Printf("- Port: %d", s.Config.Port)
     log.Printf("- Debug Mode: %v", s.Debug)
+    log.Printf("- Shards: %d", s.Engine.ShardCount())
     log.Printf("- Encryption Enabled: %v", s.Config.EnableEncryption)
+    log.Printf("- Admin Password: %v", s.Config.AdminPassword != "")
+    if s.Config.TLSCertFile != "" {
+        log.Printf("- TLS Certificate: %s", s.Config.TLSCertFile)
+        log.Printf("- TLS Client CA: %s", s.Config.TLSClientCAFile)
+    }
     if s.Config.EnableEncryption {
-        log.Printf("- Encryption Key Length: %d", len(s.Config.EncryptionKey))
+        keyID := s.Config.EncryptionKeyID
+        if keyID == "" {
+            keyID = "default"
+        }
+        log.Printf("- Encryption Key ID: %s", keyID)
     }
     log.Printf("- Memory Dump: %v", s.Config.DumpMemoryOn)
     if s.Config.DumpMemoryOn {
@@ -69,195 +161,891 @@ func (s *Server) Start() error {
         log.Printf("- Dump Interval: %d seconds", s.Config.DumpMemoryEverySecond)
         log.Printf("- Restore From Dump: %v", s.Config.RestoreMemoryDumpAtStart)
     }
+    log.Printf("- Append-Only Log: %v", s.Config.AofEnabled)
+    if s.Config.AofEnabled {
+        log.Printf("- AOF Fsync: %s", s.Config.AofFsync)
+    }
+    if s.Config.ReplicaOf != "" {
+        log.Printf("- Replica Of: %s", s.Config.ReplicaOf)
+    }
     log.Printf("- Environment: %s", s.Config.Environment)
     
-    fmt.Printf("\nServer listening on port %d\n", s.Config.Port)
+    for i, lc := range listenerConfigs {
+        if lc.TLS {
+            fmt.Printf("\nServer listening on port %d (%s protocol, TLS)\n", lc.Port, lc.Protocol)
+        } else {
+            fmt.Printf("\nServer listening on port %d (%s protocol)\n", lc.Port, lc.Protocol)
+        }
 
-    go func() {
-        for s.isRunning {
-            conn, err := s.Listener.Accept()
-            if err != nil {
-                if !s.isRunning {
-                    return
-                }
-                log.Printf("Error accepting connection: %v", err)
-                continue
-            }
-            go s.handleConnection(conn)
+        if lc.Protocol == config.ProtocolHTTP {
+            httpServer := s.newHTTPServer()
+            s.httpServers = append(s.httpServers, httpServer)
+            go httpServer.Serve(httpListener{Listener: s.listeners[i], s: s})
+            continue
+        }
+        handler := s.handleConnection
+        if lc.Protocol == config.ProtocolRESP {
+            handler = s.handleRESPConnection
         }
-    }()
+        go s.acceptLoop(s.listeners[i], lc.Protocol, handler)
+    }
+
+    if s.Config.ReplicaOf != "" {
+        s.replicaOf(s.Config.ReplicaOf)
+    }
 
     return nil
 }
 
+func (s *Server) acceptLoop(listener net.Listener, protocol string, handler func(net.Conn)) {
+    for s.isRunning.Load() {
+        conn, err := listener.Accept()
+        if err != nil {
+            if !s.isRunning.Load() {
+                return
+            }
+            log.Printf("Error accepting connection: %v", err)
+            continue
+        }
+        if reason := s.screen(conn); reason != "" {
+            go s.reject(conn, protocol, reason)
+            continue
+        }
+        go func() {
+            defer s.clients.Add(-1)
+            handler(conn)
+        }()
+    }
+}
+
 func (s *Server) Stop() error {
-    s.isRunning = false
+    s.isRunning.Store(false)
     close(s.shutdownCh)
-    if s.Listener != nil {
-        return s.Listener.Close()
+    if link := s.replica.Swap(nil); link != nil {
+        link.stop()
     }
-    return nil
+    s.Engine.Close()
+    s.guard.close()
+    var err error
+    for _, listener := range s.listeners {
+        if closeErr := listener.Close(); closeErr != nil && err == nil {
+            err = closeErr
+        }
+    }
+    // Their listeners are closed already, this ends open connections
+    for _, httpServer := range s.httpServers {
+        httpServer.Close()
+    }
+    return err
 }
 
 func (s *Server) IsRunning() bool {
-    return s.isRunning
+    return s.isRunning.Load()
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
     defer conn.Close()
     
-    reader := bufio.NewReader(conn)
-    client := &ClientConnection{
-        Conn:         conn,
-        Reader:       reader,
-        LastAccess:   time.Now(),
-        Connected:    true,
-        Authenticated: false,
+    // Responses are buffered and flushed once every pipelined command that
+    // has already arrived is answered, saving a write per command
+    client := s.newClient(conn)
+    client.Protocol = nativeLineProtocol
+    reader := client.Reader
+    client.encodePush = func(message reply) {
+        client.writer.Write(nativeResponse(client.Protocol, message, nil))
     }
+    if err := s.handshakeTLS(client); err != nil {
+        if s.Debug {
+            log.Printf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+        }
+        return
+    }
+    defer s.closeSubscriber(client)
+    defer s.stopFeed(client)
 
     // Send authentication prompt
-    if _, err := conn.Write([]byte("AUTH_REQUIRED\n")); err != nil {
+    client.write([]byte("AUTH_REQUIRED\n"))
+    if err := client.flush(); err != nil {
         if s.Debug {
             log.Printf("Error sending auth prompt: %v", err)
         }
         return
     }
 
+    defer client.flush()
+
     for {
-        command, err := reader.ReadString('\n')
-        if err != nil {
+        // Flush before blocking on the next read, pipelined commands that
+        // are already buffered are answered first
+        if reader.Buffered() == 0 {
+            if err := client.flush(); err != nil {
+                if s.Debug {
+                    log.Printf("Error writing response: %v", err)
+                }
+                return
+            }
+        }
+
+        if err := s.awaitCommand(client); err != nil {
             if err != io.EOF && s.Debug {
                 log.Printf("Error reading command: %v", err)
             }
             return
         }
 
-        command = strings.TrimSpace(command)
-        if command == "" {
-            continue
-        }
+        var response []byte
+        var switchTo int
+        var closing bool
+        if client.Protocol == nativeFramedProtocol {
+            args, err := readFramedCommand(reader, client.Authenticated)
+            if err != nil {
+                if errors.Is(err, errFraming) || errors.Is(err, errLineTooLong) {
+                    client.write(framedResponse(reply{}, err))
+                } else if err != io.EOF && s.Debug {
+                    log.Printf("Error reading command: %v", err)
+                }
+                return
+            }
+            if len(args) == 0 {
+                continue
+            }
 
-        if s.Debug {
-            log.Printf("Received command: %s", command)
-        }
+            if s.Debug {
+                log.Printf("Received framed command: %s", args[0])
+            }
 
-        // Handle authentication
-        if !client.Authenticated {
-            parts := strings.Fields(command)
-            if len(parts) != 2 || strings.ToUpper(parts[0]) != "AUTH" {
-                conn.Write([]byte("ERROR Authentication required\n"))
-                continue
+            // The writer is held from here until the response is written,
+            // so messages pushed by a stream the command starts follow its reply
+            client.writeMu.Lock()
+            var result reply
+            if strings.ToUpper(args[0]) == "PROTOCOL" {
+                switchTo, err = parseProtocolVersion(args)
+                result = okReply
+            } else {
+                result, err = s.runCommand(client, args)
             }
-            if parts[1] != s.Password {
-                if s.Debug {
-                    log.Printf("Authentication failed: invalid password. Got: %s, Expected: %s", parts[1], s.Password)
+            response = nativeResponse(client.Protocol, result, err)
+        } else {
+            command, err := readNativeLine(reader, client.Authenticated)
+            if err != nil {
+                if errors.Is(err, errLineTooLong) {
+                    client.write([]byte("ERROR " + err.Error() + "\n"))
+                } else if err != io.EOF && s.Debug {
+                    log.Printf("Error reading command: %v", err)
                 }
-                conn.Write([]byte("ERROR Invalid password\n"))
+                return
+            }
+
+            command = strings.TrimSpace(command)
+            if command == "" {
                 continue
             }
-            client.Authenticated = true
-            conn.Write([]byte("OK\n"))
-            continue
-        }
 
-        // Execute authenticated command
-        response, err := s.executeCommand(command)
-        if err != nil {
-            response = fmt.Sprintf("ERROR %s\n", err.Error())
-        } else if response == "" {
-            response = "OK\n"
-        } else {
-            response = fmt.Sprintf("%s\n", response)
+            if s.Debug {
+                log.Printf("Received command: %s", strings.Join(redactArgs(strings.Fields(command)), " "))
+            }
+
+            client.writeMu.Lock()
+            // Handle authentication. AUTH is accepted on authenticated
+            // connections too, for clients authenticated by a certificate
+            if parts := strings.Fields(command); !client.Authenticated || strings.ToUpper(parts[0]) == "AUTH" {
+                if (len(parts) != 2 && len(parts) != 3) || strings.ToUpper(parts[0]) != "AUTH" {
+                    response = []byte("ERROR Authentication required\n")
+                } else if user, err := s.login(client, parts[1:]); err != nil {
+                    response = []byte("ERROR " + err.Error() + "\n")
+                    closing = errors.Is(err, errAuthLimit)
+                } else {
+                    client.Authenticated = true
+                    client.setUser(user)
+                    response = []byte("OK\n")
+                }
+            } else {
+                // Execute authenticated command
+                var result reply
+                if parts := strings.Fields(command); strings.ToUpper(parts[0]) == "PROTOCOL" {
+                    switchTo, err = parseProtocolVersion(parts)
+                    result = okReply
+                } else {
+                    var args []string
+                    if args, err = lineArgs(command); err == nil {
+                        result, err = s.runCommand(client, args)
+                    }
+                }
+                response = nativeResponse(client.Protocol, result, err)
+            }
         }
 
-        if _, err := conn.Write([]byte(response)); err != nil {
+        _, err := client.writer.Write(response)
+        if switchTo != 0 {
+            // The reply to PROTOCOL still uses the previous framing
+            client.Protocol = switchTo
+        }
+        client.writeMu.Unlock()
+        if err != nil {
             if s.Debug {
                 log.Printf("Error writing response: %v", err)
             }
             return
         }
+        if closing {
+            return
+        }
     }
 }
 
-func (s *Server) executeCommand(command string) (string, error) {
-    parts := strings.Fields(command)
+// write appends data to the client's buffered output.
+func (c *ClientConnection) write(data []byte) {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    c.writer.Write(data)
+}
+
+// flush sends the buffered output, pushed messages may be written concurrently.
+func (c *ClientConnection) flush() error {
+    c.writeMu.Lock()
+    defer c.writeMu.Unlock()
+    return c.flushLocked()
+}
+
+// executeCommand runs a command outside of any transaction.
+func (s *Server) executeCommand(parts []string) (reply, error) {
+    return s.execute(s.Engine, parts)
+}
+
+// execute runs a command. Key operations go through ks, which is either the
+// engine itself or a transaction holding the locks of the keys involved.
+func (s *Server) execute(ks engine.Keyspace, parts []string) (reply, error) {
     if len(parts) == 0 {
-        return "", fmt.Errorf("empty command")
+        return reply{}, fmt.Errorf("empty command")
     }
 
     cmd := strings.ToUpper(parts[0])
+    if writeCommands[cmd] && s.readOnly() {
+        return reply{}, errReadOnly
+    }
+
     switch cmd {
     case "PING":
-        return "PONG", nil
-        
+        if len(parts) > 1 {
+            return bulkValue(parts[1]), nil
+        }
+        return statusValue("PONG"), nil
+
     case "SET":
         if len(parts) < 3 {
-            return "", fmt.Errorf("SET command requires key and value")
+            return reply{}, fmt.Errorf("SET command requires key and value")
         }
-        key := parts[1]
-        // Join the remaining parts to handle JSON with spaces
-        value := strings.Join(parts[2:], " ")
-        
-        // Remove surrounding quotes if present
-        value = strings.TrimPrefix(value, "\"")
-        value = strings.TrimSuffix(value, "\"")
-        
-        if err := s.Engine.Set(key, value); err != nil {
-            return "", err
+        opts, err := parseSetOptions(parts[3:])
+        if err != nil {
+            return reply{}, err
         }
-        return "OK", nil
+
+        // An absolute expiry in the past behaves like an immediate expiration
+        written, err := ks.SetIf(parts[1], []byte(parts[2]), opts.expiresAt, opts.condition, opts.version)
+        if err != nil {
+            return reply{}, err
+        }
+        if !written {
+            return nullValue(), nil
+        }
+        return okReply, nil
+
+    case "GETSET":
+        if len(parts) != 3 {
+            return reply{}, fmt.Errorf("GETSET command requires key and value")
+        }
+        previous, err := ks.GetSet(parts[1], []byte(parts[2]))
+        if err != nil {
+            return reply{}, err
+        }
+        if previous == nil {
+            return nullValue(), nil
+        }
+        return valueReply(previous), nil
+
+    case "GETDEL":
+        if len(parts) != 2 {
+            return reply{}, fmt.Errorf("GETDEL command requires key")
+        }
+        previous, err := ks.GetDel(parts[1])
+        if err != nil {
+            if err == engine.ErrKeyNotFound {
+                return nullValue(), nil
+            }
+            return reply{}, err
+        }
+        return valueReply(previous), nil
+
+    case "VERSION":
+        if len(parts) != 2 {
+            return reply{}, fmt.Errorf("VERSION command requires key")
+        }
+        return integerValue(int64(ks.Version(parts[1]))), nil
 
     case "GET":
         if len(parts) != 2 {
-            return "", fmt.Errorf("GET command requires key")
+            return reply{}, fmt.Errorf("GET command requires key")
         }
-        
-        value, err := s.Engine.Get(parts[1])
+
+        value, err := ks.Get(parts[1])
         if err != nil {
             if err == engine.ErrKeyNotFound {
-                return "nil", nil
+                return nullValue(), nil
             }
-            return "", err
+            return reply{}, err
         }
-        
-        // Return the raw JSON string without any encoding
-        return string(value), nil
 
-    case "DELETE":
+        return valueReply(value), nil
+
+    case "DELETE", "DEL":
         if len(parts) != 2 {
-            return "", fmt.Errorf("DELETE command requires key")
+            return reply{}, fmt.Errorf("DELETE command requires key")
         }
-        err := s.Engine.Delete(parts[1])
+        err := ks.Delete(parts[1])
         if err != nil {
-            return "", err
+            return reply{}, err
+        }
+        return okReply, nil
+
+    case "MGET":
+        if len(parts) < 2 {
+            return reply{}, fmt.Errorf("MGET command requires at least one key")
+        }
+        values, err := ks.MGet(parts[1:])
+        if err != nil {
+            return reply{}, err
+        }
+        items := make([]reply, len(values))
+        for i, value := range values {
+            if value == nil {
+                items[i] = nullValue()
+            } else {
+                items[i] = valueReply(value)
+            }
+        }
+        return arrayValue(items...), nil
+
+    case "MSET":
+        if len(parts) < 3 || len(parts)%2 != 1 {
+            return reply{}, fmt.Errorf("MSET command requires key value pairs")
+        }
+        keys := make([]string, 0, len(parts)/2)
+        values := make([][]byte, 0, len(parts)/2)
+        for i := 1; i < len(parts); i += 2 {
+            keys = append(keys, parts[i])
+            values = append(values, []byte(parts[i+1]))
+        }
+        if err := ks.MSet(keys, values); err != nil {
+            return reply{}, err
         }
-        return "OK", nil
+        return okReply, nil
 
-    case "TTL":
+    case "MDEL":
+        if len(parts) < 2 {
+            return reply{}, fmt.Errorf("MDEL command requires at least one key")
+        }
+        deleted, err := ks.MDelete(parts[1:])
+        if err != nil {
+            return reply{}, err
+        }
+        return integerValue(int64(deleted)), nil
+
+    case "PUBLISH":
+        if len(parts) != 3 {
+            return reply{}, fmt.Errorf("PUBLISH command requires channel and message")
+        }
+        return integerValue(int64(s.pubsub.publish(parts[1], parts[2]))), nil
+
+    case "INFO":
+        return s.infoCommand(), nil
+
+    case "ROLE":
+        return s.roleCommand()
+
+    case "REPLICAOF":
+        return s.replicaOfCommand(parts)
+
+    case "KEYS":
         if len(parts) != 2 {
-            return "", fmt.Errorf("TTL command requires key")
+            return reply{}, fmt.Errorf("KEYS command requires pattern")
         }
-        ttl, err := s.Engine.TTL(parts[1])
+        return stringsValue(s.Engine.Keys(parts[1])), nil
+
+    case "SCAN":
+        if len(parts) < 2 {
+            return reply{}, fmt.Errorf("SCAN command requires cursor")
+        }
+        cursor, err := strconv.ParseUint(parts[1], 10, 64)
         if err != nil {
-            return "", err
+            return reply{}, fmt.Errorf("invalid cursor: %s", parts[1])
         }
-        return fmt.Sprintf("%d", ttl), nil
+        pattern, count, err := parseScanOptions(parts[2:])
+        if err != nil {
+            return reply{}, err
+        }
+        next, keys := s.Engine.Scan(cursor, pattern, count)
+        return arrayValue(bulkValue(strconv.FormatUint(next, 10)), stringsValue(keys)), nil
+
+    case "TTL", "PTTL":
+        if len(parts) != 2 {
+            return reply{}, fmt.Errorf("%s command requires key", cmd)
+        }
+        ttl, err := ks.TTL(parts[1])
+        if err != nil {
+            return reply{}, err
+        }
+        if ttl < 0 {
+            // -1 and -2 are reported as-is regardless of the unit
+            return integerValue(int64(ttl / time.Second)), nil
+        }
+        if cmd == "PTTL" {
+            return integerValue(int64((ttl + time.Millisecond/2) / time.Millisecond)), nil
+        }
+        return integerValue(int64((ttl + time.Second/2) / time.Second)), nil
+
+    case "EXPIRE", "PEXPIRE":
+        if len(parts) != 3 {
+            return reply{}, fmt.Errorf("%s command requires key and timeout", cmd)
+        }
+        amount, err := strconv.ParseInt(parts[2], 10, 64)
+        if err != nil {
+            return reply{}, fmt.Errorf("invalid timeout: %s", parts[2])
+        }
+        unit := time.Second
+        if cmd == "PEXPIRE" {
+            unit = time.Millisecond
+        }
+        ttl, valid := expiryDuration(amount, unit)
+        if !valid {
+            return reply{}, fmt.Errorf("invalid expire time in %s", cmd)
+        }
+        ok, err := ks.ExpireAt(parts[1], time.Now().Add(ttl))
+        if err != nil {
+            return reply{}, err
+        }
+        return boolValue(ok), nil
+
+    case "PERSIST":
+        if len(parts) != 2 {
+            return reply{}, fmt.Errorf("PERSIST command requires key")
+        }
+        ok, err := ks.Persist(parts[1])
+        if err != nil {
+            return reply{}, err
+        }
+        return boolValue(ok), nil
+
+    case "JSON.GET":
+        if len(parts) < 2 || len(parts) > 3 {
+            return reply{}, fmt.Errorf("JSON.GET command requires key and optional path")
+        }
+        value, err := ks.JSONGet(parts[1], optionalPath(parts, 2))
+        if err != nil {
+            if err == engine.ErrKeyNotFound || err == engine.ErrPathNotFound {
+                return nullValue(), nil
+            }
+            return reply{}, err
+        }
+        return bulkValue(string(value)), nil
+
+    case "JSON.SET":
+        if len(parts) != 4 {
+            return reply{}, fmt.Errorf("JSON.SET command requires key, path and value")
+        }
+        if err := ks.JSONSet(parts[1], parts[2], []byte(parts[3])); err != nil {
+            return reply{}, err
+        }
+        return okReply, nil
+
+    case "JSON.DEL":
+        if len(parts) < 2 || len(parts) > 3 {
+            return reply{}, fmt.Errorf("JSON.DEL command requires key and optional path")
+        }
+        removed, err := ks.JSONDel(parts[1], optionalPath(parts, 2))
+        if err != nil {
+            return reply{}, err
+        }
+        return integerValue(int64(removed)), nil
+
+    case "JSON.ARRAPPEND":
+        if len(parts) < 4 {
+            return reply{}, fmt.Errorf("JSON.ARRAPPEND command requires key, path and at least one value")
+        }
+        values := make([][]byte, 0, len(parts)-3)
+        for _, value := range parts[3:] {
+            values = append(values, []byte(value))
+        }
+        length, err := ks.JSONArrAppend(parts[1], parts[2], values...)
+        if err != nil {
+            return reply{}, err
+        }
+        return integerValue(int64(length)), nil
+
+    case "JSON.NUMINCRBY":
+        if len(parts) != 4 {
+            return reply{}, fmt.Errorf("JSON.NUMINCRBY command requires key, path and number")
+        }
+        if _, err := strconv.ParseFloat(parts[3], 64); err != nil {
+            return reply{}, fmt.Errorf("invalid number: %s", parts[3])
+        }
+        value, err := ks.JSONNumIncrBy(parts[1], parts[2], json.Number(parts[3]))
+        if err != nil {
+            return reply{}, err
+        }
+        return bulkValue(string(value)), nil
+
+    case "INDEX.CREATE":
+        if len(parts) != 4 {
+            return reply{}, fmt.Errorf("INDEX.CREATE command requires name, pattern and path")
+        }
+        if err := s.Engine.CreateIndex(engine.IndexDef{Name: parts[1], Pattern: parts[2], Path: parts[3]}); err != nil {
+            return reply{}, err
+        }
+        return okReply, nil
+
+    case "INDEX.DROP":
+        if len(parts) != 2 {
+            return reply{}, fmt.Errorf("INDEX.DROP command requires name")
+        }
+        if err := s.Engine.DropIndex(parts[1]); err != nil {
+            return reply{}, err
+        }
+        return okReply, nil
+
+    case "INDEX.LIST":
+        if len(parts) != 1 {
+            return reply{}, fmt.Errorf("INDEX.LIST command takes no arguments")
+        }
+        jsonData, err := json.Marshal(s.Engine.Indexes())
+        if err != nil {
+            return reply{}, fmt.Errorf("failed to marshal indexes: %v", err)
+        }
+        return bulkValue(string(jsonData)), nil
+
+    case "QUERY":
+        if len(parts) < 4 {
+            return reply{}, fmt.Errorf("QUERY command requires index, operator and value")
+        }
+        query, err := parseQuery(parts[2:])
+        if err != nil {
+            return reply{}, err
+        }
+        keys, err := s.Engine.Query(parts[1], query)
+        if err != nil {
+            return reply{}, err
+        }
+        return stringsValue(keys), nil
+
+    case "REENCRYPT":
+        if len(parts) != 1 {
+            return reply{}, fmt.Errorf("REENCRYPT command takes no arguments")
+        }
+        rewritten, failed, err := s.Engine.Reencrypt()
+        if err != nil {
+            return reply{}, err
+        }
+        return arrayValue(integerValue(int64(rewritten)), stringsValue(failed)), nil
 
     default:
-        return "", fmt.Errorf("unknown command: %s", cmd)
+        return reply{}, fmt.Errorf("unknown command: %s", cmd)
+    }
+}
+
+// setOptions are the options following the value of a SET command.
+type setOptions struct {
+    expiresAt time.Time
+    condition engine.SetCondition
+    version   uint64
+}
+
+// parseSetOptions parses the expiry option (EX, PX, EXAT or PXAT) and the
+// write condition (NX, XX or IFVERSION) following the value of a SET command.
+func parseSetOptions(args []string) (setOptions, error) {
+    var opts setOptions
+    for i := 0; i < len(args); i++ {
+        option := strings.ToUpper(args[i])
+        switch option {
+        case "NX", "XX":
+            if opts.condition != engine.SetAlways {
+                return opts, fmt.Errorf("syntax error in SET options")
+            }
+            opts.condition = engine.SetIfAbsent
+            if option == "XX" {
+                opts.condition = engine.SetIfPresent
+            }
+            continue
+        }
+
+        if i+1 >= len(args) {
+            return opts, fmt.Errorf("syntax error in SET options")
+        }
+        i++
+
+        if option == "IFVERSION" {
+            if opts.condition != engine.SetAlways {
+                return opts, fmt.Errorf("syntax error in SET options")
+            }
+            version, err := strconv.ParseUint(args[i], 10, 64)
+            if err != nil {
+                return opts, fmt.Errorf("invalid version in SET")
+            }
+            opts.condition, opts.version = engine.SetIfVersion, version
+            continue
+        }
+
+        if !opts.expiresAt.IsZero() {
+            return opts, fmt.Errorf("syntax error in SET options")
+        }
+        amount, err := strconv.ParseInt(args[i], 10, 64)
+        if err != nil || amount <= 0 {
+            return opts, fmt.Errorf("invalid expire time in SET")
+        }
+        switch option {
+        case "EX", "PX":
+            unit := time.Second
+            if option == "PX" {
+                unit = time.Millisecond
+            }
+            ttl, valid := expiryDuration(amount, unit)
+            if !valid {
+                return opts, fmt.Errorf("invalid expire time in SET")
+            }
+            opts.expiresAt = time.Now().Add(ttl)
+        case "EXAT":
+            opts.expiresAt = time.Unix(amount, 0)
+        case "PXAT":
+            opts.expiresAt = time.UnixMilli(amount)
+        default:
+            return opts, fmt.Errorf("unknown SET option: %s", args[i-1])
+        }
+    }
+    return opts, nil
+}
+
+// expiryDuration converts a relative expiry of amount units, failing when
+// it does not fit in a time.Duration rather than wrapping around.
+func expiryDuration(amount int64, unit time.Duration) (time.Duration, bool) {
+    if amount > math.MaxInt64/int64(unit) || amount < math.MinInt64/int64(unit) {
+        return 0, false
+    }
+    return time.Duration(amount) * unit, true
+}
+
+// lineArgs splits a command line of the native protocol into arguments.
+// Values may contain spaces there, so the value of SET, JSON.SET and
+// JSON.ARRAPPEND is everything up to the trailing options.
+func lineArgs(line string) ([]string, error) {
+    parts := strings.Fields(line)
+    if len(parts) == 0 {
+        return parts, nil
+    }
+
+    switch strings.ToUpper(parts[0]) {
+    case "SET":
+        if len(parts) < 3 {
+            return parts, nil
+        }
+        valueEnd := setValueEnd(parts)
+        // Join the value parts to handle JSON with spaces and remove
+        // surrounding quotes if present
+        value := strings.Join(parts[2:valueEnd], " ")
+        value = strings.TrimPrefix(value, "\"")
+        value = strings.TrimSuffix(value, "\"")
+        return append([]string{parts[0], parts[1], value}, parts[valueEnd:]...), nil
+
+    case "GETSET", "PUBLISH":
+        if len(parts) < 3 {
+            return parts, nil
+        }
+        value := strings.Join(parts[2:], " ")
+        value = strings.TrimSuffix(strings.TrimPrefix(value, "\""), "\"")
+        return []string{parts[0], parts[1], value}, nil
+
+    case "MSET":
+        // Values cannot contain spaces here, surrounding quotes are removed like for SET
+        for i := 2; i < len(parts); i += 2 {
+            parts[i] = strings.TrimSuffix(strings.TrimPrefix(parts[i], "\""), "\"")
+        }
+        return parts, nil
+
+    case "JSON.SET":
+        if len(parts) < 4 {
+            return parts, nil
+        }
+        return []string{parts[0], parts[1], parts[2], strings.Join(parts[3:], " ")}, nil
+
+    case "JSON.ARRAPPEND":
+        if len(parts) < 4 {
+            return parts, nil
+        }
+        values, err := splitJSONValues(strings.Join(parts[3:], " "))
+        if err != nil {
+            return nil, err
+        }
+        return append(parts[:3:3], values...), nil
+    }
+    return parts, nil
+}
+
+// setValueEnd returns the index just past the value of a SET command line by
+// stripping the trailing options, so the value itself may contain spaces.
+func setValueEnd(parts []string) int {
+    end := len(parts)
+    for {
+        // At least one value part always stays in front of the options
+        if end >= 4 {
+            switch strings.ToUpper(parts[end-1]) {
+            case "NX", "XX":
+                end--
+                continue
+            }
+        }
+        if end >= 5 {
+            switch strings.ToUpper(parts[end-2]) {
+            case "EX", "PX", "EXAT", "PXAT", "IFVERSION":
+                end -= 2
+                continue
+            }
+        }
+        return end
+    }
+}
+
+// infoCommand implements INFO, reporting memory use, eviction and expiry
+// counters to operators.
+func (s *Server) infoCommand() reply {
+    memory := s.Engine.MemoryStats()
+    expiry := s.Engine.ExpiryStats()
+    save := s.Engine.SaveStatus()
+    var lastSave int64
+    if !save.LastSave.IsZero() {
+        lastSave = save.LastSave.Unix()
+    }
+    var inProgress int64
+    if save.InProgress {
+        inProgress = 1
+    }
+    bgsaveStatus := "ok"
+    if save.LastBackgroundErr != nil {
+        bgsaveStatus = "err"
+    }
+    return mapValue(
+        bulkValue("used_memory"), integerValue(memory.UsedBytes),
+        bulkValue("maxmemory"), integerValue(memory.MaxBytes),
+        bulkValue("maxmemory_policy"), bulkValue(memory.Policy),
+        bulkValue("evicted_keys"), integerValue(int64(memory.Evicted)),
+        bulkValue("rejected_writes"), integerValue(int64(memory.Rejected)),
+        bulkValue("expired_keys_active"), integerValue(int64(expiry.ActiveExpired)),
+        bulkValue("expired_keys_lazy"), integerValue(int64(expiry.LazyExpired)),
+        bulkValue("bgsave_in_progress"), integerValue(inProgress),
+        bulkValue("last_save_time"), integerValue(lastSave),
+        bulkValue("last_bgsave_status"), bulkValue(bgsaveStatus),
+        bulkValue("connected_clients"), integerValue(s.clients.Load()),
+        bulkValue("rejected_connections"), integerValue(int64(s.rejectedClients.Load())),
+        bulkValue("auth_failures"), integerValue(int64(s.guard.failures.Load())),
+        bulkValue("banned_addresses"), integerValue(int64(s.guard.bannedCount(time.Now()))),
+    )
+}
+
+// valueReply returns a stored value as a bulk string. Plain strings are
+// stored JSON encoded and are returned unquoted, byte for byte as they were
+// set, anything else as raw JSON.
+func valueReply(value []byte) reply {
+    if str, ok := engine.DecodeString(value); ok {
+        return bulkValue(str)
+    }
+    return bulkValue(string(value))
+}
+
+// parseScanOptions parses the MATCH and COUNT options of a SCAN command.
+func parseScanOptions(args []string) (string, int, error) {
+    var pattern string
+    var count int
+    for i := 0; i < len(args); i += 2 {
+        option := strings.ToUpper(args[i])
+        if i+1 >= len(args) {
+            return "", 0, fmt.Errorf("%s requires a value", option)
+        }
+        switch option {
+        case "MATCH":
+            pattern = args[i+1]
+        case "COUNT":
+            n, err := strconv.Atoi(args[i+1])
+            if err != nil || n <= 0 {
+                return "", 0, fmt.Errorf("invalid COUNT: %s", args[i+1])
+            }
+            count = n
+        default:
+            return "", 0, fmt.Errorf("unknown SCAN option: %s", args[i])
+        }
+    }
+    return pattern, count, nil
+}
+
+// parseQuery parses `op value [value2] [LIMIT n] [OFFSET m]` of a QUERY command.
+func parseQuery(args []string) (engine.IndexQuery, error) {
+    query := engine.IndexQuery{Op: strings.ToUpper(args[0])}
+
+    rest := args[1:]
+    for len(rest) > 0 {
+        option := strings.ToUpper(rest[0])
+        if option != "LIMIT" && option != "OFFSET" {
+            query.Values = append(query.Values, rest[0])
+            rest = rest[1:]
+            continue
+        }
+        if len(rest) < 2 {
+            return query, fmt.Errorf("%s requires a number", option)
+        }
+        n, err := strconv.Atoi(rest[1])
+        if err != nil || n < 0 {
+            return query, fmt.Errorf("invalid %s: %s", option, rest[1])
+        }
+        if option == "LIMIT" {
+            query.Limit = n
+        } else {
+            query.Offset = n
+        }
+        rest = rest[2:]
+    }
+    return query, nil
+}
+
+// optionalPath returns the JSON path argument at index i, defaulting to the root.
+func optionalPath(parts []string, i int) string {
+    if len(parts) > i {
+        return parts[i]
+    }
+    return "$"
+}
+
+// splitJSONValues splits a sequence of JSON values such as `"a" {"b": 1} 2`.
+func splitJSONValues(input string) ([]string, error) {
+    decoder := json.NewDecoder(strings.NewReader(input))
+    var values []string
+    for {
+        var value json.RawMessage
+        if err := decoder.Decode(&value); err != nil {
+            if err == io.EOF {
+                break
+            }
+            return nil, fmt.Errorf("invalid JSON value: %v", err)
+        }
+        values = append(values, string(value))
     }
+    return values, nil
 }
 
-func (s *Server) handleResetMemory(args []string) (string, error) {
+func (s *Server) handleResetMemory(cmd string, args []string) (reply, error) {
     if len(args) != 0 {
-        return "", fmt.Errorf("RESET_MEMORY command takes no arguments")
+        return reply{}, fmt.Errorf("%s command takes no arguments", cmd)
     }
 
     if err := s.Engine.ResetMemory(); err != nil {
-        return "", fmt.Errorf("failed to reset memory: %w", err)
+        return reply{}, fmt.Errorf("failed to reset memory: %w", err)
     }
 
-    return "OK", nil
+    return okReply, nil
 }
 
 
@@ -2,9 +2,17 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"io"
 	"jsondb/internal/config"
+	"jsondb/internal/testutil"
 	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -144,3 +152,1704 @@ func TestServerCommands(t *testing.T) {
 		}
 	}
 }
+
+// startTestServer starts a server on a free port and returns an authenticated
+// connection along with its reader.
+func startTestServer(t *testing.T, cfg *config.Config) (*Server, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	port, err := testutil.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	cfg.Port = port
+	for i := range cfg.Listeners {
+		// A native listener without a port is the one the test talks to
+		if cfg.Listeners[i].Protocol == config.ProtocolNative && cfg.Listeners[i].Port == 0 {
+			cfg.Listeners[i].Port = port
+		}
+	}
+	if cfg.Password == "" {
+		cfg.Password = "testpass"
+	}
+	if cfg.PasswordHashIterations == 0 {
+		// The default cost makes every login slow under the race detector
+		cfg.PasswordHashIterations = 1000
+	}
+
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+
+	address := fmt.Sprintf("localhost:%d", cfg.Port)
+	if err := testutil.WaitForServer(t, address, time.Second); err != nil {
+		t.Fatalf("Server did not start: %v", err)
+	}
+
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if prompt, _ := reader.ReadString('\n'); strings.TrimSpace(prompt) != "AUTH_REQUIRED" {
+		t.Fatalf("Expected AUTH_REQUIRED prompt, got: %s", prompt)
+	}
+	if response := sendCommand(t, conn, reader, "AUTH "+cfg.Password); response != "OK" {
+		t.Fatalf("Authentication failed: %s", response)
+	}
+
+	return srv, conn, reader
+}
+
+// sendCommand writes a single command line and returns the trimmed response line.
+func sendCommand(t *testing.T, conn net.Conn, reader *bufio.Reader, command string) string {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+
+	fmt.Fprintf(conn, "%s\n", command)
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Command '%s' failed: %v", command, err)
+	}
+	return strings.TrimSpace(response)
+}
+
+func TestServerTTLCommands(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{})
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{"SET session:1 data EX 60", "OK"},
+		{"TTL session:1", "60"},
+		{"GET session:1", "data"},
+		{"SET session:2 {\"user\": 1} PX 60000", "OK"},
+		{"TTL session:2", "60"},
+		{fmt.Sprintf("SET session:3 data EXAT %d", time.Now().Add(time.Hour).Unix()), "OK"},
+		{"PERSIST session:3", "1"},
+		{"SET session:4 data EX 0", "ERROR invalid expire time in SET"},
+		{"SET plain value", "OK"},
+		{"TTL plain", "-1"},
+		{"EXPIRE plain 120", "1"},
+		{"TTL plain", "120"},
+		{"PEXPIRE plain 5000", "1"},
+		{"TTL plain", "5"},
+		{"PERSIST plain", "1"},
+		{"PERSIST plain", "0"},
+		{"TTL plain", "-1"},
+		{"EXPIRE missing 10", "0"},
+		{"TTL missing", "-2"},
+		{"EXPIRE plain 0", "1"},
+		{"GET plain", "nil"},
+
+		// Relative expiries too large for a duration are refused instead
+		// of wrapping around into the past
+		{"SET huge data EX 10000000000", "ERROR invalid expire time in SET"},
+		{"SET huge data PX 10000000000000000", "ERROR invalid expire time in SET"},
+		{"SET huge data", "OK"},
+		{"EXPIRE huge 10000000000", "ERROR invalid expire time in EXPIRE"},
+		{"EXPIRE huge -10000000000", "ERROR invalid expire time in EXPIRE"},
+		{"PEXPIRE huge 10000000000000000", "ERROR invalid expire time in PEXPIRE"},
+		{"GET huge", "data"},
+		{"EXPIRE huge 9000000000", "1"},
+		{"GET huge", "data"},
+		{"EXPIRE huge -1", "1"},
+		{"GET huge", "nil"},
+	}
+
+	for _, cmd := range commands {
+		if response := sendCommand(t, conn, reader, cmd.cmd); response != cmd.expected {
+			t.Errorf("Command '%s': got %q, want %q", cmd.cmd, response, cmd.expected)
+		}
+	}
+
+	// The value of a SET with EX must survive the option parsing intact
+	value, err := srv.Engine.Get("session:2")
+	if err != nil {
+		t.Fatalf("Failed to get session:2: %v", err)
+	}
+	if string(value) != `{"user": 1}` {
+		t.Errorf("session:2 = %q, want %q", value, `{"user": 1}`)
+	}
+}
+
+func TestServerJSONCommands(t *testing.T) {
+	_, conn, reader := startTestServer(t, &config.Config{})
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{`SET user:1 {"name": "John", "age": 30, "tags": []}`, "OK"},
+		{"JSON.GET user:1 $.name", `"John"`},
+		{"JSON.GET user:1 $.missing", "nil"},
+		{`JSON.SET user:1 $.address {"city": "Oslo"}`, "OK"},
+		{"JSON.GET user:1 $.address.city", `"Oslo"`},
+		{`JSON.ARRAPPEND user:1 $.tags "admin" {"team": "core"}`, "2"},
+		{"JSON.NUMINCRBY user:1 $.age 2", "32"},
+		{"JSON.NUMINCRBY user:1 $.name 2", "ERROR value at path has the wrong type"},
+		{"JSON.DEL user:1 $.tags[1]", "1"},
+		{"JSON.GET user:1", `{"address":{"city":"Oslo"},"age":32,"name":"John","tags":["admin"]}`},
+		{`JSON.SET doc:new $ [1, 2]`, "OK"},
+		{"JSON.GET doc:new $[-1]", "2"},
+		{"JSON.DEL doc:new", "1"},
+		{"GET doc:new", "nil"},
+	}
+
+	for _, cmd := range commands {
+		if response := sendCommand(t, conn, reader, cmd.cmd); response != cmd.expected {
+			t.Errorf("Command '%s': got %q, want %q", cmd.cmd, response, cmd.expected)
+		}
+	}
+}
+
+func TestServerQueryCommands(t *testing.T) {
+	_, conn, reader := startTestServer(t, &config.Config{AdminPassword: "adminpass"})
+	// Index management is an admin command
+	if response := sendCommand(t, conn, reader, "AUTH admin adminpass"); response != "OK" {
+		t.Fatalf("AUTH as admin: got %q", response)
+	}
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{`SET users:1 {"email": "ann@example.com", "age": 31}`, "OK"},
+		{`SET users:2 {"email": "bob@example.com", "age": 25}`, "OK"},
+		{"INDEX.CREATE users_age users:* $.age", "OK"},
+		{"INDEX.CREATE users_email users:* $.email", "OK"},
+		{`SET users:3 {"email": "bea@example.org", "age": 40}`, "OK"},
+		{"INDEX.LIST", `[{"name":"users_age","pattern":"users:*","path":"$.age"},{"name":"users_email","pattern":"users:*","path":"$.email"}]`},
+		{"QUERY users_age EQ 31", `["users:1"]`},
+		{"QUERY users_age RANGE 20 35", `["users:2","users:1"]`},
+		{"QUERY users_age GT 20 LIMIT 2 OFFSET 1", `["users:1","users:3"]`},
+		{"QUERY users_email PREFIX b", `["users:3","users:2"]`},
+		{"QUERY users_email EQ nobody@example.com", `[]`},
+		{"INDEX.DROP users_email", "OK"},
+		{"QUERY users_email EQ ann@example.com", "ERROR index not found: users_email"},
+	}
+
+	for _, cmd := range commands {
+		if response := sendCommand(t, conn, reader, cmd.cmd); response != cmd.expected {
+			t.Errorf("Command '%s': got %q, want %q", cmd.cmd, response, cmd.expected)
+		}
+	}
+}
+
+func TestServerKeysAndScan(t *testing.T) {
+	_, conn, reader := startTestServer(t, &config.Config{})
+
+	for _, key := range []string{"user:1", "user:2", "user:10", "userX1", "post:1"} {
+		if response := sendCommand(t, conn, reader, "SET "+key+" v"); response != "OK" {
+			t.Fatalf("SET %s: got %q", key, response)
+		}
+	}
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{"KEYS user:*", `["user:1","user:10","user:2"]`},
+		{"KEYS user:?", `["user:1","user:2"]`},
+		{"KEYS user:[13]*", `["user:1","user:10"]`},
+		{"KEYS user.*", `[]`},
+		{"SCAN 0 COUNT", "ERROR COUNT requires a value"},
+		{"SCAN abc", "ERROR invalid cursor: abc"},
+	}
+	for _, cmd := range commands {
+		if response := sendCommand(t, conn, reader, cmd.cmd); response != cmd.expected {
+			t.Errorf("Command '%s': got %q, want %q", cmd.cmd, response, cmd.expected)
+		}
+	}
+
+	var found []string
+	cursor := "0"
+	for i := 0; ; i++ {
+		var reply []json.RawMessage
+		if err := json.Unmarshal([]byte(sendCommand(t, conn, reader, "SCAN "+cursor+" MATCH user:* COUNT 2")), &reply); err != nil || len(reply) != 2 {
+			t.Fatalf("invalid SCAN reply: %v", err)
+		}
+		var keys []string
+		json.Unmarshal(reply[0], &cursor)
+		json.Unmarshal(reply[1], &keys)
+		found = append(found, keys...)
+
+		if cursor == "0" {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("SCAN did not terminate")
+		}
+	}
+	sort.Strings(found)
+	if strings.Join(found, ",") != "user:1,user:10,user:2" {
+		t.Errorf("SCAN returned %v", found)
+	}
+}
+
+func TestServerRESP(t *testing.T) {
+	respPort, err := testutil.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+
+	// The native listener keeps working next to the RESP one
+	_, nativeConn, nativeReader := startTestServer(t, &config.Config{
+		Listeners: []config.ListenerConfig{
+			{Protocol: config.ProtocolNative},
+			{Protocol: config.ProtocolRESP, Port: respPort},
+		},
+	})
+	if response := sendCommand(t, nativeConn, nativeReader, "PING"); response != "PONG" {
+		t.Fatalf("native PING: got %q", response)
+	}
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", respPort), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to RESP listener: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	send := func(args ...string) {
+		t.Helper()
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+		conn.SetWriteDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(b.String())); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	expect := func(want string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(reader, got); err != nil {
+			t.Fatalf("read failed: %v (wanted %q)", err, want)
+		}
+		if string(got) != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	value := "  \"quoted\"\tline one\r\nline two  "
+
+	send("GET", "k")
+	expect("-NOAUTH Authentication required.\r\n")
+	send("AUTH", "wrong")
+	expect("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	send("AUTH", "testpass")
+	expect("+OK\r\n")
+
+	send("SET", "k", value)
+	expect("+OK\r\n")
+	send("GET", "k")
+	expect(fmt.Sprintf("$%d\r\n%s\r\n", len(value), value))
+	send("GET", "missing")
+	expect("$-1\r\n")
+	// Bulk strings are binary safe
+	binary := "\xff\xfe\x00bin\xc3\xa9\xc3"
+	send("SET", "bin", binary)
+	expect("+OK\r\n")
+	send("GET", "bin")
+	expect(fmt.Sprintf("$%d\r\n%s\r\n", len(binary), binary))
+	send("SET", "doc", `{"tags": []}`, "EX", "100")
+	expect("+OK\r\n")
+	send("TTL", "doc")
+	expect(":100\r\n")
+	send("JSON.ARRAPPEND", "doc", "$.tags", `"a b"`, `{"c": 1}`)
+	expect(":2\r\n")
+	send("KEYS", "*o*")
+	expect("*1\r\n$3\r\ndoc\r\n")
+	send("NOPE")
+	expect("-ERR unknown command: NOPE\r\n")
+
+	// Inline commands work as well, as sent by telnet
+	conn.Write([]byte("PING\r\n"))
+	expect("+PONG\r\n")
+
+	send("HELLO", "3")
+	expect("%6\r\n$6\r\nserver\r\n$6\r\njsondb\r\n")
+	for _, line := range []string{"$7\r\nversion\r\n$5\r\n1.0.0\r\n", "$5\r\nproto\r\n:3\r\n", "$4\r\nmode\r\n$10\r\nstandalone\r\n", "$4\r\nrole\r\n$6\r\nmaster\r\n", "$7\r\nmodules\r\n*0\r\n"} {
+		expect(line)
+	}
+	send("GET", "missing")
+	expect("_\r\n")
+
+	// RESP3 tells pushed messages from replies, so commands keep working
+	send("SUBSCRIBE", "ch")
+	expect(">3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n")
+	send("GET", "missing")
+	expect("_\r\n")
+	if response := sendCommand(t, nativeConn, nativeReader, "PUBLISH ch hi"); response != "1" {
+		t.Fatalf("PUBLISH: got %q", response)
+	}
+	expect(">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n")
+
+	// Values past the unauthenticated limits are fine once authenticated
+	large := strings.Repeat("x", 20000)
+	send("SET", "large", large)
+	expect("+OK\r\n")
+
+	send("QUIT")
+	expect("+OK\r\n")
+
+	// Before AUTH, announced lengths are held to small limits, like Redis
+	for _, request := range []string{"*11\r\n", "*1\r\n$16385\r\n"} {
+		anonymous, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", respPort), time.Second)
+		if err != nil {
+			t.Fatalf("Failed to connect to RESP listener: %v", err)
+		}
+		anonymous.SetDeadline(time.Now().Add(time.Second))
+		anonymous.Write([]byte(request))
+		line, _ := bufio.NewReader(anonymous).ReadString('\n')
+		anonymous.Close()
+		if !strings.HasPrefix(line, "-ERR Protocol error: invalid unauthenticated") {
+			t.Errorf("unauthenticated %q: got %q", request, line)
+		}
+	}
+}
+
+func TestServerFramedProtocol(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{})
+
+	if response := sendCommand(t, conn, reader, "PROTOCOL 3"); response != "ERROR unsupported protocol version: 3" {
+		t.Fatalf("PROTOCOL 3: got %q", response)
+	}
+	if response := sendCommand(t, conn, reader, "PROTOCOL 2"); response != "OK" {
+		t.Fatalf("PROTOCOL 2: got %q", response)
+	}
+
+	exchange := func(request, want string) {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(reader, got); err != nil {
+			t.Fatalf("read failed: %v (wanted %q)", err, want)
+		}
+		if string(got) != want {
+			t.Fatalf("request %q: got %q, want %q", request, got, want)
+		}
+	}
+
+	value := "\"  spaced\t\tvalue\nwith \"quotes\"  \""
+	exchange(fmt.Sprintf("SET k {%d}\n%s\n", len(value), value), "VALUE 2\nOK\n")
+	exchange("GET k\n", fmt.Sprintf("VALUE %d\n%s\n", len(value), value))
+	exchange("GET missing\n", "NIL\n")
+
+	doc := `{"name": "a  b", "tags": []}`
+	exchange(fmt.Sprintf("SET doc {%d} EX {3}\n%s\n100\n", len(doc), doc), "VALUE 2\nOK\n")
+	exchange("JSON.GET doc $.name\n", "VALUE 6\n\"a  b\"\n")
+	exchange("JSON.ARRAPPEND doc $.tags {5} 1\n\"x y\"\n", "VALUE 1\n2\n")
+	exchange("TTL doc\n", "VALUE 3\n100\n")
+	exchange("NOPE\n", "ERROR 21\nunknown command: NOPE\n")
+
+	// Literals that are not valid UTF-8 round-trip byte-for-byte too
+	binary := "\xff\xfe\n{\xe2\x82}\xdc"
+	exchange(fmt.Sprintf("SET bin {%d}\n%s\n", len(binary), binary), "VALUE 2\nOK\n")
+	exchange("GET bin\n", fmt.Sprintf("VALUE %d\n%s\n", len(binary), binary))
+
+	// An empty value is a VALUE of length 0, not OK
+	exchange("SET empty {0}\n\n", "VALUE 2\nOK\n")
+	exchange("GET empty\n", "VALUE 0\n\n")
+
+	// Back to line mode
+	exchange("PROTOCOL 1\n", "VALUE 2\nOK\n")
+	if response := sendCommand(t, conn, reader, "GET doc"); response != `{"name":"a  b","tags":["x y",1]}` {
+		t.Errorf("GET in line mode: got %q", response)
+	}
+	// Lines past the unauthenticated limit are fine once authenticated
+	if response := sendCommand(t, conn, reader, "SET large "+strings.Repeat("x", 20000)); response != "OK" {
+		t.Errorf("SET of a long line: got %q", response)
+	}
+
+	// The literals of a request share one size budget, checked before any
+	// of them is read
+	exchange("PROTOCOL 2\n", "OK\n")
+	half := maxFrameSize/2 + 1
+	want := fmt.Sprintf("framing error: literals of the request exceed %d bytes", maxFrameSize)
+	exchange(fmt.Sprintf("MSET a {%d} b {%d}\n", half, half), fmt.Sprintf("ERROR %d\n%s\n", len(want), want))
+
+	// Before AUTH, a line is held to a small limit however long it gets
+	anonymous, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", srv.Config.Port), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer anonymous.Close()
+	anonymous.SetDeadline(time.Now().Add(time.Second))
+	anonymousReader := bufio.NewReader(anonymous)
+	anonymousReader.ReadString('\n')
+	anonymous.Write([]byte(strings.Repeat("x", maxNativeLineSizeUnauthenticated+4096)))
+	want = fmt.Sprintf("ERROR request line too long: more than %d bytes\n", maxNativeLineSizeUnauthenticated)
+	if line, _ := anonymousReader.ReadString('\n'); line != want {
+		t.Errorf("unauthenticated long line: got %q, want %q", line, want)
+	}
+	if _, err := anonymousReader.ReadString('\n'); err != io.EOF {
+		t.Errorf("connection still open after a long line: %v", err)
+	}
+}
+
+func TestServerBatchCommands(t *testing.T) {
+	_, conn, reader := startTestServer(t, &config.Config{})
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{"MSET a 1 b \"two\" c {\"x\":1}", "OK"},
+		{"MSET a", "ERROR MSET command requires key value pairs"},
+		{"MGET a b missing c", `["1","two",null,"{\"x\":1}"]`},
+		{"GET b", "two"},
+		{"MDEL a missing c", "2"},
+		{"MGET a b c", `[null,"two",null]`},
+		{"MDEL", "ERROR MDEL command requires at least one key"},
+	}
+	for _, cmd := range commands {
+		if response := sendCommand(t, conn, reader, cmd.cmd); response != cmd.expected {
+			t.Errorf("Command '%s': got %q, want %q", cmd.cmd, response, cmd.expected)
+		}
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	_, conn, reader := startTestServer(t, &config.Config{})
+
+	// All commands go out in a single write, the replies come back in order
+	var b strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&b, "SET key:%d %d\nGET key:%d\n", i, i, i)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		for _, expected := range []string{"OK", strconv.Itoa(i)} {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading reply %d: %v", i, err)
+			}
+			if got := strings.TrimSpace(line); got != expected {
+				t.Fatalf("reply %d: got %q, want %q", i, got, expected)
+			}
+		}
+	}
+}
+
+func TestServerTransactions(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{})
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{"EXEC", "ERROR EXEC without MULTI"},
+		{"MULTI", "OK"},
+		{"MULTI", "ERROR MULTI calls can not be nested"},
+		{"SET order:1 {\"total\":5}", "QUEUED"},
+		{"JSON.ARRAPPEND orders:user:1 $ 1", "QUEUED"},
+		{"MSET a 1 b 2", "QUEUED"},
+		{"EXEC", `["OK","ERROR key not found","OK"]`},
+		{"MGET order:1 a b", `["{\"total\":5}","1","2"]`},
+		{"MULTI", "OK"},
+		{"KEYS *", "ERROR KEYS is not allowed inside MULTI"},
+		{"SET c 1", "QUEUED"},
+		{"EXEC", "ERROR Transaction discarded because of previous errors"},
+		{"GET c", "nil"},
+		{"MULTI", "OK"},
+		{"SET c 1", "QUEUED"},
+		{"DISCARD", "OK"},
+		{"GET c", "nil"},
+	}
+	for _, cmd := range commands {
+		if response := sendCommand(t, conn, reader, cmd.cmd); response != cmd.expected {
+			t.Errorf("Command '%s': got %q, want %q", cmd.cmd, response, cmd.expected)
+		}
+	}
+
+	// A write from another client between WATCH and EXEC aborts the transaction
+	sendCommand(t, conn, reader, "WATCH a")
+	srv.Engine.Set("a", "changed")
+	sendCommand(t, conn, reader, "MULTI")
+	sendCommand(t, conn, reader, "SET a mine")
+	if response := sendCommand(t, conn, reader, "EXEC"); response != "nil" {
+		t.Errorf("EXEC after a watched key changed: got %q, want nil", response)
+	}
+	if response := sendCommand(t, conn, reader, "GET a"); response != "changed" {
+		t.Errorf("aborted transaction wrote a: %q", response)
+	}
+
+	// EXEC clears the watch, so the next transaction goes through
+	srv.Engine.Set("a", "again")
+	sendCommand(t, conn, reader, "MULTI")
+	sendCommand(t, conn, reader, "SET a mine")
+	if response := sendCommand(t, conn, reader, "EXEC"); response != `["OK"]` {
+		t.Errorf("EXEC without watch: got %q", response)
+	}
+
+	sendCommand(t, conn, reader, "WATCH a missing")
+	sendCommand(t, conn, reader, "MULTI")
+	sendCommand(t, conn, reader, "SET a watched")
+	if response := sendCommand(t, conn, reader, "EXEC"); response != `["OK"]` {
+		t.Errorf("EXEC with unchanged watched keys: got %q", response)
+	}
+}
+
+func TestServerConditionalWrites(t *testing.T) {
+	_, conn, reader := startTestServer(t, &config.Config{})
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{"SET lock owner-1 NX EX 30", "OK"},
+		{"SET lock owner-2 NX EX 30", "nil"},
+		{"GET lock", "owner-1"},
+		{"SET missing v XX", "nil"},
+		{"SET lock owner-3 XX", "OK"},
+		{"TTL lock", "-1"},
+		{"SET lock v NX XX", "ERROR syntax error in SET options"},
+		{"SET lock v IFVERSION abc", "ERROR invalid version in SET"},
+		{"SET greeting hello world NX", "OK"},
+		{"GET greeting", "hello world"},
+		{"GETSET greeting bye", "hello world"},
+		{"GETSET unknown v", "nil"},
+		{"GETDEL greeting", "bye"},
+		{"GETDEL greeting", "nil"},
+		{"VERSION greeting", "0"},
+		{"SET fresh v IFVERSION 0", "OK"},
+	}
+	for _, cmd := range commands {
+		if response := sendCommand(t, conn, reader, cmd.cmd); response != cmd.expected {
+			t.Errorf("Command '%s': got %q, want %q", cmd.cmd, response, cmd.expected)
+		}
+	}
+
+	version := sendCommand(t, conn, reader, "VERSION fresh")
+	if response := sendCommand(t, conn, reader, "SET fresh {\"a\": 1} IFVERSION "+version); response != "OK" {
+		t.Errorf("SET with the current version: got %q", response)
+	}
+	if response := sendCommand(t, conn, reader, "SET fresh {\"a\": 2} IFVERSION "+version); response != "nil" {
+		t.Errorf("SET with a stale version: got %q", response)
+	}
+	if response := sendCommand(t, conn, reader, "GET fresh"); response != `{"a": 1}` {
+		t.Errorf("GET fresh: got %q", response)
+	}
+}
+
+func TestServerPubSub(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{
+		NotifyKeyspaceEvents: []string{"set", "del"},
+	})
+	address := fmt.Sprintf("localhost:%d", srv.Config.Port)
+
+	subConn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer subConn.Close()
+	subReader := bufio.NewReader(subConn)
+	subReader.ReadString('\n')
+	sendCommand(t, subConn, subReader, "AUTH "+srv.Config.Password)
+
+	expect := func(want string) {
+		t.Helper()
+		subConn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := subReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read failed: %v (wanted %q)", err, want)
+		}
+		if got := strings.TrimSpace(line); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	if response := sendCommand(t, subConn, subReader, "SUBSCRIBE news alerts"); response != `["subscribe","news",1]` {
+		t.Fatalf("SUBSCRIBE: got %q", response)
+	}
+	expect(`["subscribe","alerts",2]`)
+	if response := sendCommand(t, subConn, subReader, "PSUBSCRIBE __keyspace@0__:user:*"); response != `["psubscribe","__keyspace@0__:user:*",3]` {
+		t.Fatalf("PSUBSCRIBE: got %q", response)
+	}
+	if response := sendCommand(t, subConn, subReader, "GET user:1"); !strings.HasPrefix(response, "ERROR only SUBSCRIBE") {
+		t.Errorf("GET while subscribed: got %q", response)
+	}
+	if response := sendCommand(t, subConn, subReader, "PING"); response != `["pong",""]` {
+		t.Errorf("PING while subscribed: got %q", response)
+	}
+
+	if response := sendCommand(t, conn, reader, "PUBLISH news hello world"); response != "1" {
+		t.Errorf("PUBLISH news: got %q", response)
+	}
+	expect(`["message","news","hello world"]`)
+	if response := sendCommand(t, conn, reader, "PUBLISH nobody hi"); response != "0" {
+		t.Errorf("PUBLISH nobody: got %q", response)
+	}
+
+	sendCommand(t, conn, reader, "SET user:1 {\"name\": \"ann\"}")
+	expect(`["pmessage","__keyspace@0__:user:*","__keyspace@0__:user:1","set"]`)
+	sendCommand(t, conn, reader, "DEL user:1")
+	expect(`["pmessage","__keyspace@0__:user:*","__keyspace@0__:user:1","del"]`)
+	// Events outside of NOTIFY_KEYSPACE_EVENTS are not published
+	sendCommand(t, conn, reader, "SET user:2 v PX 1")
+	expect(`["pmessage","__keyspace@0__:user:*","__keyspace@0__:user:2","set"]`)
+	time.Sleep(5 * time.Millisecond)
+	sendCommand(t, conn, reader, "GET user:2")
+
+	if response := sendCommand(t, subConn, subReader, "UNSUBSCRIBE"); response != `["unsubscribe","alerts",2]` {
+		t.Fatalf("UNSUBSCRIBE: got %q", response)
+	}
+	expect(`["unsubscribe","news",1]`)
+	sendCommand(t, subConn, subReader, "PUNSUBSCRIBE")
+	if response := sendCommand(t, subConn, subReader, "PING"); response != "PONG" {
+		t.Errorf("PING after unsubscribing: got %q", response)
+	}
+}
+
+// Keyspace notifications name keys, so a subscriber only receives those of
+// the keys its user may read
+func TestServerPubSubACL(t *testing.T) {
+	aclFile := t.TempDir() + "/users.acl"
+	os.WriteFile(aclFile, []byte("user reporter on >rpass %R~reports:* +@read +@pubsub\n"), 0600)
+	srv, conn, reader := startTestServer(t, &config.Config{
+		ACLFile:              aclFile,
+		AdminPassword:        "adminpass",
+		NotifyKeyspaceEvents: []string{"set"},
+	})
+	sendCommand(t, conn, reader, "AUTH admin adminpass")
+
+	subConn, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", srv.Config.Port), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer subConn.Close()
+	subReader := bufio.NewReader(subConn)
+	subReader.ReadString('\n')
+	sendCommand(t, subConn, subReader, "AUTH reporter rpass")
+	sendCommand(t, subConn, subReader, "SUBSCRIBE __keyevent@0__:set")
+	if response := sendCommand(t, subConn, subReader, "PSUBSCRIBE __keyspace@0__:*"); response != `["psubscribe","__keyspace@0__:*",2]` {
+		t.Fatalf("PSUBSCRIBE: got %q", response)
+	}
+
+	sendCommand(t, conn, reader, "SET orders:1 1")
+	sendCommand(t, conn, reader, "SET reports:1 1")
+	for _, want := range []string{
+		`["pmessage","__keyspace@0__:*","__keyspace@0__:reports:1","set"]`,
+		`["message","__keyevent@0__:set","reports:1"]`,
+	} {
+		subConn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := subReader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read failed: %v (wanted %q)", err, want)
+		}
+		if got := strings.TrimSpace(line); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	// Rule changes apply to existing subscriptions
+	sendCommand(t, conn, reader, "ACL SETUSER reporter resetkeys %R~orders:*")
+	sendCommand(t, conn, reader, "SET reports:2 1")
+	sendCommand(t, conn, reader, "SET orders:2 1")
+	subConn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, _ := subReader.ReadString('\n'); strings.TrimSpace(line) != `["pmessage","__keyspace@0__:*","__keyspace@0__:orders:2","set"]` {
+		t.Errorf("after ACL SETUSER: got %q", line)
+	}
+}
+
+func TestServerPubSubSlowConsumer(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{PubsubClientBuffer: 4})
+	sub := srv.pubsub.newSubscriber(defaultUser)
+	srv.pubsub.subscribe(sub, "news")
+
+	// Nobody reads the subscriber's queue, so it is dropped once full
+	for i := 0; i < 4; i++ {
+		if response := sendCommand(t, conn, reader, "PUBLISH news "+strconv.Itoa(i)); response != "1" {
+			t.Fatalf("PUBLISH %d: got %q", i, response)
+		}
+	}
+	if response := sendCommand(t, conn, reader, "PUBLISH news overflow"); response != "0" {
+		t.Errorf("PUBLISH to a full subscriber: got %q", response)
+	}
+	if !sub.dropped.Load() {
+		t.Error("slow subscriber was not dropped")
+	}
+	select {
+	case <-sub.done:
+	default:
+		t.Error("slow subscriber was not closed")
+	}
+}
+
+func TestServerChangeFeed(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{ChangeFeedSize: 100})
+	address := fmt.Sprintf("localhost:%d", srv.Config.Port)
+
+	sendCommand(t, conn, reader, "SET a 1")
+
+	follow := func(from string) (net.Conn, *bufio.Reader, string) {
+		t.Helper()
+		feedConn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+		t.Cleanup(func() { feedConn.Close() })
+		feedReader := bufio.NewReader(feedConn)
+		feedReader.ReadString('\n')
+		sendCommand(t, feedConn, feedReader, "AUTH "+srv.Config.Password)
+		return feedConn, feedReader, sendCommand(t, feedConn, feedReader, "WATCHFEED "+from)
+	}
+	read := func(r *bufio.Reader, c net.Conn) []interface{} {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		var change []interface{}
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&change); err != nil || len(change) != 6 || change[0] != "change" {
+			t.Fatalf("unexpected change %q", line)
+		}
+		return change
+	}
+
+	feedConn, feedReader, response := follow("0")
+	var confirm []interface{}
+	if err := json.Unmarshal([]byte(response), &confirm); err != nil || confirm[0] != "watchfeed" {
+		t.Fatalf("WATCHFEED 0: got %q", response)
+	}
+
+	// The change made before WATCHFEED is replayed, later ones are streamed
+	change := read(feedReader, feedConn)
+	if change[2] != "set" || change[3] != "a" || change[4] != "1" || change[5] != json.Number("0") {
+		t.Errorf("first change = %v", change)
+	}
+	sendCommand(t, conn, reader, "SET doc {\"n\": 1} EX 100")
+	sendCommand(t, conn, reader, "DEL a")
+	change = read(feedReader, feedConn)
+	if change[2] != "set" || change[3] != "doc" || change[4] != `{"n": 1}` || change[5] == json.Number("0") {
+		t.Errorf("second change = %v", change)
+	}
+	last := read(feedReader, feedConn)
+	if last[2] != "del" || last[3] != "a" || last[4] != nil {
+		t.Errorf("third change = %v", last)
+	}
+
+	if response := sendCommand(t, feedConn, feedReader, "GET a"); !strings.HasPrefix(response, "ERROR only SUBSCRIBE") {
+		t.Errorf("GET while following the feed: got %q", response)
+	}
+	if response := sendCommand(t, feedConn, feedReader, "UNWATCHFEED"); response != "OK" {
+		t.Errorf("UNWATCHFEED: got %q", response)
+	}
+	if response := sendCommand(t, feedConn, feedReader, "GET doc"); response != `{"n": 1}` {
+		t.Errorf("GET after UNWATCHFEED: got %q", response)
+	}
+
+	// A follower resumes after the last change it processed
+	seq, _ := last[1].(json.Number).Int64()
+	sendCommand(t, conn, reader, "SET b 2")
+	resumedConn, resumedReader, _ := follow(strconv.FormatInt(seq+1, 10))
+	if change := read(resumedReader, resumedConn); change[3] != "b" {
+		t.Errorf("resumed change = %v", change)
+	}
+
+	_, _, response = follow("1")
+	if !strings.HasPrefix(response, "ERROR changes are no longer in the change feed") {
+		t.Errorf("WATCHFEED of a lost position: got %q", response)
+	}
+}
+
+func TestServerReplication(t *testing.T) {
+	leader, conn, reader := startTestServer(t, &config.Config{ChangeFeedSize: 100})
+	sendCommand(t, conn, reader, "SET before {\"n\": 1}")
+	sendCommand(t, conn, reader, "SET number 7 EX 100")
+	// The snapshot takes more than one frame
+	big := strings.Repeat("x", 2*snapshotChunkSize+100)
+	leader.Engine.Set("big", big)
+
+	follower, fconn, freader := startTestServer(t, &config.Config{
+		ReplicaOf:     fmt.Sprintf("localhost:%d", leader.Config.Port),
+		Password:      leader.Config.Password,
+		AdminPassword: "adminpass",
+		// The follower encrypts what it receives with its own key
+		EnableEncryption: true,
+		EncryptionKey:    "0123456789abcdef0123456789abcdef",
+	})
+
+	// waitFor polls the follower until a command returns the expected reply
+	waitFor := func(cmd, want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			got := sendCommand(t, fconn, freader, cmd)
+			if got == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("follower %s: got %q, want %q", cmd, got, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Full sync, then streamed changes
+	waitFor("GET before", `{"n": 1}`)
+	if value, err := follower.Engine.Get("big"); err != nil || string(value) != `"`+big+`"` {
+		t.Errorf("replicated big value: %d bytes, %v", len(value), err)
+	}
+	if ttl := sendCommand(t, fconn, freader, "TTL number"); ttl != "100" && ttl != "99" {
+		t.Errorf("replicated TTL = %s", ttl)
+	}
+	sendCommand(t, conn, reader, "SET after 1")
+	sendCommand(t, conn, reader, "DEL before")
+	leader.Engine.Set("binary", "\xff\xfe")
+	waitFor("GET before", "nil")
+	waitFor("GET after", "1")
+	if value, err := follower.Engine.Get("binary"); err != nil || string(value) != `"\udcff\udcfe"` {
+		t.Errorf("replicated binary value = %q, %v", value, err)
+	}
+
+	if response := sendCommand(t, fconn, freader, "SET x 1"); response != "ERROR You can't write against a read only replica." {
+		t.Errorf("write on follower: got %q", response)
+	}
+
+	role := sendCommand(t, fconn, freader, "ROLE")
+	if !strings.HasPrefix(role, `["slave","localhost",`+strconv.Itoa(leader.Config.Port)+`,"connected",`) {
+		t.Errorf("follower ROLE = %s", role)
+	}
+	var leaderRole []interface{}
+	json.Unmarshal([]byte(sendCommand(t, conn, reader, "ROLE")), &leaderRole)
+	if len(leaderRole) != 3 || leaderRole[0] != "master" || len(leaderRole[2].([]interface{})) != 1 {
+		t.Errorf("leader ROLE = %v", leaderRole)
+	}
+
+	// After a short disconnect the follower resumes from the change feed
+	// instead of a full sync, which would drop this local key
+	follower.Engine.Set("local", 1)
+	follower.replica.Load().mu.Lock()
+	follower.replica.Load().conn.Close()
+	follower.replica.Load().mu.Unlock()
+	sendCommand(t, conn, reader, "SET during 1")
+	waitFor("GET during", "1")
+	if response := sendCommand(t, fconn, freader, "GET local"); response != "1" {
+		t.Errorf("partial resync did a full sync, local key: %q", response)
+	}
+
+	if response := sendCommand(t, fconn, freader, "AUTH admin adminpass"); response != "OK" {
+		t.Fatalf("AUTH as admin: got %q", response)
+	}
+	if response := sendCommand(t, fconn, freader, "REPLICAOF NO ONE"); response != "OK" {
+		t.Errorf("REPLICAOF NO ONE: got %q", response)
+	}
+	if response := sendCommand(t, fconn, freader, "SET x 1"); response != "OK" {
+		t.Errorf("write after promotion: got %q", response)
+	}
+}
+
+func TestServerReplicationTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := testutil.NewTestCA(t, dir)
+	certFile, keyFile := ca.Issue(t, dir, "server", "localhost")
+	replicaCert, replicaKey := ca.Issue(t, dir, "replica", "replica")
+
+	// The leader only accepts replicas presenting a certificate of its CA
+	tlsPort, err := testutil.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	leader, conn, reader := startTestServer(t, &config.Config{
+		ChangeFeedSize: 100,
+		Listeners: []config.ListenerConfig{
+			{Protocol: config.ProtocolNative},
+			{Protocol: config.ProtocolNative, Port: tlsPort, TLS: true},
+		},
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		TLSClientCAFile: ca.CertFile,
+	})
+	sendCommand(t, conn, reader, "SET before 1")
+
+	_, fconn, freader := startTestServer(t, &config.Config{
+		ReplicaOf:          fmt.Sprintf("localhost:%d", tlsPort),
+		Password:           leader.Config.Password,
+		ReplicaTLS:         true,
+		ReplicaTLSCAFile:   ca.CertFile,
+		ReplicaTLSCertFile: replicaCert,
+		ReplicaTLSKeyFile:  replicaKey,
+	})
+
+	sendCommand(t, conn, reader, "SET after 2")
+	deadline := time.Now().Add(2 * time.Second)
+	for sendCommand(t, fconn, freader, "MGET before after") != `["1","2"]` {
+		if time.Now().After(deadline) {
+			t.Fatalf("follower did not sync over TLS, ROLE = %s", sendCommand(t, fconn, freader, "ROLE"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerMemoryLimit(t *testing.T) {
+	_, conn, reader := startTestServer(t, &config.Config{MaxMemory: 1024})
+
+	for i := 0; ; i++ {
+		response := sendCommand(t, conn, reader, fmt.Sprintf("SET key:%d %s", i, strings.Repeat("x", 100)))
+		if response == "OK" {
+			continue
+		}
+		if !strings.HasPrefix(response, "ERROR out of memory") {
+			t.Fatalf("SET over the limit: got %q", response)
+		}
+		break
+	}
+	if response := sendCommand(t, conn, reader, "DELETE key:0"); response != "OK" {
+		t.Errorf("DEL over the limit: got %q", response)
+	}
+
+	var info map[string]interface{}
+	response := sendCommand(t, conn, reader, "INFO")
+	if err := json.Unmarshal([]byte(response), &info); err != nil {
+		t.Fatalf("INFO: got %q", response)
+	}
+	if info["maxmemory"] != float64(1024) || info["maxmemory_policy"] != "noeviction" || info["rejected_writes"] != float64(1) {
+		t.Errorf("INFO = %v", info)
+	}
+}
+
+func TestServerConnectionLimits(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{
+		MaxConnections:     2,
+		IdleTimeoutSeconds: 1,
+		ReadTimeoutSeconds: 1,
+		AuthTimeoutSeconds: 1,
+	})
+	address := fmt.Sprintf("localhost:%d", srv.Config.Port)
+
+	// Wait for the connection of WaitForServer to be released
+	for deadline := time.Now().Add(time.Second); srv.clients.Load() != 1; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections open, want 1", srv.clients.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dial := func() (net.Conn, *bufio.Reader, string) {
+		t.Helper()
+		c, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		r := bufio.NewReader(c)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		line, _ := r.ReadString('\n')
+		return c, r, strings.TrimSpace(line)
+	}
+
+	idle, idleReader, prompt := dial()
+	if prompt != "AUTH_REQUIRED" {
+		t.Fatalf("second connection: got %q", prompt)
+	}
+	if _, _, prompt := dial(); prompt != "ERROR max number of clients reached" {
+		t.Errorf("connection over the limit: got %q", prompt)
+	}
+	if response := sendCommand(t, idle, idleReader, "AUTH "+srv.Config.Password); response != "OK" {
+		t.Fatalf("AUTH failed: %s", response)
+	}
+
+	// A command that never ends is cut off by the read timeout, an idle
+	// connection by the idle timeout, while the first connection stays busy
+	fmt.Fprint(conn, "SET partial")
+	for i := 0; i < 3; i++ {
+		time.Sleep(500 * time.Millisecond)
+		if response := sendCommand(t, idle, idleReader, "PING"); response != "PONG" {
+			t.Fatalf("PING on an active connection: got %q", response)
+		}
+	}
+	closed := func(c net.Conn, r *bufio.Reader) bool {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := r.ReadString('\n')
+		return err == io.EOF
+	}
+	if !closed(conn, reader) {
+		t.Errorf("connection with an incomplete command was not closed")
+	}
+	time.Sleep(1200 * time.Millisecond)
+	if !closed(idle, idleReader) {
+		t.Errorf("idle connection was not closed")
+	}
+
+	// An unauthenticated connection only has the auth timeout
+	unauth, unauthReader, _ := dial()
+	start := time.Now()
+	if !closed(unauth, unauthReader) || time.Since(start) > 1500*time.Millisecond {
+		t.Errorf("unauthenticated connection was not closed in time")
+	}
+}
+
+func TestServerAdminCommands(t *testing.T) {
+	srv, conn, reader := startTestServer(t, &config.Config{AdminPassword: "adminpass", DumpPath: t.TempDir()})
+
+	// The server password does not grant the admin commands
+	if response := sendCommand(t, conn, reader, "FLUSHALL"); response != "ERROR no permission: user 'default' may not run FLUSHALL (@admin)" {
+		t.Errorf("FLUSHALL without admin: got %q", response)
+	}
+	_, plain, plainReader := startTestServer(t, &config.Config{DumpPath: t.TempDir()})
+	if response := sendCommand(t, plain, plainReader, "RESTORE"); response != "ERROR no permission: user 'default' may not run RESTORE (@admin)" {
+		t.Errorf("RESTORE without ADMIN_PASSWORD: got %q", response)
+	}
+
+	admin, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", srv.Config.Port), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer admin.Close()
+	adminReader := bufio.NewReader(admin)
+	adminReader.ReadString('\n')
+	// A password alone only logs in as the default user
+	if response := sendCommand(t, admin, adminReader, "AUTH adminpass"); response != "ERROR Invalid password" {
+		t.Errorf("AUTH with the admin password alone: got %q", response)
+	}
+	if response := sendCommand(t, admin, adminReader, "AUTH admin adminpass"); response != "OK" {
+		t.Fatalf("AUTH with the admin password: got %q", response)
+	}
+
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{"LASTSAVE", "0"},
+		{"SET a 1", "OK"},
+		{"SAVE", "OK"},
+		{"SET b 2", "OK"},
+		{"BGSAVE", "Background saving started"},
+	}
+	for _, tc := range commands {
+		if response := sendCommand(t, admin, adminReader, tc.cmd); response != tc.expected {
+			t.Errorf("%s: got %q, want %q", tc.cmd, response, tc.expected)
+		}
+	}
+
+	// BGSAVE is polled through INFO
+	for deadline := time.Now().Add(time.Second); ; {
+		var info map[string]interface{}
+		json.Unmarshal([]byte(sendCommand(t, admin, adminReader, "INFO")), &info)
+		if info["bgsave_in_progress"] == float64(0) {
+			if info["last_bgsave_status"] != "ok" || info["last_save_time"] == float64(0) {
+				t.Errorf("INFO after BGSAVE = %v", info)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("BGSAVE did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if response := sendCommand(t, admin, adminReader, "LASTSAVE"); response == "0" {
+		t.Errorf("LASTSAVE after saving: got %q", response)
+	}
+
+	commands = []struct {
+		cmd      string
+		expected string
+	}{
+		{"FLUSHALL", "OK"},
+		{"KEYS *", "[]"},
+		{"RESTORE", "OK"},
+		{"GET a", "1"},
+		{"GET b", "2"},
+		{"RESET_MEMORY", "OK"},
+		{"GET a", "nil"},
+		{"RESTORE ../memory.dump", "ERROR failed to restore: invalid snapshot name: ../memory.dump"},
+		{"MULTI", "OK"},
+		{"FLUSHALL", "ERROR FLUSHALL is not allowed inside MULTI"},
+		{"DISCARD", "OK"},
+	}
+	for _, tc := range commands {
+		if response := sendCommand(t, admin, adminReader, tc.cmd); response != tc.expected {
+			t.Errorf("%s: got %q, want %q", tc.cmd, response, tc.expected)
+		}
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := testutil.NewTestCA(t, dir)
+	certFile, keyFile := ca.Issue(t, dir, "server", "localhost")
+	ca.Issue(t, dir, "ops", "ops")
+	ca.Issue(t, dir, "app", "app")
+	ca.Issue(t, dir, "stranger", "stranger")
+
+	tlsPort, err := testutil.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	srv, _, _ := startTestServer(t, &config.Config{
+		Listeners: []config.ListenerConfig{
+			{Protocol: config.ProtocolNative},
+			{Protocol: config.ProtocolNative, Port: tlsPort, TLS: true},
+		},
+		TLSCertFile:         certFile,
+		TLSKeyFile:          keyFile,
+		TLSClientCAFile:     ca.CertFile,
+		TLSClientAuth:       config.TLSClientAuthOptional,
+		TLSClientIdentities: map[string]string{"ops": "admin", "app": "default", "stranger": "missing"},
+		AdminPassword:       "admin-secret",
+	})
+
+	dial := func(name string) (*tls.Conn, *bufio.Reader) {
+		t.Helper()
+		tlsConfig := &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost"}
+		if name != "" {
+			cert, err := tls.LoadX509KeyPair(dir+"/"+name+".pem", dir+"/"+name+"-key.pem")
+			if err != nil {
+				t.Fatalf("Failed to load client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", tlsPort), tlsConfig)
+		if err != nil {
+			t.Fatalf("TLS connection failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		reader := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if prompt, _ := reader.ReadString('\n'); strings.TrimSpace(prompt) != "AUTH_REQUIRED" {
+			t.Fatalf("Expected AUTH_REQUIRED prompt, got: %q", prompt)
+		}
+		return conn, reader
+	}
+
+	// Mapped certificates authenticate as their ACL user without AUTH, an
+	// identity naming an unknown user does not
+	ops, opsReader := dial("ops")
+	app, appReader := dial("app")
+	stranger, strangerReader := dial("stranger")
+	anonymous, anonymousReader := dial("")
+
+	commands := []struct {
+		conn     net.Conn
+		reader   *bufio.Reader
+		cmd      string
+		expected string
+	}{
+		{app, appReader, "SET a 1", "OK"},
+		{app, appReader, "FLUSHALL", "ERROR no permission: user 'default' may not run FLUSHALL (@admin)"},
+		{ops, opsReader, "GET a", "1"},
+		{ops, opsReader, "FLUSHALL", "OK"},
+		{stranger, strangerReader, "GET a", "ERROR Authentication required"},
+		{stranger, strangerReader, "AUTH " + srv.Config.Password, "OK"},
+		{stranger, strangerReader, "SET b 2", "OK"},
+		{anonymous, anonymousReader, "GET b", "ERROR Authentication required"},
+		{app, appReader, "AUTH wrong", "ERROR Invalid password"},
+	}
+	for _, tc := range commands {
+		if response := sendCommand(t, tc.conn, tc.reader, tc.cmd); response != tc.expected {
+			t.Errorf("%s: got %q, want %q", tc.cmd, response, tc.expected)
+		}
+	}
+
+	// A reload serves new connections with the new certificate and leaves
+	// established ones alone
+	before := app.ConnectionState().PeerCertificates[0].SerialNumber
+	ca.Issue(t, dir, "server", "localhost")
+	if err := srv.ReloadTLS(); err != nil {
+		t.Fatalf("ReloadTLS failed: %v", err)
+	}
+	if response := sendCommand(t, app, appReader, "GET b"); response != "2" {
+		t.Errorf("GET on a connection established before the reload: got %q", response)
+	}
+	reloaded, _ := dial("app")
+	if after := reloaded.ConnectionState().PeerCertificates[0].SerialNumber; after.Cmp(before) == 0 {
+		t.Errorf("new connection still uses the old certificate %v", after)
+	}
+
+	// A broken file keeps the previous certificate in use
+	os.WriteFile(keyFile, []byte("garbage"), 0600)
+	if err := srv.ReloadTLS(); err == nil {
+		t.Errorf("ReloadTLS with a broken key succeeded")
+	}
+	dial("app")
+}
+
+func TestServerTLSRequireClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := testutil.NewTestCA(t, dir)
+	certFile, keyFile := ca.Issue(t, dir, "server", "localhost")
+
+	tlsPort, err := testutil.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	startTestServer(t, &config.Config{
+		Listeners: []config.ListenerConfig{
+			{Protocol: config.ProtocolNative},
+			{Protocol: config.ProtocolRESP, Port: tlsPort, TLS: true},
+		},
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		TLSClientCAFile: ca.CertFile,
+		TLSMinVersion:   "1.3",
+	})
+
+	// Without a client certificate the server ends the handshake
+	conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", tlsPort), &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost"})
+	if err == nil {
+		defer conn.Close()
+		fmt.Fprint(conn, "PING\r\n")
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = bufio.NewReader(conn).ReadString('\n')
+	}
+	if err == nil {
+		t.Errorf("connection without a client certificate was accepted")
+	}
+
+	// Versions below TLS_MIN_VERSION are refused
+	_, err = tls.Dial("tcp", fmt.Sprintf("localhost:%d", tlsPort), &tls.Config{RootCAs: ca.Pool(), ServerName: "localhost", MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		t.Errorf("TLS 1.2 connection was accepted")
+	}
+}
+
+func TestServerACL(t *testing.T) {
+	dir := t.TempDir()
+	aclFile := dir + "/users.acl"
+	os.WriteFile(aclFile, []byte("# reporting\nuser reporter on >rpass %R~reports:* +@read\n"), 0600)
+	srv, conn, reader := startTestServer(t, &config.Config{ACLFile: aclFile, AdminPassword: "adminpass"})
+
+	reporter, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", srv.Config.Port), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer reporter.Close()
+	reporterReader := bufio.NewReader(reporter)
+	reporterReader.ReadString('\n')
+
+	commands := []struct {
+		conn     net.Conn
+		reader   *bufio.Reader
+		cmd      string
+		expected string
+	}{
+		{conn, reader, "SET reports:daily 1", "OK"},
+		{conn, reader, "SET orders:1 2", "OK"},
+		{conn, reader, "ACL WHOAMI", "default"},
+		{conn, reader, "ACL LIST", "ERROR no permission: user 'default' may not run ACL (@admin)"},
+		{conn, reader, "AUTH admin adminpass", "OK"},
+		{reporter, reporterReader, "AUTH reporter wrong", "ERROR Invalid password"},
+		{reporter, reporterReader, "AUTH reporter rpass", "OK"},
+		{reporter, reporterReader, "ACL WHOAMI", "reporter"},
+		{reporter, reporterReader, "GET reports:daily", "1"},
+		{reporter, reporterReader, "GET orders:1", "ERROR no permission: user 'reporter' may not access key 'orders:1'"},
+		{reporter, reporterReader, "MGET reports:daily orders:1", "ERROR no permission: user 'reporter' may not access key 'orders:1'"},
+		{reporter, reporterReader, "SET reports:daily 2", "ERROR no permission: user 'reporter' may not run SET (@write)"},
+		{reporter, reporterReader, "KEYS *", `["reports:daily"]`},
+		{reporter, reporterReader, "WATCHFEED", "ERROR no permission: user 'reporter' may not run WATCHFEED without access to every key"},
+		{reporter, reporterReader, "ACL LIST", "ERROR no permission: user 'reporter' may not run ACL (@admin)"},
+
+		// Changes apply to connections already logged in
+		{conn, reader, "ACL SETUSER reporter %RW~reports:* +@write", "OK"},
+		{reporter, reporterReader, "SET reports:daily 2", "OK"},
+		{reporter, reporterReader, "SET orders:1 3", "ERROR no permission: user 'reporter' may not access key 'orders:1'"},
+		{reporter, reporterReader, "MSET reports:daily 3 orders:1", "ERROR MSET command requires key value pairs"},
+		{conn, reader, "ACL SETUSER reporter +@bogus", "ERROR unknown command category 'bogus'"},
+		{conn, reader, "ACL SETUSER reporter off", "OK"},
+		{reporter, reporterReader, "GET reports:daily", "ERROR no permission: user 'reporter' no longer exists or is disabled"},
+		{conn, reader, "ACL DELUSER reporter nobody", "1"},
+		{conn, reader, "ACL DELUSER default", "ERROR the 'default' user cannot be removed"},
+		{conn, reader, "ACL SETUSER viewer on nopass ~* +@read", "OK"},
+		{conn, reader, "ACL SAVE", "OK"},
+	}
+	for _, tc := range commands {
+		if response := sendCommand(t, tc.conn, tc.reader, tc.cmd); response != tc.expected {
+			t.Errorf("%s: got %q, want %q", tc.cmd, response, tc.expected)
+		}
+	}
+
+	// Saved users are loaded again, with their passwords hashed
+	saved, err := os.ReadFile(aclFile)
+	if err != nil {
+		t.Fatalf("Failed to read ACL file: %v", err)
+	}
+	if strings.Contains(string(saved), "testpass") || !strings.Contains(string(saved), "user viewer on nopass ~* +@read\n") {
+		t.Errorf("saved ACL file:\n%s", saved)
+	}
+	store, err := newACLStore(&config.Config{Password: "other", ACLFile: aclFile})
+	if err != nil {
+		t.Fatalf("Failed to load saved ACL file: %v", err)
+	}
+	if user := store.user(defaultUser); user == nil || !store.checkPassword(user, "testpass") || store.checkPassword(user, "other") {
+		t.Errorf("saved default user does not keep its password")
+	}
+	if user := store.user("reporter"); user != nil {
+		t.Errorf("deleted user was saved: %s", user.describe())
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	// RFC 7914 test vector of PBKDF2-HMAC-SHA256
+	if key := fmt.Sprintf("%x", pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)); key != "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783" {
+		t.Errorf("pbkdf2SHA256 = %s", key)
+	}
+
+	first, err := hashPassword("secret", passwordHashIterations)
+	if err != nil {
+		t.Fatalf("hashPassword failed: %v", err)
+	}
+	second, _ := hashPassword("secret", passwordHashIterations)
+	if first == second || !strings.HasPrefix(first, fmt.Sprintf("$pbkdf2-sha256$%d$", passwordHashIterations)) {
+		t.Errorf("hashes of one password = %s, %s, want salted PBKDF2 hashes", first, second)
+	}
+	hash, ok := parsePasswordHash(first)
+	if !ok || hash.String() != first || !hash.matches("secret") || hash.matches("Secret") {
+		t.Errorf("parsed hash %s does not round-trip or match", first)
+	}
+
+	// Unsalted digests and hashes asking for excessive work are refused
+	for _, stored := range []string{
+		"2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+		"$pbkdf2-sha256$100000000$c2FsdHNhbHQ$" + strings.Repeat("A", 43),
+		"$pbkdf2-sha256$1000$c2FsdA$" + strings.Repeat("A", 43),
+	} {
+		if _, ok := parsePasswordHash(stored); ok {
+			t.Errorf("parsePasswordHash(%s) accepted", stored)
+		}
+	}
+
+	user := &aclUser{name: "u", categories: make(map[string]bool)}
+	for _, rule := range []string{"on", ">one", ">two", ">one", "<two"} {
+		if err := user.applyRule(rule, 1000); err != nil {
+			t.Fatalf("applyRule(%s) failed: %v", rule, err)
+		}
+	}
+	store := &aclStore{users: map[string]*aclUser{"u": user}}
+	if len(user.passwords) != 1 || !store.checkPassword(user, "one") || !store.checkPassword(user, "one") || store.checkPassword(user, "two") {
+		t.Errorf("passwords after >one >two >one <two: %v", user.passwords)
+	}
+	if err := user.applyRule("!"+user.passwords[0], 1000); err != nil || len(user.passwords) != 0 || store.checkPassword(user, "one") {
+		t.Errorf("removing the hash with ! left %v, %v", user.passwords, err)
+	}
+
+	// Unknown users are checked against a dummy hash of the configured cost
+	store, err = newACLStore(&config.Config{Password: "pass", PasswordHashIterations: 1000})
+	if err != nil {
+		t.Fatalf("newACLStore failed: %v", err)
+	}
+	if store.dummyHash.iterations != 1000 || store.checkPassword(store.user("nobody"), "pass") {
+		t.Errorf("unknown user: dummy hash %v", store.dummyHash)
+	}
+
+	// The configured password is compared as it is, and only hashed to be listed
+	if !store.checkPassword(store.user(defaultUser), "pass") || store.checkPassword(store.user(defaultUser), "Pass") {
+		t.Errorf("default user does not log in with the configured password only")
+	}
+	lines, err := store.list()
+	if err != nil || len(lines) != 2 || !strings.Contains(lines[1], " #$pbkdf2-sha256$1000$") || strings.Contains(lines[1], "pass ") {
+		t.Errorf("ACL LIST = %q, %v, want the configured password hashed", lines, err)
+	}
+	if err := store.setUser(defaultUser, []string{"<pass"}); err != nil || store.checkPassword(store.user(defaultUser), "pass") {
+		t.Errorf("<pass did not remove the configured password: %v", err)
+	}
+	if _, err := newACLStore(&config.Config{Password: "pass", PasswordHashIterations: maxPasswordHashIterations + 1}); err == nil {
+		t.Errorf("newACLStore accepted %d iterations", maxPasswordHashIterations+1)
+	}
+}
+
+func TestServerAuthLimits(t *testing.T) {
+	auditLog := t.TempDir() + "/auth-audit.log"
+	srv, conn, reader := startTestServer(t, &config.Config{
+		AuthMaxFailuresPerConnection: 2,
+		AuthMaxFailuresPerIP:         3,
+		AuthBanSeconds:               60,
+		AuthBackoffMs:                20,
+		AuthAuditLog:                 auditLog,
+	})
+
+	dial := func() (net.Conn, *bufio.Reader, string) {
+		t.Helper()
+		c, err := net.DialTimeout("tcp", fmt.Sprintf("localhost:%d", srv.Config.Port), time.Second)
+		if err != nil {
+			t.Fatalf("Failed to connect to server: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		r := bufio.NewReader(c)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		prompt, _ := r.ReadString('\n')
+		return c, r, strings.TrimSpace(prompt)
+	}
+	expectClosed := func(c net.Conn, r *bufio.Reader) {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if line, err := r.ReadString('\n'); err != io.EOF {
+			t.Errorf("connection still open: %q, %v", line, err)
+		}
+	}
+
+	// Failures are answered after a growing delay; the connection is closed
+	// once it reaches its limit
+	first, firstReader, _ := dial()
+	start := time.Now()
+	if response := sendCommand(t, first, firstReader, "AUTH wrong1"); response != "ERROR Invalid password" {
+		t.Errorf("first failure: got %q", response)
+	}
+	if response := sendCommand(t, first, firstReader, "AUTH wrong2"); response != "ERROR too many failed authentication attempts" {
+		t.Errorf("second failure: got %q", response)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("two failures answered in %v, want at least 60ms of backoff", elapsed)
+	}
+	expectClosed(first, firstReader)
+
+	// The third failure from the address bans it
+	second, secondReader, _ := dial()
+	if response := sendCommand(t, second, secondReader, "AUTH wrong3"); response != "ERROR too many failed authentication attempts from this address, try again later" {
+		t.Errorf("failure that bans: got %q", response)
+	}
+	expectClosed(second, secondReader)
+	if _, _, prompt := dial(); prompt != "ERROR too many failed authentication attempts from this address, try again later" {
+		t.Errorf("connection from a banned address: got %q", prompt)
+	}
+
+	// Connections authenticated before the ban keep working
+	if response := sendCommand(t, conn, reader, "PING"); response != "PONG" {
+		t.Errorf("PING after the ban: got %q", response)
+	}
+	var info map[string]interface{}
+	json.Unmarshal([]byte(sendCommand(t, conn, reader, "INFO")), &info)
+	if info["auth_failures"] != float64(3) || info["banned_addresses"] != float64(1) {
+		t.Errorf("INFO after the ban = %v", info)
+	}
+
+	audit, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatalf("Failed to read audit log: %v", err)
+	}
+	if strings.Contains(string(audit), "wrong") {
+		t.Errorf("audit log contains a password:\n%s", audit)
+	}
+	var events []string
+	for _, line := range strings.Split(strings.TrimSpace(string(audit)), "\n") {
+		var entry struct{ Event, Address string }
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.Address == "" {
+			t.Errorf("invalid audit log line %q", line)
+		}
+		events = append(events, entry.Event)
+	}
+	if got := strings.Join(events, ","); got != "auth_failure,auth_failure,auth_failure,address_banned" {
+		t.Errorf("audit events = %s", got)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"AUTH", "secret"}, "AUTH ***"},
+		{[]string{"auth", "app", "secret"}, "auth app ***"},
+		{[]string{"HELLO", "3", "AUTH", "app", "secret", "SETNAME", "worker"}, "HELLO 3 AUTH app *** SETNAME worker"},
+		{[]string{"ACL", "SETUSER", "app", "on", ">secret", "<old", "~app:*"}, "ACL SETUSER app on >*** <*** ~app:*"},
+		{[]string{"SET", "key", "value"}, "SET key value"},
+	}
+	for _, tc := range tests {
+		if got := strings.Join(redactArgs(tc.args), " "); got != tc.expected {
+			t.Errorf("redactArgs(%v) = %q, want %q", tc.args, got, tc.expected)
+		}
+	}
+}
+
+func TestServerHTTP(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/users.acl", []byte("user reporter on >rpass %R~page:* +@read\n"), 0600)
+	httpPort, err := testutil.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	_, conn, reader := startTestServer(t, &config.Config{
+		Listeners: []config.ListenerConfig{
+			{Protocol: config.ProtocolNative},
+			{Protocol: config.ProtocolHTTP, Port: httpPort},
+		},
+		ACLFile: dir + "/users.acl",
+	})
+
+	request := func(method, path, token, body string) (int, string, http.Header) {
+		t.Helper()
+		req, err := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", httpPort, path), strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		client := http.Client{Timeout: time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data), resp.Header
+	}
+
+	if status, _, header := request("GET", "/keys/a", "", ""); status != http.StatusUnauthorized || header.Get("WWW-Authenticate") == "" {
+		t.Errorf("GET without a token: status %d, header %v", status, header)
+	}
+
+	tests := []struct {
+		method, path, token, body string
+		status                    int
+		expected                  string
+	}{
+		{"GET", "/keys/a", "wrong", "", http.StatusUnauthorized, `{"error":"Invalid password"}`},
+		{"PUT", "/keys/user:1", "testpass", `{"name": "Ann", "tags": ["a"]}`, http.StatusNoContent, ""},
+		{"GET", "/keys/user:1", "testpass", "", http.StatusOK, `{"name":"Ann","tags":["a"]}`},
+		{"GET", "/keys/user:2", "testpass", "", http.StatusNotFound, `{"error":"key not found"}`},
+		{"PUT", "/keys/user:2", "testpass", "not json", http.StatusBadRequest, `{"error":"bad request: the body must be a JSON value"}`},
+		{"PUT", "/keys/session?ttl=0", "testpass", `"abc"`, http.StatusBadRequest, `{"error":"bad request: invalid ttl: 0"}`},
+		{"PUT", "/keys/session?ttl=10000000000", "testpass", `"abc"`, http.StatusBadRequest, `{"error":"bad request: invalid ttl: 10000000000"}`},
+		{"PUT", "/keys/session?ttl=60", "default:testpass", `"abc"`, http.StatusNoContent, ""},
+		{"PUT", "/keys/a%2Fb", "testpass", `1`, http.StatusNoContent, ""},
+		{"PUT", "/keys/flag", "testpass", `true`, http.StatusNoContent, ""},
+		{"GET", "/keys/flag", "testpass", "", http.StatusOK, `true`},
+		{"PATCH", "/keys/user:1", "testpass", `{}`, http.StatusMethodNotAllowed, ""},
+
+		// JSON paths
+		{"GET", "/keys/user:1/json?path=$.name", "testpass", "", http.StatusOK, `"Ann"`},
+		{"GET", "/keys/user:1/json?path=$.age", "testpass", "", http.StatusNotFound, `{"error":"path not found"}`},
+		{"GET", "/keys/user:1/json?path=name", "testpass", "", http.StatusBadRequest, ""},
+		{"PUT", "/keys/user:1/json?path=$.age", "testpass", `30`, http.StatusNoContent, ""},
+		{"DELETE", "/keys/user:1/json?path=$.tags", "testpass", "", http.StatusNoContent, ""},
+		{"DELETE", "/keys/user:1/json?path=$.tags", "testpass", "", http.StatusNotFound, `{"error":"path not found"}`},
+		{"GET", "/keys/user:1/json", "testpass", "", http.StatusOK, `{"age":30,"name":"Ann"}`},
+
+		{"GET", "/keys?match=user:*", "testpass", "", http.StatusOK, `{"cursor":"0","keys":["user:1"]}`},
+		{"GET", "/keys?cursor=x", "testpass", "", http.StatusBadRequest, `{"error":"bad request: invalid cursor: x"}`},
+		{"DELETE", "/keys/user:1", "testpass", "", http.StatusNoContent, ""},
+		{"DELETE", "/keys/user:1", "testpass", "", http.StatusNotFound, `{"error":"key not found"}`},
+
+		// ACL users log in with username:password
+		{"PUT", "/keys/page:1", "testpass", `"home"`, http.StatusNoContent, ""},
+		{"GET", "/keys/page:1", "reporter:rpass", "", http.StatusOK, `"home"`},
+		{"PUT", "/keys/page:1", "reporter:rpass", `"x"`, http.StatusForbidden, `{"error":"no permission: user 'reporter' may not run JSON.SET (@write)"}`},
+		{"GET", "/keys/session", "reporter:rpass", "", http.StatusForbidden, `{"error":"no permission: user 'reporter' may not access key 'session'"}`},
+		{"GET", "/keys", "reporter:rpass", "", http.StatusOK, `{"cursor":"0","keys":["page:1"]}`},
+	}
+	for _, tc := range tests {
+		status, body, _ := request(tc.method, tc.path, tc.token, tc.body)
+		if status != tc.status || (tc.expected != "" && body != tc.expected) {
+			t.Errorf("%s %s: got %d %s, want %d %s", tc.method, tc.path, status, body, tc.status, tc.expected)
+		}
+	}
+
+	// The gateway shares the engine with the TCP listeners
+	commands := []struct {
+		cmd      string
+		expected string
+	}{
+		{"TTL session", "60"},
+		{"GET a/b", "1"},
+		{"SET user:3 {\"name\":\"Bob\"}", "OK"},
+	}
+	for _, tc := range commands {
+		if response := sendCommand(t, conn, reader, tc.cmd); response != tc.expected {
+			t.Errorf("%s: got %q, want %q", tc.cmd, response, tc.expected)
+		}
+	}
+	if status, body, _ := request("GET", "/keys/user:3", "testpass", ""); status != http.StatusOK || body != `{"name":"Bob"}` {
+		t.Errorf("GET of a key set over TCP: got %d %s", status, body)
+	}
+	// PUT without ttl replaces the value and its expiry, like SET
+	request("PUT", "/keys/session", "testpass", `"def"`)
+	if response := sendCommand(t, conn, reader, "TTL session"); response != "-1" {
+		t.Errorf("TTL after PUT without ttl: got %q", response)
+	}
+
+	// Listing pages through every key
+	for i := 0; i < 30; i++ {
+		sendCommand(t, conn, reader, fmt.Sprintf("SET item:%d %d", i, i))
+	}
+	seen := map[string]bool{}
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatalf("listing did not finish")
+		}
+		status, body, _ := request("GET", "/keys?match=item:*&count=5&cursor="+cursor, "testpass", "")
+		var page struct {
+			Cursor string
+			Keys   []string
+		}
+		if err := json.Unmarshal([]byte(body), &page); status != http.StatusOK || err != nil {
+			t.Fatalf("listing page: got %d %s", status, body)
+		}
+		for _, key := range page.Keys {
+			seen[key] = true
+		}
+		if cursor = page.Cursor; cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 30 {
+		t.Errorf("listing returned %d distinct keys, want 30", len(seen))
+	}
+}
+
+func TestServerHTTPColonPassword(t *testing.T) {
+	httpPort, err := testutil.GetFreePort()
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	aclFile := t.TempDir() + "/users.acl"
+	os.WriteFile(aclFile, []byte("user team on >other ~* +@read\n"), 0600)
+	startTestServer(t, &config.Config{
+		Password: "team:secret",
+		ACLFile:  aclFile,
+		Listeners: []config.ListenerConfig{
+			{Protocol: config.ProtocolNative},
+			{Protocol: config.ProtocolHTTP, Port: httpPort},
+		},
+	})
+
+	// A token is tried as username:password, then as a password alone
+	tests := []struct {
+		token  string
+		status int
+	}{
+		{"team:secret", http.StatusNotFound},
+		{"team:other", http.StatusNotFound},
+		{"default:team:secret", http.StatusNotFound},
+		{"nobody:team:secret", http.StatusUnauthorized},
+		{"team:wrong", http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/keys/missing", httpPort), nil)
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		client := http.Client{Timeout: time.Second}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET with token %q failed: %v", tc.token, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("GET with token %q: status %d, want %d", tc.token, resp.StatusCode, tc.status)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+    "crypto/tls"
+    "crypto/x509"
+    "fmt"
+    "jsondb/internal/config"
+    "log"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of a new connection, whatever
+// AUTH_TIMEOUT_SECONDS is
+const tlsHandshakeTimeout = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+    "1.0": tls.VersionTLS10,
+    "1.1": tls.VersionTLS11,
+    "1.2": tls.VersionTLS12,
+    "1.3": tls.VersionTLS13,
+}
+
+// tlsState holds the TLS configuration handed to new connections. It is
+// replaced as a whole on reload, connections already established keep the
+// certificates they were accepted with.
+type tlsState struct {
+    config atomic.Pointer[tls.Config]
+}
+
+// loadTLSConfig reads the certificate, key and client CA files.
+func loadTLSConfig(cfg *config.Config) (*tls.Config, error) {
+    cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+    }
+    tlsConfig := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion:   tls.VersionTLS12,
+    }
+    if version, ok := tlsVersions[cfg.TLSMinVersion]; ok {
+        tlsConfig.MinVersion = version
+    }
+
+    if cfg.TLSClientCAFile != "" {
+        pem, err := os.ReadFile(cfg.TLSClientCAFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read TLS client CA: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificate found in TLS client CA %s", cfg.TLSClientCAFile)
+        }
+        tlsConfig.ClientCAs = pool
+        tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+        if cfg.TLSClientAuth == config.TLSClientAuthOptional {
+            tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+        }
+    }
+    return tlsConfig, nil
+}
+
+// loadReplicaTLSConfig reads the files a follower uses to connect to its
+// leader over TLS: the CA the leader's certificate is verified against, and
+// the client certificate presented to a leader requiring one.
+func loadReplicaTLSConfig(cfg *config.Config) (*tls.Config, error) {
+    tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+    if version, ok := tlsVersions[cfg.TLSMinVersion]; ok {
+        tlsConfig.MinVersion = version
+    }
+    if cfg.ReplicaTLSCAFile != "" {
+        pem, err := os.ReadFile(cfg.ReplicaTLSCAFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read replica TLS CA: %v", err)
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificate found in replica TLS CA %s", cfg.ReplicaTLSCAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+    if cfg.ReplicaTLSCertFile != "" {
+        cert, err := tls.LoadX509KeyPair(cfg.ReplicaTLSCertFile, cfg.ReplicaTLSKeyFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to load replica TLS certificate: %v", err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
+    }
+    return tlsConfig, nil
+}
+
+// listenerTLSConfig returns the configuration of TLS listeners. Every
+// handshake picks up the configuration loaded last, see ReloadTLS.
+func (s *Server) listenerTLSConfig() *tls.Config {
+    return &tls.Config{
+        GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+            return s.tls.config.Load(), nil
+        },
+    }
+}
+
+// ReloadTLS reads the certificate, key and client CA files again, as on
+// SIGHUP. New connections use them, established ones are left alone. On
+// error the previous configuration stays in use.
+func (s *Server) ReloadTLS() error {
+    if s.Config.TLSCertFile == "" {
+        return fmt.Errorf("TLS is not configured")
+    }
+    tlsConfig, err := loadTLSConfig(s.Config)
+    if err != nil {
+        return err
+    }
+    s.tls.config.Store(tlsConfig)
+    log.Printf("Reloaded TLS certificate %s", s.Config.TLSCertFile)
+    return nil
+}
+
+// handshakeTLS completes the TLS handshake of a connection before it is
+// served, within tlsHandshakeTimeout or the auth timeout when that ends
+// first, so a client that never finishes the handshake is always dropped,
+// even with AUTH_TIMEOUT_SECONDS set to 0. A verified client certificate whose
+// common name is listed in TLS_CLIENT_IDENTITIES authenticates the client
+// as the ACL user it maps to, as long as that user is enabled.
+func (s *Server) handshakeTLS(client *ClientConnection) error {
+    conn, ok := client.Conn.(*tls.Conn)
+    if !ok {
+        return nil
+    }
+    deadline := time.Now().Add(tlsHandshakeTimeout)
+    if !client.authDeadline.IsZero() && client.authDeadline.Before(deadline) {
+        deadline = client.authDeadline
+    }
+    conn.SetDeadline(deadline)
+    if err := conn.Handshake(); err != nil {
+        return err
+    }
+    conn.SetDeadline(time.Time{})
+
+    state := conn.ConnectionState()
+    if len(state.VerifiedChains) == 0 {
+        return nil
+    }
+    name := state.PeerCertificates[0].Subject.CommonName
+    username, mapped := s.Config.TLSClientIdentities[name]
+    if user := s.acl.user(username); !mapped || user == nil || !user.enabled {
+        return nil
+    }
+    client.Authenticated = true
+    client.setUser(username)
+    if s.Debug {
+        log.Printf("Client %s authenticated by certificate %s as %s", conn.RemoteAddr(), name, username)
+    }
+    return nil
+}
@@ -1,7 +1,16 @@
 package testutil
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -32,4 +41,87 @@ func GetFreePort() (int, error) {
     }
     defer l.Close()
     return l.Addr().(*net.TCPAddr).Port, nil
-}
\ No newline at end of file
+}
+
+// TestCA is a certificate authority issuing certificates for TLS tests
+type TestCA struct {
+    CertFile string
+    cert     *x509.Certificate
+    key      *ecdsa.PrivateKey
+    serial   int64
+}
+
+// NewTestCA creates a certificate authority and writes its certificate to dir
+func NewTestCA(t *testing.T, dir string) *TestCA {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("Failed to generate CA key: %v", err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(1),
+        Subject:               pkix.Name{CommonName: "jsondb test CA"},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        IsCA:                  true,
+        KeyUsage:              x509.KeyUsageCertSign,
+        BasicConstraintsValid: true,
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf("Failed to create CA certificate: %v", err)
+    }
+    cert, _ := x509.ParseCertificate(der)
+    ca := &TestCA{CertFile: filepath.Join(dir, "ca.pem"), cert: cert, key: key, serial: 1}
+    writePEM(t, ca.CertFile, "CERTIFICATE", der)
+    return ca
+}
+
+// Pool returns a certificate pool holding the CA
+func (ca *TestCA) Pool() *x509.CertPool {
+    pool := x509.NewCertPool()
+    pool.AddCert(ca.cert)
+    return pool
+}
+
+// Issue writes a certificate for commonName, valid for localhost as a
+// server and as a client, to name.pem and its key to name-key.pem in dir
+func (ca *TestCA) Issue(t *testing.T, dir, name, commonName string) (certFile, keyFile string) {
+    t.Helper()
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatalf("Failed to generate key: %v", err)
+    }
+    ca.serial++
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(ca.serial),
+        Subject:      pkix.Name{CommonName: commonName},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        DNSNames:     []string{"localhost"},
+        IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+    if err != nil {
+        t.Fatalf("Failed to create certificate: %v", err)
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        t.Fatalf("Failed to encode key: %v", err)
+    }
+    certFile = filepath.Join(dir, name+".pem")
+    keyFile = filepath.Join(dir, name+"-key.pem")
+    writePEM(t, certFile, "CERTIFICATE", der)
+    writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+    return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+    t.Helper()
+    data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+    if err := os.WriteFile(path, data, 0600); err != nil {
+        t.Fatalf("Failed to write %s: %v", path, err)
+    }
+}